@@ -0,0 +1,34 @@
+// debux-wrappers generates, in the debug image, the wrappers that run the
+// target's binaries from the debug shell:
+//
+//	debux-wrappers <target-path> <sidecar-path>
+//
+// The debug shell then prepends wrappers.Dir to its PATH.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/clement-tourriere/debux/internal/wrappers"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "usage: debux-wrappers <target-path> <sidecar-path>")
+		os.Exit(2)
+	}
+	root := os.Getenv("DEBUX_TARGET_ROOT")
+	if root == "" {
+		root = "/proc/1/root"
+	}
+	_, err := wrappers.Generate(wrappers.Dir, wrappers.Options{
+		TargetRoot:  root,
+		TargetPath:  os.Args[1],
+		SidecarPath: os.Args[2],
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "debux-wrappers: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/clement-tourriere/debux/internal/cli"
+	"github.com/clement-tourriere/debux/internal/render"
 )
 
 func main() {
 	if err := cli.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if code, ok := cli.ExitStatus(err); ok {
+			os.Exit(code)
+		}
+		render.Errorf(os.Stderr, "%v", err)
 		os.Exit(1)
 	}
 }
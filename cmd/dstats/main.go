@@ -0,0 +1,48 @@
+// dstats prints, in the debug image, the limits and usage of the target's
+// cgroup instead of the host-wide numbers of free and top:
+//
+//	dstats [-o json] [-i interval]
+//
+// debux stats runs it from the host.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/cgstats"
+)
+
+func main() {
+	output := flag.String("o", "text", "output format (text, json)")
+	interval := flag.Duration("i", time.Second, "interval to sample CPU usage over")
+	flag.Parse()
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "dstats: invalid output format %q: must be text or json\n", *output)
+		os.Exit(2)
+	}
+	root := os.Getenv("DEBUX_TARGET_ROOT")
+	if root == "" {
+		root = "/proc/1/root"
+	}
+
+	stats, err := cgstats.Read(root, *interval)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dstats: %v\n", err)
+		os.Exit(1)
+	}
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(stats)
+	} else {
+		err = stats.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dstats: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -4,12 +4,12 @@ set -e
 # Wait for target PID 1 to be visible (namespace sharing)
 timeout=30
 elapsed=0
-while [ ! -d /proc/1/root ] && [ "$elapsed" -lt "$timeout" ]; do
+while [ ! -L /proc/1/root ] && [ "$elapsed" -lt "$timeout" ]; do
   sleep 0.1
   elapsed=$((elapsed + 1))
 done
 
-if [ ! -d /proc/1/root ]; then
+if [ ! -L /proc/1/root ]; then
   echo "Warning: could not find target process namespace"
 fi
 
@@ -19,8 +19,64 @@ export PATH="/nix/var/debux-profile/bin:/usr/local/bin:${HOME:-/tmp}/.nix-profil
 
 # Export target root for easy access
 export DEBUX_TARGET_ROOT="/proc/1/root"
+
+# Running as another user than the target, without CAP_SYS_PTRACE, the
+# debug container can't follow /proc/1/root: link the target's volumes the
+# debug container shares at their paths in /tmp/debux-target instead
+# (DEBUX_TARGET_VOLUMES: "<path in the target>=<path here>" lines, parents
+# first, whose trees already hold the nested ones)
+if ! ls /proc/1/root/ >/dev/null 2>&1 && [ -n "${DEBUX_TARGET_VOLUMES:-}" ]; then
+  rm -rf /tmp/debux-target
+  mkdir -p /tmp/debux-target
+  printf '%s\n' "$DEBUX_TARGET_VOLUMES" | LC_ALL=C sort -t= -k1,1 | while IFS= read -r line; do
+    dst="${line%%=*}" src="${line#*=}"
+    [ -n "$dst" ] && [ "$dst" != / ] || continue
+    p="$dst" nested=""
+    while p=$(dirname "$p"); [ "$p" != / ]; do
+      [ -L "/tmp/debux-target$p" ] && nested=1
+    done
+    [ -z "$nested" ] || continue
+    mkdir -p "/tmp/debux-target$(dirname "$dst")"
+    ln -sfn "$src" "/tmp/debux-target$dst"
+  done
+  export DEBUX_TARGET_ROOT=/tmp/debux-target
+  echo "Warning: the target's root filesystem is out of reach, $DEBUX_TARGET_ROOT only holds its shared volumes"
+fi
 ln -sfn "$DEBUX_TARGET_ROOT" /target 2>/dev/null || true
 
+# Extra Nix binary caches (debux config file / --substituter)
+if [ -n "${DEBUX_NIX_SUBSTITUTERS:-}${DEBUX_NIX_TRUSTED_PUBLIC_KEYS:-}" ]; then
+  {
+    if [ -n "${DEBUX_NIX_SUBSTITUTERS:-}" ]; then
+      if [ "${DEBUX_NIX_REPLACE_SUBSTITUTERS:-}" = 1 ]; then
+        echo "substituters = $DEBUX_NIX_SUBSTITUTERS"
+      else
+        echo "extra-substituters = $DEBUX_NIX_SUBSTITUTERS"
+      fi
+    fi
+    if [ -n "${DEBUX_NIX_TRUSTED_PUBLIC_KEYS:-}" ]; then
+      echo "extra-trusted-public-keys = $DEBUX_NIX_TRUSTED_PUBLIC_KEYS"
+    fi
+  } > /etc/nix/debux.conf 2>/dev/null &&
+    { grep -qx '!include debux.conf' /etc/nix/nix.conf || echo '!include debux.conf' >> /etc/nix/nix.conf; } 2>/dev/null ||
+    echo "Warning: could not configure Nix binary caches"
+fi
+
+# The target's time zone
+if [ -n "$DEBUX_TARGET_ROOT" ]; then
+  tz="$DEBUX_TARGET_ROOT/etc/localtime"
+  if [ -L "$tz" ]; then
+    link=$(readlink "$tz")
+    case "$link" in /*) tz="$DEBUX_TARGET_ROOT$link" ;; esac
+  fi
+  if [ -f "$tz" ]; then
+    { cp -f "$tz" /etc/.localtime.debux && mv -f /etc/.localtime.debux /etc/localtime; } 2>/dev/null || true
+  fi
+  if [ -f "$DEBUX_TARGET_ROOT/etc/timezone" ]; then
+    cp -f "$DEBUX_TARGET_ROOT/etc/timezone" /etc/timezone 2>/dev/null || true
+  fi
+fi
+
 # Create convenience symlinks for target filesystem
 ln -sf "$DEBUX_TARGET_ROOT/etc/hosts" /etc/hosts 2>/dev/null || true
 ln -sf "$DEBUX_TARGET_ROOT/etc/resolv.conf" /etc/resolv.conf 2>/dev/null || true
@@ -28,6 +84,19 @@ ln -sf "$DEBUX_TARGET_ROOT/etc/resolv.conf" /etc/resolv.conf 2>/dev/null || true
 # Ensure persistent data directory exists (for shell history etc.)
 mkdir -p /nix/var/debux-data 2>/dev/null || mkdir -p /tmp/debux-data
 
+# Setup hooks of the debux config file (hooks.container)
+if [ -n "${DEBUX_SETUP_HOOKS:-}" ] && [ ! -e /tmp/debux-setup.done ]; then
+  echo "Running setup hooks (log: /tmp/debux-setup.log)..."
+  status=0 i=1
+  while [ "$i" -le "$DEBUX_SETUP_HOOKS" ]; do
+    eval "hook=\$DEBUX_SETUP_HOOK_$i"
+    sh -c "$hook" >> /tmp/debux-setup.log 2>&1 || status=$?
+    i=$((i + 1))
+  done
+  echo "$status" > /tmp/debux-setup.done
+  [ "$status" = 0 ] || echo "Warning: a setup hook failed, see /tmp/debux-setup.log"
+fi
+
 # Launch shell (or daemon mode for k8s container reuse)
 if [ "${DEBUX_DAEMON:-}" = "1" ]; then
   exec tail -f /dev/null
@@ -0,0 +1,74 @@
+// Package api is the debux daemon API (debux daemon): debux's operations on
+// running targets over HTTP, for platforms and bots that drive debugging,
+// and for the CLI itself with --host.
+//
+// Requests and responses are JSON, except the output of exec, which is
+// multiplexed like Docker's (see stdcopy), and bundles, which are gzipped
+// tars. Both are streamed; their outcome comes in the Debux-Exit-Code and
+// Debux-Error trailers. Errors are {"error": "..."} objects.
+//
+//	GET    /v1/targets?scope=k8s://ns/    running targets (Docker without scope)
+//	GET    /v1/sessions?scope=k8s://ns/   running debug containers
+//	POST   /v1/sessions {"target": ...}   create a debug container
+//	DELETE /v1/sessions?target=...        remove or stop a debug container
+//	POST   /v1/exec {"target": ..., "command": [...]}
+//	POST   /v1/bundle {"target": ...}     diagnostics bundle
+//
+// Over TCP, every request carries the daemon's token as a bearer token.
+package api
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Target is a running container or pod that can be debugged.
+type Target struct {
+	Target  string `json:"target"` // as passed to debux, e.g. k8s://prod/api-7d9f
+	Name    string `json:"name"`
+	Detail  string `json:"detail"` // image, or namespace
+	Status  string `json:"status"`
+	Session bool   `json:"session"` // a debug container is running
+}
+
+// Session is a running debug container.
+type Session struct {
+	Target    string    `json:"target"`
+	Container string    `json:"container"`
+	Started   time.Time `json:"started,omitzero"`
+	Shells    int       `json:"shells"` // open shells, -1 when unknown
+}
+
+// Backend runs debux's operations, locally or through a daemon (Client).
+// A scope is empty for Docker containers, or k8s://[namespace/] for pods.
+type Backend interface {
+	Targets(ctx context.Context, scope string) ([]Target, error)
+	Sessions(ctx context.Context, scope string) ([]Session, error)
+	CreateSession(ctx context.Context, target string) (Session, error)
+	DeleteSession(ctx context.Context, target string) error
+	// Exec runs a command without a TTY in a target's debug container and
+	// returns its exit code.
+	Exec(ctx context.Context, target string, command []string, stdout, stderr io.Writer) (int, error)
+	// Bundle writes a gzipped tar of diagnostics about a target.
+	Bundle(ctx context.Context, target string, w io.Writer) error
+}
+
+const (
+	exitCodeTrailer = "Debux-Exit-Code"
+	errorTrailer    = "Debux-Error"
+	streamType      = "application/vnd.debux.multiplexed-stream"
+)
+
+type targetRequest struct {
+	Target string `json:"target"`
+}
+
+type execRequest struct {
+	Target  string   `json:"target"`
+	Command []string `json:"command"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Client is a Backend served by a debux daemon.
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+var _ Backend = (*Client)(nil)
+
+// NewClient returns a client of the daemon at host: unix:///path/to.sock,
+// tcp://host:port, or an http:// or https:// URL.
+func NewClient(host, token string) (*Client, error) {
+	c := &Client{token: token, http: &http.Client{}}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		path := strings.TrimPrefix(host, "unix://")
+		c.base = "http://debux"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	case strings.HasPrefix(host, "tcp://"):
+		c.base = "http://" + strings.TrimPrefix(host, "tcp://")
+	case strings.HasPrefix(host, "http://"), strings.HasPrefix(host, "https://"):
+		c.base = strings.TrimSuffix(host, "/")
+	default:
+		return nil, fmt.Errorf("invalid daemon host %q: expected unix://, tcp://, http:// or https://", host)
+	}
+	return c, nil
+}
+
+func (c *Client) Targets(ctx context.Context, scope string) ([]Target, error) {
+	var targets []Target
+	err := c.do(ctx, http.MethodGet, "/v1/targets?"+url.Values{"scope": {scope}}.Encode(), nil, &targets)
+	return targets, err
+}
+
+func (c *Client) Sessions(ctx context.Context, scope string) ([]Session, error) {
+	var sessions []Session
+	err := c.do(ctx, http.MethodGet, "/v1/sessions?"+url.Values{"scope": {scope}}.Encode(), nil, &sessions)
+	return sessions, err
+}
+
+func (c *Client) CreateSession(ctx context.Context, target string) (Session, error) {
+	var session Session
+	err := c.do(ctx, http.MethodPost, "/v1/sessions", targetRequest{Target: target}, &session)
+	return session, err
+}
+
+func (c *Client) DeleteSession(ctx context.Context, target string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/sessions?"+url.Values{"target": {target}}.Encode(), nil, nil)
+}
+
+func (c *Client) Exec(ctx context.Context, target string, command []string, stdout, stderr io.Writer) (int, error) {
+	resp, err := c.send(ctx, http.MethodPost, "/v1/exec", execRequest{Target: target, Command: command})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if _, err := stdcopy.StdCopy(stdout, stderr, resp.Body); err != nil {
+		return 0, fmt.Errorf("reading command output: %w", err)
+	}
+	if msg := resp.Trailer.Get(errorTrailer); msg != "" {
+		return 0, errors.New(msg)
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get(exitCodeTrailer))
+	if err != nil {
+		return 0, errors.New("the daemon didn't report the exit code")
+	}
+	return code, nil
+}
+
+func (c *Client) Bundle(ctx context.Context, target string, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodPost, "/v1/bundle", targetRequest{Target: target})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("reading bundle: %w", err)
+	}
+	if msg := resp.Trailer.Get(errorTrailer); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding daemon response: %w", err)
+	}
+	return nil
+}
+
+// send sends a request with an optional JSON body, and turns error
+// responses into errors.
+func (c *Client) send(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the debux daemon: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer func() { _ = resp.Body.Close() }()
+		var e errorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		return nil, fmt.Errorf("debux daemon: %s", e.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Server serves a Backend over HTTP.
+type Server struct {
+	Backend Backend
+	// Token is required from clients as a bearer token; empty disables
+	// authentication, for Unix sockets protected by their permissions.
+	Token string
+}
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/targets", s.targets)
+	mux.HandleFunc("GET /v1/sessions", s.sessions)
+	mux.HandleFunc("POST /v1/sessions", s.createSession)
+	mux.HandleFunc("DELETE /v1/sessions", s.deleteSession)
+	mux.HandleFunc("POST /v1/exec", s.exec)
+	mux.HandleFunc("POST /v1/bundle", s.bundle)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) targets(w http.ResponseWriter, r *http.Request) {
+	targets, err := s.Backend.Targets(r.Context(), r.URL.Query().Get("scope"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonNil(targets))
+}
+
+func (s *Server) sessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.Backend.Sessions(r.Context(), r.URL.Query().Get("scope"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, nonNil(sessions))
+}
+
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request) {
+	var req targetRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	session, err := s.Backend.CreateSession(r.Context(), req.Target)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing target"))
+		return
+	}
+	if err := s.Backend.DeleteSession(r.Context(), target); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) exec(w http.ResponseWriter, r *http.Request) {
+	var req execRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if len(req.Command) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing command"))
+		return
+	}
+	w.Header().Set("Trailer", exitCodeTrailer+", "+errorTrailer)
+	w.Header().Set("Content-Type", streamType)
+	w.WriteHeader(http.StatusOK)
+	out := &flushWriter{w: w}
+	code, err := s.Backend.Exec(r.Context(), req.Target, req.Command,
+		stdcopy.NewStdWriter(out, stdcopy.Stdout), stdcopy.NewStdWriter(out, stdcopy.Stderr))
+	if err != nil {
+		w.Header().Set(errorTrailer, trailerValue(err))
+		return
+	}
+	w.Header().Set(exitCodeTrailer, strconv.Itoa(code))
+}
+
+func (s *Server) bundle(w http.ResponseWriter, r *http.Request) {
+	var req targetRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	w.Header().Set("Trailer", errorTrailer)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+	if err := s.Backend.Bundle(r.Context(), req.Target, &flushWriter{w: w}); err != nil {
+		w.Header().Set(errorTrailer, trailerValue(err))
+	}
+}
+
+// trailerValue fits an error in a trailer.
+func trailerValue(err error) string {
+	return strings.ReplaceAll(err.Error(), "\n", " ")
+}
+
+// flushWriter sends streamed output to the client as it comes.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// nonNil makes empty lists [] rather than null.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
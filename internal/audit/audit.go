@@ -0,0 +1,177 @@
+// Package audit records debug sessions for environments that must account
+// for every access to their workloads: a record when a session starts and
+// one when it ends, appended to a local log, sent to syslog and POSTed to a
+// webhook, as the audit section of the config file says.
+//
+//	{"time":"2026-10-17T09:12:42.37Z","type":"session-start","session":"5f0c2a9e81d4b7a3","command":"exec","kind":"container","runtime":"kubernetes","target":"k8s://shop/api","name":"api","context":"prod-eu","namespace":"shop","image":"ghcr.io/clement-tourriere/debux:latest","profile":"general","privileged":false,"user":"alice@laptop","flags":["--profile=general"]}
+//	{"time":"2026-10-17T09:20:05.80Z","type":"session-end","session":"5f0c2a9e81d4b7a3",...,"duration":443.43}
+//
+// Fields are only ever added.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/render"
+)
+
+// Record types.
+const (
+	SessionStart = "session-start"
+	SessionEnd   = "session-end"
+)
+
+// Record is an entry of the audit log.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Session string    `json:"session"` // pairs the start and end of a session
+	policy.Request
+	Flags    []string `json:"flags,omitempty"`    // flags set on the command line
+	Duration float64  `json:"duration,omitempty"` // seconds, at the end
+	Error    string   `json:"error,omitempty"`    // why the session failed, at the end
+}
+
+// Logger writes audit records.
+type Logger struct {
+	cfg    config.Audit
+	client *http.Client
+}
+
+// New returns a logger for cfg, or nil when cfg doesn't audit anything.
+func New(cfg config.Audit) *Logger {
+	if cfg.File == "" && !cfg.Syslog && cfg.Webhook == "" {
+		return nil
+	}
+	return &Logger{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Session is a started session, to record the end of.
+type Session struct {
+	l       *Logger
+	start   Record
+	started time.Time
+	once    sync.Once
+}
+
+// Start records the start of a session. Errors only cancel the session when
+// the config requires auditing: otherwise they are reported on stderr.
+func (l *Logger) Start(ctx context.Context, req policy.Request, flags []string) (*Session, error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	s := &Session{l: l, started: time.Now(), start: Record{
+		Type:    SessionStart,
+		Session: hex.EncodeToString(id),
+		Request: req,
+		Flags:   flags,
+	}}
+	if err := l.write(ctx, s.start); err != nil {
+		if l.cfg.Required {
+			return nil, fmt.Errorf("%w; not starting the session (audit.required)", err)
+		}
+		render.Warnf(os.Stderr, "%v", err)
+	}
+	return s, nil
+}
+
+// End records the end of the session, once, with its error if it failed.
+func (s *Session) End(sessionErr error) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		r := s.start
+		r.Type = SessionEnd
+		r.Duration = time.Since(s.started).Round(10 * time.Millisecond).Seconds()
+		if sessionErr != nil {
+			r.Error = sessionErr.Error()
+		}
+		// Even when the session was interrupted
+		if err := s.l.write(context.Background(), r); err != nil {
+			render.Warnf(os.Stderr, "%v", err)
+		}
+	})
+}
+
+var fileMu sync.Mutex
+
+// write sends r to every configured destination, and returns their errors.
+func (l *Logger) write(ctx context.Context, r Record) error {
+	r.Time = time.Now().UTC()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if l.cfg.File != "" {
+		errs = append(errs, l.writeFile(data))
+	}
+	if l.cfg.Syslog {
+		errs = append(errs, writeSyslog(data))
+	}
+	if l.cfg.Webhook != "" {
+		errs = append(errs, l.post(ctx, data))
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Logger) writeFile(data []byte) error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	f, err := os.OpenFile(l.cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening the audit log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing the audit log: %w", err)
+	}
+	return nil
+}
+
+func writeSyslog(data []byte) error {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "debux")
+	if err != nil {
+		return fmt.Errorf("connecting to syslog: %w", err)
+	}
+	defer w.Close()
+	if err := w.Notice(string(data)); err != nil {
+		return fmt.Errorf("writing to syslog: %w", err)
+	}
+	return nil
+}
+
+// post sends a record to the webhook. Header values expand environment
+// variables, so that tokens can stay out of the config file.
+func (l *Logger) post(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.cfg.Webhook, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("audit webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range l.cfg.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("audit webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook: %s returned %s", l.cfg.Webhook, resp.Status)
+	}
+	return nil
+}
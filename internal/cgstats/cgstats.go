@@ -0,0 +1,377 @@
+// Package cgstats reads the limits and usage of a target's cgroup, v1 or
+// v2, from the debug container. free, top and /proc/meminfo show the host's
+// numbers even in a container; the cgroup has the ones that matter: limits,
+// throttling, OOM kills and pressure.
+package cgstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Unlimited is the value of limits that aren't set.
+const Unlimited = -1
+
+// Memory is the memory of a cgroup, in bytes.
+type Memory struct {
+	Limit       int64   `json:"limit"` // Unlimited when not set
+	High        int64   `json:"high,omitempty"`
+	Current     int64   `json:"current"`
+	Peak        int64   `json:"peak,omitempty"`
+	Anon        int64   `json:"anon"`
+	File        int64   `json:"file"` // page cache, reclaimable
+	SwapLimit   int64   `json:"swapLimit,omitempty"`
+	SwapCurrent int64   `json:"swapCurrent,omitempty"`
+	MaxEvents   int64   `json:"maxEvents"` // times usage hit the limit
+	OOMKills    int64   `json:"oomKills"`
+	Pressure    float64 `json:"pressure"` // % of the last 10s some tasks stalled (v2)
+	HostTotal   int64   `json:"hostTotal"`
+}
+
+// CPU is the CPU of a cgroup.
+type CPU struct {
+	Limit          float64 `json:"limit"` // in CPUs, 0 when not set
+	Weight         int64   `json:"weight,omitempty"`
+	Usage          float64 `json:"usage"` // in CPUs, over the sampling interval
+	Periods        int64   `json:"periods"`
+	Throttled      int64   `json:"throttled"` // periods throttled, since the cgroup started
+	ThrottledTime  float64 `json:"throttledSeconds"`
+	ThrottledRatio float64 `json:"throttledRatio"` // of the periods of the sampling interval
+	Pressure       float64 `json:"pressure"`
+	HostCPUs       int     `json:"hostCPUs"`
+}
+
+// Pids are the processes of a cgroup.
+type Pids struct {
+	Limit   int64 `json:"limit"`
+	Current int64 `json:"current"`
+}
+
+// Stats are the limits and usage of a cgroup.
+type Stats struct {
+	Version  int           `json:"version"`
+	Cgroup   string        `json:"cgroup"`
+	Interval time.Duration `json:"-"`
+	Memory   Memory        `json:"memory"`
+	CPU      CPU           `json:"cpu"`
+	Pids     Pids          `json:"pids"`
+	IOStall  float64       `json:"ioPressure"`
+}
+
+// cgroup locates the files of a cgroup.
+type cgroup struct {
+	version int
+	name    string            // path in the hierarchy, from /proc/1/cgroup
+	dirs    map[string]string // controller ("" for v2) → directory
+}
+
+// find locates the cgroup of PID 1 of the target whose root filesystem is
+// root, through the target's own view of /sys/fs/cgroup: with a cgroup
+// namespace, that's its cgroup; without, the path of /proc/1/cgroup leads
+// there.
+func find(root string) (*cgroup, error) {
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("reading the target's cgroup: %w", err)
+	}
+	base := filepath.Join(root, "sys/fs/cgroup")
+	cg := &cgroup{dirs: map[string]string{}}
+	if _, err := os.Stat(filepath.Join(base, "cgroup.controllers")); err == nil {
+		cg.version = 2
+	} else {
+		cg.version = 1
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(data)))
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if cg.version == 2 {
+			if parts[0] == "0" {
+				cg.name = parts[2]
+				cg.dirs[""] = dirOf(base, parts[2])
+			}
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			switch c {
+			case "memory", "cpu", "cpuacct", "pids":
+				cg.name = parts[2]
+				cg.dirs[c] = dirOf(filepath.Join(base, parts[1]), parts[2])
+			}
+		}
+	}
+	if len(cg.dirs) == 0 {
+		return nil, fmt.Errorf("no cgroup found for the target in /proc/1/cgroup")
+	}
+	return cg, nil
+}
+
+// dirOf returns the directory of the cgroup name in the hierarchy mounted at
+// base: base itself in a cgroup namespace, where the target's cgroup is the
+// root.
+func dirOf(base, name string) string {
+	if dir := filepath.Join(base, name); name != "/" {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+	}
+	return base
+}
+
+func (cg *cgroup) file(controller, name string) string {
+	if cg.version == 2 {
+		controller = ""
+	}
+	return filepath.Join(cg.dirs[controller], name)
+}
+
+// Read returns the stats of the target whose root filesystem is root,
+// sampling CPU usage and throttling over interval.
+func Read(root string, interval time.Duration) (*Stats, error) {
+	cg, err := find(root)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{Version: cg.version, Cgroup: cg.name, Interval: interval}
+	s.Memory.HostTotal = hostMemory()
+	s.CPU.HostCPUs = goruntime.NumCPU()
+
+	usage0, periods0, throttled0 := cg.cpuCounters()
+	start := time.Now()
+	time.Sleep(interval)
+	usage1, periods1, throttled1 := cg.cpuCounters()
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		s.CPU.Usage = (usage1 - usage0) / elapsed
+	}
+	if periods1 > periods0 {
+		s.CPU.ThrottledRatio = float64(throttled1-throttled0) / float64(periods1-periods0)
+	}
+
+	if cg.version == 2 {
+		cg.readV2(s)
+	} else {
+		cg.readV1(s)
+	}
+	return s, nil
+}
+
+// cpuCounters returns the CPU time used in seconds, and the periods and
+// throttled periods.
+func (cg *cgroup) cpuCounters() (usage float64, periods, throttled int64) {
+	if cg.version == 2 {
+		stat := readKeyed(cg.file("", "cpu.stat"))
+		return float64(stat["usage_usec"]) / 1e6, stat["nr_periods"], stat["nr_throttled"]
+	}
+	stat := readKeyed(cg.file("cpu", "cpu.stat"))
+	return float64(readInt(cg.file("cpuacct", "cpuacct.usage"))) / 1e9, stat["nr_periods"], stat["nr_throttled"]
+}
+
+func (cg *cgroup) readV2(s *Stats) {
+	m := &s.Memory
+	m.Limit = readInt(cg.file("", "memory.max"))
+	m.High = readInt(cg.file("", "memory.high"))
+	m.Current = readInt(cg.file("", "memory.current"))
+	m.Peak = readInt(cg.file("", "memory.peak"))
+	m.SwapLimit = readInt(cg.file("", "memory.swap.max"))
+	m.SwapCurrent = readInt(cg.file("", "memory.swap.current"))
+	stat := readKeyed(cg.file("", "memory.stat"))
+	m.Anon, m.File = stat["anon"], stat["file"]
+	events := readKeyed(cg.file("", "memory.events"))
+	m.MaxEvents, m.OOMKills = events["max"], events["oom_kill"]
+	m.Pressure = pressure(cg.file("", "memory.pressure"))
+
+	c := &s.CPU
+	if fields := strings.Fields(readString(cg.file("", "cpu.max"))); len(fields) == 2 && fields[0] != "max" {
+		quota, _ := strconv.ParseFloat(fields[0], 64)
+		period, _ := strconv.ParseFloat(fields[1], 64)
+		if period > 0 {
+			c.Limit = quota / period
+		}
+	}
+	c.Weight = readInt(cg.file("", "cpu.weight"))
+	cpu := readKeyed(cg.file("", "cpu.stat"))
+	c.Periods, c.Throttled = cpu["nr_periods"], cpu["nr_throttled"]
+	c.ThrottledTime = float64(cpu["throttled_usec"]) / 1e6
+	c.Pressure = pressure(cg.file("", "cpu.pressure"))
+
+	s.Pids = Pids{Limit: readInt(cg.file("", "pids.max")), Current: readInt(cg.file("", "pids.current"))}
+	s.IOStall = pressure(cg.file("", "io.pressure"))
+}
+
+func (cg *cgroup) readV1(s *Stats) {
+	m := &s.Memory
+	m.Limit = readInt(cg.file("memory", "memory.limit_in_bytes"))
+	// v1 reports no limit as a huge page-aligned number
+	if m.Limit >= math.MaxInt64/2 || m.Limit >= s.Memory.HostTotal && s.Memory.HostTotal > 0 {
+		m.Limit = Unlimited
+	}
+	m.Current = readInt(cg.file("memory", "memory.usage_in_bytes"))
+	m.Peak = readInt(cg.file("memory", "memory.max_usage_in_bytes"))
+	stat := readKeyed(cg.file("memory", "memory.stat"))
+	m.Anon, m.File = stat["rss"], stat["cache"]
+	m.MaxEvents = readInt(cg.file("memory", "memory.failcnt"))
+	m.OOMKills = readKeyed(cg.file("memory", "memory.oom_control"))["oom_kill"]
+
+	c := &s.CPU
+	quota := readInt(cg.file("cpu", "cpu.cfs_quota_us"))
+	period := readInt(cg.file("cpu", "cpu.cfs_period_us"))
+	if quota > 0 && period > 0 {
+		c.Limit = float64(quota) / float64(period)
+	}
+	c.Weight = readInt(cg.file("cpu", "cpu.shares"))
+	cpu := readKeyed(cg.file("cpu", "cpu.stat"))
+	c.Periods, c.Throttled = cpu["nr_periods"], cpu["nr_throttled"]
+	c.ThrottledTime = float64(cpu["throttled_time"]) / 1e9
+
+	s.Pids = Pids{Limit: readInt(cg.file("pids", "pids.max")), Current: readInt(cg.file("pids", "pids.current"))}
+}
+
+func readString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readInt reads a file holding a number, or "max" (Unlimited). Missing
+// files read as 0.
+func readInt(path string) int64 {
+	s := readString(path)
+	if s == "max" {
+		return Unlimited
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// readKeyed reads a file of "key value" lines.
+func readKeyed(path string) map[string]int64 {
+	values := map[string]int64{}
+	for _, line := range strings.Split(readString(path), "\n") {
+		if k, v, ok := strings.Cut(line, " "); ok {
+			values[k], _ = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		}
+	}
+	return values
+}
+
+// pressure returns the avg10 of the "some" line of a PSI file.
+func pressure(path string) float64 {
+	for _, line := range strings.Split(readString(path), "\n") {
+		if !strings.HasPrefix(line, "some ") {
+			continue
+		}
+		for _, f := range strings.Fields(line) {
+			if v, ok := strings.CutPrefix(f, "avg10="); ok {
+				p, _ := strconv.ParseFloat(v, 64)
+				return p
+			}
+		}
+	}
+	return 0
+}
+
+// hostMemory returns the memory of the host, which the container's
+// /proc/meminfo shows.
+func hostMemory() int64 {
+	for _, line := range strings.Split(readString("/proc/meminfo"), "\n") {
+		if v, ok := strings.CutPrefix(line, "MemTotal:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// Print writes the stats for humans, with warnings for what's worth a look.
+func (s *Stats) Print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "cgroup v%d\t%s\n\n", s.Version, s.Cgroup)
+
+	m := s.Memory
+	limit := "none (host " + bytes(m.HostTotal) + ")"
+	if m.Limit != Unlimited && m.Limit > 0 {
+		limit = fmt.Sprintf("%s (%.0f%% used)", bytes(m.Limit), 100*float64(m.Current)/float64(m.Limit))
+	}
+	_, _ = fmt.Fprintf(w, "Memory\t%s used: %s anon, %s cache\n", bytes(m.Current), bytes(m.Anon), bytes(m.File))
+	_, _ = fmt.Fprintf(w, "  limit\t%s\n", limit)
+	if m.High > 0 {
+		_, _ = fmt.Fprintf(w, "  high\t%s\n", bytes(m.High))
+	}
+	if m.Peak > 0 {
+		_, _ = fmt.Fprintf(w, "  peak\t%s\n", bytes(m.Peak))
+	}
+	if m.SwapCurrent > 0 || m.SwapLimit > 0 {
+		_, _ = fmt.Fprintf(w, "  swap\t%s (limit %s)\n", bytes(m.SwapCurrent), bytes(m.SwapLimit))
+	}
+	_, _ = fmt.Fprintf(w, "  hit the limit\t%d times%s\n", m.MaxEvents, warnIf(m.MaxEvents > 0, "reclaiming under pressure"))
+	_, _ = fmt.Fprintf(w, "  OOM kills\t%d%s\n", m.OOMKills, warnIf(m.OOMKills > 0, "processes were killed"))
+	if s.Version == 2 {
+		_, _ = fmt.Fprintf(w, "  pressure\t%.1f%% stalled (10s)%s\n", m.Pressure, warnIf(m.Pressure >= 10, "memory-bound"))
+	}
+
+	c := s.CPU
+	cpuLimit := fmt.Sprintf("none (host %d CPUs)", c.HostCPUs)
+	if c.Limit > 0 {
+		cpuLimit = fmt.Sprintf("%.2f CPUs", c.Limit)
+	}
+	_, _ = fmt.Fprintf(w, "\nCPU\t%.2f CPUs used (over %s)\n", c.Usage, s.Interval)
+	_, _ = fmt.Fprintf(w, "  limit\t%s\n", cpuLimit)
+	if c.Weight > 0 {
+		_, _ = fmt.Fprintf(w, "  weight\t%d\n", c.Weight)
+	}
+	if c.Periods > 0 {
+		_, _ = fmt.Fprintf(w, "  throttled\t%.0f%% of periods now, %d/%d overall (%.1fs)%s\n",
+			100*c.ThrottledRatio, c.Throttled, c.Periods, c.ThrottledTime, warnIf(c.ThrottledRatio >= 0.1, "CPU limit too low?"))
+	}
+	if s.Version == 2 {
+		_, _ = fmt.Fprintf(w, "  pressure\t%.1f%% stalled (10s)\n", c.Pressure)
+	}
+
+	pids := "none"
+	if s.Pids.Limit > 0 {
+		pids = strconv.FormatInt(s.Pids.Limit, 10)
+	}
+	_, _ = fmt.Fprintf(w, "\nProcesses\t%d (limit %s)%s\n", s.Pids.Current, pids,
+		warnIf(s.Pids.Limit > 0 && s.Pids.Current*10 >= s.Pids.Limit*9, "close to the limit"))
+	if s.Version == 2 {
+		_, _ = fmt.Fprintf(w, "I/O\t%.1f%% stalled (10s)\n", s.IOStall)
+	}
+	return w.Flush()
+}
+
+func warnIf(cond bool, msg string) string {
+	if cond {
+		return "  ⚠ " + msg
+	}
+	return ""
+}
+
+// bytes formats a size in binary units.
+func bytes(n int64) string {
+	if n == Unlimited {
+		return "none"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
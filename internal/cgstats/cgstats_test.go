@@ -0,0 +1,250 @@
+package cgstats
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files of a cgroup directory.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadInt(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"max": "max\n", "number": "536870912\n", "junk": "a lot\n", "empty": ""})
+	tests := []struct {
+		file string
+		want int64
+	}{
+		{"max", Unlimited},
+		{"number", 536870912},
+		{"junk", 0},
+		{"empty", 0},
+		{"missing", 0},
+	}
+	for _, tt := range tests {
+		if got := readInt(filepath.Join(dir, tt.file)); got != tt.want {
+			t.Errorf("readInt(%s) = %d, want %d", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestReadKeyed(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"memory.events": "low 0\nhigh 3\nmax 12\noom 1\noom_kill 2\n"})
+	got := readKeyed(filepath.Join(dir, "memory.events"))
+	for k, want := range map[string]int64{"low": 0, "high": 3, "max": 12, "oom": 1, "oom_kill": 2} {
+		if got[k] != want {
+			t.Errorf("%s = %d, want %d", k, got[k], want)
+		}
+	}
+	if len(readKeyed(filepath.Join(dir, "missing"))) != 0 {
+		t.Errorf("a missing file has values")
+	}
+}
+
+func TestPressure(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    float64
+	}{
+		{"some and full", "some avg10=12.50 avg60=3.00 avg300=1.00 total=123\nfull avg10=4.00 avg60=1.00 avg300=0.50 total=45\n", 12.5},
+		{"full only", "full avg10=4.00 avg60=1.00 avg300=0.50 total=45\n", 0},
+		{"idle", "some avg10=0.00 avg60=0.00 avg300=0.00 total=0\n", 0},
+		{"empty", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "cpu.pressure")
+			writeFiles(t, filepath.Dir(file), map[string]string{"cpu.pressure": tt.content})
+			if got := pressure(file); got != tt.want {
+				t.Errorf("pressure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		check func(t *testing.T, s *Stats)
+	}{
+		{
+			name: "limits",
+			files: map[string]string{
+				"memory.max":     "1073741824\n",
+				"memory.high":    "max\n",
+				"memory.current": "536870912\n",
+				"memory.stat":    "anon 402653184\nfile 134217728\n",
+				"memory.events":  "max 7\noom_kill 1\n",
+				"cpu.max":        "150000 100000\n",
+				"cpu.weight":     "100\n",
+				"cpu.stat":       "usage_usec 5000000\nnr_periods 200\nnr_throttled 50\nthrottled_usec 2500000\n",
+				"cpu.pressure":   "some avg10=8.00 avg60=0 avg300=0 total=0\n",
+				"pids.max":       "100\n",
+				"pids.current":   "95\n",
+			},
+			check: func(t *testing.T, s *Stats) {
+				m, c := s.Memory, s.CPU
+				if m.Limit != 1<<30 || m.High != Unlimited || m.Current != 1<<29 || m.Anon != 402653184 || m.File != 134217728 {
+					t.Errorf("memory = %+v", m)
+				}
+				if m.MaxEvents != 7 || m.OOMKills != 1 {
+					t.Errorf("memory events = %d, %d OOM kills", m.MaxEvents, m.OOMKills)
+				}
+				if c.Limit != 1.5 || c.Weight != 100 || c.Periods != 200 || c.Throttled != 50 || c.ThrottledTime != 2.5 || c.Pressure != 8 {
+					t.Errorf("cpu = %+v", c)
+				}
+				if s.Pids != (Pids{Limit: 100, Current: 95}) {
+					t.Errorf("pids = %+v", s.Pids)
+				}
+			},
+		},
+		{
+			name: "no limits",
+			files: map[string]string{
+				"memory.max": "max\n",
+				"cpu.max":    "max 100000\n",
+				"pids.max":   "max\n",
+			},
+			check: func(t *testing.T, s *Stats) {
+				if s.Memory.Limit != Unlimited || s.CPU.Limit != 0 || s.Pids.Limit != Unlimited {
+					t.Errorf("limits = %d, %v CPUs, %d pids", s.Memory.Limit, s.CPU.Limit, s.Pids.Limit)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			cg := &cgroup{version: 2, dirs: map[string]string{"": dir}}
+			s := &Stats{Version: 2}
+			cg.readV2(s)
+			tt.check(t, s)
+		})
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		name      string
+		memory    map[string]string
+		cpu       map[string]string
+		hostTotal int64
+		limit     int64
+		cpus      float64
+	}{
+		{
+			name:      "limits",
+			memory:    map[string]string{"memory.limit_in_bytes": "268435456\n", "memory.usage_in_bytes": "134217728\n", "memory.stat": "cache 4096\nrss 8192\n", "memory.failcnt": "3\n", "memory.oom_control": "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"},
+			cpu:       map[string]string{"cpu.cfs_quota_us": "50000\n", "cpu.cfs_period_us": "100000\n", "cpu.stat": "nr_periods 10\nnr_throttled 4\nthrottled_time 3000000000\n"},
+			hostTotal: 8 << 30,
+			limit:     256 << 20,
+			cpus:      0.5,
+		},
+		{
+			name:      "no limits",
+			memory:    map[string]string{"memory.limit_in_bytes": "9223372036854771712\n"},
+			cpu:       map[string]string{"cpu.cfs_quota_us": "-1\n", "cpu.cfs_period_us": "100000\n"},
+			hostTotal: 8 << 30,
+			limit:     Unlimited,
+		},
+		{
+			name:      "limit above the host memory",
+			memory:    map[string]string{"memory.limit_in_bytes": "17179869184\n"},
+			hostTotal: 8 << 30,
+			limit:     Unlimited,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory, cpu := t.TempDir(), t.TempDir()
+			writeFiles(t, memory, tt.memory)
+			writeFiles(t, cpu, tt.cpu)
+			cg := &cgroup{version: 1, dirs: map[string]string{"memory": memory, "cpu": cpu, "pids": t.TempDir()}}
+			s := &Stats{Version: 1, Memory: Memory{HostTotal: tt.hostTotal}}
+			cg.readV1(s)
+			if s.Memory.Limit != tt.limit {
+				t.Errorf("memory limit = %d, want %d", s.Memory.Limit, tt.limit)
+			}
+			if s.CPU.Limit != tt.cpus {
+				t.Errorf("cpu limit = %v, want %v", s.CPU.Limit, tt.cpus)
+			}
+			if tt.name == "limits" {
+				m, c := s.Memory, s.CPU
+				if m.Anon != 8192 || m.File != 4096 || m.MaxEvents != 3 || m.OOMKills != 2 {
+					t.Errorf("memory = %+v", m)
+				}
+				if c.Periods != 10 || c.Throttled != 4 || c.ThrottledTime != 3 {
+					t.Errorf("cpu = %+v", c)
+				}
+			}
+		})
+	}
+}
+
+func TestBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{Unlimited, "none"},
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{256 << 20, "256.0MiB"},
+		{3 << 30, "3.0GiB"},
+	}
+	for _, tt := range tests {
+		if got := bytes(tt.n); got != tt.want {
+			t.Errorf("bytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPrintWarnings(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats Stats
+		warns []string
+	}{
+		{
+			name:  "healthy",
+			stats: Stats{Version: 2, Memory: Memory{Limit: 1 << 30, Current: 1 << 28}, CPU: CPU{Limit: 1, Periods: 10}, Pids: Pids{Limit: 100, Current: 10}},
+		},
+		{
+			name: "under pressure",
+			stats: Stats{Version: 2, Memory: Memory{Limit: 1 << 30, Current: 1 << 30, MaxEvents: 4, OOMKills: 1, Pressure: 25},
+				CPU: CPU{Limit: 0.5, Periods: 10, Throttled: 8, ThrottledRatio: 0.8}, Pids: Pids{Limit: 100, Current: 95}},
+			warns: []string{"reclaiming under pressure", "processes were killed", "memory-bound", "CPU limit too low?", "close to the limit"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := tt.stats.Print(&out); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(out.String(), "⚠"); got != len(tt.warns) {
+				t.Errorf("%d warnings, want %d:\n%s", got, len(tt.warns), out.String())
+			}
+			for _, w := range tt.warns {
+				if !strings.Contains(out.String(), w) {
+					t.Errorf("no %q warning:\n%s", w, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+// approvalPoll is how often a session waiting for an approval checks on it.
+const approvalPoll = 2 * time.Second
+
+// awaitApproval waits until someone approves the session, through the
+// webhook of the approval or else, when the policy allows it, an annotation
+// on the target pod.
+func awaitApproval(ctx context.Context, req policy.Request, a *policy.Approval) error {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	r := policy.ApprovalRequest{
+		ID:        hex.EncodeToString(id),
+		Requested: time.Now().UTC(),
+		Request:   req,
+		Approvers: a.Approvers,
+		Status:    policy.StatusPending,
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.Deadline())
+	defer cancel()
+
+	var err error
+	switch {
+	case a.Webhook != "":
+		fmt.Fprintf(os.Stderr, "Waiting for an approval of %s on %s (%s)...\n", req.Command, req.Target, r.ID)
+		r, err = pollApproval(ctx, r, func(r policy.ApprovalRequest) (policy.ApprovalRequest, error) {
+			return a.Ask(ctx, r)
+		})
+	case a.Annotations && req.Runtime == "kubernetes" && req.Kind == policy.KindContainer:
+		r, err = annotationApproval(ctx, r)
+	case a.Annotations:
+		return fmt.Errorf("%s on %s needs an approval, which the policy can only get through a webhook: annotations only apply to running pods", req.Command, req.Target)
+	default:
+		return fmt.Errorf("%s on %s needs an approval, which the policy can only get through a webhook: pod annotations don't authenticate approvers, and need annotations: true", req.Command, req.Target)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s on %s: no approval after %s", req.Command, req.Target, a.Deadline())
+	}
+	if err != nil {
+		return err
+	}
+	if r.Status == policy.StatusDenied {
+		reason := ""
+		if r.Reason != "" {
+			reason = ": " + r.Reason
+		}
+		return fmt.Errorf("%s on %s denied by %s%s", req.Command, req.Target, r.Approver, reason)
+	}
+	fmt.Fprintf(os.Stderr, "Approved by %s\n", r.Approver)
+	return nil
+}
+
+// pollApproval checks on r until it's no longer pending.
+func pollApproval(ctx context.Context, r policy.ApprovalRequest, check func(policy.ApprovalRequest) (policy.ApprovalRequest, error)) (policy.ApprovalRequest, error) {
+	for {
+		var err error
+		r, err = check(r)
+		if err != nil || r.Status != policy.StatusPending {
+			return r, err
+		}
+		select {
+		case <-ctx.Done():
+			return r, ctx.Err()
+		case <-time.After(approvalPoll):
+		}
+	}
+}
+
+// annotationApproval stores r in an annotation of the target pod, where
+// debux approve answers it, and removes it once answered or given up on.
+// The answer names its approver, whom nothing authenticates: checking it
+// keeps honest approvers to the policy, not anyone who can patch the pod.
+func annotationApproval(ctx context.Context, r policy.ApprovalRequest) (policy.ApprovalRequest, error) {
+	key := meta.ApprovalKeyPrefix + r.ID
+	requester, err := runtime.KubernetesUser(ctx, r.Kubeconfig)
+	if err != nil {
+		return r, err
+	}
+	r.Requester = requester
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	value := string(data)
+	if err := runtime.KubernetesAnnotate(ctx, r.Kubeconfig, r.Namespace, r.Name, map[string]*string{key: &value}); err != nil {
+		return r, err
+	}
+	defer func() {
+		_ = runtime.KubernetesAnnotate(context.WithoutCancel(ctx), r.Kubeconfig, r.Namespace, r.Name, map[string]*string{key: nil})
+	}()
+	fmt.Fprintf(os.Stderr, "Waiting for an approval of %s on %s, ask an approver to run:\n\n  debux approve %s %s\n\n", r.Command, r.Target, r.Target, r.ID)
+	return pollApproval(ctx, r, func(r policy.ApprovalRequest) (policy.ApprovalRequest, error) {
+		annotations, err := runtime.KubernetesAnnotations(ctx, r.Kubeconfig, r.Namespace, r.Name)
+		if err != nil {
+			return r, err
+		}
+		value, ok := annotations[key]
+		if !ok {
+			return r, fmt.Errorf("the approval request of %s was removed from the pod", r.ID)
+		}
+		var answer policy.ApprovalRequest
+		if err := json.Unmarshal([]byte(value), &answer); err != nil {
+			return r, fmt.Errorf("invalid approval annotation %s: %w", key, err)
+		}
+		if answer.Status == policy.StatusPending {
+			return r, nil
+		}
+		// Check the answer against our own copy of the request
+		if err := r.MayApprove(answer.Approver); err != nil {
+			return r, fmt.Errorf("rejecting the answer to %s: %w", r.ID, err)
+		}
+		r.Status, r.Approver, r.Reason = answer.Status, answer.Approver, answer.Reason
+		return r, nil
+	})
+}
+
+func newApproveCmd() *cobra.Command {
+	var deny bool
+	var reason string
+	cmd := &cobra.Command{
+		Use:   "approve <target> [id]",
+		Short: "Approve a debug session waiting for an approval",
+		Long: `Approve (or deny) a debug session on a pod that the policy makes wait for an
+approval. Without an ID, approves the only session waiting on the pod.
+Sessions approved through a webhook are answered by the webhook instead.`,
+		Example: `  debux approve k8s://prod/api-7d9f
+  debux approve k8s://prod/api-7d9f 5f0c2a9e81d4b7a3 --deny --reason "use staging"`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			target, err := runtime.ParseTarget(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid target: %w", err)
+			}
+			if target.Runtime != "kubernetes" || target.Name == "" {
+				return fmt.Errorf("only sessions on pods are approved with debux approve: k8s://[namespace/]pod")
+			}
+			kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+			namespace := target.Namespace
+			if namespace == "default" {
+				namespace = runtime.KubernetesNamespace(kubeconfig)
+			}
+			annotations, err := runtime.KubernetesAnnotations(ctx, kubeconfig, namespace, target.Name)
+			if err != nil {
+				return err
+			}
+
+			var pending []policy.ApprovalRequest
+			for key, value := range annotations {
+				var r policy.ApprovalRequest
+				if !strings.HasPrefix(key, meta.ApprovalKeyPrefix) || json.Unmarshal([]byte(value), &r) != nil {
+					continue
+				}
+				if r.Status == policy.StatusPending && (len(args) == 1 || r.ID == args[1]) {
+					pending = append(pending, r)
+				}
+			}
+			switch {
+			case len(pending) == 0 && len(args) == 2:
+				return fmt.Errorf("no session waits for an approval %s on %s", args[1], args[0])
+			case len(pending) == 0:
+				return fmt.Errorf("no session waits for an approval on %s", args[0])
+			case len(pending) > 1:
+				sort.Slice(pending, func(i, j int) bool { return pending[i].Requested.Before(pending[j].Requested) })
+				var b strings.Builder
+				for _, r := range pending {
+					fmt.Fprintf(&b, "\n  %s  %s by %s, %s ago", r.ID, r.Command, r.Requester, time.Since(r.Requested).Round(time.Second))
+				}
+				return fmt.Errorf("several sessions wait for an approval on %s, pass the ID of one:%s", args[0], b.String())
+			}
+
+			r := pending[0]
+			approver, err := runtime.KubernetesUser(ctx, kubeconfig)
+			if err != nil {
+				return err
+			}
+			if err := r.MayApprove(approver); err != nil {
+				return err
+			}
+			r.Status, r.Approver, r.Reason = policy.StatusApproved, approver, reason
+			if deny {
+				r.Status = policy.StatusDenied
+			}
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			value := string(data)
+			if err := runtime.KubernetesAnnotate(ctx, kubeconfig, namespace, target.Name, map[string]*string{meta.ApprovalKeyPrefix + r.ID: &value}); err != nil {
+				return err
+			}
+			fmt.Printf("%s %s on %s by %s\n", strings.ToUpper(r.Status[:1])+r.Status[1:], r.Command, r.Target, r.Requester)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&deny, "deny", false, "Deny the session instead")
+	cmd.Flags().StringVar(&reason, "reason", "", "Why, shown to the requester")
+	return cmd
+}
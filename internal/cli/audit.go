@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/clement-tourriere/debux/internal/audit"
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// auditFlags are the flags of the running command, as audited.
+	auditFlags []string
+
+	// openSessions are the audited sessions Execute ends when their
+	// command returns, for those whose end the command doesn't record:
+	// runners and SSH pipes may run several commands.
+	openSessionsMu sync.Mutex
+	openSessions   []*audit.Session
+)
+
+// startSession decides on a session with the policy file, waits for its
+// approval when the policy asks for one, and records its start in the audit
+// log. Call end with the outcome of the session.
+func startSession(ctx context.Context, req policy.Request) (end func(error), err error) {
+	req.User = meta.Creator()
+	approval, err := checkPolicy(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if approval != nil {
+		if err := awaitApproval(ctx, req, approval); err != nil {
+			return nil, err
+		}
+	}
+	recordHistory(req)
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	l := audit.New(cfg.Audit)
+	if l == nil {
+		return func(error) {}, nil
+	}
+	s, err := l.Start(ctx, req, auditFlags)
+	if err != nil {
+		return nil, err
+	}
+	openSessionsMu.Lock()
+	openSessions = append(openSessions, s)
+	openSessionsMu.Unlock()
+	return s.End, nil
+}
+
+// endSessions records the end of the sessions left open when the command
+// returns, with its error.
+func endSessions(err error) {
+	openSessionsMu.Lock()
+	defer openSessionsMu.Unlock()
+	for _, s := range openSessions {
+		s.End(err)
+	}
+	openSessions = nil
+}
+
+// redactedFlags hold secrets, audited without their values.
+var redactedFlags = map[string]bool{"registry-auth": true, "token": true}
+
+// changedFlags returns the flags set on the command line as --name=value.
+// Only the names of -e variables are kept, since values may be secrets.
+func changedFlags(cmd *cobra.Command) []string {
+	var flags []string
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		value := f.Value.String()
+		switch {
+		case redactedFlags[f.Name]:
+			value = "<redacted>"
+		case f.Name == "env":
+			var keys []string
+			for _, e := range flagEnv {
+				key, _, _ := strings.Cut(e, "=")
+				keys = append(keys, key)
+			}
+			value = "[" + strings.Join(keys, ",") + "]"
+		}
+		flags = append(flags, fmt.Sprintf("--%s=%s", f.Name, value))
+	})
+	return flags
+}
@@ -0,0 +1,160 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/api"
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+// backend returns where commands run: the daemon of --host, or here.
+func backend(cmd *cobra.Command) (api.Backend, error) {
+	if flagHost != "" {
+		return api.NewClient(flagHost, os.Getenv("DEBUX_TOKEN"))
+	}
+	return newLocalBackend(cmd)
+}
+
+// localBackend runs operations with the local Docker daemon and kubeconfig,
+// with the debug options of the command line.
+type localBackend struct {
+	opts    runtime.DebugOpts
+	command string // the debux command serving, for the policy
+}
+
+var _ api.Backend = localBackend{}
+
+func newLocalBackend(cmd *cobra.Command) (localBackend, error) {
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return localBackend{}, err
+	}
+	// Commands run as root: --as-target-user is for shells
+	opts.AsTargetUser = false
+	return localBackend{opts: opts, command: commandName(cmd)}, nil
+}
+
+func (b localBackend) Targets(ctx context.Context, scope string) ([]api.Target, error) {
+	s, d, err := parseScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	list, err := d.List(ctx, s.Namespace, b.opts)
+	if err != nil {
+		return nil, err
+	}
+	var targets []api.Target
+	for _, t := range list {
+		targets = append(targets, api.Target{Target: t.Target, Name: t.Name, Detail: t.Detail, Status: t.Status, Session: t.Session})
+	}
+	return targets, nil
+}
+
+func (b localBackend) Sessions(ctx context.Context, scope string) ([]api.Session, error) {
+	s, d, err := parseScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := d.Sessions(ctx, s.Namespace, b.opts)
+	if err != nil {
+		return nil, err
+	}
+	var result []api.Session
+	for _, session := range sessions {
+		result = append(result, api.Session{Target: session.Target, Container: session.Container, Started: session.Started, Shells: session.Shells})
+	}
+	return result, nil
+}
+
+func (b localBackend) CreateSession(ctx context.Context, arg string) (api.Session, error) {
+	target, d, err := parseRunningTarget(arg)
+	if err != nil {
+		return api.Session{}, err
+	}
+	end, err := startSession(ctx, containerRequest(b.command, target, b.opts))
+	if err != nil {
+		return api.Session{}, err
+	}
+	// The session is the creation of the debug container: shells are
+	// audited when they run commands through Exec
+	name, err := d.Sidecar(ctx, target, b.opts)
+	end(err)
+	if err != nil {
+		return api.Session{}, err
+	}
+	return api.Session{Target: arg, Container: name, Started: time.Now(), Shells: 0}, nil
+}
+
+func (b localBackend) DeleteSession(ctx context.Context, arg string) error {
+	target, d, err := parseRunningTarget(arg)
+	if err != nil {
+		return err
+	}
+	return d.Cleanup(ctx, target, b.opts)
+}
+
+func (b localBackend) Exec(ctx context.Context, arg string, command []string, stdout, stderr io.Writer) (int, error) {
+	target, d, err := parseRunningTarget(arg)
+	if err != nil {
+		return -1, err
+	}
+	end, err := startSession(ctx, containerRequest(b.command, target, b.opts))
+	if err != nil {
+		return -1, err
+	}
+	code, err := d.Pipe(ctx, target, b.opts, command, nil, stdout, stderr)
+	end(err)
+	return code, err
+}
+
+func (b localBackend) Bundle(ctx context.Context, arg string, w io.Writer) error {
+	var stderr bytes.Buffer
+	code, err := b.Exec(ctx, arg, []string{"sh", "-c", entrypoint.Bundle}, w, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("collecting the bundle: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// parseScope parses the scope of target and session lists, a target
+// without a name: empty for Docker, or k8s://[namespace/], and returns its
+// driver.
+func parseScope(scope string) (*runtime.Target, runtime.Driver, error) {
+	s := &runtime.Target{Runtime: "docker"}
+	if scope != "" {
+		var err error
+		if s, err = runtime.ParseTarget(scope); err != nil {
+			return nil, nil, fmt.Errorf("invalid target: %w", err)
+		}
+		if s.Name != "" {
+			return nil, nil, fmt.Errorf("expected a runtime or namespace like k8s:// or k8s://<namespace>/, got %q", scope)
+		}
+	}
+	d, err := runtime.DriverFor(s.Runtime)
+	return s, d, err
+}
+
+// parseRunningTarget parses the target of an operation on a running
+// container or pod, and returns its driver.
+func parseRunningTarget(arg string) (*runtime.Target, runtime.Driver, error) {
+	target, err := runtime.ParseTarget(arg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Name == "" {
+		return nil, nil, fmt.Errorf("missing target name in %q", arg)
+	}
+	d, err := runtime.DriverFor(target.Runtime)
+	return target, d, err
+}
@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/api"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newDaemonCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Serve debux operations over an HTTP API",
+		Long: `Run a debux daemon: an HTTP API listing targets and debug containers,
+creating and removing debug containers, running commands in them and
+collecting diagnostics bundles, for platforms and chatops bots.
+
+The debux CLI uses the daemon with --host (or $DEBUX_HOST) for these
+operations (sessions, scan, secrets, bundle, cleanup, --detach...); debug
+shells always run locally.
+
+The daemon listens on a Unix socket only its user can use by default. Over
+TCP, clients must send the token (--token, $DEBUX_TOKEN, or printed at start)
+as a bearer token; use a TLS-terminating proxy beyond localhost. Debug options
+(--image, --profile, ...) given to the daemon apply to every request.
+
+--metrics-listen serves Prometheus metrics of the sessions, debug
+containers, image pulls and API requests on a separate address, without the
+token; --otlp-endpoint exports OpenTelemetry traces of each request and its
+setup phases (image pull, debug container, waiting for it to run).`,
+		Example: `  debux daemon
+  debux --host unix://$XDG_RUNTIME_DIR/debux.sock sessions
+  debux daemon --listen tcp://127.0.0.1:7070 --profile restricted
+  debux daemon --metrics-listen :9464 --otlp-endpoint http://otel-collector:4318`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			listen, _ := cmd.Flags().GetString("listen")
+			token, _ := cmd.Flags().GetString("token")
+			if flagHost != "" {
+				return fmt.Errorf("--host doesn't apply to the daemon itself")
+			}
+			if listen == "" {
+				path := defaultSocket()
+				if err := privateDir(filepath.Dir(path)); err != nil {
+					return err
+				}
+				listen = "unix://" + path
+			}
+
+			b, err := newLocalBackend(cmd)
+			if err != nil {
+				return err
+			}
+			srv := &api.Server{Backend: b}
+
+			var ln net.Listener
+			if path, ok := strings.CutPrefix(listen, "unix://"); ok {
+				// A leftover socket from a previous run
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				// Only the user can connect, from the socket's creation on
+				mask := syscall.Umask(0o177)
+				ln, err = net.Listen("unix", path)
+				syscall.Umask(mask)
+				if err != nil {
+					return fmt.Errorf("listening on %s: %w", listen, err)
+				}
+				fmt.Fprintf(os.Stderr, "debux daemon listening on %s\n", listen)
+			} else if addr, ok := strings.CutPrefix(listen, "tcp://"); ok {
+				if token == "" {
+					token = os.Getenv("DEBUX_TOKEN")
+				}
+				if token == "" {
+					raw := make([]byte, 24)
+					if _, err := rand.Read(raw); err != nil {
+						return err
+					}
+					token = base64.RawURLEncoding.EncodeToString(raw)
+					fmt.Fprintf(os.Stderr, "Token: %s\n", token)
+				}
+				srv.Token = token
+				if ln, err = net.Listen("tcp", addr); err != nil {
+					return fmt.Errorf("listening on %s: %w", listen, err)
+				}
+				fmt.Fprintf(os.Stderr, "debux daemon listening on tcp://%s\n", ln.Addr())
+			} else {
+				return fmt.Errorf("invalid --listen %q: expected unix://<path> or tcp://<host:port>", listen)
+			}
+
+			handler, _, stopTelemetry, err := startTelemetry(ctx, cmd, "debux-daemon", srv.Handler())
+			if err != nil {
+				_ = ln.Close()
+				return err
+			}
+			defer stopTelemetry()
+			httpSrv := &http.Server{
+				Handler:           handler,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = httpSrv.Shutdown(shutdownCtx)
+			}()
+			if err := httpSrv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().String("listen", "", "Address to listen on: unix://<path> or tcp://<host:port> (default: a Unix socket in the runtime directory)")
+	cmd.Flags().String("token", "", "Token clients must send over TCP (default: $DEBUX_TOKEN, or generated)")
+	addTelemetryFlags(cmd)
+
+	return cmd
+}
+
+// defaultSocket returns the path of the daemon's Unix socket.
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "debux.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("debux-%d", os.Getuid()), "debux.sock")
+}
+
+// privateDir creates the directory of the default socket for the user only.
+// It fails if the directory exists for others to use: in the temporary
+// directory, anyone could have created it first.
+func privateDir(dir string) error {
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(st.Uid) != os.Getuid() || info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s isn't a directory only you can use: remove it, or choose the socket with --listen", dir)
+	}
+	return nil
+}
+
+func newBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bundle <target>",
+		Short: "Collect a diagnostics bundle from a container or pod",
+		Long: `Collect diagnostics about a running container or pod from its debug
+container (creating it if needed) into a gzipped tar: processes, the main
+process's status, limits, cgroup, mounts and open files, memory, disks,
+network addresses, routes and sockets, and DNS configuration. The target's
+environment is left out, as it often holds secrets.`,
+		Example: `  debux bundle my-app
+  debux bundle k8s://prod/api-7d9f -o api.tar.gz`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			output, _ := cmd.Flags().GetString("output")
+			if output == "" {
+				output = "debux-bundle-" + strings.Trim(nonAliasChars.ReplaceAllString(args[0], "-"), "-") + "-" + time.Now().Format("20060102-150405") + ".tar.gz"
+			}
+			b, err := backend(cmd)
+			if err != nil {
+				return err
+			}
+
+			var w io.Writer = os.Stdout
+			if output == "-" {
+				// Status messages would otherwise mix with the bundle
+				runtime.SetStatusOutput(os.Stderr)
+			} else {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = f.Close() }()
+				w = f
+			}
+			if err := b.Bundle(ctx, args[0], w); err != nil {
+				if output != "-" {
+					_ = os.Remove(output)
+				}
+				return err
+			}
+			if output != "-" {
+				fmt.Fprintf(os.Stderr, "Bundle written to %s\n", output)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "", "Output file, - for stdout (default: debux-bundle-<target>-<time>.tar.gz)")
+
+	return cmd
+}
+
+func newCleanupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cleanup <target>",
+		Short: "Remove the debug container of a container or pod",
+		Long: `Remove the debug sidecar of a Docker container, or stop the debux ephemeral
+container of a pod (ephemeral containers can't be removed from a pod: it
+stays in the pod's spec, terminated).`,
+		Example: `  debux cleanup my-app
+  debux cleanup k8s://prod/api-7d9f`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			b, err := backend(cmd)
+			if err != nil {
+				return err
+			}
+			return b.DeleteSession(ctx, args[0])
+		},
+	}
+}
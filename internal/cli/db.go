@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/moby/term"
+	"github.com/spf13/cobra"
+)
+
+func newDBCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "db <target> [variable] [-- client args...]",
+		Short: "Open a database client configured from the target's environment",
+		Long: `Run dbconn in the target's debug container: it reads the database settings
+of the target's environment (DATABASE_URL and other URLs, JDBC URLs, PG*,
+MYSQL_*, REDIS_* variables), installs the matching client with dctl when
+missing (psql, mysql, redis-cli or mongosh) and connects it from the target's
+network namespace. Name the variable to pick among several databases;
+--list lists them, without passwords.
+
+Credentials never leave the debug container: dbconn reads them there, and
+passes them to the client through its environment rather than its command
+line. Clients keep no history file, and debux records no credentials in its
+own history.
+
+On a terminal, the client gets one through SSH, like debux ssh. Otherwise it
+reads stdin, for scripts. The same tool is available as dbconn in debug
+shells.`,
+		Example: `  debux db my-app
+  debux db k8s://prod/api-7d9f --list
+  debux db k8s://prod/api-7d9f REDIS_URL
+  echo 'select count(*) from orders' | debux db my-app DATABASE_URL`,
+		Args: dbArgs,
+		RunE: runDB,
+	}
+
+	cmd.Flags().Bool("list", false, "List the database settings of the target's environment")
+	cmd.Flags().Int("pid", 1, "Process whose environment to read, in the target's PID namespace")
+
+	return cmd
+}
+
+// dbArgs accepts a target and a variable, and client arguments after "--".
+func dbArgs(cmd *cobra.Command, args []string) error {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args = args[:dash]
+	}
+	return cobra.RangeArgs(1, 2)(cmd, args)
+}
+
+func runDB(cmd *cobra.Command, args []string) error {
+	var extra []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args, extra = args[:dash], args[dash:]
+	}
+	list, _ := cmd.Flags().GetBool("list")
+	pid, _ := cmd.Flags().GetInt("pid")
+	if pid <= 0 {
+		return fmt.Errorf("invalid --pid %d", pid)
+	}
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("db needs a running container or pod: images have no environment or network to connect from")
+	}
+
+	command := []string{"dbconn", "--pid", strconv.Itoa(pid)}
+	if list {
+		command = append(command, "--list")
+	}
+	command = append(command, args[1:]...)
+	command = append(append(command, "--"), extra...)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	_, isTerminal := term.GetFdInfo(os.Stdin)
+	if flagHost != "" {
+		run, err := subjectRunner(ctx, cmd, args[0])
+		if err != nil {
+			return err
+		}
+		return dbStatus(run(ctx, command, os.Stdout, os.Stderr))
+	}
+	if !isTerminal || list {
+		pipe, err := targetPipe(ctx, cmd, args[0], false)
+		if err != nil {
+			return err
+		}
+		var stdin io.Reader
+		if !isTerminal {
+			stdin = os.Stdin
+		}
+		return dbStatus(pipe(ctx, command, stdin, os.Stdout, os.Stderr))
+	}
+
+	// The client wants a terminal: only SSH gives commands one
+	alias, configFile, err := setupSSH(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(command))
+	for i, w := range command {
+		quoted[i] = shellQuoteWord(w)
+	}
+	ssh := exec.CommandContext(ctx, "ssh", "-q", "-t", "-F", configFile, alias, "PATH=/usr/local/bin:$PATH "+strings.Join(quoted, " "))
+	ssh.Stdin, ssh.Stdout, ssh.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := ssh.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return dbStatus(exitErr.ExitCode(), nil)
+		}
+		return fmt.Errorf("running ssh: %w", err)
+	}
+	return nil
+}
+
+// dbStatus turns the exit code of dbconn into an error, which debux exits
+// with.
+func dbStatus(code int, err error) error {
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 0:
+		return nil
+	case 127:
+		return fmt.Errorf("the debug image has no dbconn: update it, or set --image to a recent debux image")
+	}
+	return &runtime.ExitError{Code: code}
+}
@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newDnsqCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dnsq <target> <name> [type]",
+		Short: "Resolve a name like the target does, and compare resolvers",
+		Long: `Run dnsq in the target's debug container: it resolves the name with the
+target's /etc/resolv.conf (nameservers, search domains and ndots), not the
+debug container's, showing each name the target's resolver tries. It then
+asks every resolver the same question and flags the ones that disagree:
+
+  target             nameservers of the target's resolv.conf
+  debug-container    nameservers of the debug container's resolv.conf
+  kube-dns-service   the kube-dns service (Kubernetes)
+  coredns/<pod>      each CoreDNS pod directly, bypassing the service
+  upstream           resolvers CoreDNS forwards to, when its Corefile lists
+                     addresses
+  host               resolvers of the Docker host (local Docker daemon)
+
+The same tool is available as dnsq in debug shells. Exits with status 1 when
+the name doesn't resolve or resolvers disagree.`,
+		Example: `  debux dnsq k8s://prod/api-7d9f payments
+  debux dnsq my-app db.internal AAAA
+  debux dnsq k8s://prod/api-7d9f api.example.com --server corp=10.1.0.2`,
+		Args: cobra.RangeArgs(2, 3),
+		RunE: runDnsq,
+	}
+
+	cmd.Flags().StringArray("server", nil, "Also compare this resolver, as <label>=<ip> (repeatable)")
+	cmd.Flags().String("cluster-domain", "cluster.local", "Cluster domain, whose names upstream resolvers aren't asked (Kubernetes)")
+
+	return cmd
+}
+
+func runDnsq(cmd *cobra.Command, args []string) error {
+	servers, _ := cmd.Flags().GetStringArray("server")
+	for _, s := range servers {
+		if label, ip, ok := strings.Cut(s, "="); !ok || label == "" || ip == "" {
+			return fmt.Errorf("invalid --server %q: expected <label>=<ip>", s)
+		}
+	}
+	clusterDomain, _ := cmd.Flags().GetString("cluster-domain")
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("dnsq needs a running container or pod: images have no resolver")
+	}
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+
+	// stdout carries dnsq's output only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// Resolvers only the host can find
+	if d, err := runtime.DriverFor(target.Runtime); err == nil && flagHost == "" {
+		if r, ok := d.(runtime.DNSResolvers); ok {
+			opts, err := debugOpts(cmd)
+			if err != nil {
+				return err
+			}
+			host, err := r.DNSServers(ctx, opts)
+			if err != nil {
+				render.Warnf(os.Stderr, "%v; comparing the target's resolvers only", err)
+			}
+			servers = append(host, servers...)
+		}
+	}
+
+	run, err := containerRunner(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+	command := []string{"env", "DNSQ_CLUSTER_DOMAIN=" + clusterDomain, "dnsq"}
+	for _, s := range servers {
+		command = append(command, "--server", s)
+	}
+	command = append(command, args[1:]...)
+	code, err := run(ctx, command, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code == 127 {
+		return fmt.Errorf("the debug image has no dnsq: update it, or set --image to a recent debux image")
+	}
+	if code != 0 {
+		return &runtime.ExitError{Code: code}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+	"github.com/spf13/cobra"
+)
+
+// editMaxSize is the largest file debux edit opens.
+const editMaxSize = 10 * 1024 * 1024
+
+// editReadScript prints the mode, owner, group and modification time of the
+// target's file $1 on a line, then its contents.
+const editReadScript = `f="${DEBUX_TARGET_ROOT:-/proc/1/root}$1"
+if [ ! -f "$f" ]; then
+  echo "$1: no such regular file in the target" >&2
+  exit 2
+fi
+stat -c '%a %u %g %Y %s' "$f" && exec cat "$f"`
+
+// editWriteScript replaces the target's file $1 with stdin, with mode $2 and
+// owner $3:$4, unless it changed since its modification time was $5. The
+// new contents are written next to it then renamed over it, so the
+// application never reads half a file. Files that can't be renamed over
+// (bind mounts: docker -v, ConfigMap subPaths) or given their owner back are
+// rewritten in place instead, which keeps their mode and owner too.
+const editWriteScript = `f="${DEBUX_TARGET_ROOT:-/proc/1/root}$1"
+if [ "$(stat -c %Y "$f" 2>/dev/null)" != "$5" ]; then
+  echo "$1 changed in the target since it was opened" >&2
+  exit 3
+fi
+t="$(dirname "$f")/.$(basename "$f").debux-edit"
+trap 'rm -f "$t"' EXIT
+cat > "$t" || exit 1
+{ chown "$3:$4" "$t" && chmod "$2" "$t" && mv -f "$t" "$f"; } 2>/dev/null || cat "$t" > "$f"`
+
+func newEditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "edit <target>:<path>",
+		Short: "Edit a file of the target with the local editor",
+		Long: `Copy a file of the target's filesystem locally, open it in $VISUAL or
+$EDITOR (vi by default), then show the changes and, once confirmed, write it
+back. The file keeps its mode and owner, and is replaced at once, so the
+application never reads half of it.
+
+debux refuses to write the file back when it changed in the target while it
+was being edited, and keeps the local copy when writing fails, so that no
+edit is lost. Read-only filesystems, like ConfigMap and Secret volumes, can't
+be edited: change their source instead.`,
+		Example: `  debux edit my-app:/etc/nginx/nginx.conf
+  debux edit k8s://prod/api-7d9f:/app/config.yaml
+  EDITOR="code --wait" debux edit my-app:/app/.env`,
+		Args: cobra.ExactArgs(1),
+		RunE: runEdit,
+	}
+
+	cmd.Flags().BoolP("yes", "y", false, "Write the changes back without asking")
+
+	return cmd
+}
+
+// splitTargetPath splits "<target>:<path>" at the colon before the absolute
+// path, which Kubernetes targets' own "k8s://" isn't.
+func splitTargetPath(arg string) (target, file string, err error) {
+	i := strings.LastIndex(arg, ":/")
+	if i <= 0 || strings.HasPrefix(arg[i:], "://") {
+		return "", "", fmt.Errorf("invalid argument %q: must be <target>:<absolute path>", arg)
+	}
+	return arg[:i], path.Clean(arg[i+1:]), nil
+}
+
+func runEdit(cmd *cobra.Command, args []string) error {
+	yes, _ := cmd.Flags().GetBool("yes")
+	arg, file, err := splitTargetPath(args[0])
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(arg, imageSchema) || dbximage.IsArchiveRef(arg) {
+		return fmt.Errorf("edit needs a running container or pod: images can't be written to")
+	}
+	if flagHost != "" {
+		return fmt.Errorf("edit doesn't support --host: run debux edit on the host itself")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	pipe, err := targetPipe(ctx, cmd, arg, false)
+	if err != nil {
+		return err
+	}
+	var out, stderr bytes.Buffer
+	code, err := pipe(ctx, []string{"sh", "-c", editReadScript, "edit", file}, nil, &out, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("reading %s: %s", file, strings.TrimSpace(stderr.String()))
+	}
+	header, original, _ := bytes.Cut(out.Bytes(), []byte("\n"))
+	var mode, uid, gid, mtime string
+	var size int64
+	if n, _ := fmt.Sscan(string(header), &mode, &uid, &gid, &mtime, &size); n != 5 {
+		return fmt.Errorf("reading %s: unexpected metadata %q", file, header)
+	}
+	if size > editMaxSize {
+		return fmt.Errorf("%s is too large to edit (%s)", file, units.HumanSize(float64(size)))
+	}
+	if bytes.IndexByte(original, 0) >= 0 {
+		return fmt.Errorf("%s is a binary file", file)
+	}
+
+	// Same name as the file, so that the editor picks the right syntax
+	dir, err := os.MkdirTemp("", "debux-edit-")
+	if err != nil {
+		return fmt.Errorf("creating a temporary directory: %w", err)
+	}
+	local := filepath.Join(dir, path.Base(file))
+	if err := os.WriteFile(local, original, 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("writing %s: %w", local, err)
+	}
+	keep := false
+	defer func() {
+		if keep {
+			fmt.Fprintf(os.Stderr, "Your changes are kept in %s\n", local)
+			return
+		}
+		_ = os.RemoveAll(dir)
+	}()
+
+	if err := runEditor(ctx, local); err != nil {
+		return err
+	}
+	edited, err := os.ReadFile(local)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", local, err)
+	}
+	if bytes.Equal(edited, original) {
+		fmt.Fprintln(os.Stderr, "No changes")
+		return nil
+	}
+
+	showEditDiff(arg+":"+file, original, local)
+	if !yes {
+		ok, err := confirmEdit(fmt.Sprintf("Write %s back to %s?", file, arg))
+		if err != nil {
+			keep = true
+			return err
+		}
+		if !ok {
+			keep = true
+			return fmt.Errorf("not written back")
+		}
+	}
+
+	stderr.Reset()
+	code, err = pipe(ctx, []string{"sh", "-c", editWriteScript, "edit", file, mode, uid, gid, mtime}, bytes.NewReader(edited), io.Discard, &stderr)
+	if err != nil {
+		keep = true
+		return err
+	}
+	if code != 0 {
+		keep = true
+		return fmt.Errorf("writing %s: %s", file, strings.TrimSpace(stderr.String()))
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s to %s\n", file, arg)
+	return nil
+}
+
+// runEditor opens file in $VISUAL or $EDITOR, which may have arguments
+// ("code --wait").
+func runEditor(ctx context.Context, file string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	c := exec.CommandContext(ctx, "sh", "-c", editor+` "$1"`, "editor", file)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("running %s: %w", editor, err)
+	}
+	return nil
+}
+
+// showEditDiff prints the changes to a file with diff -u, or their size
+// when diff isn't installed.
+func showEditDiff(name string, original []byte, local string) {
+	if _, err := exec.LookPath("diff"); err != nil {
+		if info, err := os.Stat(local); err == nil {
+			fmt.Fprintf(os.Stderr, "%s: %d → %d bytes\n", name, len(original), info.Size())
+		}
+		return
+	}
+	c := exec.Command("diff", "-u", "--label", name, "--label", name+" (edited)", "-", local)
+	c.Stdin = bytes.NewReader(original)
+	c.Stdout, c.Stderr = os.Stderr, os.Stderr
+	_ = c.Run() // diff exits with 1 on differences
+}
+
+// confirmEdit asks a yes/no question on the terminal.
+func confirmEdit(question string) (bool, error) {
+	if _, isTerminal := term.GetFdInfo(os.Stdin); !isTerminal {
+		return false, errors.New("no terminal to confirm the changes on: pass --yes")
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	a := strings.ToLower(strings.TrimSpace(answer))
+	return a == "y" || a == "yes", nil
+}
@@ -2,36 +2,106 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/clement-tourriere/debux/internal/config"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
 	"github.com/clement-tourriere/debux/internal/picker"
+	"github.com/clement-tourriere/debux/internal/render"
 	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/moby/term"
 	"github.com/spf13/cobra"
 )
 
 func newExecCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:    "exec [target]",
+		Use:    "exec [target] [-- command...]",
 		Short:  "Debug a running container",
 		Hidden: true,
-		Args:   cobra.MaximumNArgs(1),
+		Args:   execArgs,
 		RunE:   runExec,
 	}
 }
 
+func newAttachCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "attach <target>",
+		Short: "Open a shell in a target's running debug container",
+		Long: `Open a new shell in the debug container of a running container or pod,
+for instance one started with --detach or from another terminal. Unlike
+debux exec, it never creates a debug container, and joins the existing
+one whatever options it was started with.`,
+		Example: `  debux exec my-app --detach
+  debux attach my-app`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return debugTarget(cmd, args, true)
+		},
+	}
+}
+
+// execArgs accepts a target, and a command to run instead of a shell after
+// "--".
+func execArgs(cmd *cobra.Command, args []string) error {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args = args[:dash]
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("accepts at most 1 target, received %d", len(args))
+	}
+	return nil
+}
+
 func runExec(cmd *cobra.Command, args []string) error {
+	if flagLast {
+		if len(args) > 0 {
+			return fmt.Errorf("--last takes no target")
+		}
+		return reconnect("")
+	}
+	return debugTarget(cmd, args, false)
+}
+
+// debugTarget opens a debug shell in the target of args (picked when
+// missing), or runs the command following "--" in it, joining an existing
+// debug container only when attach is set.
+func debugTarget(cmd *cobra.Command, args []string, attach bool) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	var command []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args, command = args[:dash], args[dash:]
+	}
+	if len(command) > 0 && flagDetach {
+		return fmt.Errorf("--detach starts no shell: it takes no command")
+	}
+
+	if flagHost != "" {
+		if len(command) > 0 && len(args) == 1 {
+			return remoteCommand(ctx, cmd, args[0], command)
+		}
+		return remoteDetach(ctx, cmd, args, attach)
+	}
+
 	var target *runtime.Target
 
 	if len(args) == 0 {
-		// No args: default to Docker, show picker
+		// No args: default to Docker, show picker, unless picking pods
 		target = &runtime.Target{Runtime: "docker"}
+		if flagAllNamespaces || flagSelector != "" {
+			target = &runtime.Target{Runtime: "kubernetes", Namespace: "default"}
+		}
 	} else {
 		var err error
 		target, err = runtime.ParseTarget(args[0])
@@ -47,109 +117,349 @@ func runExec(cmd *cobra.Command, args []string) error {
 			return err
 		}
 		target.Name = name
+		arg := ""
+		if len(args) > 0 {
+			arg = args[0]
+		}
+		setHistoryTarget(arg, target.String())
 	}
 
-	profile, err := resolveProfile(cmd)
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return err
+	}
+	opts.Attach = attach
+	opts.Detach = flagDetach && !attach
+	end, err := startSession(ctx, containerRequest(commandName(cmd), target, opts))
 	if err != nil {
 		return err
 	}
 
-	image := flagImage
-	if image == "" {
-		image = runtime.DefaultImage
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		end(err)
+		return err
+	}
+	if opts.Detach {
+		err = d.Exec(ctx, target, opts)
+		end(err)
+		return err
 	}
 
-	opts := runtime.DebugOpts{
-		Image:        image,
-		Privileged:   flagPrivileged,
-		User:         flagUser,
-		AutoRemove:   flagRemove,
-		ShareVolumes: !flagNoVolumes,
-		PullPolicy:   flagPullPolicy,
-		Fresh:        flagFresh,
-		Profile:      profile,
-	}
-
-	switch target.Runtime {
-	case "docker":
-		return runtime.DockerExec(ctx, target, opts)
-	case "containerd":
-		return runtime.ContainerdExec(ctx, target, opts)
-	case "kubernetes":
-		kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
-		opts.Kubeconfig = kubeconfig
-		return runtime.KubernetesExec(ctx, target, opts)
-	default:
-		return fmt.Errorf("unsupported runtime: %s", target.Runtime)
+	hooks, err := hooksConfig()
+	if err != nil {
+		end(err)
+		return err
+	}
+	if err := runHostHooks(ctx, "pre-session", hooks.PreSession, target, opts, nil); err != nil {
+		err = fmt.Errorf("%w; not starting the session", err)
+		end(err)
+		return err
+	}
+	if len(command) > 0 {
+		err = runCommand(ctx, d, target, opts, command)
+	} else {
+		err = d.Exec(ctx, target, opts)
+	}
+	end(err)
+	if errors.Is(err, runtime.ErrSessionExpired) {
+		// Closed by --idle-timeout or --max-duration: nothing stays behind
+		if cerr := d.Cleanup(context.WithoutCancel(ctx), target, opts); cerr != nil {
+			render.Warnf(os.Stderr, "removing the debug container: %v", cerr)
+		}
+	} else if target.Runtime == "docker" {
+		// With --rm, or when an earlier session with --rm left it to the last
+		if cerr := runtime.DockerSessionEnded(context.WithoutCancel(ctx), target, opts.RemoveOnExit); cerr != nil && opts.RemoveOnExit {
+			render.Warnf(os.Stderr, "removing the debug container: %v", cerr)
+		}
 	}
+	// Even when the session was interrupted
+	if herr := runHostHooks(context.WithoutCancel(ctx), "post-session", hooks.PostSession, target, opts, err); herr != nil {
+		render.Warnf(os.Stderr, "%v", herr)
+	}
+	return err
 }
 
-func pickTarget(ctx context.Context, cmd *cobra.Command, target *runtime.Target) (string, error) {
-	switch target.Runtime {
-	case "docker":
-		return pickDockerContainer(ctx)
-	case "kubernetes":
-		kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
-		return pickK8sPod(ctx, kubeconfig, target.Namespace)
-	default:
-		return "", fmt.Errorf("interactive selection is not supported for runtime %q", target.Runtime)
+// runCommand runs a command line in the debug shell of a target, without
+// a TTY, with stdin when it isn't a terminal.
+func runCommand(ctx context.Context, d runtime.Driver, target *runtime.Target, opts runtime.DebugOpts, command []string) error {
+	var stdin io.Reader
+	if _, isTerminal := term.GetFdInfo(os.Stdin); !isTerminal {
+		stdin = os.Stdin
 	}
+	code, err := d.Pipe(ctx, target, opts, runtime.ShellCommand(strings.Join(command, " "), flagQuiet, opts.Pid), stdin, os.Stdout, os.Stderr)
+	return commandStatus(code, err)
 }
 
-func pickDockerContainer(ctx context.Context) (string, error) {
-	containers, err := runtime.DockerList(ctx)
+// remoteCommand runs a command line in the debug shell of a target through
+// the daemon of --host.
+func remoteCommand(ctx context.Context, cmd *cobra.Command, arg string, command []string) error {
+	b, err := backend(cmd)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if len(containers) == 0 {
-		return "", fmt.Errorf("no running Docker containers found")
+	code, err := b.Exec(ctx, arg, runtime.ShellCommand(strings.Join(command, " "), flagQuiet, flagPid), os.Stdout, os.Stderr)
+	return commandStatus(code, err)
+}
+
+// commandStatus turns the exit code of a command into an error, which debux
+// exits with.
+func commandStatus(code int, err error) error {
+	if err != nil {
+		return err
 	}
+	if code != 0 {
+		return &runtime.ExitError{Code: code}
+	}
+	return nil
+}
 
-	// Sort: active debux sessions first
-	sort.SliceStable(containers, func(i, j int) bool {
-		return containers[i].HasDebuxSession && !containers[j].HasDebuxSession
-	})
+// remoteDetach starts a debug container through the daemon of --host.
+// Shells need a terminal here: they only run locally.
+func remoteDetach(ctx context.Context, cmd *cobra.Command, args []string, attach bool) error {
+	if attach || !flagDetach || len(args) == 0 {
+		return fmt.Errorf("debug shells run locally: with --host, only --detach <target> starts a debug container through the daemon")
+	}
+	b, err := backend(cmd)
+	if err != nil {
+		return err
+	}
+	session, err := b.CreateSession(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Debug container %q is running for %s\n", session.Container, session.Target)
+	return nil
+}
 
-	items := make([]picker.Item, len(containers))
-	for i, c := range containers {
-		label := fmt.Sprintf("%s (%s) — %s", c.Name, c.Image, c.Status)
-		if c.HasDebuxSession {
-			label = "● " + label
+// debugOpts builds DebugOpts for a running target from the global flags.
+func debugOpts(cmd *cobra.Command) (runtime.DebugOpts, error) {
+	profile, err := resolveProfile(cmd)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	if _, err := dbximage.ParsePlatform(flagPlatform); err != nil {
+		return runtime.DebugOpts{}, err
+	}
+
+	image := flagImage
+	if image == "" {
+		image = runtime.DefaultImage
+	}
+	kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+	nix, err := nixConfig()
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	storeName, err := storeName()
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	var share []string
+	if cmd.Flags().Changed("share") {
+		if share, err = runtime.ParseShare(flagShare); err != nil {
+			return runtime.DebugOpts{}, err
 		}
-		items[i] = picker.Item{
-			Label: label,
-			Value: c.Name,
+	}
+	if flagPid < 0 {
+		return runtime.DebugOpts{}, fmt.Errorf("invalid --pid %d", flagPid)
+	}
+	if flagPid > 1 && share != nil && !slices.Contains(share, "pid") {
+		return runtime.DebugOpts{}, fmt.Errorf("--pid needs the target's PID namespace (--share pid)")
+	}
+	mounts, err := parseMounts(flagMounts)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	env, err := parseEnv(flagEnv)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	cpus, memory, err := resources()
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	asTarget, err := asTargetUser(cmd)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	hooks, err := hooksConfig()
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	sec, err := security(profile)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	for _, p := range append(cfg.Exec.RedactEnv, cfg.Exec.KeepEnv...) {
+		if p == "" || strings.ContainsAny(p, ", \t") {
+			return runtime.DebugOpts{}, fmt.Errorf("invalid environment variable pattern %q in the config file", p)
 		}
 	}
+	idle, maxDuration, err := sessionLimits(cmd, cfg)
+	if err != nil {
+		return runtime.DebugOpts{}, err
+	}
+	// --rm defaults to true for image sessions; sidecars are only removed
+	// when it's given
+	removeOnExit := cmd.Flags().Changed("rm") && flagRemove || flagRmOnExit
+	if removeOnExit && flagKeep {
+		return runtime.DebugOpts{}, fmt.Errorf("conflicting flags: --rm and --keep")
+	}
+	if flagNoVolumes && (len(flagVolumes) > 0 || len(flagExcludeVolumes) > 0) {
+		return runtime.DebugOpts{}, fmt.Errorf("conflicting flags: --no-volumes and --volumes or --exclude-volumes")
+	}
+	for _, patterns := range [][]string{flagVolumes, flagExcludeVolumes} {
+		if err := runtime.ValidatePathPatterns(patterns); err != nil {
+			return runtime.DebugOpts{}, err
+		}
+	}
+
+	return runtime.DebugOpts{
+		Image:          image,
+		Privileged:     profile == runtime.ProfileSysadmin,
+		User:           flagUser,
+		AsTargetUser:   asTarget,
+		AutoRemove:     flagRemove,
+		Kubeconfig:     kubeconfig,
+		ShareVolumes:   !flagNoVolumes,
+		Volumes:        flagVolumes,
+		ExcludeVolumes: flagExcludeVolumes,
+		PullPolicy:     flagPullPolicy,
+		Fresh:          flagFresh,
+		RemoveOnExit:   removeOnExit,
+		Name:           flagName,
+		PerUser:        flagPerUser || (!cmd.Flags().Changed("per-user") && cfg.Exec.PerUser),
+		Profile:        profile,
+		Security:       sec,
+		Platform:       flagPlatform,
+		StoreName:      storeName,
+		Share:          share,
+		Mounts:         mounts,
+		Env:            env,
+		Workdir:        flagWorkdir,
+		Pid:            flagPid,
+		NoTargetEnv:    flagNoTargetEnv,
+		NoWrappers:     flagNoWrappers,
+		NoBanner:       flagNoBanner,
+		RedactEnv:      cfg.Exec.RedactEnv,
+		KeepEnv:        cfg.Exec.KeepEnv,
+		ReadOnlyTarget: flagReadOnlyTarget,
+		Operator:       flagOperator || (!cmd.Flags().Changed("operator") && cfg.Exec.Operator),
+		CPUs:           cpus,
+		Memory:         memory,
+		SetupHooks:     hooks.Container,
+		IdleTimeout:    idle,
+		MaxDuration:    maxDuration,
+		Nix:            nix,
+	}, nil
+}
+
+// parseMounts parses --mount values, resolving relative host paths.
+func parseMounts(values []string) ([]runtime.Mount, error) {
+	var mounts []runtime.Mount
+	for _, v := range values {
+		m, err := runtime.ParseMount(v)
+		if err != nil {
+			return nil, err
+		}
+		if m.Source, err = filepath.Abs(m.Source); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			return nil, fmt.Errorf("invalid mount %q: %w", v, err)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
 
-	return picker.Pick("Select a container", items)
+// parseEnv parses -e values. A bare KEY takes its value from the local
+// environment, as with docker run.
+func parseEnv(values []string) ([]string, error) {
+	var env []string
+	for _, v := range values {
+		key, _, hasValue := strings.Cut(v, "=")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid environment variable %q: expected KEY=VALUE", v)
+		}
+		if !hasValue {
+			value, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			v = key + "=" + value
+		}
+		env = append(env, v)
+	}
+	return env, nil
 }
 
-func pickK8sPod(ctx context.Context, kubeconfig, namespace string) (string, error) {
-	pods, err := runtime.KubernetesList(ctx, kubeconfig, namespace)
+// pickTarget picks a target among those its runtime's driver lists, active
+// debux sessions first, and sets the target's namespace to that of the pick.
+// Kubernetes pods are those of the target's namespace, or of all namespaces
+// with --all-namespaces.
+func pickTarget(ctx context.Context, cmd *cobra.Command, target *runtime.Target) (string, error) {
+	kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+	opts := runtime.DebugOpts{Kubeconfig: kubeconfig, Selector: flagSelector}
+	cfg, err := config.Load()
 	if err != nil {
 		return "", err
 	}
-	if len(pods) == 0 {
-		return "", fmt.Errorf("no running pods found")
+	if cfg.Exec.PickerCache != "" {
+		if opts.ListCache, err = time.ParseDuration(cfg.Exec.PickerCache); err != nil {
+			return "", fmt.Errorf("invalid exec.picker-cache %q in the config file: %w", cfg.Exec.PickerCache, err)
+		}
+	}
+	namespace := target.Namespace
+	if flagAllNamespaces {
+		namespace = ""
+	}
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return "", err
+	}
+	targets, err := d.List(ctx, namespace, opts)
+	if err != nil {
+		return "", err
+	}
+	if len(targets) == 0 {
+		return "", fmt.Errorf("no running %s targets found", target.Runtime)
 	}
 
 	// Sort: active debux sessions first
-	sort.SliceStable(pods, func(i, j int) bool {
-		return pods[i].HasDebuxSession && !pods[j].HasDebuxSession
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].Session && !targets[j].Session
 	})
 
-	items := make([]picker.Item, len(pods))
-	for i, p := range pods {
-		label := fmt.Sprintf("%s/%s [%s]", p.Namespace, p.Name, strings.Join(p.Containers, ", "))
-		if p.HasDebuxSession {
-			label = "● " + label
+	items := make([]picker.Item, len(targets))
+	byTarget := make(map[string]runtime.TargetInfo, len(targets))
+	for i, t := range targets {
+		byTarget[t.Target] = t
+		name := t.Name
+		if t.Namespace != "" {
+			name = t.Namespace + "/" + name
+		}
+		label := fmt.Sprintf("%s (%s) — %s", name, t.Detail, t.Status)
+		if len(t.Containers) > 0 {
+			label = fmt.Sprintf("%s [%s]", name, strings.Join(t.Containers, ", "))
 		}
-		items[i] = picker.Item{
-			Label: label,
-			Value: p.Name,
+		if t.Session {
+			label = "● " + label
 		}
+		items[i] = picker.Item{Label: label, Value: t.Target}
 	}
 
-	return picker.Pick("Select a pod", items)
+	picked, err := picker.Pick("Select a target", items)
+	if err != nil {
+		return "", err
+	}
+	if t := byTarget[picked]; t.Namespace != "" {
+		target.Namespace = t.Namespace
+	}
+	return byTarget[picked].Name, nil
 }
@@ -0,0 +1,184 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/history"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// noHistory are the commands whose sessions are someone else's, run for
+// clients: they stay out of the local history.
+var noHistory = []string{"serve", "daemon", "mcp", "operator"}
+
+var (
+	// historyArgs are the arguments of the running command, to start its
+	// session again. Nil when it stays out of the history.
+	historyArgs []string
+	historyOnce sync.Once
+)
+
+// setHistoryArgs keeps the arguments of cmd for the history, but those of
+// flags that hold secrets.
+func setHistoryArgs(cmd *cobra.Command) {
+	command := commandName(cmd)
+	for _, c := range noHistory {
+		if command == c || strings.HasPrefix(command, c+" ") {
+			return
+		}
+	}
+	args := os.Args[1:]
+	historyArgs = []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			historyArgs = append(historyArgs, args[i:]...)
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(a, "--"), "=")
+		if strings.HasPrefix(a, "--") && redactedFlags[name] {
+			if !hasValue {
+				i++
+			}
+			continue
+		}
+		historyArgs = append(historyArgs, a)
+	}
+}
+
+// setHistoryTarget records the target picked for the argument arg (empty
+// without one), so that the session starts again in the same target.
+func setHistoryTarget(arg, target string) {
+	if historyArgs == nil {
+		return
+	}
+	// Before the command of "debux <target> -- <command>"
+	end := slices.Index(historyArgs, "--")
+	if end < 0 {
+		end = len(historyArgs)
+	}
+	if arg != "" {
+		for i := end - 1; i >= 0; i-- {
+			if historyArgs[i] == arg {
+				historyArgs[i] = target
+				return
+			}
+		}
+	}
+	historyArgs = slices.Insert(historyArgs, end, target)
+}
+
+// recordHistory adds the first session of the command to the history.
+// Failures are only warnings: the history is a convenience.
+func recordHistory(req policy.Request) {
+	if historyArgs == nil {
+		return
+	}
+	historyOnce.Do(func() {
+		_, err := history.Add(history.Entry{
+			Time:      time.Now(),
+			Command:   req.Command,
+			Runtime:   req.Runtime,
+			Target:    req.Target,
+			Context:   req.Context,
+			Namespace: req.Namespace,
+			Flags:     auditFlags,
+			Args:      historyArgs,
+		})
+		if err != nil {
+			render.Warnf(os.Stderr, "%v", err)
+		}
+	})
+}
+
+func newHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "List the last debug sessions",
+		Long: `List the last debug sessions started from this machine, newest last, with
+the id to start one again with debux reconnect.`,
+		Example: `  debux history
+  debux history -n 50`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			entries, err := history.Load()
+			if err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				fmt.Println("No sessions in the history yet.")
+				return nil
+			}
+			n, _ := cmd.Flags().GetInt("number")
+			if n > 0 && len(entries) > n {
+				entries = entries[len(entries)-n:]
+			}
+
+			w := render.NewTable(os.Stdout)
+			_, _ = fmt.Fprintln(w, "ID\tSTARTED\tCOMMAND\tTARGET\tCONTEXT\tFLAGS")
+			for _, e := range entries {
+				started := units.HumanDuration(time.Since(e.Time)) + " ago"
+				context := "-"
+				if e.Context != "" {
+					context = e.Context
+				}
+				flags := strings.Join(e.Flags, " ")
+				if flags == "" {
+					flags = "-"
+				}
+				_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.ID, started, e.Command, e.Target, context, flags)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().IntP("number", "n", 20, "Number of sessions to list (0 for all)")
+	return cmd
+}
+
+func newReconnectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "reconnect [id]",
+		Short: "Start a session of the history again",
+		Long: `Start a session of debux history again, the last one without an id, with
+the same command, target and options. debux --last is short for
+debux reconnect.`,
+		Example: `  debux reconnect
+  debux reconnect 42`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := ""
+			if len(args) == 1 {
+				id = args[0]
+			}
+			return reconnect(id)
+		},
+	}
+}
+
+// reconnect runs debux again with the arguments of a session of the
+// history, the last one when id is empty.
+func reconnect(id string) error {
+	e, err := history.Find(id)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("finding the debux executable: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Reconnecting to %s (session %d): debux %s\n", e.Target, e.ID, strings.Join(e.Args, " "))
+	argv := append([]string{os.Args[0]}, e.Args...)
+	if err := syscall.Exec(exe, argv, os.Environ()); err != nil {
+		return fmt.Errorf("running debux: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/runtime"
+)
+
+// runHostHooks runs host-side hooks of the config file, in order, with the
+// session in DEBUX_* environment variables. sessionErr is how the session
+// ended, for post-session hooks.
+func runHostHooks(ctx context.Context, stage string, scripts []string, target *runtime.Target, opts runtime.DebugOpts, sessionErr error) error {
+	if len(scripts) == 0 {
+		return nil
+	}
+	env := append(os.Environ(),
+		"DEBUX_HOOK="+stage,
+		"DEBUX_TARGET="+target.String(),
+		"DEBUX_RUNTIME="+target.Runtime,
+		"DEBUX_TARGET_NAME="+target.Name,
+		"DEBUX_NAMESPACE="+target.Namespace,
+		"DEBUX_TARGET_CONTAINER="+target.Container,
+		"DEBUX_IMAGE="+opts.Image,
+		"DEBUX_PROFILE="+opts.Profile,
+		"DEBUX_CREATOR="+meta.Creator(),
+		"DEBUX_VERSION="+meta.BuildVersion(),
+	)
+	if sessionErr != nil {
+		env = append(env, "DEBUX_SESSION_ERROR="+sessionErr.Error())
+	}
+	for _, script := range scripts {
+		c := exec.CommandContext(ctx, "sh", "-c", script)
+		c.Env = env
+		// stdout may carry a command's output
+		c.Stdout = os.Stderr
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %w", stage, script, err)
+		}
+	}
+	return nil
+}
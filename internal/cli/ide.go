@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newIDECmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ide <target>",
+		Short: "Open a target's debug container in VS Code or a JetBrains IDE",
+		Long: `Prepare the debug container of a container or pod (creating it if needed)
+for an IDE, and open it with --open.
+
+VS Code attaches to Docker sidecars with the Dev Containers extension: debux
+writes an attached-container configuration opening the target's filesystem.
+Kubernetes targets, and JetBrains IDEs (through Gateway), connect over SSH
+as set up by debux ssh.
+
+The IDE sees the target's filesystem under --path and its processes, like
+the debug shell.`,
+		Example: `  debux ide my-app --open
+  debux ide k8s://prod/api-7d9f --ide jetbrains`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			ide, _ := cmd.Flags().GetString("ide")
+			path, _ := cmd.Flags().GetString("path")
+			open, _ := cmd.Flags().GetBool("open")
+			if ide != "vscode" && ide != "jetbrains" {
+				return fmt.Errorf("invalid --ide %q: must be vscode or jetbrains", ide)
+			}
+
+			target, err := runtime.ParseTarget(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid target: %w", err)
+			}
+			if target.Name == "" {
+				return fmt.Errorf("missing target name in %q", args[0])
+			}
+
+			if ide == "vscode" && target.Runtime == "docker" {
+				return vscodeAttach(ctx, cmd, target, path, open)
+			}
+
+			alias, configFile, err := setupSSH(ctx, cmd, args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Printf("SSH host %q is configured in %s.\n", alias, configFile)
+			fmt.Printf("Add this line to ~/.ssh/config so that the IDE finds it:\n\n  Include %s\n\n", configFile)
+			if ide == "jetbrains" {
+				fmt.Printf("In JetBrains Gateway, choose SSH, connect to %s and open %s.\n", alias, path)
+				return nil
+			}
+			uri := fmt.Sprintf("vscode-remote://ssh-remote+%s%s", alias, path)
+			return openVSCode(ctx, uri, open)
+		},
+	}
+
+	cmd.Flags().String("ide", "vscode", "IDE to prepare: vscode or jetbrains")
+	cmd.Flags().String("path", "/proc/1/root", "Folder to open in the debug container (/proc/1/root is the target's filesystem)")
+	cmd.Flags().Bool("open", false, "Open the IDE (VS Code's code command)")
+
+	return cmd
+}
+
+// vscodeAttach writes the Dev Containers configuration of a Docker sidecar
+// and opens or prints its folder URI.
+func vscodeAttach(ctx context.Context, cmd *cobra.Command, target *runtime.Target, path string, open bool) error {
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return err
+	}
+	opts.AsTargetUser = false
+	// Ended by Execute, once the sidecar is ready for VS Code
+	if _, err := startSession(ctx, containerRequest(commandName(cmd), target, opts)); err != nil {
+		return err
+	}
+	name, err := runtime.DockerSidecar(ctx, target, opts)
+	if err != nil {
+		return err
+	}
+
+	// Dev Containers reads per-container settings from its global storage.
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, "Code", "User", "globalStorage", "ms-vscode-remote.remote-containers", "nameConfigs")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	settings, _ := json.MarshalIndent(map[string]any{
+		"workspaceFolder": path,
+		"remoteUser":      "root",
+		"remoteEnv":       map[string]string{"DEBUX_TARGET": target.Name},
+	}, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), append(settings, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing Dev Containers configuration: %w", err)
+	}
+
+	ref, _ := json.Marshal(map[string]string{"containerName": "/" + name})
+	uri := fmt.Sprintf("vscode-remote://attached-container+%s%s", hex.EncodeToString(ref), path)
+	return openVSCode(ctx, uri, open)
+}
+
+// openVSCode opens a folder URI with the code command, or prints how to.
+func openVSCode(ctx context.Context, uri string, open bool) error {
+	if !open {
+		fmt.Printf("Open it in VS Code with:\n\n  code --folder-uri %s\n", uri)
+		return nil
+	}
+	code := exec.CommandContext(ctx, "code", "--folder-uri", uri)
+	code.Stdout, code.Stderr = os.Stdout, os.Stderr
+	if err := code.Run(); err != nil {
+		return fmt.Errorf("running code (is VS Code's command in PATH?): %w", err)
+	}
+	return nil
+}
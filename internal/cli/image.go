@@ -2,43 +2,487 @@ package cli
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/picker"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/render"
 	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
 func newImageCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "image <image-ref>",
 		Short: "Debug a Docker image directly",
 		Long: `Debug a Docker image by copying its filesystem into a debug container.
 
 Works with ALL images including scratch and distroless — the target image
-is never started. The image filesystem is available at /target.`,
+is never started. The image filesystem is available at /target.
+
+Image references:
+  <image>                         Image from the Docker daemon or a registry
+  oci-archive:<path>              OCI image layout archive (e.g. buildah, skopeo)
+  docker-archive:<path>           Tarball produced by "docker save"
+
+The image filesystem is copied into /target. With --mount-layers, images in
+the Docker daemon (overlay2 storage driver) are mounted from their layers
+instead, so startup is near-instant even for large images, but the debug
+container gets SYS_ADMIN and no AppArmor confinement to mount them; changes
+are kept in memory and never touch the image. When mounting isn't possible,
+the filesystem is copied.
+
+Archives are unpacked directly and never loaded into the Docker daemon.
+With --direct, registry images are pulled the same way (using credentials
+from ~/.docker/config.json) instead of through the daemon. --extract writes
+the filesystem to a local directory and exits, without needing Docker at all.
+
+With --run-entrypoint, the image's ENTRYPOINT/CMD is started chrooted into
+/target (with its env, working directory and user) in the debug shell, so a
+failing binary can be watched with every tool at hand; --trace runs it under
+strace or ltrace. Re-run it any time with "target-run [--strace|--ltrace]".
+
+With --commit, changes made under /target are saved as a new image when the
+shell exits (see also "debux image commit").
+
+With --runtime k8s, the session runs in a debug pod instead: the target image
+is pulled by the cluster node (node credentials, IAM roles, pull secrets),
+unpacked into /target inside the pod, and the shell attaches to it. Use this
+when the image is only reachable from within the cluster.`,
 		Args: cobra.ExactArgs(1),
 		RunE: runImage,
 	}
+
+	cmd.Flags().Bool("direct", false, "Pull the target image straight from the registry instead of via the Docker daemon")
+	cmd.Flags().String("extract", "", "Extract the image filesystem to a local directory and exit (implies --direct)")
+	cmd.Flags().String("runtime", "docker", "Where to run the session: docker or k8s (debug pod in the cluster)")
+	cmd.Flags().StringP("namespace", "n", "default", "Kubernetes namespace for the debug pod (--runtime k8s)")
+	cmd.Flags().Bool("keep", false, "Keep the debug pod after exit (--runtime k8s)")
+	cmd.Flags().Bool("run-entrypoint", false, "Start the image's entrypoint chrooted into /target when the shell opens")
+	cmd.Flags().String("trace", "", "Run the entrypoint under a tracer: strace or ltrace (implies --run-entrypoint)")
+	cmd.Flags().String("commit", "", "On exit, save changes made under /target as a new image with this tag (or docker-archive:/oci-archive: path)")
+	cmd.PersistentFlags().Bool("mount-layers", false, "Mount the image layers instead of copying the filesystem; gives the debug container SYS_ADMIN, unconfined by AppArmor")
+	cmd.PersistentFlags().StringSlice("include", nil, "Only copy paths matching these globs, e.g. /app,/etc/*.conf")
+	cmd.PersistentFlags().StringSlice("exclude", nil, "Skip paths matching these globs, e.g. /usr/share/doc")
+	cmd.PersistentFlags().Int("jobs", runtime.DefaultJobs, "Copy the image filesystem in this many parallel streams")
+
+	cmd.AddCommand(newImageLayersCmd())
+	cmd.AddCommand(newImageDiffCmd())
+	cmd.AddCommand(newImageCommitCmd())
+
+	return cmd
 }
 
-func runImage(cmd *cobra.Command, args []string) error {
+func newImageLayersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "layers <image-ref>",
+		Short: "List image layers and explore individual layers",
+		Long: `List the filesystem layers of an image with their sizes and the build
+instruction that created each one.
+
+With --open (or -i to pick interactively), a debug session is started with the
+merged filesystem at /target and each selected layer extracted on its own under
+/target/layer-N — handy to find which layer introduced a file. Whiteout files
+(.wh.*) are kept so deletions made by a layer remain visible.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runImageLayers,
+	}
+
+	cmd.Flags().Bool("direct", false, "Pull the target image straight from the registry instead of via the Docker daemon")
+	cmd.Flags().IntSlice("open", nil, "Start a debug session with these layers (1-based) under /target/layer-N")
+	cmd.Flags().BoolP("interactive", "i", false, "Pick a layer interactively and start a debug session")
+
+	return cmd
+}
+
+func runImageLayers(cmd *cobra.Command, args []string) error {
 	imageRef := args[0]
+	open, _ := cmd.Flags().GetIntSlice("open")
+	interactive, _ := cmd.Flags().GetBool("interactive")
+
+	opts, err := imageOpts(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	layers, err := runtime.ImageLayers(ctx, imageRef, opts)
+	if err != nil {
+		return err
+	}
+
+	if interactive {
+		items := make([]picker.Item, len(layers))
+		for i, l := range layers {
+			items[i] = picker.Item{
+				Label: fmt.Sprintf("#%d %s — %s", l.Index, units.HumanSize(float64(l.Size)), layerCommand(l.CreatedBy, 80)),
+				Value: strconv.Itoa(l.Index),
+			}
+		}
+		choice, err := picker.Pick("Select a layer", items)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(choice)
+		open = append(open, n)
+	}
+
+	if len(open) == 0 {
+		w := render.NewTable(os.Stdout)
+		_, _ = fmt.Fprintln(w, "#\tDIGEST\tSIZE\tCREATED BY")
+		for _, l := range layers {
+			digest := strings.TrimPrefix(l.Digest, "sha256:")
+			if len(digest) > 12 {
+				digest = digest[:12]
+			}
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", l.Index, digest, units.HumanSize(float64(l.Size)), layerCommand(l.CreatedBy, 100))
+		}
+		return w.Flush()
+	}
+
+	opts.Layers = open
+	end, err := startSession(ctx, imageRequest(commandName(cmd), imageRef, opts))
+	if err != nil {
+		return err
+	}
+
+	err = runtime.DockerImage(ctx, imageRef, opts)
+	end(err)
+	return err
+}
+
+func newImageDiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <image-a> <image-b>",
+		Short: "Compare the filesystems and configuration of two images",
+		Long: `Compare two images and report added, removed and changed files (by content
+hash, mode, type and link target) along with differences in the image
+configuration: entrypoint, cmd, env, user, workdir, labels and exposed ports.
+
+With --shell, a debug session is started afterwards with the first image
+under /target-a and the second under /target-b.`,
+		Args: cobra.ExactArgs(2),
+		RunE: runImageDiff,
+	}
+
+	cmd.Flags().Bool("direct", false, "Pull the images straight from the registry instead of via the Docker daemon")
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	cmd.Flags().Bool("shell", false, "Open a debug shell with both images under /target-a and /target-b")
+
+	return cmd
+}
+
+func runImageDiff(cmd *cobra.Command, args []string) error {
+	refA, refB := args[0], args[1]
+	output, _ := cmd.Flags().GetString("output")
+	shell, _ := cmd.Flags().GetBool("shell")
+
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+
+	opts, err := imageOpts(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	report, err := runtime.ImageDiff(ctx, refA, refB, opts)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printDiffReport(report)
+	}
+
+	if !shell {
+		return nil
+	}
+	end, err := startSession(ctx, imageRequest(commandName(cmd), refA+" "+refB, opts))
+	if err != nil {
+		return err
+	}
+
+	err = runtime.DockerImageDiff(ctx, refA, refB, opts)
+	end(err)
+	return err
+}
+
+func printDiffReport(r *dbximage.DiffReport) {
+	fmt.Printf("--- %s\n+++ %s\n\n", r.ImageA, r.ImageB)
+	fmt.Printf("Files: %d added, %d removed, %d changed\n", r.NumAdded, r.NumRemoved, r.NumChanged)
+	fmt.Printf("Size:  %s → %s\n", units.HumanSize(float64(r.SizeA)), units.HumanSize(float64(r.SizeB)))
+
+	if len(r.Config) > 0 {
+		fmt.Println("\nConfig:")
+		for _, c := range r.Config {
+			fmt.Printf("  %s\n", c.Field)
+			if c.A != "" {
+				fmt.Printf("    - %s\n", c.A)
+			}
+			if c.B != "" {
+				fmt.Printf("    + %s\n", c.B)
+			}
+		}
+	}
 
+	if len(r.Files) > 0 {
+		fmt.Println("\nFiles:")
+		for _, f := range r.Files {
+			switch f.Kind {
+			case dbximage.ChangeAdded:
+				fmt.Printf("  + %s (%s)\n", f.Path, units.HumanSize(float64(f.SizeB)))
+			case dbximage.ChangeRemoved:
+				fmt.Printf("  - %s (%s)\n", f.Path, units.HumanSize(float64(f.SizeA)))
+			default:
+				fmt.Printf("  ~ %s (%s; %s → %s)\n", f.Path, f.Detail,
+					units.HumanSize(float64(f.SizeA)), units.HumanSize(float64(f.SizeB)))
+			}
+		}
+	}
+}
+
+func newImageCommitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "commit <new-ref>",
+		Short: "Save the changes made under /target in an image session as a new image",
+		Long: `Pack the /target filesystem of a running "debux image" session into a new
+image: the original image plus one layer holding the files added, changed or
+removed during the session. The original configuration (entrypoint, env,
+user, ...) is preserved — handy for quick hotfix images during incidents.
+
+<new-ref> is a tag loaded into the Docker daemon, or a docker-archive:<path>
+or oci-archive:<path> file. Run it from another terminal while the session is
+open; with several sessions running, pick one with --container.`,
+		Args: cobra.ExactArgs(1),
+		RunE: runImageCommit,
+	}
+
+	cmd.Flags().String("container", "", "Debug container of the session to commit (default: the only running image session)")
+	cmd.Flags().Bool("direct", false, "Read the original image straight from the registry instead of via the Docker daemon")
+
+	return cmd
+}
+
+func runImageCommit(cmd *cobra.Command, args []string) error {
+	newRef := args[0]
+	name, _ := cmd.Flags().GetString("container")
+
+	opts, err := imageOpts(cmd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	return runtime.DockerImageCommit(ctx, name, newRef, opts)
+}
+
+// imageOpts builds ImageOpts from the global flags and the image command's
+// own flags (--direct, --mount-layers, --include, --exclude).
+func imageOpts(cmd *cobra.Command) (runtime.ImageOpts, error) {
 	debugImage := flagImage
 	if debugImage == "" {
 		debugImage = runtime.DefaultImage
 	}
+	direct, _ := cmd.Flags().GetBool("direct")
+	mountLayers, _ := cmd.Flags().GetBool("mount-layers")
+	include, _ := cmd.Flags().GetStringSlice("include")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	jobs, _ := cmd.Flags().GetInt("jobs")
+	if jobs < 1 {
+		return runtime.ImageOpts{}, fmt.Errorf("invalid --jobs %d: expected at least 1", jobs)
+	}
+	if err := runtime.ValidatePathPatterns(append(include, exclude...)); err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	if _, err := dbximage.ParsePlatform(flagPlatform); err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	nix, err := nixConfig()
+	if err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	storeName, err := storeName()
+	if err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	hooks, err := hooksConfig()
+	if err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	profile, err := resolveProfile(cmd)
+	if err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	sec, err := security(profile)
+	if err != nil {
+		return runtime.ImageOpts{}, err
+	}
+	if mountLayers {
+		switch {
+		case len(include) > 0 || len(exclude) > 0:
+			return runtime.ImageOpts{}, fmt.Errorf("--include and --exclude only apply to copies, not --mount-layers")
+		case profile == runtime.ProfileBaseline || profile == runtime.ProfileRestricted:
+			return runtime.ImageOpts{}, fmt.Errorf("--mount-layers conflicts with --profile=%s: mounting takes SYS_ADMIN", profile)
+		case !sec.IsZero():
+			return runtime.ImageOpts{}, fmt.Errorf("--mount-layers conflicts with --cap-add, --cap-drop, --seccomp-profile and --apparmor: mounting sets its own")
+		}
+	}
+
+	return runtime.ImageOpts{
+		DebugImage:  debugImage,
+		Privileged:  profile == runtime.ProfileSysadmin,
+		User:        flagUser,
+		AutoRemove:  flagRemove,
+		Direct:      direct,
+		MountLayers: mountLayers,
+		Include:     include,
+		Exclude:     exclude,
+		Jobs:        jobs,
+		Platform:    flagPlatform,
+		StoreName:   storeName,
+		Profile:     profile,
+		Security:    sec,
+		SetupHooks:  hooks.Container,
+		NoBanner:    flagNoBanner,
+		Nix:         nix,
+	}, nil
+}
 
-	opts := runtime.ImageOpts{
-		DebugImage: debugImage,
-		Privileged: flagPrivileged,
-		User:       flagUser,
-		AutoRemove: flagRemove,
+// layerCommand shortens a history CreatedBy entry for display, dropping the
+// "/bin/sh -c #(nop)" noise Docker adds to non-RUN instructions.
+func layerCommand(createdBy string, width int) string {
+	s := strings.TrimSpace(createdBy)
+	s = strings.TrimPrefix(s, "/bin/sh -c #(nop) ")
+	s = strings.TrimPrefix(s, "/bin/sh -c ")
+	s = strings.Join(strings.Fields(s), " ")
+	if s == "" {
+		return "<unknown>"
 	}
+	if len(s) > width {
+		s = s[:width-1] + "…"
+	}
+	return s
+}
+
+func runImage(cmd *cobra.Command, args []string) error {
+	imageRef := args[0]
+	extractDir, _ := cmd.Flags().GetString("extract")
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	return runtime.DockerImage(ctx, imageRef, opts)
+	if extractDir != "" {
+		return runtime.ExtractImage(ctx, imageRef, extractDir, flagPlatform)
+	}
+
+	switch rt, _ := cmd.Flags().GetString("runtime"); rt {
+	case "docker":
+	case "k8s", "kubernetes":
+		return runKubernetesImage(ctx, cmd, imageRef)
+	default:
+		return fmt.Errorf("invalid runtime %q: must be docker or k8s", rt)
+	}
+
+	opts, err := imageOpts(cmd)
+	if err != nil {
+		return err
+	}
+	opts.RunEntrypoint, _ = cmd.Flags().GetBool("run-entrypoint")
+	opts.Trace, _ = cmd.Flags().GetString("trace")
+	switch opts.Trace {
+	case "":
+	case "strace", "ltrace":
+		opts.RunEntrypoint = true
+	default:
+		return fmt.Errorf("invalid --trace %q: must be strace or ltrace", opts.Trace)
+	}
+	opts.Commit, _ = cmd.Flags().GetString("commit")
+	if opts.Commit != "" && (len(opts.Include) > 0 || len(opts.Exclude) > 0) {
+		return fmt.Errorf("--commit can't be combined with --include/--exclude: /target would only hold part of the image")
+	}
+	end, err := startSession(ctx, imageRequest(commandName(cmd), imageRef, opts))
+	if err != nil {
+		return err
+	}
+
+	err = runtime.DockerImage(ctx, imageRef, opts)
+	end(err)
+	return err
+}
+
+// runKubernetesImage starts an image debug session in a Kubernetes debug pod.
+// Options that rely on the Docker daemon or on reading the image client-side
+// are rejected.
+func runKubernetesImage(ctx context.Context, cmd *cobra.Command, imageRef string) error {
+	for _, name := range []string{"direct", "mount-layers", "include", "exclude", "run-entrypoint", "trace", "commit", "platform"} {
+		if cmd.Flags().Changed(name) {
+			return fmt.Errorf("--%s is not supported with --runtime k8s", name)
+		}
+	}
+
+	profile, err := resolveProfile(cmd)
+	if err != nil {
+		return err
+	}
+	namespace, _ := cmd.Flags().GetString("namespace")
+	kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+	keep, _ := cmd.Flags().GetBool("keep")
+	nix, err := nixConfig()
+	if err != nil {
+		return err
+	}
+	hooks, err := hooksConfig()
+	if err != nil {
+		return err
+	}
+	sec, err := security(profile)
+	if err != nil {
+		return err
+	}
+
+	debugImage := flagImage
+	if debugImage == "" {
+		debugImage = runtime.DefaultImage
+	}
+	end, err := startSession(ctx, kubeRequest(commandName(cmd), policy.KindImage, imageRef, namespace, kubeconfig, debugImage, profile, sec))
+	if err != nil {
+		return err
+	}
+
+	err = runtime.KubernetesImage(ctx, imageRef, runtime.KubeImageOpts{
+		DebugImage:  debugImage,
+		Namespace:   namespace,
+		Kubeconfig:  kubeconfig,
+		Keep:        keep,
+		PullPolicy:  flagPullPolicy,
+		Profile:     profile,
+		Security:    sec,
+		PullSecrets: flagPullSecrets,
+		SetupHooks:  hooks.Container,
+		Nix:         nix,
+	})
+	end(err)
+	return err
 }
@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+func newInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect <target>",
+		Short: "Describe a container or pod the same way whatever its runtime",
+		Long: `Print a document describing the target: image and digest, command, state,
+environment, mounts, namespaces, security context, network, resources and
+probes, in the same format for Docker containers and Kubernetes pods, so that
+scripts don't need to tell docker inspect and kubectl get apart.
+
+Variables that look like secrets are redacted as in debug shells (see
+exec.redact-env and exec.keep-env in the config file), unless --redact=false
+is given. Nothing is started in the target.`,
+		Example: `  debux inspect my-app
+  debux inspect k8s://prod/api-7d9f/app -o yaml
+  debux inspect my-app | jq -r '.network.ips[]'`,
+		Args: cobra.ExactArgs(1),
+		RunE: runInspect,
+	}
+
+	cmd.Flags().StringP("output", "o", "json", "Output format (json, yaml)")
+	cmd.Flags().Bool("redact", true, "Mask the values of variables that look like secrets")
+
+	return cmd
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "json" && output != "yaml" {
+		return fmt.Errorf("invalid output format %q: must be json or yaml", output)
+	}
+	redact, _ := cmd.Flags().GetBool("redact")
+
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Name == "" {
+		return fmt.Errorf("missing target name in %q", args[0])
+	}
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return err
+	}
+	if !redact {
+		opts.KeepEnv = []string{"*"}
+	}
+
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return err
+	}
+	inspector, ok := d.(runtime.Inspector)
+	if !ok {
+		return fmt.Errorf("the %s driver can't inspect targets", target.Runtime)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	in, err := inspector.Inspect(ctx, target, opts)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(in); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if output == "yaml" {
+		if data, err = yaml.JSONToYAML(data); err != nil {
+			return err
+		}
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/jvm"
+	"github.com/clement-tourriere/debux/internal/picker"
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+	"github.com/spf13/cobra"
+)
+
+func newJVMCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "jvm <target>",
+		Short: "List a target's JVMs, and take thread dumps, heap dumps and JFR recordings",
+		Long: `Find the JVMs among the target's processes and, with --thread-dump,
+--heap-dump or --flight-record, take the dumps or recordings and download
+them to --output-dir. Without any, list the JVMs.
+
+debux drives the JVM with jattach from the debug container (installed with
+dctl when the debug image lacks it), so the target image needs no JDK tools.
+Heap dumps and recordings are written to --dir in the JVM's filesystem,
+then downloaded and removed. Ctrl-C during --flight-record stops the
+recording early and still downloads it.
+
+Like debux strace, this needs the SYS_PTRACE capability, which debux adds to
+new Kubernetes ephemeral containers.`,
+		Example: `  debux jvm my-app
+  debux jvm my-app --thread-dump
+  debux jvm k8s://prod/api-7d9f --pid 7 --heap-dump --output-dir /tmp/incident
+  debux jvm k8s://prod/api-7d9f --flight-record 60s`,
+		Args: cobra.ExactArgs(1),
+		RunE: runJVM,
+	}
+
+	cmd.Flags().Int("pid", 0, "PID of the JVM, in the target's PID namespace (default: the only JVM, or pick one)")
+	cmd.Flags().Bool("thread-dump", false, "Download a thread dump")
+	cmd.Flags().Bool("heap-dump", false, "Download a heap dump (.hprof) of the live objects")
+	cmd.Flags().Duration("flight-record", 0, "Record with Java Flight Recorder for this long and download the .jfr")
+	cmd.Flags().String("output-dir", ".", "Local directory to download dumps and recordings to")
+	cmd.Flags().String("dir", "/tmp", "Directory of the JVM's filesystem to write heap dumps and recordings to, before downloading them")
+
+	return cmd
+}
+
+func runJVM(cmd *cobra.Command, args []string) error {
+	pid, _ := cmd.Flags().GetInt("pid")
+	threadDump, _ := cmd.Flags().GetBool("thread-dump")
+	heapDump, _ := cmd.Flags().GetBool("heap-dump")
+	record, _ := cmd.Flags().GetDuration("flight-record")
+	outputDir, _ := cmd.Flags().GetString("output-dir")
+	dir, _ := cmd.Flags().GetString("dir")
+	if record < 0 {
+		return fmt.Errorf("invalid --flight-record %s", record)
+	}
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("invalid --dir %q: must be an absolute path", dir)
+	}
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("jvm needs a running container or pod: images have no processes")
+	}
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	if err := addPtraceCapability(cmd, target, "jvm"); err != nil {
+		return err
+	}
+
+	// stdout carries the listing only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	pipe, err := targetPipe(ctx, cmd, args[0], false)
+	if err != nil {
+		return err
+	}
+	var out, stderr bytes.Buffer
+	if code, err := pipe(ctx, []string{"sh", "-c", jvm.DetectScript}, nil, &out, &stderr); err != nil {
+		return err
+	} else if code != 0 {
+		return fmt.Errorf("listing the target's processes: %s", strings.TrimSpace(stderr.String()))
+	}
+	procs := jvm.ParseProcesses(out.Bytes())
+
+	if !threadDump && !heapDump && record == 0 {
+		if len(procs) == 0 {
+			return fmt.Errorf("no JVM found in %s", args[0])
+		}
+		w := render.NewTable(os.Stdout)
+		_, _ = fmt.Fprintln(w, "PID\tUID\tMAIN")
+		for _, p := range procs {
+			_, _ = fmt.Fprintf(w, "%d\t%d\t%s\n", p.PID, p.UID, p.Main())
+		}
+		return w.Flush()
+	}
+
+	proc, err := pickJVM(procs, pid, args[0])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", outputDir, err)
+	}
+	stamp := time.Now().Format("20060102-150405")
+	base := fmt.Sprintf("%s-%d-%s", strings.ReplaceAll(target.Name, "/", "_"), proc.PID, stamp)
+	jattach := func(ctx context.Context, stdout io.Writer, args ...string) error {
+		code, err := pipe(ctx, []string{"sh", "-c", jvm.Script(proc.PID, args...)}, nil, stdout, os.Stderr)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("jattach %s on PID %d exited with status %d", args[0], proc.PID, code)
+		}
+		return nil
+	}
+	// Files the JVM writes are read through its root filesystem
+	download := func(ctx context.Context, remote, local string) error {
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		var stderr bytes.Buffer
+		file := fmt.Sprintf("/proc/%d/root%s", proc.PID, remote)
+		code, err := pipe(ctx, []string{"cat", file}, nil, f, &stderr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		_, _ = pipe(context.WithoutCancel(ctx), []string{"rm", "-f", file}, nil, io.Discard, io.Discard)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("downloading %s: %s", remote, strings.TrimSpace(stderr.String()))
+		}
+		if info, err := os.Stat(local); err == nil {
+			fmt.Fprintf(os.Stderr, "Downloaded %s (%s)\n", local, units.HumanSize(float64(info.Size())))
+		}
+		return nil
+	}
+
+	if threadDump {
+		local := filepath.Join(outputDir, "threads-"+base+".txt")
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Taking a thread dump of PID %d (%s)...\n", proc.PID, proc.Main())
+		err = jattach(ctx, f, "threaddump")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", local)
+	}
+
+	if heapDump {
+		remote := dir + "/debux-heap-" + stamp + ".hprof"
+		fmt.Fprintf(os.Stderr, "Taking a heap dump of PID %d (%s) to %s...\n", proc.PID, proc.Main(), remote)
+		if err := jattach(ctx, io.Discard, "dumpheap", remote); err != nil {
+			return err
+		}
+		if err := download(ctx, remote, filepath.Join(outputDir, "heap-"+base+".hprof")); err != nil {
+			return err
+		}
+	}
+
+	if record > 0 {
+		name := "debux-" + stamp
+		remote := dir + "/" + name + ".jfr"
+		fmt.Fprintf(os.Stderr, "Recording PID %d (%s) with Flight Recorder for %s; Ctrl-C to stop early\n", proc.PID, proc.Main(), record)
+		if err := jattach(ctx, io.Discard, "jcmd", "JFR.start name="+name+" settings=profile"); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(record):
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "Stopping the recording")
+		}
+		// Stop and download even after Ctrl-C: the recording is what was asked
+		stop := context.WithoutCancel(ctx)
+		if err := jattach(stop, io.Discard, "jcmd", "JFR.stop name="+name+" filename="+remote); err != nil {
+			return err
+		}
+		if err := download(stop, remote, filepath.Join(outputDir, "recording-"+base+".jfr")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pickJVM returns the JVM of pid, the only one, or the one picked.
+func pickJVM(procs []jvm.Process, pid int, target string) (jvm.Process, error) {
+	if pid != 0 {
+		for _, p := range procs {
+			if p.PID == pid {
+				return p, nil
+			}
+		}
+		return jvm.Process{}, fmt.Errorf("PID %d of %s is not a JVM", pid, target)
+	}
+	switch len(procs) {
+	case 0:
+		return jvm.Process{}, fmt.Errorf("no JVM found in %s", target)
+	case 1:
+		return procs[0], nil
+	}
+	if _, isTerminal := term.GetFdInfo(os.Stdin); !isTerminal {
+		return jvm.Process{}, fmt.Errorf("%s runs %d JVMs: pick one with --pid (debux jvm %s lists them)", target, len(procs), target)
+	}
+	items := make([]picker.Item, len(procs))
+	for i, p := range procs {
+		items[i] = picker.Item{Label: fmt.Sprintf("%d  %s", p.PID, p.Main()), Value: strconv.Itoa(p.PID)}
+	}
+	picked, err := picker.Pick("Select a JVM", items)
+	if err != nil {
+		return jvm.Process{}, err
+	}
+	pid, _ = strconv.Atoi(picked)
+	return pickJVM(procs, pid, target)
+}
@@ -0,0 +1,421 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/clement-tourriere/debux/internal/api"
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/mcp"
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+// defaultMCPAllow are the programs run_command runs without confirmation by
+// default: they only read, whatever their arguments, and send nothing over the
+// network. That leaves out getent and the DNS lookups of netstat and lsof,
+// ss -K killing sockets and file -C writing a magic file: collect_diagnostics
+// covers the network.
+var defaultMCPAllow = []string{
+	"cat", "head", "tail", "ls", "stat", "readlink", "wc", "grep",
+	"ps", "pstree", "top", "pidof", "uptime", "free", "vmstat", "df", "du", "findmnt",
+	"id", "whoami", "uname", "nproc", "lscpu",
+}
+
+var mcpTools = []string{"list_targets", "start_session", "run_command", "fetch_file", "collect_diagnostics"}
+
+const (
+	mcpOutputLimit = 100 << 10 // bytes of output returned per stream
+	mcpFileLimit   = 1 << 20   // bytes of fetched files
+)
+
+func newMCPCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mcp [k8s://[namespace/]]",
+		Short: "Serve debux tools to AI assistants over the Model Context Protocol",
+		Long: `Serve debux tools over the Model Context Protocol (MCP) on stdin and stdout,
+for AI assistants to run diagnostics in debug containers:
+
+  list_targets         running containers, or pods with a k8s:// scope
+  start_session        start the debug container of a target
+  run_command          run a program in a target's debug container
+  fetch_file           read a file of the target's filesystem
+  collect_diagnostics  processes, limits, mounts, memory, disks, network, DNS
+
+run_command runs a program without a shell. Only the programs of --allow run
+(by default, programs that only read, whatever their arguments); with
+--confirm, debux asks on the terminal for the others instead of refusing
+them. --target restricts the targets the tools may use and --tools the tools
+offered. Every call is logged to stderr. The optional argument is the
+default scope of list_targets. Debug options (--image, --profile, ...) apply
+to every debug container, and with --host the tools run through a debux
+daemon.`,
+		Example: `  debux mcp
+  debux mcp k8s://prod/ --target 'k8s://prod/*' --profile restricted
+  debux mcp --allow '*' --confirm`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			// stdout is the protocol's
+			runtime.SetStatusOutput(os.Stderr)
+
+			p := &mcpPolicy{}
+			p.allow, _ = cmd.Flags().GetStringSlice("allow")
+			p.targets, _ = cmd.Flags().GetStringSlice("target")
+			p.confirm, _ = cmd.Flags().GetBool("confirm")
+			p.timeout, _ = cmd.Flags().GetDuration("timeout")
+			tools, _ := cmd.Flags().GetStringSlice("tools")
+			for _, pattern := range append(slices.Clone(p.allow), p.targets...) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+				}
+			}
+			for _, t := range tools {
+				if !slices.Contains(mcpTools, t) {
+					return fmt.Errorf("unknown tool %q (valid: %s)", t, strings.Join(mcpTools, ", "))
+				}
+			}
+
+			scope := ""
+			if len(args) == 1 {
+				scope = args[0]
+			}
+			if _, _, err := parseScope(scope); err != nil {
+				return err
+			}
+			b, err := backend(cmd)
+			if err != nil {
+				return err
+			}
+
+			srv := &mcp.Server{
+				Name:         "debux",
+				Version:      meta.BuildVersion(),
+				Instructions: `debux debugs running containers and Kubernetes pods from a debug container sharing their namespaces, even when the target has no shell or tools. Targets are Docker container names, or k8s://<namespace>/<pod>. The target's filesystem is under $DEBUX_TARGET_ROOT in the debug container; fetch_file takes paths of the target's filesystem. Start with list_targets, then collect_diagnostics.`,
+			}
+			for _, t := range mcpServerTools(b, p, scope) {
+				if slices.Contains(tools, t.Name) {
+					srv.Tools = append(srv.Tools, t)
+				}
+			}
+			fmt.Fprintf(os.Stderr, "debux mcp: serving %s on stdio\n", strings.Join(tools, ", "))
+			return srv.Serve(ctx, os.Stdin, os.Stdout)
+		},
+	}
+
+	cmd.Flags().StringSlice("allow", defaultMCPAllow, "Programs run_command may run, as glob patterns; * for any (repeatable)")
+	cmd.Flags().Bool("confirm", false, "Ask on the terminal before running programs outside --allow, instead of refusing them")
+	cmd.Flags().StringSlice("target", nil, "Targets the tools may use, as glob patterns such as k8s://prod/* (default: any; repeatable)")
+	cmd.Flags().StringSlice("tools", mcpTools, "Tools to offer")
+	cmd.Flags().Duration("timeout", time.Minute, "Time limit of each command")
+
+	return cmd
+}
+
+// mcpPolicy decides what the tools may do.
+type mcpPolicy struct {
+	allow   []string
+	targets []string
+	confirm bool
+	timeout time.Duration
+
+	mu sync.Mutex // one question on the terminal at a time
+}
+
+// checkTarget fails unless the tools may use a target.
+func (p *mcpPolicy) checkTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("missing target")
+	}
+	if len(p.targets) == 0 {
+		return nil
+	}
+	for _, pattern := range p.targets {
+		if ok, _ := path.Match(pattern, target); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("target %s is not allowed by the debux policy (--target)", target)
+}
+
+// checkCommand fails unless run_command may run a command: its program is
+// allowed, or the user agrees. Programs are names found in the debug
+// container's PATH, never paths, which could run anything under an allowed
+// name.
+func (p *mcpPolicy) checkCommand(target string, command []string) error {
+	program := command[0]
+	if strings.Contains(program, "/") {
+		return fmt.Errorf("program %s is a path: run_command runs programs by name, from the debug container's PATH", program)
+	}
+	for _, pattern := range p.allow {
+		if ok, _ := path.Match(pattern, program); ok {
+			return nil
+		}
+	}
+	if !p.confirm {
+		return fmt.Errorf("program %s is not allowed by the debux policy (--allow); allowed: %s", program, strings.Join(p.allow, ", "))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("program %s needs confirmation, but there is no terminal to ask on", program)
+	}
+	defer func() { _ = tty.Close() }()
+	fmt.Fprintf(tty, "\ndebux mcp: run on %s:\n  %q\nAllow? [y/N] ", target, command)
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return fmt.Errorf("the user refused to run %s", program)
+	}
+	return nil
+}
+
+func mcpServerTools(b api.Backend, p *mcpPolicy, scope string) []mcp.Tool {
+	targetSchema := map[string]any{
+		"type":        "string",
+		"description": "Docker container name, or k8s://<namespace>/<pod>[/<container>]",
+	}
+	logf := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "debux mcp: "+format+"\n", args...)
+	}
+	// run runs a command with the time limit and returns its output.
+	run := func(ctx context.Context, target string, command []string, limit int) (stdout, stderr *limitedBuffer, code int, err error) {
+		ctx, cancel := context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+		stdout, stderr = &limitedBuffer{limit: limit}, &limitedBuffer{limit: mcpOutputLimit}
+		code, err = b.Exec(ctx, target, command, stdout, stderr)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", p.timeout)
+		}
+		logf("%s: %q → exit code %d", target, command, code)
+		return stdout, stderr, code, err
+	}
+
+	return []mcp.Tool{
+		{
+			Name:        "list_targets",
+			Description: "List the running containers, or the pods of a Kubernetes scope, with whether a debux debug container is running for them.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"scope": map[string]any{
+						"type":        "string",
+						"description": "Empty for Docker containers, k8s:// for all pods, k8s://<namespace>/ for a namespace",
+					},
+				},
+			},
+			ReadOnly: true,
+			Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Scope *string `json:"scope"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", err
+				}
+				s := scope
+				if args.Scope != nil {
+					s = *args.Scope
+				}
+				logf("list_targets %s", s)
+				targets, err := b.Targets(ctx, s)
+				if err != nil {
+					return "", err
+				}
+				// Only the targets the tools may use
+				targets = slices.DeleteFunc(targets, func(t api.Target) bool { return p.checkTarget(t.Target) != nil })
+				if len(targets) == 0 {
+					return "No running targets.", nil
+				}
+				data, err := json.MarshalIndent(targets, "", "  ")
+				return string(data), err
+			},
+		},
+		{
+			Name:        "start_session",
+			Description: "Start the debug container of a target, or return the running one. The other tools start it when needed too.",
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"target": targetSchema},
+				"required":   []string{"target"},
+			},
+			Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Target string `json:"target"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", err
+				}
+				if err := p.checkTarget(args.Target); err != nil {
+					return "", err
+				}
+				logf("start_session %s", args.Target)
+				session, err := b.CreateSession(ctx, args.Target)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Debug container %s is running for %s.", session.Container, args.Target), nil
+			},
+		},
+		{
+			Name:        "run_command",
+			Description: "Run a program without a shell in the debug container of a target, which shares its network, processes and filesystem (under $DEBUX_TARGET_ROOT). Only the programs allowed by the debux policy run.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"target": targetSchema,
+					"command": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": `Program name, found in PATH, and arguments, e.g. ["ss", "-tanp"]`,
+					},
+				},
+				"required": []string{"target", "command"},
+			},
+			Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Target  string   `json:"target"`
+					Command []string `json:"command"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", err
+				}
+				if len(args.Command) == 0 || args.Command[0] == "" {
+					return "", fmt.Errorf("missing command")
+				}
+				if err := p.checkTarget(args.Target); err != nil {
+					return "", err
+				}
+				if err := p.checkCommand(args.Target, args.Command); err != nil {
+					logf("%s: %q refused: %v", args.Target, args.Command, err)
+					return "", err
+				}
+				stdout, stderr, code, err := run(ctx, args.Target, args.Command, mcpOutputLimit)
+				if err != nil {
+					return "", err
+				}
+				var sb strings.Builder
+				sb.WriteString(stdout.String())
+				if stderr.Len() > 0 {
+					fmt.Fprintf(&sb, "\n[stderr]\n%s", stderr.String())
+				}
+				fmt.Fprintf(&sb, "\n[exit code %d]", code)
+				return sb.String(), nil
+			},
+		},
+		{
+			Name:        "fetch_file",
+			Description: "Read a text file of a target's filesystem, up to 1 MiB.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"target": targetSchema,
+					"path": map[string]any{
+						"type":        "string",
+						"description": "Absolute path in the target, e.g. /etc/nginx/nginx.conf",
+					},
+				},
+				"required": []string{"target", "path"},
+			},
+			ReadOnly: true,
+			Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Target string `json:"target"`
+					Path   string `json:"path"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", err
+				}
+				if err := p.checkTarget(args.Target); err != nil {
+					return "", err
+				}
+				if !strings.HasPrefix(args.Path, "/") {
+					return "", fmt.Errorf("path must be absolute: %s", args.Path)
+				}
+				script := fmt.Sprintf(`f="$DEBUX_TARGET_ROOT$1"; [ -f "$f" ] || { echo "not a regular file: $1" >&2; exit 1; }; head -c %d -- "$f"`, mcpFileLimit+1)
+				stdout, stderr, code, err := run(ctx, args.Target, []string{"sh", "-c", script, "sh", args.Path}, mcpFileLimit+1)
+				if err != nil {
+					return "", err
+				}
+				if code != 0 {
+					return "", fmt.Errorf("reading %s: %s", args.Path, strings.TrimSpace(stderr.String()))
+				}
+				data := stdout.Bytes()
+				if !utf8.Valid(data[:min(len(data), mcpFileLimit)]) || bytes.IndexByte(data, 0) >= 0 {
+					return "", fmt.Errorf("%s is a binary file", args.Path)
+				}
+				if len(data) > mcpFileLimit {
+					return string(data[:mcpFileLimit]) + "\n[truncated at 1 MiB]", nil
+				}
+				return string(data), nil
+			},
+		},
+		{
+			Name:        "collect_diagnostics",
+			Description: "Collect diagnostics about a target: processes, its main process's status, limits, cgroup, mounts and open files, memory, disks, network addresses, routes and sockets, and DNS configuration. The environment is left out, as it often holds secrets.",
+			InputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"target": targetSchema},
+				"required":   []string{"target"},
+			},
+			ReadOnly: true,
+			Call: func(ctx context.Context, raw json.RawMessage) (string, error) {
+				var args struct {
+					Target string `json:"target"`
+				}
+				if err := json.Unmarshal(raw, &args); err != nil {
+					return "", err
+				}
+				if err := p.checkTarget(args.Target); err != nil {
+					return "", err
+				}
+				stdout, stderr, code, err := run(ctx, args.Target, []string{"sh", "-c", entrypoint.Diagnostics}, 4*mcpOutputLimit)
+				if err != nil {
+					return "", err
+				}
+				if code != 0 {
+					return "", fmt.Errorf("collecting diagnostics: %s", strings.TrimSpace(stderr.String()))
+				}
+				return stdout.String(), nil
+			},
+		},
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + "\n[output truncated]"
+	}
+	return b.Buffer.String()
+}
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/netcheck"
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newNetcheckCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "netcheck <target>",
+		Short: "Check DNS, routes, MTU and connectivity from a target's network",
+		Long: `Run the network checklist of an incident from inside the target's network
+namespace, and report each check as pass, warn, fail or skip:
+
+  dns     nameservers of the target's resolv.conf answer, endpoints resolve
+          with its search domains
+  route   there is a default route
+  mtu     interface MTU, and path MTU to each endpoint (tracepath)
+  tcp     each endpoint accepts connections
+  tls     the certificate of TLS endpoints (port 443, tls:// or https://)
+          verifies
+  policy  NetworkPolicies selecting the pod, egress policies without DNS,
+          and which may explain failures (Kubernetes)
+
+Endpoints are host:port, tls://host[:port], https://host[:port], or
+svc/<name>[:port] for the ports of a service in the pod's namespace. Without
+--to, Kubernetes targets check the API server (kubernetes.default.svc:443).
+
+debux netcheck exits with status 1 when a check fails.`,
+		Example: `  debux netcheck my-app --to db:5432 --to https://api.example.com
+  debux netcheck k8s://prod/api-7d9f --to svc/payments --to svc/redis:6379
+  debux netcheck k8s://prod/api-7d9f -o json`,
+		Args: cobra.ExactArgs(1),
+		RunE: runNetcheck,
+	}
+
+	cmd.Flags().StringArray("to", nil, "Endpoint to check: host:port, tls://host[:port], https://host[:port] or svc/<name>[:port] (repeatable)")
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+
+	return cmd
+}
+
+func runNetcheck(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+	to, _ := cmd.Flags().GetStringArray("to")
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("netcheck needs a running container or pod: images have no network")
+	}
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return err
+	}
+	services, _ := d.(runtime.Services)
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return err
+	}
+
+	// stdout carries the report only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var endpoints []netcheck.Endpoint
+	for _, t := range to {
+		if strings.HasPrefix(t, "svc/") {
+			if services == nil || flagHost != "" {
+				return fmt.Errorf("%s: svc/ endpoints need a Kubernetes target", t)
+			}
+			svc, err := services.ServiceEndpoints(ctx, target, opts, t)
+			if err != nil {
+				return err
+			}
+			endpoints = append(endpoints, svc...)
+			continue
+		}
+		e, err := netcheck.ParseEndpoint(t)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(to) == 0 && services != nil {
+		endpoints = append(endpoints, services.DefaultEndpoints()...)
+	}
+
+	run, err := containerRunner(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Checking the network of %s...\n", args[0])
+	var stdout bytes.Buffer
+	command := append([]string{"zsh", "-c", netcheck.Script(), "netcheck"}, netcheck.Args(endpoints)...)
+	code, err := run(ctx, command, &stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("network checks exited with status %d", code)
+	}
+
+	report := netcheck.Parse(stdout.Bytes())
+	report.Target = args[0]
+	if services != nil && flagHost == "" {
+		policies, err := services.NetworkPolicies(ctx, target, opts)
+		if err != nil {
+			report.Checks = append(report.Checks, netcheck.Check{Category: "policy", Name: "networkpolicies", Status: netcheck.Skip, Detail: err.Error()})
+		} else {
+			report.AddPolicies(policies)
+		}
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if err := printNetcheckReport(report); err != nil {
+		return err
+	}
+	if n := report.Failed(); n > 0 {
+		return fmt.Errorf("%d network check(s) failed", n)
+	}
+	return nil
+}
+
+func printNetcheckReport(r *netcheck.Report) error {
+	w := render.NewTable(os.Stdout)
+	w.Mark(checkStyle)
+	_, _ = fmt.Fprintln(w, "STATUS\tCHECK\tNAME\tDETAIL")
+	for _, c := range r.Checks {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.ToUpper(c.Status), c.Category, c.Name, c.Detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, c := range r.Checks {
+		counts[c.Status]++
+	}
+	fmt.Printf("\n%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[netcheck.Pass], counts[netcheck.Warn], counts[netcheck.Fail], counts[netcheck.Skip])
+	return nil
+}
+
+// checkStyle colors the statuses of checks.
+func checkStyle(status string) render.Style {
+	switch strings.ToLower(status) {
+	case netcheck.Pass:
+		return render.Green
+	case netcheck.Warn:
+		return render.Yellow
+	case netcheck.Fail:
+		return render.Bold + ";" + render.Red
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/audit"
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/operator"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/spf13/cobra"
+)
+
+func newOperatorCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "operator",
+		Short: "Run the debux Kubernetes operator",
+		Long: `Run the debux operator, usually in-cluster (deploy/operator.yaml): it injects
+debug containers for DebugSession resources, which debux creates with
+--operator (or exec.operator in the config file). Users then only need RBAC
+on DebugSessions, not on the ephemeral containers of pods.
+
+The operator enforces its own policy file ($DEBUX_POLICY or
+/etc/debux/policy.yaml) and TTLs, records sessions with the audit section of
+its config file, stops the debug container of sessions past their TTL or
+deleted, and deletes finished sessions after --retention.`,
+		Example: `  debux operator --namespace prod --ttl 30m --max-ttl 2h --cluster prod-eu`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			opts := operator.Options{Image: debugImage()}
+			opts.Kubeconfig, _ = cmd.Flags().GetString("kubeconfig")
+			opts.Namespace, _ = cmd.Flags().GetString("namespace")
+			opts.Cluster, _ = cmd.Flags().GetString("cluster")
+			opts.TTL, _ = cmd.Flags().GetDuration("ttl")
+			opts.MaxTTL, _ = cmd.Flags().GetDuration("max-ttl")
+			opts.Retention, _ = cmd.Flags().GetDuration("retention")
+			if opts.TTL <= 0 || opts.MaxTTL < opts.TTL {
+				return fmt.Errorf("--ttl must be positive and at most --max-ttl")
+			}
+			var err error
+			if opts.Policy, err = policy.Load(); err != nil {
+				return err
+			}
+			cfg, err := config.Load()
+			if err != nil {
+				return err
+			}
+			opts.Audit = audit.New(cfg.Audit)
+			return operator.Run(ctx, opts)
+		},
+	}
+	cmd.Flags().StringP("namespace", "n", "", "Namespace to watch (default: all)")
+	cmd.Flags().String("cluster", "", "Cluster name, matched by the contexts of policy rules")
+	cmd.Flags().Duration("ttl", 1*time.Hour, "TTL of sessions that don't set one")
+	cmd.Flags().Duration("max-ttl", 4*time.Hour, "Longest TTL a session may ask for")
+	cmd.Flags().Duration("retention", 1*time.Hour, "How long finished sessions are kept")
+	return cmd
+}
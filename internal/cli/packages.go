@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/store"
+	"github.com/spf13/cobra"
+)
+
+func newInstallCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "install <target|image> <pkg>...",
+		Short: "Install packages in a target's debug container",
+		Long: `Run "dctl install" in the debug container of a container, pod or image
+(creating it if needed), without opening a shell. Packages persist in the
+debux store like the ones installed from the shell, which makes this handy
+to script tool setup before an incident.
+
+Exits with an error when a package can't be installed.`,
+		Example: `  debux install my-app tcpdump mtr
+  debux install k8s://prod/api-7d9f kubectl`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			run, err := subjectRunner(ctx, cmd, args[0])
+			if err != nil {
+				return err
+			}
+
+			script := entrypoint.Dctl(append([]string{"install"}, args[1:]...)...)
+			code, err := run(ctx, []string{"sh", "-c", script}, os.Stdout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return fmt.Errorf("installing %s failed (exit code %d)", strings.Join(args[1:], ", "), code)
+			}
+			return nil
+		},
+	}
+}
+
+func newSearchCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "search <query>",
+		Short: "Search the packages available to dctl install",
+		Long: `Run "dctl search" in a short-lived container of the debux store, honoring
+the configured binary caches and --nixpkgs pin.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nix, err := nixConfig()
+			if err != nil {
+				return err
+			}
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			return store.Search(ctx, debugImage(), name, nix, args[0])
+		},
+	}
+}
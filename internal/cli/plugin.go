@@ -0,0 +1,254 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// pluginPrefix is the prefix of plugin executables: debux-foo on the PATH
+// is the debux foo command.
+const pluginPrefix = "debux-"
+
+func newPluginCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugin",
+		Short: "List plugins and give them the environment of a target",
+		Long: `Plugins are executables named debux-<name> on the PATH: debux <name> [args...]
+runs debux-<name> with the arguments, like kubectl plugins. debux-foo-bar is
+debux foo bar. Built-in commands take precedence over plugins, and plugins
+over Docker container names (use debux docker://<name> for a container named
+like a plugin).
+
+Plugins run with DEBUX_BIN (this debux executable), DEBUX_PLUGIN (their
+name), DEBUX_KUBECONFIG, and DEBUX_HOST and DEBUX_CONFIG when set. To work on
+a target, they call debux plugin env.`,
+	}
+	cmd.AddCommand(newPluginListCmd(), newPluginEnvCmd())
+	return cmd
+}
+
+func newPluginListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the plugins on the PATH",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			plugins, shadowed := listPlugins(cmd.Root())
+			if len(plugins) == 0 {
+				fmt.Println("No plugins found: add executables named debux-<name> to the PATH.")
+				return nil
+			}
+			for _, p := range plugins {
+				fmt.Println(p)
+			}
+			for _, w := range shadowed {
+				render.Warnf(os.Stderr, "%s", w)
+			}
+			return nil
+		},
+	}
+}
+
+func newPluginEnvCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env <target>",
+		Short: "Print the environment of a target for plugins",
+		Long: `Resolve a target, start its debug container unless --start=false, and print
+shell exports for plugins to eval:
+
+  DEBUX_TARGET            the target, as passed to debux
+  DEBUX_RUNTIME           docker, kubernetes, ...
+  DEBUX_TARGET_NAME       container or pod name
+  DEBUX_NAMESPACE         pod namespace, resolved from the kubeconfig
+  DEBUX_TARGET_CONTAINER  container in the pod, when given
+  DEBUX_KUBECONFIG        kubeconfig path
+  DEBUX_SESSION_CONTAINER debug container name, empty when none runs
+
+Debug options (--image, --profile, ...) apply to the debug container.`,
+		Example: `  # in a plugin script
+  eval "$("$DEBUX_BIN" plugin env "$1")"
+  kubectl --kubeconfig "$DEBUX_KUBECONFIG" -n "$DEBUX_NAMESPACE" \
+    exec "$DEBUX_TARGET_NAME" -c "$DEBUX_SESSION_CONTAINER" -- ss -tanp`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			// stdout is for eval
+			runtime.SetStatusOutput(os.Stderr)
+
+			target, _, err := parseRunningTarget(args[0])
+			if err != nil {
+				return err
+			}
+			flag, _ := cmd.Flags().GetString("kubeconfig")
+			kubeconfig := kubeconfigPath(flag)
+			namespace := target.Namespace
+			if target.Runtime == "kubernetes" && namespace == "default" {
+				namespace = runtime.KubernetesNamespace(flag)
+			}
+
+			b, err := backend(cmd)
+			if err != nil {
+				return err
+			}
+			var container string
+			if start, _ := cmd.Flags().GetBool("start"); start {
+				session, err := b.CreateSession(ctx, args[0])
+				if err != nil {
+					return err
+				}
+				container = session.Container
+			} else {
+				scope := runtime.SchemeOf(target.Runtime) + "://"
+				if namespace != "" {
+					scope += namespace + "/"
+				}
+				sessions, err := b.Sessions(ctx, scope)
+				if err != nil {
+					return err
+				}
+				for _, s := range sessions {
+					st, err := runtime.ParseTarget(s.Target)
+					if err == nil && st.Name == target.Name && st.Namespace == namespace {
+						container = s.Container
+					}
+				}
+			}
+
+			for _, kv := range [][2]string{
+				{"DEBUX_TARGET", args[0]},
+				{"DEBUX_RUNTIME", target.Runtime},
+				{"DEBUX_TARGET_NAME", target.Name},
+				{"DEBUX_NAMESPACE", namespace},
+				{"DEBUX_TARGET_CONTAINER", target.Container},
+				{"DEBUX_KUBECONFIG", kubeconfig},
+				{"DEBUX_SESSION_CONTAINER", container},
+			} {
+				fmt.Printf("export %s=%s\n", kv[0], shellQuoteWord(kv[1]))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("start", true, "Start the debug container if none runs")
+
+	return cmd
+}
+
+// findPlugin returns the plugin executable of a command line and its
+// arguments: the longest debux-<arg>[-<arg>...] on the PATH, unless the
+// command line runs a built-in command.
+func findPlugin(root *cobra.Command, args []string) (string, []string, bool) {
+	var words []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") || strings.Contains(a, "://") {
+			break
+		}
+		words = append(words, a)
+	}
+	if len(words) == 0 {
+		return "", nil, false
+	}
+	if c, _, err := root.Find(args); err == nil && c != root {
+		return "", nil, false
+	}
+	for n := len(words); n > 0; n-- {
+		if path, err := exec.LookPath(pluginPrefix + strings.Join(words[:n], "-")); err == nil {
+			return path, args[n:], true
+		}
+	}
+	return "", nil, false
+}
+
+// runPlugin runs a plugin with the environment of plugins.
+func runPlugin(path string, args []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	name := strings.TrimPrefix(filepath.Base(path), pluginPrefix)
+	c := exec.Command(path, args...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	c.Env = append(os.Environ(),
+		"DEBUX_BIN="+self,
+		"DEBUX_PLUGIN="+name,
+		"DEBUX_KUBECONFIG="+kubeconfigPath(""),
+	)
+
+	// Ctrl-C goes to the plugin, which decides when to stop
+	signal.Ignore(syscall.SIGINT)
+	defer signal.Reset(syscall.SIGINT)
+	if err := c.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("plugin %s exited with status %d", name, exitErr.ExitCode())
+		}
+		return fmt.Errorf("running plugin %s: %w", name, err)
+	}
+	return nil
+}
+
+// listPlugins returns the plugins on the PATH, and warnings about the ones
+// that can't run: shadowed by a built-in command or an earlier one, or not
+// executable.
+func listPlugins(root *cobra.Command) (plugins, warnings []string) {
+	seen := make(map[string]string)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasPrefix(e.Name(), pluginPrefix) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			name := strings.TrimPrefix(e.Name(), pluginPrefix)
+			info, err := os.Stat(path)
+			switch {
+			case err != nil || info.Mode()&0o111 == 0:
+				warnings = append(warnings, fmt.Sprintf("%s is not executable", path))
+			case seen[name] != "":
+				warnings = append(warnings, fmt.Sprintf("%s is shadowed by %s", path, seen[name]))
+			default:
+				if c, _, err := root.Find(strings.Split(name, "-")); err == nil && c != root {
+					warnings = append(warnings, fmt.Sprintf("%s is shadowed by the built-in command %q", path, c.CommandPath()))
+					continue
+				}
+				seen[name] = path
+				plugins = append(plugins, path)
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return plugins, warnings
+}
+
+// kubeconfigPath returns the kubeconfig used for Kubernetes targets: the
+// --kubeconfig flag, $KUBECONFIG's first file, or ~/.kube/config.
+func kubeconfigPath(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	if list := filepath.SplitList(os.Getenv("KUBECONFIG")); len(list) > 0 && list[0] != "" {
+		return list[0]
+	}
+	return clientcmd.RecommendedHomeFile
+}
+
+// shellQuoteWord single-quotes a word for a POSIX shell.
+func shellQuoteWord(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -2,9 +2,11 @@ package cli
 
 import (
 	"context"
+	"fmt"
 	"os/signal"
 	"syscall"
 
+	"github.com/clement-tourriere/debux/internal/policy"
 	"github.com/clement-tourriere/debux/internal/runtime"
 	"github.com/spf13/cobra"
 )
@@ -35,6 +37,14 @@ func runPod(cmd *cobra.Command, args []string) error {
 	kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
 	keep, _ := cmd.Flags().GetBool("keep")
 	hostNetwork, _ := cmd.Flags().GetBool("host-network")
+	nix, err := nixConfig()
+	if err != nil {
+		return err
+	}
+	sec, err := security(profile)
+	if err != nil {
+		return err
+	}
 
 	image := flagImage
 	if image == "" {
@@ -47,14 +57,32 @@ func runPod(cmd *cobra.Command, args []string) error {
 		Kubeconfig:  kubeconfig,
 		Keep:        keep,
 		HostNetwork: hostNetwork,
-		Privileged:  flagPrivileged,
+		Privileged:  profile == runtime.ProfileSysadmin,
 		User:        flagUser,
 		PullPolicy:  flagPullPolicy,
 		Profile:     profile,
+		Security:    sec,
+		PullSecrets: flagPullSecrets,
+		Nix:         nix,
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	return runtime.KubernetesPod(ctx, opts)
+	end, err := startSession(ctx, kubeRequest(commandName(cmd), policy.KindPod, "", namespace, kubeconfig, image, profile, sec))
+	if err != nil {
+		return err
+	}
+
+	d, err := runtime.DriverFor("kubernetes")
+	if err != nil {
+		return err
+	}
+	standalone, ok := d.(runtime.Standalone)
+	if !ok {
+		return fmt.Errorf("the kubernetes driver doesn't start standalone debug pods")
+	}
+	err = standalone.Pod(ctx, opts)
+	end(err)
+	return err
 }
@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/clement-tourriere/debux/internal/events"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+// recordOnce starts recording lifecycle events once per process, however
+// many sessions a server starts.
+var recordOnce sync.Once
+
+// checkPolicy decides on a session with the policy file, and records its
+// lifecycle events in the policy log when the policy says so. It returns
+// the approval the session needs, if any.
+func checkPolicy(ctx context.Context, req policy.Request) (*policy.Approval, error) {
+	p, err := policy.Load()
+	if err != nil || p == nil {
+		return nil, err
+	}
+	d, err := p.Decide(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Allowed {
+		by := "the debux policy"
+		if d.Rule != "" {
+			by += " (" + d.Rule + ")"
+		}
+		return nil, fmt.Errorf("%s on %s denied by %s: %s", req.Command, req.Target, by, d.Reason)
+	}
+	if d.Record {
+		recordOnce.Do(func() {
+			f, ferr := p.OpenLog()
+			if ferr != nil {
+				err = ferr
+				return
+			}
+			events.AddOutput(f)
+		})
+	}
+	return d.Approval, err
+}
+
+// commandName returns the debux command of cmd, e.g. "exec" or
+// "image layers". Running debux with a target is exec.
+func commandName(cmd *cobra.Command) string {
+	if !cmd.HasParent() {
+		return "exec"
+	}
+	return strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+}
+
+// containerRequest describes a session in a running container or pod.
+func containerRequest(command string, target *runtime.Target, opts runtime.DebugOpts) policy.Request {
+	req := policy.Request{
+		Command:    command,
+		Kind:       policy.KindContainer,
+		Runtime:    target.Runtime,
+		Target:     target.String(),
+		Name:       target.Name,
+		Image:      opts.Image,
+		Profile:    opts.Profile,
+		Privileged: opts.Privileged || opts.Profile == runtime.ProfileSysadmin,
+		CapAdd:     opts.Security.CapAdd,
+		Seccomp:    opts.Security.Seccomp,
+		AppArmor:   opts.Security.AppArmor,
+		Kubeconfig: opts.Kubeconfig,
+	}
+	for _, m := range opts.Mounts {
+		// As the daemon resolves it, so that src=/tmp/.. counts as /
+		source, err := filepath.Abs(m.Source)
+		if err != nil {
+			source = filepath.Clean(m.Source)
+		}
+		req.Mounts = append(req.Mounts, source)
+	}
+	if target.Runtime == "kubernetes" {
+		req.Context = runtime.KubernetesContext(opts.Kubeconfig)
+		// As the driver resolves it
+		req.Namespace = target.Namespace
+		if req.Namespace == "default" {
+			req.Namespace = runtime.KubernetesNamespace(opts.Kubeconfig)
+		}
+	}
+	return req
+}
+
+// imageRequest describes a session on an image in a Docker debug container.
+func imageRequest(command, ref string, opts runtime.ImageOpts) policy.Request {
+	req := policy.Request{
+		Command:    command,
+		Kind:       policy.KindImage,
+		Runtime:    "docker",
+		Target:     ref,
+		Name:       ref,
+		Image:      opts.DebugImage,
+		Profile:    opts.Profile,
+		Privileged: opts.Privileged || opts.Profile == runtime.ProfileSysadmin,
+		CapAdd:     opts.Security.CapAdd,
+		Seccomp:    opts.Security.Seccomp,
+		AppArmor:   opts.Security.AppArmor,
+	}
+	if opts.MountLayers {
+		// What mounting the layers takes
+		req.CapAdd = append(req.CapAdd, "SYS_ADMIN")
+		req.AppArmor = "unconfined"
+	}
+	return req
+}
+
+// kubeRequest describes a session in a debug pod of its own: standalone,
+// or holding the image ref.
+func kubeRequest(command, kind, ref, namespace, kubeconfig, image, profile string, sec runtime.Security) policy.Request {
+	if namespace == "" {
+		namespace = runtime.KubernetesNamespace(kubeconfig)
+	}
+	target := ref
+	if target == "" {
+		target = "k8s://" + namespace + "/"
+	}
+	return policy.Request{
+		Command:    command,
+		Kind:       kind,
+		Runtime:    "kubernetes",
+		Target:     target,
+		Name:       ref,
+		Context:    runtime.KubernetesContext(kubeconfig),
+		Namespace:  namespace,
+		Image:      image,
+		Profile:    profile,
+		Privileged: profile == runtime.ProfileSysadmin,
+		CapAdd:     sec.CapAdd,
+		Seccomp:    sec.Seccomp,
+		AppArmor:   sec.AppArmor,
+		Kubeconfig: kubeconfig,
+	}
+}
@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newPrewarmCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prewarm [docker:// | k8s://[namespace/]]",
+		Short: "Pull the debug image ahead of debug sessions",
+		Long: `Pull the debug image onto the local Docker daemon, or with a k8s:// argument
+onto the nodes of the cluster, so that the first debug session of an incident
+doesn't wait for the pull.
+
+On Kubernetes, a DaemonSet named debux-prewarm runs a sleeping pod of the
+debug image on every node (or those of --node-selector), tolerating every
+taint, and is deleted once all nodes have the image. With --keep it stays, so
+that nodes keep the image through image garbage collection and new nodes get
+it when they join.`,
+		Example: `  debux prewarm
+  debux prewarm k8s://
+  debux prewarm k8s://debug/ --node-selector pool=prod --keep`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runPrewarm,
+	}
+
+	cmd.Flags().StringToString("node-selector", nil, "Only pull on nodes with these labels, e.g. pool=prod (Kubernetes)")
+	cmd.Flags().Bool("keep", false, "Keep the prewarm DaemonSet, so that nodes keep the image (Kubernetes)")
+	cmd.Flags().Duration("timeout", 10*time.Minute, "Give up pulling after this long")
+	return cmd
+}
+
+func runPrewarm(cmd *cobra.Command, args []string) error {
+	scope := "docker://"
+	if len(args) == 1 {
+		scope = args[0]
+	}
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
+
+	switch {
+	case scope == "docker://":
+		return runtime.DockerPrewarm(ctx, debugImage(), flagPlatform)
+	case strings.HasPrefix(scope, "k8s://"):
+		namespace := strings.TrimSuffix(strings.TrimPrefix(scope, "k8s://"), "/")
+		if strings.Contains(namespace, "/") {
+			return fmt.Errorf("invalid scope %q: expected k8s://[namespace/]", scope)
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+		kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+		nodeSelector, _ := cmd.Flags().GetStringToString("node-selector")
+		keep, _ := cmd.Flags().GetBool("keep")
+		return runtime.KubernetesPrewarm(ctx, runtime.PrewarmOpts{
+			Image:        debugImage(),
+			Namespace:    namespace,
+			Kubeconfig:   kubeconfig,
+			PullPolicy:   flagPullPolicy,
+			PullSecrets:  flagPullSecrets,
+			NodeSelector: nodeSelector,
+			Keep:         keep,
+		})
+	}
+	return fmt.Errorf("invalid scope %q: expected docker:// or k8s://[namespace/]", scope)
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newProxyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy <target> --to [host:]port",
+		Short: "Forward a local port into a target's network namespace",
+		Long: `Listen locally and forward each connection to an address as seen from the
+target's network namespace, so that local clients (redis-cli, psql, a
+browser, Postman...) reach processes that only listen on localhost inside
+the container or pod.
+
+Kubernetes targets use the pods/portforward API for loopback addresses, like
+kubectl port-forward. Other addresses, Docker targets and --exec relay each
+connection over an exec stream to ncat in the debug container, which is
+created if needed.`,
+		Example: `  debux proxy my-redis --to 6379
+  debux proxy k8s://prod/api-7d9f --listen 127.0.0.1:9000 --to 127.0.0.1:8080
+  debux proxy k8s://prod/api-7d9f --to 10.0.3.7:5432 --listen 15432`,
+		Args: cobra.ExactArgs(1),
+		RunE: runProxy,
+	}
+
+	cmd.Flags().String("to", "", "Address to reach in the target's network namespace: [host:]port (host defaults to 127.0.0.1)")
+	cmd.Flags().String("listen", "", "Local address to listen on: [host:]port (default: 127.0.0.1 and the port of --to)")
+	cmd.Flags().Bool("exec", false, "Relay connections through the debug container even where port-forward works (Kubernetes)")
+
+	return cmd
+}
+
+// hostPort parses [host:]port, with host defaulting to 127.0.0.1.
+func hostPort(s string) (string, int, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = "127.0.0.1", s
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return "", 0, fmt.Errorf("invalid address %q: expected [host:]port", s)
+	}
+	return host, n, nil
+}
+
+func runProxy(cmd *cobra.Command, args []string) error {
+	to, _ := cmd.Flags().GetString("to")
+	listen, _ := cmd.Flags().GetString("listen")
+	viaExec, _ := cmd.Flags().GetBool("exec")
+	if to == "" {
+		return fmt.Errorf("--to is required: the [host:]port to reach in the target")
+	}
+	toHost, toPort, err := hostPort(to)
+	if err != nil {
+		return err
+	}
+	if listen == "" {
+		listen = strconv.Itoa(toPort)
+	}
+	listenHost, listenPort, err := hostPort(listen)
+	if err != nil {
+		return err
+	}
+	listen = net.JoinHostPort(listenHost, strconv.Itoa(listenPort))
+	to = net.JoinHostPort(toHost, strconv.Itoa(toPort))
+
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Name == "" {
+		return fmt.Errorf("missing target name in %q", args[0])
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	loopback := toHost == "localhost" || net.ParseIP(toHost).IsLoopback()
+	if loopback && !viaExec && flagHost == "" {
+		d, err := runtime.DriverFor(target.Runtime)
+		if err != nil {
+			return err
+		}
+		opts, err := debugOpts(cmd)
+		if err != nil {
+			return err
+		}
+		err = d.PortForward(ctx, target, opts, listen, toPort, func() {
+			fmt.Fprintf(os.Stderr, "Forwarding %s to %s in %s (port-forward); Ctrl-C to stop\n", listen, to, args[0])
+		})
+		// Runtimes that can't forward ports relay through the debug container
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	// Start the debug container before the first connection, so that
+	// connections don't race to create it and errors show right away
+	pipe, err := targetPipe(ctx, cmd, args[0], false)
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	if code, err := pipe(ctx, []string{"ncat", "--version"}, nil, io.Discard, &stderr); err != nil {
+		return err
+	} else if code != 0 {
+		return fmt.Errorf("the debug container can't relay connections (ncat exited with status %d): %s", code, strings.TrimSpace(stderr.String()))
+	}
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", listen)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %w", listen, err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "Forwarding %s to %s in %s (through the debug container); Ctrl-C to stop\n", listen, to, args[0])
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("accepting connections: %w", err)
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			var stderr bytes.Buffer
+			code, err := pipe(ctx, []string{"ncat", toHost, strconv.Itoa(toPort)}, conn, conn, &stderr)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				fmt.Fprintf(os.Stderr, "Connection from %s: %v\n", conn.RemoteAddr(), err)
+			case code != 0 && ctx.Err() == nil:
+				fmt.Fprintf(os.Stderr, "Connection from %s: %s\n", conn.RemoteAddr(), strings.TrimSpace(stderr.String()))
+			}
+		}()
+	}
+}
@@ -1,11 +1,20 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/events"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/render"
 	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/store"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -16,18 +25,67 @@ var (
 	flagRemove     bool
 	flagNoVolumes  bool
 	flagPullPolicy string
+	flagPull       string
+	flagOffline    bool
 	flagFresh      bool
+	flagKeep       bool
+	flagRmOnExit   bool
+	flagName       string
+	flagPerUser    bool
 	flagProfile    string
+	flagPlatform   string
+	flagSeccomp    string
+	flagAppArmor   string
+	flagCapAdd     []string
+	flagCapDrop    []string
+
+	flagStoreName         string
+	flagSubstituters      []string
+	flagTrustedPublicKeys []string
+	flagFlake             string
+	flagNixpkgs           string
+	flagShare             []string
+	flagRegistryAuth      string
+	flagPullSecrets       []string
+	flagExpectDigest      string
+	flagVerifySignature   bool
+	flagMounts            []string
+	flagEnv               []string
+	flagWorkdir           string
+	flagPid               int
+	flagCPUs              float64
+	flagMemory            string
+	flagAsTargetUser      bool
+	flagNoTargetEnv       bool
+	flagNoWrappers        bool
+	flagNoBanner          bool
+	flagReadOnlyTarget    bool
+	flagVolumes           []string
+	flagExcludeVolumes    []string
+	flagOperator          bool
+	flagLast              bool
+	flagAllNamespaces     bool
+	flagSelector          string
+	flagQuiet             bool
+	flagNoColor           bool
+	flagIdleTimeout       time.Duration
+	flagMaxDuration       time.Duration
+	flagDetach            bool
+	flagHost              string
+	flagEvents            string
+	flagEventsFile        string
 )
 
 func NewRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "debux [target]",
+		Use:   "debux [target] [-- command...]",
 		Short: "Universal container debugging tool",
 		Long: `Debug any container — even distroless/scratch — with a rich NixOS-powered shell.
 
 If no target is specified, an interactive picker lists running Docker containers.
 Using a schema without a name (e.g. docker://, k8s://) shows a picker for that runtime.
+A command after "--" runs in the debug shell instead of an interactive one,
+e.g. debux my-app -q -- ss -tlnp.
 
 Target formats:
   <container>                     Docker container (default runtime)
@@ -36,34 +94,325 @@ Target formats:
   nerdctl://<container>           containerd container (alias)
   k8s://<pod>                     Kubernetes pod (default namespace)
   k8s://<namespace>/<pod>         Kubernetes pod (specific namespace)
-  k8s://<ns>/<pod>/<container>    Kubernetes pod (specific container)`,
-		Args:          cobra.MaximumNArgs(1),
-		RunE:          runExec,
+  k8s://<ns>/<pod>/<container>    Kubernetes pod (specific container)
+
+` + shareHelp(),
+		Args: execArgs,
+		RunE: runExec,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if flagQuiet {
+				runtime.SetQuiet()
+			}
+			if flagNoColor || machineOutput(cmd) {
+				render.Disable()
+			}
+			dbximage.RegistryAuth = flagRegistryAuth
+			if dbximage.RegistryAuth == "" {
+				dbximage.RegistryAuth = os.Getenv("DEBUX_REGISTRY_AUTH")
+			}
+			if err := setOffline(cmd); err != nil {
+				return err
+			}
+			if err := setPull(cmd); err != nil {
+				return err
+			}
+			if err := setupEvents(); err != nil {
+				return err
+			}
+			auditFlags = changedFlags(cmd)
+			setHistoryArgs(cmd)
+			if err := verifyDebugImage(cmd.Context(), cmd); err != nil {
+				return err
+			}
+			if flagExpectDigest != "" {
+				return dbximage.ExpectDigest(debugImage(), flagExpectDigest)
+			}
+			return nil
+		},
 		SilenceUsage:  true,
 		SilenceErrors: true,
 	}
 
 	cmd.PersistentFlags().StringVar(&flagImage, "image", "", "Override debug image (default: ghcr.io/clement-tourriere/debux:latest)")
-	cmd.PersistentFlags().BoolVar(&flagPrivileged, "privileged", false, "Run debug container in privileged mode")
+	cmd.PersistentFlags().BoolVar(&flagPrivileged, "privileged", false, "Run the debug container privileged: same as --profile=sysadmin (deprecated)")
 	cmd.PersistentFlags().StringVar(&flagUser, "user", "", "Run as specific user (uid:gid)")
-	cmd.PersistentFlags().BoolVar(&flagRemove, "rm", true, "Auto-remove debug container on exit")
+	cmd.PersistentFlags().BoolVar(&flagAsTargetUser, "as-target-user", false, "Start the debug shell as the user the target runs as, instead of root (default from the config file)")
+	cmd.PersistentFlags().BoolVar(&flagRemove, "rm", true, "Auto-remove debug container on exit: image sessions, and, when given, Docker sidecars once their last shell closes")
+	cmd.PersistentFlags().BoolVar(&flagRmOnExit, "rm-on-exit", false, "Remove the debug sidecar when its last shell closes (Docker)")
+	cmd.PersistentFlags().BoolVar(&flagKeep, "keep", false, "Keep the debug sidecar for reuse once its last shell closes; the default (Docker)")
 	cmd.PersistentFlags().BoolVar(&flagNoVolumes, "no-volumes", false, "Don't share target container's volumes")
-	cmd.PersistentFlags().StringVar(&flagPullPolicy, "pull-policy", "IfNotPresent", "Image pull policy for Kubernetes (Always, IfNotPresent, Never)")
-	cmd.PersistentFlags().BoolVar(&flagFresh, "fresh", false, "Force a new debug container instead of reusing an existing one (Kubernetes)")
+	cmd.PersistentFlags().StringSliceVar(&flagVolumes, "volumes", nil, "Only share the target's volumes mounted at or under paths matching these globs, e.g. /data/*,/var/log")
+	cmd.PersistentFlags().StringSliceVar(&flagExcludeVolumes, "exclude-volumes", nil, "Don't share the target's volumes mounted at or under paths matching these globs")
+	cmd.PersistentFlags().StringArrayVar(&flagMounts, "mount", nil, "Mount a host path in the debug container: src=<path>,dst=<path>[,ro] (Docker; repeatable)")
+	cmd.PersistentFlags().StringArrayVarP(&flagEnv, "env", "e", nil, "Set an environment variable in the debug container: KEY=VALUE, or KEY to pass the local value (repeatable)")
+	cmd.PersistentFlags().BoolVar(&flagNoBanner, "no-banner", false, "Don't print the target's image, command, limits, node, IPs and volumes as the debug shell opens")
+	cmd.PersistentFlags().BoolVar(&flagNoTargetEnv, "no-target-env", false, "Don't import the target's environment in the debug shell, only its PATH")
+	cmd.PersistentFlags().BoolVar(&flagNoWrappers, "no-wrappers", false, "Don't generate the wrappers running the target's binaries chrooted in its filesystem")
+	cmd.PersistentFlags().BoolVar(&flagReadOnlyTarget, "read-only-target", false, "Share the target's volumes read-only and browse its root filesystem read-only where possible")
+	cmd.PersistentFlags().BoolVar(&flagOperator, "operator", false, "Have the debux operator start debug containers in pods, through a DebugSession (default from the config file)")
+	cmd.PersistentFlags().DurationVar(&flagIdleTimeout, "idle-timeout", 0, "Close interactive shells without input for this long, e.g. 30m, after a warning (default from the config file)")
+	cmd.PersistentFlags().DurationVar(&flagMaxDuration, "max-duration", 0, "Close interactive shells after this long, e.g. 4h, after warnings (default from the config file)")
+	cmd.PersistentFlags().StringVarP(&flagWorkdir, "workdir", "w", "", "Initial working directory of the debug shell")
+	cmd.PersistentFlags().IntVar(&flagPid, "pid", 0, "Aim the debug shell at this process of the target instead of PID 1, e.g. the child of a supervisor: its root filesystem, environment and working directory")
+	cmd.PersistentFlags().Float64Var(&flagCPUs, "cpus", 0, "CPU limit of the debug sidecar, e.g. 0.5 (Docker; default from the config file)")
+	cmd.PersistentFlags().StringVar(&flagMemory, "memory", "", "Memory limit of the debug sidecar, e.g. 512m (Docker; default from the config file)")
+	cmd.PersistentFlags().StringSliceVar(&flagShare, "share", nil,
+		fmt.Sprintf("Namespaces to share with the target: %s (Docker; default: %s)", strings.Join(runtime.NamespaceNames(), ","), strings.Join(runtime.DefaultShare, ",")))
+	cmd.PersistentFlags().StringVar(&flagPull, "pull", dbximage.PullMissing, "Pull images: missing, always (when their registry digest changed) or never")
+	cmd.PersistentFlags().BoolVar(&flagOffline, "offline", false, "Air-gapped mode: never pull, use local images, and install prefetched packages only (default from the config file)")
+	cmd.PersistentFlags().StringVar(&flagPullPolicy, "pull-policy", "IfNotPresent", "Image pull policy (Always, IfNotPresent, Never): the Kubernetes spelling of --pull, which it sets for Docker too unless --pull is given")
+	cmd.PersistentFlags().BoolVar(&flagDetach, "detach", false, "Start the debug container and return without opening a shell (join it later with debux attach)")
+	cmd.PersistentFlags().BoolVar(&flagFresh, "fresh", false, "Force a new debug container instead of reusing an existing one (replaces the Docker sidecar)")
+	cmd.PersistentFlags().BoolVar(&flagPerUser, "per-user", false, "Only reuse debug containers you created, so that each user of a shared pod gets their own (Kubernetes; default from the config file)")
+	cmd.PersistentFlags().StringVar(&flagName, "name", "", "Name of the debug container to reuse, or to create (Kubernetes; default: debux-<user>-<profile>-<time>)")
 	cmd.PersistentFlags().String("kubeconfig", "", "Override kubeconfig path")
-	cmd.PersistentFlags().StringVar(&flagProfile, "profile", "general",
-		fmt.Sprintf("Security profile for Kubernetes (%s)", strings.Join(runtime.ValidProfiles, ", ")))
+	cmd.PersistentFlags().StringVar(&flagHost, "host", os.Getenv("DEBUX_HOST"), "debux daemon to run commands through: unix:///path, tcp://host:port or https://... (or set $DEBUX_HOST)")
+	cmd.PersistentFlags().BoolVarP(&flagQuiet, "quiet", "q", false, "Print no progress messages, only the output of the shell or command")
+	cmd.PersistentFlags().BoolVar(&flagNoColor, "no-color", false, "Print no colors (also set by $NO_COLOR; never used when output isn't a terminal)")
+	cmd.PersistentFlags().StringVar(&flagEvents, "events", "", "Write lifecycle events (image pulls, debug containers, sessions) as json lines to stderr")
+	cmd.PersistentFlags().StringVar(&flagEventsFile, "events-file", "", "Append the --events to this file instead of stderr")
+	cmd.PersistentFlags().StringVar(&flagRegistryAuth, "registry-auth", "", "Registry credentials as user:password, instead of the Docker config (or set $DEBUX_REGISTRY_AUTH)")
+	cmd.PersistentFlags().StringVar(&flagExpectDigest, "expect-digest", "", "Fail unless the debug image has this digest (sha256:...)")
+	cmd.PersistentFlags().BoolVar(&flagVerifySignature, "verify-signature", false, "Verify the cosign signature of the debug image before using it, and pin its digest (default from the config file)")
+	cmd.PersistentFlags().StringSliceVar(&flagPullSecrets, "pull-secret", nil, "Image pull secret for Kubernetes debug pods (repeatable)")
+	cmd.PersistentFlags().StringVar(&flagPlatform, "platform", "", "Image platform, e.g. linux/arm64 (Docker; default: match the target)")
+	cmd.PersistentFlags().StringVar(&flagProfile, "profile", "",
+		fmt.Sprintf("Security profile of the debug container: %s (default general, or from the config file)", strings.Join(runtime.ValidProfiles, ", ")))
+	_ = cmd.RegisterFlagCompletionFunc("profile", cobra.FixedCompletions(runtime.ValidProfiles, cobra.ShellCompDirectiveNoFileComp))
+	cmd.PersistentFlags().StringVar(&flagSeccomp, "seccomp-profile", "", "Seccomp profile of the debug container: runtime/default, unconfined, localhost/<profile> (Kubernetes) or a JSON file (Docker)")
+	cmd.PersistentFlags().StringVar(&flagAppArmor, "apparmor", "", "AppArmor profile of the debug container: runtime/default, unconfined or a profile loaded on the host ([localhost/]<profile>)")
+	cmd.PersistentFlags().StringSliceVar(&flagCapAdd, "cap-add", nil, "Add a capability to those of --profile, e.g. SYS_ADMIN (repeatable)")
+	cmd.PersistentFlags().StringSliceVar(&flagCapDrop, "cap-drop", nil, "Drop a capability from those of --profile, or ALL (repeatable)")
+	cmd.PersistentFlags().StringVar(&flagStoreName, "store-name", store.DefaultName, "Persistent Nix store to use, for separate stores per project or cluster (Docker)")
+	cmd.PersistentFlags().StringSliceVar(&flagSubstituters, "substituter", nil, "Extra Nix binary cache URL for package installs (repeatable)")
+	cmd.PersistentFlags().StringSliceVar(&flagTrustedPublicKeys, "trusted-public-key", nil, "Signing key of an extra Nix binary cache (repeatable)")
+	cmd.PersistentFlags().StringVar(&flagFlake, "flake", "", "Flake whose devShell provides the session's tools, e.g. github:org/debug-env#incident or ./env")
+	cmd.PersistentFlags().StringVar(&flagNixpkgs, "nixpkgs", "", "Pin the nixpkgs revision dctl installs from (commit, branch like nixos-24.11, or flake reference)")
+	cmd.PersistentFlags().BoolVarP(&flagAllNamespaces, "all-namespaces", "A", false, "Pick among the pods of all namespaces (Kubernetes picker)")
+	cmd.PersistentFlags().StringVarP(&flagSelector, "selector", "l", "", "Only pick among pods matching this label selector, e.g. app=api (Kubernetes picker)")
+	cmd.Flags().BoolVar(&flagLast, "last", false, "Start the last session of debux history again (same as debux reconnect)")
+	_ = cmd.PersistentFlags().MarkDeprecated("rm-on-exit", "use --rm instead")
 	_ = cmd.PersistentFlags().MarkDeprecated("privileged", "use --profile=sysadmin instead")
 
 	cmd.AddCommand(newExecCmd())
+	cmd.AddCommand(newAttachCmd())
+	cmd.AddCommand(newSessionsCmd())
+	cmd.AddCommand(newShareCmd())
+	cmd.AddCommand(newJoinCmd())
+	cmd.AddCommand(newSSHCmd())
+	cmd.AddCommand(newSSHProxyCmd())
+	cmd.AddCommand(newIDECmd())
+	cmd.AddCommand(newServeCmd())
+	cmd.AddCommand(newMCPCmd())
+	cmd.AddCommand(newPluginCmd())
+	cmd.AddCommand(newDaemonCmd())
+	cmd.AddCommand(newBundleCmd())
+	cmd.AddCommand(newCleanupCmd())
+	cmd.AddCommand(newApproveCmd())
+	cmd.AddCommand(newHistoryCmd())
+	cmd.AddCommand(newReconnectCmd())
+	cmd.AddCommand(newOperatorCmd())
 	cmd.AddCommand(newPodCmd())
 	cmd.AddCommand(newImageCmd())
+	cmd.AddCommand(newPrewarmCmd())
 	cmd.AddCommand(newStoreCmd())
+	cmd.AddCommand(newScanCmd())
+	cmd.AddCommand(newSecretsCmd())
+	cmd.AddCommand(newInspectCmd())
+	cmd.AddCommand(newNetcheckCmd())
+	cmd.AddCommand(newDnsqCmd())
+	cmd.AddCommand(newProxyCmd())
+	cmd.AddCommand(newTLSCmd())
+	cmd.AddCommand(newStatsCmd())
+	cmd.AddCommand(newSvcCmd())
+	cmd.AddCommand(newStraceCmd())
+	cmd.AddCommand(newJVMCmd())
+	cmd.AddCommand(newDBCmd())
+	cmd.AddCommand(newEditCmd())
+	cmd.AddCommand(newSyncCmd())
+	cmd.AddCommand(newInstallCmd())
+	cmd.AddCommand(newSearchCmd())
 
 	return cmd
 }
 
-// resolveProfile resolves the security profile from --profile and --privileged flags.
+// debugImage returns the debug image from --image, or the default one.
+func debugImage() string {
+	if flagImage == "" {
+		return runtime.DefaultImage
+	}
+	return flagImage
+}
+
+// storeName returns the validated --store-name.
+func storeName() (string, error) {
+	if err := store.ValidateName(flagStoreName); err != nil {
+		return "", err
+	}
+	return flagStoreName, nil
+}
+
+// shareHelp describes the namespaces accepted by --share.
+func shareHelp() string {
+	var b strings.Builder
+	b.WriteString("Namespaces shared with Docker targets (--share, default: " + strings.Join(runtime.DefaultShare, ",") + "):\n")
+	for _, ns := range runtime.Namespaces {
+		fmt.Fprintf(&b, "  %-8s %s\n", ns.Name, ns.Description)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// nixConfig returns the Nix settings from the config file plus the
+// --substituter and --trusted-public-key flags.
+func nixConfig() (config.Nix, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return config.Nix{}, err
+	}
+	nix := cfg.Nix
+	nix.Substituters = append(nix.Substituters, flagSubstituters...)
+	nix.TrustedPublicKeys = append(nix.TrustedPublicKeys, flagTrustedPublicKeys...)
+	if flagFlake != "" {
+		nix.Flake = flagFlake
+	}
+	if flagNixpkgs != "" {
+		nix.Nixpkgs = flagNixpkgs
+	}
+	nix.Offline = flagOffline
+	return nix, nil
+}
+
+// hooksConfig returns the session hooks of the config file.
+func hooksConfig() (config.Hooks, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return config.Hooks{}, err
+	}
+	return cfg.Hooks, nil
+}
+
+// resources returns the sidecar limits: the flags, or else the config file.
+func resources() (cpus float64, memory int64, err error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return 0, 0, err
+	}
+	cpus = cfg.Resources.CPUs
+	if flagCPUs != 0 {
+		cpus = flagCPUs
+	}
+	if cpus < 0 {
+		return 0, 0, fmt.Errorf("invalid CPU limit %g", cpus)
+	}
+	size := cfg.Resources.Memory
+	if flagMemory != "" {
+		size = flagMemory
+	}
+	if size != "" {
+		if memory, err = units.RAMInBytes(size); err != nil || memory <= 0 {
+			return 0, 0, fmt.Errorf("invalid memory limit %q", size)
+		}
+	}
+	return cpus, memory, nil
+}
+
+// pullPolicies are the Kubernetes pull policies of the --pull modes.
+var pullPolicies = map[string]string{
+	dbximage.PullMissing: "IfNotPresent",
+	dbximage.PullAlways:  "Always",
+	dbximage.PullNever:   "Never",
+}
+
+// setOffline applies --offline, or offline in the config file: debux never
+// pulls, so that it runs on the images already there, and debug containers
+// install prefetched packages only.
+func setOffline(cmd *cobra.Command) error {
+	if !cmd.Flags().Changed("offline") {
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+		flagOffline = cfg.Offline
+	}
+	if !flagOffline {
+		return nil
+	}
+	if cmd.Flags().Changed("pull") && flagPull != dbximage.PullNever {
+		return fmt.Errorf("--pull=%s needs network access, which --offline rules out", flagPull)
+	}
+	if cmd.Flags().Changed("pull-policy") && flagPullPolicy != "Never" {
+		return fmt.Errorf("--pull-policy=%s needs network access, which --offline rules out", flagPullPolicy)
+	}
+	flagPull, flagPullPolicy = dbximage.PullNever, "Never"
+	dbximage.Offline = true
+	return nil
+}
+
+// setPull applies --pull to the pulls of debux, and to Kubernetes unless
+// --pull-policy is set. --pull-policy alone applies to both too, so that
+// Always re-pulls a stale Docker debug image as it does on Kubernetes.
+func setPull(cmd *cobra.Command) error {
+	mode, err := dbximage.ParsePull(flagPull)
+	if err != nil {
+		return err
+	}
+	policyMode := ""
+	for m, policy := range pullPolicies {
+		if policy == flagPullPolicy {
+			policyMode = m
+		}
+	}
+	if policyMode == "" {
+		return fmt.Errorf("invalid --pull-policy %q: expected Always, IfNotPresent or Never", flagPullPolicy)
+	}
+	switch pull, policy := cmd.Flags().Changed("pull"), cmd.Flags().Changed("pull-policy"); {
+	case pull && !policy:
+		flagPullPolicy = pullPolicies[mode]
+	case policy && !pull:
+		mode = policyMode
+	}
+	dbximage.Pull = mode
+	return nil
+}
+
+// sessionLimits returns --idle-timeout and --max-duration, or else those of
+// the config file.
+func sessionLimits(cmd *cobra.Command, cfg *config.Config) (idle, maxDuration time.Duration, err error) {
+	idle, maxDuration = flagIdleTimeout, flagMaxDuration
+	if !cmd.Flags().Changed("idle-timeout") && cfg.Exec.IdleTimeout != "" {
+		if idle, err = time.ParseDuration(cfg.Exec.IdleTimeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid exec.idle-timeout in the config file: %w", err)
+		}
+	}
+	if !cmd.Flags().Changed("max-duration") && cfg.Exec.MaxDuration != "" {
+		if maxDuration, err = time.ParseDuration(cfg.Exec.MaxDuration); err != nil {
+			return 0, 0, fmt.Errorf("invalid exec.max-duration in the config file: %w", err)
+		}
+	}
+	if idle < 0 || maxDuration < 0 {
+		return 0, 0, fmt.Errorf("--idle-timeout and --max-duration can't be negative")
+	}
+	return idle, maxDuration, nil
+}
+
+// asTargetUser reports whether the debug shell runs as the target's user:
+// --as-target-user, or else the config file. --user takes precedence.
+func asTargetUser(cmd *cobra.Command) (bool, error) {
+	if flagUser != "" {
+		return false, nil
+	}
+	if cmd.Flags().Changed("as-target-user") {
+		return flagAsTargetUser, nil
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return false, err
+	}
+	return cfg.Exec.AsTargetUser, nil
+}
+
+// resolveProfile resolves the security profile from --profile and --privileged
+// flags, or else the config file.
 func resolveProfile(cmd *cobra.Command) (string, error) {
 	privilegedSet := cmd.Flags().Changed("privileged") && flagPrivileged
 	profileSet := cmd.Flags().Changed("profile")
@@ -73,28 +422,99 @@ func resolveProfile(cmd *cobra.Command) (string, error) {
 	}
 
 	if privilegedSet {
-		fmt.Fprintln(os.Stderr, "Warning: --privileged is deprecated, use --profile=sysadmin instead")
+		render.Warnf(os.Stderr, "--privileged is deprecated, use --profile=sysadmin instead")
 		return runtime.ProfileSysadmin, nil
 	}
 
 	if profileSet {
-		// Validate profile
-		valid := false
-		for _, p := range runtime.ValidProfiles {
-			if flagProfile == p {
-				valid = true
-				break
-			}
-		}
-		if !valid {
+		if !slices.Contains(runtime.ValidProfiles, flagProfile) {
 			return "", fmt.Errorf("invalid profile %q: must be one of %s", flagProfile, strings.Join(runtime.ValidProfiles, ", "))
 		}
 		return flagProfile, nil
 	}
 
+	cfg, err := config.Load()
+	if err != nil {
+		return "", err
+	}
+	if cfg.Profile != "" {
+		if !slices.Contains(runtime.ValidProfiles, cfg.Profile) {
+			return "", fmt.Errorf("invalid profile %q in the config file: must be one of %s", cfg.Profile, strings.Join(runtime.ValidProfiles, ", "))
+		}
+		return cfg.Profile, nil
+	}
 	return runtime.ProfileGeneral, nil
 }
 
+// security returns the --seccomp-profile, --apparmor, --cap-add and
+// --cap-drop options, checked against the security profile.
+func security(profile string) (runtime.Security, error) {
+	s := runtime.Security{Seccomp: flagSeccomp, AppArmor: flagAppArmor}
+	var err error
+	if s.CapAdd, err = runtime.ParseCapabilities(flagCapAdd); err != nil {
+		return runtime.Security{}, fmt.Errorf("--cap-add: %w", err)
+	}
+	if s.CapDrop, err = runtime.ParseCapabilities(flagCapDrop); err != nil {
+		return runtime.Security{}, fmt.Errorf("--cap-drop: %w", err)
+	}
+	if err := runtime.ValidateSecurity(s, profile); err != nil {
+		return runtime.Security{}, err
+	}
+	return s, nil
+}
+
+// setupEvents turns on the lifecycle events of --events.
+func setupEvents() error {
+	switch flagEvents {
+	case "":
+		if flagEventsFile != "" {
+			return fmt.Errorf("--events-file needs --events json")
+		}
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("invalid --events %q: only json is supported", flagEvents)
+	}
+	if flagEventsFile == "" {
+		events.SetOutput(os.Stderr)
+		return nil
+	}
+	f, err := os.OpenFile(flagEventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening the events file: %w", err)
+	}
+	events.SetOutput(f)
+	return nil
+}
+
+// machineOutput reports whether cmd prints for programs: an -o format other
+// than text (-o is a file for the commands without a default format), or
+// events on stderr along with the messages, which then stay plain whatever
+// the terminal.
+func machineOutput(cmd *cobra.Command) bool {
+	if f := cmd.Flags().Lookup("output"); f != nil && f.DefValue != "" && f.Value.String() != "text" {
+		return true
+	}
+	return flagEvents != "" && flagEventsFile == ""
+}
+
 func Execute() error {
-	return NewRootCmd().Execute()
+	root := NewRootCmd()
+	if path, args, ok := findPlugin(root, os.Args[1:]); ok {
+		return runPlugin(path, args)
+	}
+	err := root.Execute()
+	endSessions(err)
+	return err
+}
+
+// ExitStatus returns the exit status of a debug shell or command that
+// failed Execute, which already reported the failure, and false for other
+// errors.
+func ExitStatus(err error) (int, bool) {
+	var exitErr *runtime.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code, true
+	}
+	return 0, false
 }
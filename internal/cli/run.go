@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+// imageSchema explicitly marks a subject as an image rather than a container.
+const imageSchema = "image://"
+
+// runner runs a command without a TTY in a debug container where the
+// subject's root filesystem is at $DEBUX_TARGET_ROOT, returning its exit code.
+type runner func(ctx context.Context, command []string, stdout, stderr io.Writer) (int, error)
+
+// subjectRunner resolves the argument of a non-interactive command (scan,
+// secrets, ...) to a runner. It accepts every target format, plus images:
+// image://<ref>, oci-archive:/docker-archive: references, or a bare name that
+// isn't a running Docker container.
+func subjectRunner(ctx context.Context, cmd *cobra.Command, arg string) (runner, error) {
+	if flagHost != "" {
+		return remoteRunner(cmd, arg)
+	}
+	if ref, ok := strings.CutPrefix(arg, imageSchema); ok {
+		return imageRunner(ctx, cmd, ref)
+	}
+	if dbximage.IsArchiveRef(arg) {
+		return imageRunner(ctx, cmd, arg)
+	}
+
+	target, err := runtime.ParseTarget(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Runtime == "docker" && target.Name != "" {
+		running, err := runtime.DockerContainerRunning(ctx, target.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !running && !strings.HasPrefix(arg, "docker://") {
+			return imageRunner(ctx, cmd, arg)
+		}
+	}
+	return containerRunner(ctx, cmd, arg)
+}
+
+// containerRunner is subjectRunner for the commands that need a running
+// container or pod: no argument is taken for an image.
+func containerRunner(ctx context.Context, cmd *cobra.Command, arg string) (runner, error) {
+	if flagHost != "" {
+		return remoteRunner(cmd, arg)
+	}
+	target, err := runtime.ParseTarget(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Name == "" {
+		return nil, fmt.Errorf("missing target name in %q", arg)
+	}
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// Scans and package installs need root; --as-target-user is for shells
+	opts.AsTargetUser = false
+
+	// Ended by Execute, once the command has run what it needs
+	if _, err := startSession(ctx, containerRequest(commandName(cmd), target, opts)); err != nil {
+		return nil, err
+	}
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, command []string, stdout, stderr io.Writer) (int, error) {
+		return d.Pipe(ctx, target, opts, command, nil, stdout, stderr)
+	}, nil
+}
+
+func remoteRunner(cmd *cobra.Command, arg string) (runner, error) {
+	if strings.HasPrefix(arg, imageSchema) || dbximage.IsArchiveRef(arg) {
+		return nil, fmt.Errorf("images can't be debugged through a daemon (--host): only running containers and pods")
+	}
+	b, err := backend(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, command []string, stdout, stderr io.Writer) (int, error) {
+		return b.Exec(ctx, arg, command, stdout, stderr)
+	}, nil
+}
+
+func imageRunner(ctx context.Context, cmd *cobra.Command, ref string) (runner, error) {
+	opts, err := imageOpts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := startSession(ctx, imageRequest(commandName(cmd), ref, opts)); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, command []string, stdout, stderr io.Writer) (int, error) {
+		return runtime.DockerImageRun(ctx, ref, opts, command, stdout, stderr)
+	}, nil
+}
@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/scan"
+	"github.com/spf13/cobra"
+)
+
+func newScanCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "scan <target|image>",
+		Short: "Scan a container or image for known vulnerabilities",
+		Long: `Run a vulnerability scanner (grype or trivy) inside a debug container against
+the target's root filesystem and print the findings, most severe first.
+
+The scanner is installed into the debug container on first use and cached in
+the debux store. Works with running containers, pods and images — including
+distroless and scratch images, which ship no package manager of their own.
+
+Subjects:
+  <container> | docker://... | k8s://...   Running container or pod
+  <image> | image://<ref>                  Image (a bare name that isn't a running container)
+  oci-archive:<path> | docker-archive:<path>`,
+		Args: cobra.ExactArgs(1),
+		RunE: runScan,
+	}
+
+	cmd.Flags().String("scanner", scan.Grype, fmt.Sprintf("Vulnerability scanner (%s)", strings.Join(scan.Scanners, ", ")))
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+
+	return cmd
+}
+
+func runScan(cmd *cobra.Command, args []string) error {
+	scanner, _ := cmd.Flags().GetString("scanner")
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+	script, err := scan.Script(scanner)
+	if err != nil {
+		return err
+	}
+
+	// stdout carries the report only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	run, err := subjectRunner(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Scanning %s with %s...\n", args[0], scanner)
+	var stdout bytes.Buffer
+	code, err := run(ctx, []string{"sh", "-c", script}, &stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("%s exited with status %d", scanner, code)
+	}
+
+	report, err := scan.Parse(scanner, stdout.Bytes())
+	if err != nil {
+		return err
+	}
+	report.Target = args[0]
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return printScanReport(report)
+}
+
+func printScanReport(r *scan.Report) error {
+	if len(r.Vulnerabilities) == 0 {
+		fmt.Printf("No known vulnerabilities found in %s\n", r.Target)
+		return nil
+	}
+
+	w := render.NewTable(os.Stdout)
+	w.Mark(severityStyle)
+	_, _ = fmt.Fprintln(w, "SEVERITY\tID\tPACKAGE\tVERSION\tFIXED IN\tTYPE")
+	for _, v := range r.Vulnerabilities {
+		fixed := v.FixedIn
+		if fixed == "" {
+			fixed = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Severity, v.ID, v.Package, v.Version, fixed, v.Type)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	var counts []string
+	for _, sev := range scan.Severities(r.Counts) {
+		counts = append(counts, fmt.Sprintf("%d %s", r.Counts[sev], strings.ToLower(sev)))
+	}
+	fmt.Printf("\n%d vulnerabilities (%s)\n", len(r.Vulnerabilities), strings.Join(counts, ", "))
+	return nil
+}
+
+// severityStyle colors the severities of vulnerabilities.
+func severityStyle(severity string) render.Style {
+	switch severity {
+	case "Critical":
+		return render.Bold + ";" + render.Red
+	case "High":
+		return render.Red
+	case "Medium":
+		return render.Yellow
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/secrets"
+	"github.com/spf13/cobra"
+)
+
+func newSecretsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "secrets <target|image>",
+		Short: "Look for secrets left in a container or image",
+		Long: `Search the target's root filesystem for credentials: secret patterns in file
+contents (AWS keys, GitHub/GitLab/Slack tokens, private keys, JWTs, ...) and
+files that usually hold credentials (.env files, kubeconfigs, SSH keys, cloud
+and registry credential files).
+
+Matched values are redacted unless --redact=false is given. Files larger than
+5MB and binary files are not searched.
+
+Subjects:
+  <container> | docker://... | k8s://...   Running container or pod
+  <image> | image://<ref>                  Image (a bare name that isn't a running container)
+  oci-archive:<path> | docker-archive:<path>`,
+		Args: cobra.ExactArgs(1),
+		RunE: runSecrets,
+	}
+
+	cmd.Flags().Bool("redact", true, "Mask matched secret values in the output")
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+
+	return cmd
+}
+
+func runSecrets(cmd *cobra.Command, args []string) error {
+	redact, _ := cmd.Flags().GetBool("redact")
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+
+	// stdout carries the report only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	run, err := subjectRunner(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Searching %s for secrets...\n", args[0])
+	var stdout bytes.Buffer
+	code, err := run(ctx, []string{"sh", "-c", secrets.Script()}, &stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("secret search exited with status %d", code)
+	}
+
+	report, err := secrets.Parse(stdout.Bytes(), redact)
+	if err != nil {
+		return err
+	}
+	report.Target = args[0]
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return printSecretsReport(report)
+}
+
+func printSecretsReport(r *secrets.Report) error {
+	if len(r.Findings) == 0 {
+		fmt.Printf("No secrets found in %s\n", r.Target)
+		return nil
+	}
+
+	w := render.NewTable(os.Stdout)
+	_, _ = fmt.Fprintln(w, "RULE\tLOCATION\tMATCH")
+	for _, f := range r.Findings {
+		loc := f.Path
+		if f.Line > 0 {
+			loc = fmt.Sprintf("%s:%d", f.Path, f.Line)
+		}
+		match := f.Match
+		if match == "" {
+			match = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", f.Rule, loc, match)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	for _, f := range r.Findings {
+		files[f.Path] = true
+	}
+	fmt.Printf("\n%d finding(s) in %d file(s)\n", len(r.Findings), len(files))
+	return nil
+}
@@ -0,0 +1,157 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/api"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/webterm"
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve [k8s://[namespace/]]",
+		Short: "Serve debug shells to a browser",
+		Long: `Serve a web page listing running Docker containers, or with a k8s:// argument
+the pods of a namespace, and opening debug shells in them in the browser
+(xterm.js over a WebSocket).
+
+Every request needs the access token: debux prints the URL to open, which
+carries it. Set it with --token or DEBUX_SERVE_TOKEN, or let debux generate
+one. The server listens on localhost by default; to expose it, use
+--listen :8080 with --tls-cert and --tls-key, or put it behind a reverse
+proxy that terminates TLS. Debug options (--image, --profile, ...) apply to
+every shell. --metrics-listen and --otlp-endpoint monitor the shells as for
+debux daemon.`,
+		Example: `  debux serve
+  debux serve k8s://staging/ --listen :8080 --tls-cert cert.pem --tls-key key.pem`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			listen, _ := cmd.Flags().GetString("listen")
+			token, _ := cmd.Flags().GetString("token")
+			certFile, _ := cmd.Flags().GetString("tls-cert")
+			keyFile, _ := cmd.Flags().GetString("tls-key")
+			if (certFile == "") != (keyFile == "") {
+				return fmt.Errorf("--tls-cert and --tls-key go together")
+			}
+			if token == "" {
+				token = os.Getenv("DEBUX_SERVE_TOKEN")
+			}
+			if token == "" {
+				b := make([]byte, 24)
+				if _, err := rand.Read(b); err != nil {
+					return err
+				}
+				token = base64.RawURLEncoding.EncodeToString(b)
+			}
+
+			scope := ""
+			if len(args) == 1 {
+				scope = args[0]
+			}
+			if _, _, err := parseScope(scope); err != nil {
+				return err
+			}
+			b, err := newLocalBackend(cmd)
+			if err != nil {
+				return err
+			}
+			opts := b.opts
+
+			srv := &webterm.Server{
+				Token:   token,
+				Targets: func(ctx context.Context) ([]api.Target, error) { return b.Targets(ctx, scope) },
+				Shell: func(ctx context.Context, arg string, t runtime.Terminal) error {
+					target, d, err := parseRunningTarget(arg)
+					if err != nil {
+						return err
+					}
+					end, err := startSession(ctx, containerRequest(b.command, target, opts))
+					if err != nil {
+						return err
+					}
+					err = d.Shell(ctx, target, opts, t)
+					end(err)
+					return err
+				},
+				Log: func(msg string) {
+					fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.TimeOnly), msg)
+				},
+			}
+
+			handler, metrics, stopTelemetry, err := startTelemetry(ctx, cmd, "debux-serve", srv.Handler())
+			if err != nil {
+				return err
+			}
+			defer stopTelemetry()
+			if metrics != nil {
+				shell := srv.Shell
+				srv.Shell = func(ctx context.Context, arg string, t runtime.Terminal) error {
+					err := shell(ctx, arg, t)
+					var exit *runtime.ExitError
+					if err != nil && ctx.Err() == nil && !errors.As(err, &exit) {
+						metrics.Failure("shell", err)
+					}
+					return err
+				}
+			}
+
+			ln, err := net.Listen("tcp", listen)
+			if err != nil {
+				return fmt.Errorf("listening on %s: %w", listen, err)
+			}
+			host, port, _ := net.SplitHostPort(ln.Addr().String())
+			if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+				if name, err := os.Hostname(); err == nil {
+					host = name
+				}
+			} else if ip.IsLoopback() {
+				host = "localhost"
+			}
+			scheme := "http"
+			if certFile != "" {
+				scheme = "https"
+			}
+			fmt.Fprintf(os.Stderr, "Serving debug shells, open:\n\n  %s://%s/?token=%s\n\n", scheme, net.JoinHostPort(host, port), token)
+
+			httpSrv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = httpSrv.Shutdown(shutdownCtx)
+			}()
+			if certFile != "" {
+				err = httpSrv.ServeTLS(ln, certFile, keyFile)
+			} else {
+				err = httpSrv.Serve(ln)
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().String("listen", "localhost:8080", "Address to listen on (host:port)")
+	cmd.Flags().String("token", "", "Access token (default: $DEBUX_SERVE_TOKEN, or generated)")
+	cmd.Flags().String("tls-cert", "", "TLS certificate file, to serve over HTTPS")
+	cmd.Flags().String("tls-key", "", "TLS private key file")
+	addTelemetryFlags(cmd)
+
+	return cmd
+}
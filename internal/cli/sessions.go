@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+func newSessionsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "sessions [k8s://[namespace/]]",
+		Short: "List running debug containers and their open shells",
+		Long: `List the debug containers still running for Docker containers, or with a
+k8s:// argument for the pods of a namespace, with the number of shells open
+in each. Join one with debux attach.`,
+		Example: `  debux sessions
+  debux sessions k8s://prod/`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			scope := ""
+			if len(args) == 1 {
+				scope = args[0]
+			}
+			b, err := backend(cmd)
+			if err != nil {
+				return err
+			}
+			sessions, err := b.Sessions(ctx, scope)
+			if err != nil {
+				return err
+			}
+			if len(sessions) == 0 {
+				fmt.Println("No running debug containers.")
+				return nil
+			}
+
+			w := render.NewTable(os.Stdout)
+			_, _ = fmt.Fprintln(w, "TARGET\tDEBUG CONTAINER\tSTARTED\tSHELLS")
+			for _, s := range sessions {
+				shells := "-"
+				if s.Shells >= 0 {
+					shells = fmt.Sprint(s.Shells)
+				}
+				started := units.HumanDuration(time.Since(s.Started)) + " ago"
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Target, s.Container, started, shells)
+			}
+			return w.Flush()
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/share"
+	"github.com/moby/term"
+	"github.com/spf13/cobra"
+)
+
+// detachKey ends a debux join session with shared control (Ctrl-]), as
+// every other key goes to the shared shell.
+const detachKey = 0x1d
+
+func newShareCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "share <target>",
+		Short: "Open a debug shell that others can join",
+		Long: `Open a debug shell in a container or pod, like debux <target>, and share it
+with other terminals. debux prints a "debux join" command with a one-time
+code: whoever runs it sees the session live, and with --control can type in
+it too.
+
+Participants connect straight to this machine over TLS; the code pins its
+throwaway certificate and is only valid for --participants joins. debux
+listens on localhost unless --listen chooses another address, e.g. one
+reachable through a VPN; otherwise forward the port (ssh -R).`,
+		Example: `  debux share my-app
+  debux share k8s://prod/api-7d9f --control --listen 0.0.0.0:7681`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listen, _ := cmd.Flags().GetString("listen")
+			control, _ := cmd.Flags().GetBool("control")
+			participants, _ := cmd.Flags().GetInt("participants")
+			if participants < 1 {
+				return fmt.Errorf("--participants must be at least 1")
+			}
+
+			srv, err := share.Listen(listen, !control, participants)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = srv.Close() }()
+			srv.Notify = func(msg string) {
+				_, _ = fmt.Fprintf(os.Stderr, "\r\n[debux] %s\r\n", msg)
+			}
+
+			host, port, _ := net.SplitHostPort(srv.Addr().String())
+			if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+				if name, err := os.Hostname(); err == nil {
+					host = name
+				}
+			}
+			mode := "watch"
+			if control {
+				mode = "type in"
+			}
+			fmt.Fprintf(os.Stderr, "Sharing the session: others can %s it with\n\n  debux join %s %s\n\n",
+				mode, net.JoinHostPort(host, port), srv.Code())
+
+			runtime.SetSessionMirror(srv)
+			return debugTarget(cmd, args, false)
+		},
+	}
+
+	cmd.Flags().String("listen", "127.0.0.1:0", "Address to listen on for participants (host:port)")
+	cmd.Flags().Bool("control", false, "Let participants type in the session instead of only watching")
+	cmd.Flags().Int("participants", 1, "Number of participants the code admits")
+
+	return cmd
+}
+
+func newJoinCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "join <host:port> <code>",
+		Short: "Join a debug session shared with debux share",
+		Long: `Join a debug session shared with "debux share", using the address and code
+it printed. Quit with Ctrl-C when watching, or with Ctrl-] when you share
+control of the session.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			addr := args[0]
+			if _, err := strconv.Atoi(addr); err == nil {
+				addr = net.JoinHostPort("localhost", addr)
+			}
+			conn, control, err := share.Dial(addr, args[1])
+			if err != nil {
+				return err
+			}
+			defer func() { _ = conn.Close() }()
+			go func() {
+				<-ctx.Done()
+				_ = conn.Close()
+			}()
+
+			if control {
+				fmt.Fprintln(os.Stderr, "Joined with shared control; press Ctrl-] to leave.")
+				if fd, isTerminal := term.GetFdInfo(os.Stdin); isTerminal {
+					if state, err := term.SetRawTerminal(fd); err == nil {
+						defer func() { _ = term.RestoreTerminal(fd, state) }()
+					}
+				}
+				go func() {
+					buf := make([]byte, 4096)
+					for {
+						n, err := os.Stdin.Read(buf)
+						if i := bytes.IndexByte(buf[:n], detachKey); i >= 0 {
+							_, _ = conn.Write(buf[:i])
+							_ = conn.Close()
+							return
+						}
+						if _, werr := conn.Write(buf[:n]); werr != nil || err != nil {
+							return
+						}
+					}
+				}()
+			} else {
+				fmt.Fprintln(os.Stderr, "Watching the session; press Ctrl-C to leave.")
+			}
+
+			_, _ = io.Copy(os.Stdout, conn)
+			fmt.Fprintln(os.Stderr, "\r\nSession ended.")
+			return nil
+		},
+	}
+}
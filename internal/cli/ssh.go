@@ -0,0 +1,277 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newSSHCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh <target> [-- ssh args...]",
+		Short: "Reach a target's debug container over SSH",
+		Long: `Set up SSH access to the debug container of a container or pod (creating it
+if needed) and connect, so that scp, rsync, VS Code Remote-SSH and other SSH
+tools can use the debug environment.
+
+sshd runs inside the debug container only for the duration of each
+connection, on the connection itself: it never listens on a port. Each
+connection is tunneled through debux (ProxyCommand). Only the key debux
+generates for you is accepted, and the host key is pinned.
+
+The SSH configuration is written to a file in the debux configuration
+directory; add "Include <file>" to ~/.ssh/config to use the host alias from
+any SSH tool.`,
+		Example: `  debux ssh my-app
+  debux ssh k8s://prod/api-7d9f --setup-only
+  scp -F ~/.config/debux/ssh/config debux-my-app:/tmp/heap.hprof .`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			alias, configFile, err := setupSSH(ctx, cmd, args[0])
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "Connect with:\n\n  ssh -F %s %s\n\nor add \"Include %s\" to ~/.ssh/config and use %q as the host.\n",
+				configFile, alias, configFile, alias)
+			if setupOnly, _ := cmd.Flags().GetBool("setup-only"); setupOnly {
+				return nil
+			}
+
+			sshArgs := append([]string{"-F", configFile, alias}, args[1:]...)
+			ssh := exec.CommandContext(ctx, "ssh", sshArgs...)
+			ssh.Stdin, ssh.Stdout, ssh.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := ssh.Run(); err != nil {
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					// ssh reports its own errors: exit with its status
+					return &runtime.ExitError{Code: exitErr.ExitCode()}
+				}
+				return fmt.Errorf("running ssh: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("setup-only", false, "Only set up access and print the ssh command")
+
+	return cmd
+}
+
+// newSSHProxyCmd is the ProxyCommand of the SSH configuration: it runs sshd
+// in the debug container over its stdin and stdout.
+func newSSHProxyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:    "ssh-proxy <target>",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			// stdout is the SSH connection
+			runtime.SetStatusOutput(io.Discard)
+			pipe, err := targetPipe(ctx, cmd, args[0], true)
+			if err != nil {
+				return err
+			}
+			code, err := pipe(ctx, []string{"sh", "-c", entrypoint.SSHD}, os.Stdin, os.Stdout, os.Stderr)
+			if err != nil {
+				return err
+			}
+			if code != 0 {
+				return fmt.Errorf("sshd exited with status %d", code)
+			}
+			return nil
+		},
+	}
+}
+
+// piper runs a command with stdin in a target's debug container.
+type piper func(ctx context.Context, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+
+// targetPipe returns a piper for a running container or pod. With attach, it
+// only joins an existing debug container.
+func targetPipe(ctx context.Context, cmd *cobra.Command, arg string, attach bool) (piper, error) {
+	target, err := runtime.ParseTarget(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if target.Name == "" {
+		return nil, fmt.Errorf("missing target name in %q", arg)
+	}
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	opts.Attach = attach
+	// sshd runs as root, --as-target-user doesn't apply
+	opts.AsTargetUser = false
+	// Ended by Execute, after the SSH connection
+	if _, err := startSession(ctx, containerRequest(commandName(cmd), target, opts)); err != nil {
+		return nil, err
+	}
+
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		code, err := d.Pipe(ctx, target, opts, command, stdin, stdout, stderr)
+		// --fresh replaces the debug container once, not at every command
+		opts.Fresh = false
+		return code, err
+	}, nil
+}
+
+// copier extracts a tar archive into a directory of a target's filesystem.
+type copier func(ctx context.Context, dir string, archive io.Reader) error
+
+// targetCopier returns a copier for a running container or pod, whose debug
+// container targetPipe already started.
+func targetCopier(cmd *cobra.Command, arg string) (copier, error) {
+	target, err := runtime.ParseTarget(arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	opts, err := debugOpts(cmd)
+	if err != nil {
+		return nil, err
+	}
+	opts.AsTargetUser = false
+	opts.Fresh = false
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, dir string, archive io.Reader) error {
+		return d.Copy(ctx, target, opts, dir, archive)
+	}, nil
+}
+
+// setupSSH prepares sshd in the target's debug container and the local SSH
+// configuration, and returns the host alias and the configuration file.
+func setupSSH(ctx context.Context, cmd *cobra.Command, arg string) (alias, configFile string, err error) {
+	dir, err := sshDir()
+	if err != nil {
+		return "", "", err
+	}
+	key := filepath.Join(dir, "id_ed25519")
+	if _, err := os.Stat(key); os.IsNotExist(err) {
+		keygen := exec.CommandContext(ctx, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "debux", "-f", key)
+		keygen.Stderr = os.Stderr
+		if err := keygen.Run(); err != nil {
+			return "", "", fmt.Errorf("generating SSH key with ssh-keygen: %w", err)
+		}
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		return "", "", fmt.Errorf("reading SSH key: %w", err)
+	}
+
+	pipe, err := targetPipe(ctx, cmd, arg, false)
+	if err != nil {
+		return "", "", err
+	}
+	var hostKey, stderr bytes.Buffer
+	code, err := pipe(ctx, []string{"sh", "-c", entrypoint.SSHSetup(strings.TrimSpace(string(pub)))}, nil, &hostKey, &stderr)
+	if err != nil {
+		return "", "", err
+	}
+	if code != 0 {
+		return "", "", fmt.Errorf("setting up sshd in the debug container: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	alias = sshAlias(arg)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := replaceSSHEntry(knownHosts, alias+" ", alias+" "+strings.TrimSpace(hostKey.String())+"\n"); err != nil {
+		return "", "", err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	proxy := fmt.Sprintf("%q ssh-proxy %q", exe, arg)
+	if kubeconfig, _ := cmd.Flags().GetString("kubeconfig"); kubeconfig != "" {
+		proxy += fmt.Sprintf(" --kubeconfig %q", kubeconfig)
+	}
+	block := fmt.Sprintf(`Host %s
+  User root
+  IdentityFile "%s"
+  IdentitiesOnly yes
+  HostKeyAlias %s
+  UserKnownHostsFile "%s"
+  StrictHostKeyChecking yes
+  ProxyCommand %s
+
+`, alias, key, alias, knownHosts, proxy)
+	configFile = filepath.Join(dir, "config")
+	if err := replaceSSHEntry(configFile, "Host "+alias+"\n", block); err != nil {
+		return "", "", err
+	}
+	return alias, configFile, nil
+}
+
+// sshDir returns the directory of the debux SSH key and configuration.
+func sshDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "debux", "ssh")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+var nonAliasChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sshAlias returns the SSH host alias of a target, e.g. debux-k8s-prod-api.
+func sshAlias(arg string) string {
+	return "debux-" + strings.Trim(nonAliasChars.ReplaceAllString(arg, "-"), "-")
+}
+
+// replaceSSHEntry replaces the entry starting with prefix in an SSH file
+// (known_hosts lines, or config blocks up to the next blank line), or
+// appends it.
+func replaceSSHEntry(path, prefix, entry string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var out strings.Builder
+	skipping := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, prefix) || (strings.HasSuffix(prefix, "\n") && line == prefix):
+			skipping = strings.HasSuffix(prefix, "\n") // config blocks span lines
+			continue
+		case skipping && strings.TrimSpace(line) == "":
+			skipping = false
+			continue
+		case skipping:
+			continue
+		}
+		out.WriteString(line)
+	}
+	out.WriteString(entry)
+	return os.WriteFile(path, []byte(out.String()), 0o600)
+}
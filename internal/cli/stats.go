@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newStatsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats <target>",
+		Short: "Show the target's cgroup limits and usage",
+		Long: `Run dstats in the target's debug container: it reads the target's cgroup
+(v1 or v2) instead of the host-wide numbers free, top and /proc/meminfo show
+even in a container, and prints its memory limit and usage, CPU limit, usage
+and throttling, OOM kills, process count and pressure (v2), flagging what's
+worth a look.
+
+CPU usage and throttling are sampled over --interval. The same tool is
+available as dstats in debug shells.`,
+		Example: `  debux stats my-app
+  debux stats k8s://prod/api-7d9f --interval 5s
+  debux stats my-app -o json`,
+		Args: cobra.ExactArgs(1),
+		RunE: runStats,
+	}
+
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	cmd.Flags().Duration("interval", time.Second, "Interval to sample CPU usage and throttling over")
+
+	return cmd
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+	interval, _ := cmd.Flags().GetDuration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("invalid --interval %s: must be positive", interval)
+	}
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("stats needs a running container or pod: images have no cgroup")
+	}
+
+	// stdout carries dstats' output only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	run, err := subjectRunner(ctx, cmd, args[0])
+	if err != nil {
+		return err
+	}
+	code, err := run(ctx, []string{"dstats", "-o", output, "-i", interval.String()}, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if code == 127 {
+		return fmt.Errorf("the debug image has no dstats: update it, or set --image to a recent debux image")
+	}
+	if code != 0 {
+		return &runtime.ExitError{Code: code}
+	}
+	return nil
+}
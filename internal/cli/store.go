@@ -3,10 +3,14 @@ package cli
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/clement-tourriere/debux/internal/render"
 	"github.com/clement-tourriere/debux/internal/store"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 )
 
@@ -14,10 +18,17 @@ func newStoreCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "store",
 		Short: "Manage the persistent Nix store",
+		Long: `Manage the persistent Nix store shared by debug sessions. Subcommands act on
+the store selected with --store-name ("default" unless given).`,
 	}
 
 	cmd.AddCommand(newStoreCleanCmd())
 	cmd.AddCommand(newStoreInfoCmd())
+	cmd.AddCommand(newStoreGCCmd())
+	cmd.AddCommand(newStorePrefetchCmd())
+	cmd.AddCommand(newStoreExportCmd())
+	cmd.AddCommand(newStoreImportCmd())
+	cmd.AddCommand(newStoreListCmd())
 
 	return cmd
 }
@@ -30,7 +41,11 @@ func newStoreCleanCmd() *cobra.Command {
 			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 			defer cancel()
 
-			if err := store.Clean(ctx); err != nil {
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+			if err := store.Clean(ctx, name); err != nil {
 				return err
 			}
 			fmt.Println("Store volumes removed.")
@@ -39,6 +54,140 @@ func newStoreCleanCmd() *cobra.Command {
 	}
 }
 
+func newStoreGCCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Garbage-collect unreferenced paths from the persistent store",
+		Long: `Run Nix garbage collection against the persistent store volumes, in a
+maintenance container. Old generations of the dctl profile are dropped first
+(keeping the last --keep-last ones), so removed packages can be collected.
+
+With --max-size, only enough is collected to bring the store under that size.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keepLast, _ := cmd.Flags().GetInt("keep-last")
+			maxSize, _ := cmd.Flags().GetString("max-size")
+			force, _ := cmd.Flags().GetBool("force")
+
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			opts := store.GCOpts{DebugImage: debugImage(), KeepLast: keepLast, Force: force, Store: name}
+			if maxSize != "" {
+				n, err := units.FromHumanSize(maxSize)
+				if err != nil {
+					return fmt.Errorf("invalid --max-size %q: %w", maxSize, err)
+				}
+				opts.MaxSize = n
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			return store.GC(ctx, opts)
+		},
+	}
+
+	cmd.Flags().Int("keep-last", 5, "dctl profile generations to keep (0 keeps all)")
+	cmd.Flags().String("max-size", "", "Only collect until the store is under this size (e.g. 5GB)")
+	cmd.Flags().Bool("force", false, "Run even while debug sessions use the store")
+
+	return cmd
+}
+
+func newStorePrefetchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prefetch [pkg...]",
+		Short: "Download packages into the persistent store for offline use",
+		Long: `Populate the persistent store with packages ahead of time, on a machine with
+internet access. Later sessions install them with "dctl install" straight
+from the store, without network access.
+
+Presets: ` + strings.Join(store.PresetNames(), ", "),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			presets, _ := cmd.Flags().GetStringSlice("preset")
+
+			pkgs := append([]string(nil), args...)
+			for _, name := range presets {
+				preset, ok := store.Presets[name]
+				if !ok {
+					return fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(store.PresetNames(), ", "))
+				}
+				pkgs = append(pkgs, preset...)
+			}
+			if len(pkgs) == 0 {
+				return fmt.Errorf("no packages given (pass package names or --preset)")
+			}
+			nix, err := nixConfig()
+			if err != nil {
+				return err
+			}
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			return store.Prefetch(ctx, debugImage(), name, nix, pkgs)
+		},
+	}
+
+	cmd.Flags().StringSlice("preset", nil, "Prefetch a named package set (repeatable)")
+
+	return cmd
+}
+
+func newStoreExportCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <file>",
+		Short: "Export the persistent store to an archive",
+		Long: `Write the persistent store to a tar archive, compressed with zstd (.zst) or
+gzip (.gz) depending on the file name. Import it elsewhere with
+"debux store import" to seed other machines with a warmed store.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			return store.Export(ctx, debugImage(), name, args[0])
+		},
+	}
+}
+
+func newStoreImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import a store archive written by store export",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			replace, _ := cmd.Flags().GetBool("replace")
+
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			return store.Import(ctx, debugImage(), name, args[0], replace)
+		},
+	}
+
+	cmd.Flags().Bool("replace", false, "Replace the existing store")
+
+	return cmd
+}
+
 func newStoreInfoCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "info",
@@ -47,7 +196,47 @@ func newStoreInfoCmd() *cobra.Command {
 			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 			defer cancel()
 
-			return store.Info(ctx)
+			name, err := storeName()
+			if err != nil {
+				return err
+			}
+
+			return store.Info(ctx, debugImage(), name)
+		},
+	}
+}
+
+func newStoreListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the named stores",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			stores, err := store.List(ctx)
+			if err != nil {
+				return err
+			}
+			if len(stores) == 0 {
+				fmt.Println("No debux stores found.")
+				return nil
+			}
+
+			w := render.NewTable(os.Stdout)
+			_, _ = fmt.Fprintln(w, "NAME\tSIZE\tSESSIONS")
+			for _, s := range stores {
+				size, sessions := "-", "-"
+				if s.Size >= 0 {
+					size = units.HumanSize(float64(s.Size))
+				}
+				if s.Sessions >= 0 {
+					sessions = fmt.Sprint(s.Sessions)
+				}
+				_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, size, sessions)
+			}
+			return w.Flush()
 		},
 	}
 }
@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/config"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+func newStraceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "strace <target> [--pid N] [-- strace options...]",
+		Short: "Trace a target's process with strace or ltrace, to a local file",
+		Long: `Attach strace (or ltrace with --ltrace) from the debug container to a process
+of the target, and write the trace to a local file until Ctrl-C, --duration
+or --max-size, whichever comes first. PIDs are those of the target's PID
+namespace, which the debug container shares: 1 is the target's main process.
+Options after "--" go to strace, e.g. -e trace=network.
+
+Tracing needs the SYS_PTRACE capability. Docker sidecars have it; on
+Kubernetes, debux adds it to new ephemeral containers (the default
+seccomp profile allows ptrace), which --profile=restricted and baseline
+don't allow. Ephemeral containers can't be changed once created: when a
+reused one lacks it, use --fresh.`,
+		Example: `  debux strace my-app
+  debux strace k8s://prod/api-7d9f --pid 42 --follow --duration 30s
+  debux strace my-app --max-size 10MB -- -e trace=network -s 256`,
+		Args: straceArgs,
+		RunE: runStrace,
+	}
+
+	cmd.Flags().Int("pid", 1, "PID to trace, in the target's PID namespace")
+	cmd.Flags().Bool("follow", false, "Also trace the threads and children of the process (-f)")
+	cmd.Flags().Bool("ltrace", false, "Trace library calls with ltrace instead of system calls")
+	cmd.Flags().StringP("output", "o", "", "File to write the trace to, - for stdout (default: strace-<target>-<time>.txt)")
+	cmd.Flags().String("max-size", "100MB", "Stop tracing once the trace reaches this size")
+	cmd.Flags().Duration("duration", 0, "Stop tracing after this long (default: until Ctrl-C)")
+
+	return cmd
+}
+
+// straceArgs accepts a target, and options for strace after "--".
+func straceArgs(cmd *cobra.Command, args []string) error {
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args = args[:dash]
+	}
+	return cobra.ExactArgs(1)(cmd, args)
+}
+
+func runStrace(cmd *cobra.Command, args []string) error {
+	var extra []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		args, extra = args[:dash], args[dash:]
+	}
+	pid, _ := cmd.Flags().GetInt("pid")
+	follow, _ := cmd.Flags().GetBool("follow")
+	ltrace, _ := cmd.Flags().GetBool("ltrace")
+	output, _ := cmd.Flags().GetString("output")
+	maxSize, _ := cmd.Flags().GetString("max-size")
+	duration, _ := cmd.Flags().GetDuration("duration")
+	if pid <= 0 {
+		return fmt.Errorf("invalid --pid %d", pid)
+	}
+	limit, err := units.FromHumanSize(maxSize)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("invalid --max-size %q", maxSize)
+	}
+	if strings.HasPrefix(args[0], imageSchema) || dbximage.IsArchiveRef(args[0]) {
+		return fmt.Errorf("strace needs a running container or pod: images have no processes")
+	}
+	target, err := runtime.ParseTarget(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	tool := "strace"
+	if ltrace {
+		tool = "ltrace"
+	}
+	if err := addPtraceCapability(cmd, target, tool); err != nil {
+		return err
+	}
+
+	command := []string{tool, "-tt", "-o", "/dev/stdout", "-p", strconv.Itoa(pid)}
+	if follow {
+		command = append(command, "-f")
+	}
+	if !ltrace {
+		command = append(command, "-T")
+	}
+	command = append(command, extra...)
+
+	// stdout may carry the trace.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	pipe, err := targetPipe(ctx, cmd, args[0], false)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "-" {
+		if output == "" {
+			output = fmt.Sprintf("%s-%s-%s.txt", tool, strings.ReplaceAll(target.Name, "/", "_"), time.Now().Format("20060102-150405"))
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("creating the trace file: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+
+	if duration > 0 {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, duration)
+		defer stop()
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	trace := &limitWriter{w: out, limit: limit, full: stop}
+
+	where := output
+	if output == "-" {
+		where = "stdout"
+	}
+	fmt.Fprintf(os.Stderr, "Tracing PID %d of %s with %s to %s (at most %s); Ctrl-C to stop\n",
+		pid, args[0], tool, where, units.HumanSize(float64(limit)))
+	var stderr bytes.Buffer
+	code, err := pipe(ctx, command, nil, trace, io.MultiWriter(os.Stderr, &stderr))
+	stopped := ctx.Err() != nil
+	if err != nil && !stopped {
+		return err
+	}
+	switch {
+	case trace.n >= limit:
+		fmt.Fprintf(os.Stderr, "Stopped at --max-size %s\n", units.HumanSize(float64(limit)))
+	case code == 127:
+		return fmt.Errorf("the debug image has no %s: update it, or set --image to a recent debux image", tool)
+	case code != 0 && !stopped:
+		if strings.Contains(stderr.String(), "Operation not permitted") {
+			return fmt.Errorf("%s can't attach to PID %d: the debug container lacks SYS_PTRACE or runs as another user; on Kubernetes, create a new one with --fresh", tool, pid)
+		}
+		return fmt.Errorf("%s exited with status %d", tool, code)
+	}
+	if output != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %s of trace to %s\n", units.HumanSize(float64(trace.n)), output)
+	}
+	return nil
+}
+
+// addPtraceCapability adds SYS_PTRACE to the --cap-add of new debug
+// containers of the target, when its runtime doesn't give it from their
+// profile (Kubernetes), for the command what.
+func addPtraceCapability(cmd *cobra.Command, target *runtime.Target, what string) error {
+	d, err := runtime.DriverFor(target.Runtime)
+	if err != nil {
+		return err
+	}
+	if p, ok := d.(runtime.Ptracer); !ok || !p.PtraceNeedsCapability() || flagHost != "" {
+		return nil
+	}
+	profile, err := resolveProfile(cmd)
+	if err != nil {
+		return err
+	}
+	switch profile {
+	case runtime.ProfileSysadmin:
+		return nil
+	case runtime.ProfileRestricted, runtime.ProfileBaseline:
+		return fmt.Errorf("%s needs the SYS_PTRACE capability, which --profile=%s doesn't allow: use --profile=general or sysadmin", what, profile)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if flagOperator || (!cmd.Flags().Changed("operator") && cfg.Exec.Operator) {
+		return nil // the operator decides the capabilities of its debug containers
+	}
+	flagCapAdd = append(flagCapAdd, "SYS_PTRACE")
+	return nil
+}
+
+// limitWriter writes up to limit bytes to w, then calls full and drops the
+// rest.
+type limitWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+	full  func()
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n >= l.limit {
+		return len(p), nil
+	}
+	size := len(p)
+	if rest := l.limit - l.n; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	if l.n >= l.limit {
+		l.full()
+	}
+	if err != nil {
+		return n, err
+	}
+	return size, nil
+}
@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/clement-tourriere/debux/internal/picker"
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+func newSvcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "svc [namespace/]<service>",
+		Short: "Show the pods behind a Kubernetes Service, and debug one",
+		Long: `Show a Service's endpoints (from its EndpointSlices) and the pods its
+selector matches, with the readiness of each pod and why it isn't ready,
+and flag common problems: a selector matching no pods, no ready endpoints,
+or a named targetPort the pods don't declare.
+
+With --debug, pick a backend pod from the listing and open a debug shell in
+it, as debux exec k8s://<namespace>/<pod> would, with the same flags.
+
+Exits with status 1 when the service has problems (without --debug).`,
+		Example: `  debux svc prod/payments
+  debux svc payments -o json
+  debux svc prod/payments --debug --profile netadmin`,
+		Args: cobra.ExactArgs(1),
+		RunE: runSvc,
+	}
+
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+	cmd.Flags().Bool("debug", false, "Pick a backend pod and open a debug shell in it")
+
+	return cmd
+}
+
+func runSvc(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+	debug, _ := cmd.Flags().GetBool("debug")
+	if debug && output == "json" {
+		return fmt.Errorf("--debug opens a shell: it can't be used with -o json")
+	}
+	if flagHost != "" {
+		return fmt.Errorf("svc queries the Kubernetes API directly: it doesn't run through --host")
+	}
+	target, err := runtime.ParseTarget("k8s://" + strings.TrimPrefix(args[0], "k8s://"))
+	if err != nil || target.Name == "" || target.Container != "" {
+		return fmt.Errorf("invalid service %q: expected [namespace/]<service>", args[0])
+	}
+	kubeconfig, _ := cmd.Flags().GetString("kubeconfig")
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	svc, err := runtime.KubeService(ctx, kubeconfig, target.Namespace, target.Name)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(svc); err != nil {
+			return err
+		}
+	} else if err := printService(svc); err != nil {
+		return err
+	}
+
+	if !debug {
+		if len(svc.Problems) > 0 {
+			return fmt.Errorf("service %s/%s has %d problem(s)", svc.Namespace, svc.Name, len(svc.Problems))
+		}
+		return nil
+	}
+
+	var items []picker.Item
+	for _, b := range svc.Backends {
+		if b.Pod == "" || b.Phase != "Running" {
+			continue // no containers to debug
+		}
+		label := fmt.Sprintf("%s  %s  %s", b.Pod, b.Endpoint, b.IP)
+		if b.Reason != "" {
+			label += "  (" + b.Reason + ")"
+		}
+		items = append(items, picker.Item{Label: label, Value: b.Pod})
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("service %s/%s has no running pod to debug", svc.Namespace, svc.Name)
+	}
+	pod, err := picker.Pick("Select a backend pod", items)
+	if err != nil {
+		return err
+	}
+	return debugTarget(cmd, []string{"k8s://" + svc.Namespace + "/" + pod}, false)
+}
+
+func printService(s *runtime.Service) error {
+	fmt.Printf("Service %s/%s (%s", s.Namespace, s.Name, s.Type)
+	if s.ClusterIP != "" {
+		fmt.Printf(", %s", s.ClusterIP)
+	}
+	fmt.Println(")")
+	if len(s.Ports) > 0 {
+		fmt.Printf("  ports     %s\n", strings.Join(s.Ports, ", "))
+	}
+	if len(s.Selector) > 0 {
+		var selector []string
+		for k, v := range s.Selector {
+			selector = append(selector, k+"="+v)
+		}
+		sort.Strings(selector)
+		fmt.Printf("  selector  %s\n", strings.Join(selector, ","))
+	}
+	fmt.Println()
+
+	if len(s.Backends) > 0 {
+		w := render.NewTable(os.Stdout)
+		_, _ = fmt.Fprintln(w, "POD\tIP\tNODE\tENDPOINT\tREADY\tRESTARTS\tREASON")
+		for _, b := range s.Backends {
+			pod, ready := b.Pod, "no"
+			switch {
+			case pod == "":
+				pod, ready = "-", "-"
+			case b.Ready:
+				ready = "yes"
+			}
+			if b.Phase != "" && b.Phase != "Running" {
+				ready += " (" + b.Phase + ")"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", pod, b.IP, b.Node, b.Endpoint, ready, b.Restarts, b.Reason)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("No endpoints.")
+	}
+
+	if len(s.Problems) > 0 {
+		fmt.Println("\nProblems:")
+		for _, p := range s.Problems {
+			fmt.Printf("  ⚠ %s\n", p)
+		}
+	}
+	return nil
+}
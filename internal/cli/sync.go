@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/filesync"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/spf13/cobra"
+)
+
+// syncTargetRoot is where the debug container sees the target's filesystem.
+const syncTargetRoot = `${DEBUX_TARGET_ROOT:-/proc/1/root}`
+
+func newSyncCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sync <local-dir> <target>:<path>",
+		Short: "Push a local directory to a target as its files change",
+		Long: `Copy a local directory to a path of the target's filesystem, then watch it
+and push the files that change, until Ctrl-C. Handy to swap instrumented
+scripts or configuration into a running container while editing them
+locally. Files go through tar in the debug container, with their local mode
+and modification time; they belong to the owner of the target's directory,
+or --chown.
+
+With --delete, files deleted locally are deleted in the target too; files
+that only the target has are left alone. --debug-container syncs to the
+debug container's own filesystem instead, e.g. for tools to run from there.`,
+		Example: `  debux sync ./scripts my-app:/app/scripts
+  debux sync ./src k8s://prod/api-7d9f:/app/src --delete --exclude '*.pyc'
+  debux sync ./tools my-app:/tmp/tools --debug-container --once`,
+		Args: cobra.ExactArgs(2),
+		RunE: runSync,
+	}
+
+	cmd.Flags().Bool("once", false, "Copy the directory and exit, without watching it")
+	cmd.Flags().Bool("delete", false, "Delete in the target the files deleted locally")
+	cmd.Flags().StringSlice("exclude", []string{".git", ".DS_Store", "*.swp", "*~"}, "Names or relative paths not to sync (glob patterns)")
+	cmd.Flags().Duration("interval", 500*time.Millisecond, "How often to look for changes")
+	cmd.Flags().String("chown", "", "Owner of the synced files in the target, as uid[:gid] (default: the owner of the target's directory)")
+	cmd.Flags().Bool("debug-container", false, "Sync to the debug container's filesystem instead of the target's")
+
+	return cmd
+}
+
+func runSync(cmd *cobra.Command, args []string) error {
+	once, _ := cmd.Flags().GetBool("once")
+	del, _ := cmd.Flags().GetBool("delete")
+	exclude, _ := cmd.Flags().GetStringSlice("exclude")
+	interval, _ := cmd.Flags().GetDuration("interval")
+	chown, _ := cmd.Flags().GetString("chown")
+	toDebug, _ := cmd.Flags().GetBool("debug-container")
+	if interval <= 0 {
+		return fmt.Errorf("invalid --interval %s", interval)
+	}
+	local := args[0]
+	if info, err := os.Stat(local); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", local)
+	}
+	arg, dir, err := splitTargetPath(args[1])
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(arg, imageSchema) || dbximage.IsArchiveRef(arg) {
+		return fmt.Errorf("sync needs a running container or pod: images can't be written to")
+	}
+	if flagHost != "" {
+		return fmt.Errorf("sync doesn't support --host: run debux sync on the host itself")
+	}
+	root := syncTargetRoot
+	if toDebug {
+		root = ""
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	pipe, err := targetPipe(ctx, cmd, arg, false)
+	if err != nil {
+		return err
+	}
+	copyTo, err := targetCopier(cmd, arg)
+	if err != nil {
+		return err
+	}
+
+	// The directory, and its owner for the files
+	var out, stderr bytes.Buffer
+	script := `d="` + root + `$1"; mkdir -p "$d" && stat -c '%u %g' "$d"`
+	code, err := pipe(ctx, []string{"sh", "-c", script, "sync", dir}, nil, &out, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("creating %s: %s", dir, strings.TrimSpace(stderr.String()))
+	}
+	if chown != "" {
+		out.Reset()
+		out.WriteString(strings.Replace(chown, ":", " ", 1))
+	}
+	uid, gid, err := parseOwner(out.String())
+	if err != nil {
+		return fmt.Errorf("invalid --chown %q: must be uid[:gid]", chown)
+	}
+
+	push := func(paths []string) error {
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(filesync.WriteTar(pw, local, paths, uid, gid)) }()
+		defer func() { _ = pr.Close() }()
+		if !toDebug {
+			return copyTo(ctx, dir, pr)
+		}
+		stderr.Reset()
+		script := `cd "$1" && exec tar -x --same-owner -p -f -`
+		code, err := pipe(ctx, []string{"sh", "-c", script, "sync", dir}, pr, io.Discard, &stderr)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("writing to %s: %s", dir, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+	remove := func(paths []string) error {
+		stderr.Reset()
+		script := `cd "` + root + `$1" && shift && rm -rf -- "$@"`
+		code, err := pipe(ctx, append([]string{"sh", "-c", script, "sync", dir}, paths...), nil, io.Discard, &stderr)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("deleting in %s: %s", dir, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	prev, err := filesync.Scan(local, exclude)
+	if err != nil {
+		return err
+	}
+	all, _ := filesync.Changes(nil, prev)
+	if err := push(all); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Synced %d files to %s:%s\n", len(all), arg, dir)
+	if once {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Watching %s for changes; Ctrl-C to stop\n", local)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		next, err := filesync.Scan(local, exclude)
+		if err != nil {
+			return err
+		}
+		changed, removed := filesync.Changes(prev, next)
+		prev = next
+		if !del {
+			removed = nil
+		}
+		if len(changed) == 0 && len(removed) == 0 {
+			continue
+		}
+		// Failures don't stop the watch: the next save retries
+		stamp := time.Now().Format("15:04:05")
+		if len(changed) > 0 {
+			if err := push(changed); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "%s  error: %v\n", stamp, err)
+			} else {
+				for _, p := range changed {
+					if !next[p].Mode.IsDir() {
+						fmt.Fprintf(os.Stderr, "%s  %s\n", stamp, p)
+					}
+				}
+			}
+		}
+		if len(removed) > 0 {
+			if err := remove(removed); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr, "%s  error: %v\n", stamp, err)
+			} else {
+				for _, p := range removed {
+					fmt.Fprintf(os.Stderr, "%s  %s (deleted)\n", stamp, p)
+				}
+			}
+		}
+	}
+}
+
+// parseOwner parses "<uid> [gid]"; the gid defaults to the uid.
+func parseOwner(s string) (uid, gid int, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("invalid owner %q", s)
+	}
+	if uid, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, 0, err
+	}
+	gid = uid
+	if len(fields) == 2 {
+		if gid, err = strconv.Atoi(fields[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
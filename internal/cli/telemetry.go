@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/telemetry"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// addTelemetryFlags adds the monitoring flags of the long-lived commands.
+func addTelemetryFlags(cmd *cobra.Command) {
+	cmd.Flags().String("metrics-listen", "", "Serve Prometheus metrics on this address (host:port), at /metrics")
+	cmd.Flags().String("otlp-endpoint", "", "Export OpenTelemetry traces of session setup to this OTLP/HTTP endpoint, e.g. http://otel-collector:4318 (default: $OTEL_EXPORTER_OTLP_ENDPOINT)")
+}
+
+// startTelemetry starts the metrics server and the trace exporter of
+// --metrics-listen and --otlp-endpoint, until ctx is done, and returns the
+// handler instrumenting h, the metrics (nil without --metrics-listen) and
+// the function flushing traces on exit.
+func startTelemetry(ctx context.Context, cmd *cobra.Command, service string, h http.Handler) (http.Handler, *telemetry.Metrics, func(), error) {
+	listen, _ := cmd.Flags().GetString("metrics-listen")
+	endpoint, _ := cmd.Flags().GetString("otlp-endpoint")
+
+	shutdown, err := telemetry.StartTracing(ctx, endpoint, service)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdown(ctx)
+	}
+	// Spans are named after the route of their request once it's served
+	traced := func(h http.Handler) http.Handler {
+		named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			if r.Pattern != "" {
+				trace.SpanFromContext(r.Context()).SetName(r.Pattern)
+			}
+		})
+		return otelhttp.NewHandler(named, service)
+	}
+	if listen == "" {
+		return traced(h), nil, stop, nil
+	}
+
+	metrics := telemetry.NewMetrics()
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		stop()
+		return nil, nil, nil, fmt.Errorf("listening on %s: %w", listen, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "Metrics server: %v\n", err)
+		}
+	}()
+	fmt.Fprintf(os.Stderr, "Serving metrics on http://%s/metrics\n", ln.Addr())
+	return traced(metrics.Instrument(h)), metrics, stop, nil
+}
@@ -0,0 +1,181 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/tlscheck"
+	"github.com/spf13/cobra"
+)
+
+func newTLSCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tls <target> <host[:port]>",
+		Short: "Inspect a TLS endpoint as the target sees it",
+		Long: `Connect to a TLS endpoint from the target's network namespace and print the
+certificate chain, protocol, SNI behavior and expiry, and whether the chain
+verifies against the target's CA bundle ($SSL_CERT_FILE or the usual
+distribution paths under its root filesystem) and against the local one,
+since trust often differs between a laptop and a pod.
+
+Connections are relayed by ncat in the debug container (created if needed);
+the handshake itself runs locally. The port defaults to 443.
+
+Exits with status 1 when the chain doesn't verify against the target's CA
+bundle or the hostname doesn't match.`,
+		Example: `  debux tls k8s://prod/api-7d9f payments.internal:8443
+  debux tls my-app api.example.com --servername example.com -o json`,
+		Args: cobra.ExactArgs(2),
+		RunE: runTLS,
+	}
+
+	cmd.Flags().String("servername", "", "Server name to send as SNI and verify (default: the host)")
+	cmd.Flags().StringP("output", "o", "text", "Output format (text, json)")
+
+	return cmd
+}
+
+func runTLS(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("invalid output format %q: must be text or json", output)
+	}
+	host, port, err := net.SplitHostPort(args[1])
+	if err != nil {
+		host, port = strings.Trim(args[1], "[]"), "443"
+	}
+	serverName, _ := cmd.Flags().GetString("servername")
+	if serverName == "" {
+		serverName = host
+	}
+	address := net.JoinHostPort(host, port)
+
+	// stdout carries the report only.
+	runtime.SetStatusOutput(os.Stderr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	pipe, err := targetPipe(ctx, cmd, args[0], false)
+	if err != nil {
+		return err
+	}
+
+	// Reach the server first, for a clear error when the target can't
+	var stderr bytes.Buffer
+	code, err := pipe(ctx, []string{"ncat", "-z", "-w", "5", host, port}, nil, &bytes.Buffer{}, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("%s can't connect to %s: %s", args[0], address, strings.TrimSpace(stderr.String()))
+	}
+
+	var bundle bytes.Buffer
+	stderr.Reset()
+	if code, err = pipe(ctx, []string{"sh", "-c", tlscheck.BundleScript()}, nil, &bundle, &stderr); err != nil {
+		return err
+	}
+	var roots *x509.CertPool
+	var bundlePath string
+	if code == 0 {
+		path, pem, _ := bytes.Cut(bundle.Bytes(), []byte("\n"))
+		bundlePath = string(path)
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			render.Warnf(os.Stderr, "no certificate in the target's CA bundle %s", bundlePath)
+		}
+	}
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go func() {
+			_, _ = pipe(ctx, []string{"ncat", host, port}, remote, remote, &bytes.Buffer{})
+			_ = remote.Close()
+		}()
+		return local, nil
+	}
+	report, err := tlscheck.Inspect(ctx, dial, address, serverName, roots, bundlePath)
+	if err != nil {
+		return err
+	}
+	report.Target = args[0]
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else if err := printTLSReport(report); err != nil {
+		return err
+	}
+	if !report.HostnameMatch || !report.Verifications[0].OK {
+		return fmt.Errorf("%s doesn't trust %s", args[0], address)
+	}
+	return nil
+}
+
+func printTLSReport(r *tlscheck.Report) error {
+	fmt.Printf("%s from %s: %s, %s", r.Address, r.Target, r.Version, r.CipherSuite)
+	if r.ALPN != "" {
+		fmt.Printf(", ALPN %s", r.ALPN)
+	}
+	fmt.Print("\n\nChain:\n")
+	for i, c := range r.Chain {
+		fmt.Printf("  %d  %s\n", i, c.Subject)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		_, _ = fmt.Fprintf(w, "     issuer\t%s\n", c.Issuer)
+		if names := append(append([]string{}, c.DNSNames...), c.IPs...); len(names) > 0 {
+			_, _ = fmt.Fprintf(w, "     names\t%s\n", strings.Join(names, ", "))
+		}
+		expiry := fmt.Sprintf("%s (%d days left)", c.NotAfter.Format("2006-01-02"), c.DaysLeft)
+		switch {
+		case c.DaysLeft < 0:
+			expiry = fmt.Sprintf("%s (EXPIRED %d days ago)", c.NotAfter.Format("2006-01-02"), -c.DaysLeft)
+		case c.DaysLeft < 14:
+			expiry += " EXPIRES SOON"
+		}
+		_, _ = fmt.Fprintf(w, "     expires\t%s\n", expiry)
+		kind := c.Key
+		if c.IsCA {
+			kind += ", CA"
+		}
+		if c.SelfSigned {
+			kind += ", self-signed"
+		}
+		_, _ = fmt.Fprintf(w, "     key\t%s\n", kind)
+		_, _ = fmt.Fprintf(w, "     sha256\t%s\n", c.SHA256)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	hostname := "OK"
+	if !r.HostnameMatch {
+		hostname = "FAIL  " + r.HostnameError
+	}
+	_, _ = fmt.Fprintf(w, "Hostname %s\t%s\n", r.SNI.ServerName, hostname)
+	_, _ = fmt.Fprintf(w, "Without SNI\t%s\n", r.SNI.WithoutSNI)
+	for _, v := range r.Verifications {
+		result := "OK"
+		if !v.OK {
+			result = "FAIL  " + v.Error
+		}
+		_, _ = fmt.Fprintf(w, "Trusted by %s\t%s\n", v.Store, result)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/clement-tourriere/debux/internal/config"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+)
+
+// noDebugImage are the commands that never start a debug container, whose
+// image needs no verification.
+var noDebugImage = []string{"sessions", "cleanup", "approve", "history", "reconnect", "join", "search", "plugin list", "store", "completion", "help", "__complete"}
+
+// verifyDebugImage verifies the signature of the debug image with
+// --verify-signature (or the config file), and pins --image to the verified
+// digest. Through --host, the daemon verifies its own.
+func verifyDebugImage(ctx context.Context, cmd *cobra.Command) error {
+	if flagHost != "" {
+		return nil
+	}
+	command := commandName(cmd)
+	for _, c := range noDebugImage {
+		if command == c || strings.HasPrefix(command, c+" ") {
+			return nil
+		}
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	verify := cfg.Verify.Always
+	if cmd.Flags().Changed("verify-signature") {
+		verify = flagVerifySignature
+	}
+	if !verify {
+		return nil
+	}
+
+	ref := debugImage()
+	signer := dbximage.Signer{Key: cfg.Verify.Key, Identity: cfg.Verify.Identity, Issuer: cfg.Verify.Issuer}
+	if signer == (dbximage.Signer{}) {
+		if !releasedImage(ref) {
+			return fmt.Errorf("can't verify %s: set verify.key, or verify.identity and verify.issuer, in the config file", ref)
+		}
+		signer = dbximage.DefaultSigner
+	}
+	pinned, err := dbximage.Verify(ctx, ref, signer)
+	if err != nil {
+		return err
+	}
+	flagImage = pinned
+	return nil
+}
+
+// releasedImage reports whether ref is one of the debug images released with
+// debux, which DefaultSigner signs.
+func releasedImage(ref string) bool {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return false
+	}
+	def, _ := name.ParseReference(runtime.DefaultImage)
+	return parsed.Context().Name() == def.Context().Name()
+}
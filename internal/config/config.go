@@ -0,0 +1,251 @@
+// Package config loads the optional debux configuration file.
+//
+// The file lives at $DEBUX_CONFIG, or config.yaml in the debux directory under
+// the user configuration directory (~/.config/debux/config.yaml on Linux):
+//
+//	offline: true
+//	profile: baseline
+//	nix:
+//	  substituters:
+//	    - https://nix-cache.corp.example.com
+//	  trusted-public-keys:
+//	    - nix-cache.corp.example.com-1:AAAA...
+//	  replace-default-substituters: true
+//	  flake: github:acme/debug-env#incident
+//	  nixpkgs: nixos-24.11
+//	resources:
+//	  cpus: 1
+//	  memory: 512m
+//	exec:
+//	  as-target-user: true
+//	  per-user: true
+//	  redact-env: ["SENTRY_*"]
+//	  idle-timeout: 30m
+//	  max-duration: 4h
+//	  picker-cache: 30s
+//	hooks:
+//	  pre-session:
+//	    - notify-oncall "debux session on $DEBUX_TARGET by $DEBUX_CREATOR"
+//	  post-session:
+//	    - notify-oncall "debux session on $DEBUX_TARGET ended"
+//	  container:
+//	    - dctl install jq
+//	verify:
+//	  always: true
+//	  key: /etc/debux/cosign.pub
+//	audit:
+//	  file: /var/log/debux/audit.jsonl
+//	  webhook: https://siem.corp.example.com/debux
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the debux configuration file.
+type Config struct {
+	// Offline keeps debux off the network, as with --offline.
+	Offline bool `json:"offline,omitempty"`
+	// Profile is the security profile of debug containers, as with
+	// --profile.
+	Profile   string    `json:"profile,omitempty"`
+	Nix       Nix       `json:"nix"`
+	Resources Resources `json:"resources"`
+	Exec      Exec      `json:"exec"`
+	Hooks     Hooks     `json:"hooks"`
+	Verify    Verify    `json:"verify"`
+	Audit     Audit     `json:"audit"`
+}
+
+// Audit configures the audit log of debug sessions: a record when each
+// starts and ends, with who ran it, on what and with which flags.
+type Audit struct {
+	// File is a log the records are appended to, one JSON object per line.
+	File string `json:"file,omitempty"`
+	// Syslog also sends the records to the local syslog daemon.
+	Syslog bool `json:"syslog,omitempty"`
+	// Webhook is a URL each record is POSTed to as JSON, e.g. a SIEM
+	// collector, with Headers such as an authorization token.
+	Webhook string            `json:"webhook,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Required refuses to start sessions whose start can't be recorded.
+	Required bool `json:"required,omitempty"`
+}
+
+// Verify configures the cosign signature verification of debug images.
+type Verify struct {
+	// Always verifies the debug image before every session, as with
+	// --verify-signature.
+	Always bool `json:"always,omitempty"`
+	// Key is the cosign public key debug images are signed with: a file or
+	// a KMS URI.
+	Key string `json:"key,omitempty"`
+	// Identity is a regular expression matching the certificate identity
+	// of keyless signatures, and Issuer their OIDC issuer. Without a key or
+	// an identity, only the released debux images can be verified.
+	Identity string `json:"identity,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`
+}
+
+// Hooks are shell commands run around debug sessions.
+type Hooks struct {
+	// PreSession runs on the host before a debug shell starts. A failing
+	// command cancels the session.
+	PreSession []string `json:"pre-session,omitempty"`
+	// PostSession runs on the host after a debug shell ends.
+	PostSession []string `json:"post-session,omitempty"`
+	// Container runs in new debug containers, once they are set up and
+	// before any shell starts, e.g. to install company-standard tools.
+	Container []string `json:"container,omitempty"`
+}
+
+// Exec are the defaults of debug shells in running containers.
+type Exec struct {
+	// AsTargetUser starts the shell as the user the target runs as rather
+	// than root.
+	AsTargetUser bool `json:"as-target-user,omitempty"`
+	// PerUser gives each local user their own debug container in shared
+	// pods, as with --per-user.
+	PerUser bool `json:"per-user,omitempty"`
+	// RedactEnv are globs of target variables the shell doesn't import,
+	// besides the built-in ones (*TOKEN*, *SECRET*, *PASSWORD*...).
+	RedactEnv []string `json:"redact-env,omitempty"`
+	// KeepEnv are globs of target variables the shell imports even though
+	// they look like secrets.
+	KeepEnv []string `json:"keep-env,omitempty"`
+	// Operator has the debux operator start the debug containers of pods,
+	// as with --operator.
+	Operator bool `json:"operator,omitempty"`
+	// IdleTimeout closes interactive shells without input for this long,
+	// e.g. "30m", as with --idle-timeout.
+	IdleTimeout string `json:"idle-timeout,omitempty"`
+	// MaxDuration closes interactive shells after this long, e.g. "4h", as
+	// with --max-duration.
+	MaxDuration string `json:"max-duration,omitempty"`
+	// PickerCache reuses the pods the Kubernetes picker listed this long
+	// ago at most, e.g. "30s", rather than listing them again.
+	PickerCache string `json:"picker-cache,omitempty"`
+}
+
+// Resources are the default limits of Docker debug sidecars, so that tools
+// run from the debug shell can't starve the workload sharing the host.
+type Resources struct {
+	// CPUs is the number of CPUs, e.g. 0.5.
+	CPUs float64 `json:"cpus,omitempty"`
+	// Memory is a size such as "512m" or "2g".
+	Memory string `json:"memory,omitempty"`
+}
+
+// Nix configures how debug containers fetch packages.
+type Nix struct {
+	// Substituters are extra binary caches, e.g. a corporate cache.
+	Substituters []string `json:"substituters,omitempty"`
+	// TrustedPublicKeys are the signing keys of those caches.
+	TrustedPublicKeys []string `json:"trusted-public-keys,omitempty"`
+	// ReplaceDefault drops cache.nixos.org, for networks that block it.
+	ReplaceDefault bool `json:"replace-default-substituters,omitempty"`
+	// Flake is a flake whose devShell provides the tools of every session,
+	// e.g. "github:acme/debug-env#incident" or a local path.
+	Flake string `json:"flake,omitempty"`
+	// Nixpkgs pins the nixpkgs that dctl installs from: a commit, a branch
+	// such as "nixos-24.11", or a full flake reference.
+	Nixpkgs string `json:"nixpkgs,omitempty"`
+	// Offline restricts dctl to the prefetched packages (--offline).
+	Offline bool `json:"-"`
+}
+
+// Path returns the configuration file location.
+func Path() (string, error) {
+	if p := os.Getenv("DEBUX_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "debux", "config.yaml"), nil
+}
+
+// Load reads the configuration file. A missing file yields an empty config.
+func Load() (*Config, error) {
+	path, err := Path()
+	if err != nil {
+		return &Config{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Env returns the environment variables through which the debug container
+// entrypoint applies the Nix settings to nix.conf.
+func (n Nix) Env() []string {
+	var env []string
+	if len(n.Substituters) > 0 {
+		env = append(env, "DEBUX_NIX_SUBSTITUTERS="+strings.Join(n.Substituters, " "))
+		if n.ReplaceDefault {
+			env = append(env, "DEBUX_NIX_REPLACE_SUBSTITUTERS=1")
+		}
+	}
+	if len(n.TrustedPublicKeys) > 0 {
+		env = append(env, "DEBUX_NIX_TRUSTED_PUBLIC_KEYS="+strings.Join(n.TrustedPublicKeys, " "))
+	}
+	if n.Flake != "" {
+		env = append(env, "DEBUX_FLAKE="+n.Flake)
+	}
+	if n.Nixpkgs != "" {
+		env = append(env, "DEBUX_NIXPKGS="+n.NixpkgsRef())
+	}
+	if n.Offline {
+		env = append(env, "DEBUX_OFFLINE=1")
+	}
+	return env
+}
+
+// NixpkgsRef returns the flake reference of the pinned nixpkgs. Commits and
+// branch names refer to the NixOS/nixpkgs repository on GitHub.
+func (n Nix) NixpkgsRef() string {
+	if n.Nixpkgs == "" || strings.Contains(n.Nixpkgs, ":") {
+		return n.Nixpkgs
+	}
+	return "github:NixOS/nixpkgs/" + n.Nixpkgs
+}
+
+// LocalFlake splits a flake reference pointing at a local directory
+// ("./env#shell", "/abs/path", "path:/abs/path#shell") into the absolute
+// directory and the "#attr" suffix. ok is false for remote references.
+func LocalFlake(ref string) (dir, attr string, ok bool, err error) {
+	p, rest, _ := strings.Cut(strings.TrimPrefix(ref, "path:"), "#")
+	if !strings.HasPrefix(ref, "path:") && !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, ".") && !strings.HasPrefix(p, "~") {
+		return "", "", false, nil
+	}
+	if rest != "" {
+		attr = "#" + rest
+	}
+	if home, herr := os.UserHomeDir(); herr == nil && (p == "~" || strings.HasPrefix(p, "~/")) {
+		p = filepath.Join(home, p[1:])
+	}
+	dir, err = filepath.Abs(p)
+	if err != nil {
+		return "", "", true, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "flake.nix")); err != nil {
+		return "", "", true, fmt.Errorf("flake %s: no flake.nix in %s", ref, dir)
+	}
+	return dir, attr, true, nil
+}
@@ -0,0 +1,50 @@
+package entrypoint
+
+// Bundle collects diagnostics about the target from its debug container and
+// writes them to stdout as a gzipped tar (debux bundle). It leaves the
+// target's environment out: it often holds secrets.
+const Bundle = `set -u
+d=$(mktemp -d /tmp/debux-bundle.XXXXXX)
+trap 'rm -rf "$d"' EXIT
+run() { f=$1; shift; "$@" > "$d/$f" 2>&1 || true; }
+` + diagnostics + `tar czf - -C "$d" .
+`
+
+// Diagnostics writes the diagnostics of Bundle to stdout as text, one
+// section per file of the bundle.
+const Diagnostics = `set -u
+run() { printf '==> %s <==\n' "$1"; shift; "$@" 2>&1 || true; echo; }
+` + diagnostics
+
+// diagnostics runs the commands of Bundle and Diagnostics with run <file>
+// <command...>.
+const diagnostics = `run date.txt date -u
+run uname.txt uname -a
+run ps.txt ps auxww
+run cmdline.txt sh -c 'tr "\0" " " < /proc/1/cmdline; echo'
+run status.txt cat /proc/1/status
+run limits.txt cat /proc/1/limits
+run cgroup.txt cat /proc/1/cgroup
+run mountinfo.txt cat /proc/1/mountinfo
+run fds.txt ls -l /proc/1/fd
+run meminfo.txt cat /proc/meminfo
+run df.txt df -h
+run ip-addr.txt ip addr
+run ip-route.txt ip route
+run sockets.txt ss -tanup
+run resolv.conf cat /proc/1/root/etc/resolv.conf
+run hosts cat /proc/1/root/etc/hosts
+`
+
+// StopDaemon stops a debug container kept running between sessions (see
+// DEBUX_DAEMON in Script) from a session inside it: its main process is the
+// one running "tail -f /dev/null" in the container's own mount namespace.
+const StopDaemon = `self=$(readlink /proc/self/ns/mnt)
+for p in /proc/[0-9]*; do
+  [ "$(readlink "$p/ns/mnt" 2>/dev/null)" = "$self" ] || continue
+  [ "$(tr '\0' ' ' < "$p/cmdline" 2>/dev/null)" = "tail -f /dev/null " ] || continue
+  kill "${p#/proc/}" && exit 0
+done
+echo "debug container main process not found" >&2
+exit 1
+`
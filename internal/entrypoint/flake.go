@@ -0,0 +1,30 @@
+package entrypoint
+
+// FlakeZshrc is the zshrc part activating the --flake devShell: the first
+// shell builds it and saves its environment, later shells (and shells started
+// while it builds) reuse it. Only exported upper-case variables are kept,
+// minus the ones describing the build sandbox or the session.
+const FlakeZshrc = `# Activate the --flake tool environment (built once per container)
+if [[ -n "${DEBUX_FLAKE:-}" ]]; then
+  _debux_flake_env=/tmp/debux-flake.env
+  if [[ ! -f $_debux_flake_env ]]; then
+    if mkdir /tmp/.debux-flake-lock 2>/dev/null; then
+      [[ -n "${DEBUX_QUIET:-}" ]] || echo "Activating $DEBUX_FLAKE..." >&2
+      if nix develop ${DEBUX_OFFLINE:+--offline} "$DEBUX_FLAKE" --command bash -c 'export -p' > $_debux_flake_env.tmp; then
+        awk -v skip=" HOME PWD OLDPWD SHLVL TERM SHELL USER LOGNAME HOSTNAME TMP TMPDIR TEMP TEMPDIR NIX_BUILD_TOP NIX_LOG_FD PS1 _ " '
+          /^declare -x / { n = $3; sub(/=.*/, "", n); keep = n ~ /^[A-Z_][A-Z0-9_]*$/ && index(skip, " " n " ") == 0 }
+          keep' $_debux_flake_env.tmp > $_debux_flake_env
+      else
+        echo "Warning: could not activate $DEBUX_FLAKE" >&2
+      fi
+      rm -f $_debux_flake_env.tmp
+      rmdir /tmp/.debux-flake-lock
+    else
+      [[ -n "${DEBUX_QUIET:-}" ]] || echo "Waiting for $DEBUX_FLAKE to be activated..." >&2
+      while [[ ! -f $_debux_flake_env && -d /tmp/.debux-flake-lock ]]; do sleep 1; done
+    fi
+  fi
+  [[ -s $_debux_flake_env ]] && source $_debux_flake_env
+  unset _debux_flake_env
+fi
+`
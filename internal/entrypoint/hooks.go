@@ -0,0 +1,49 @@
+package entrypoint
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SetupHooks runs the container-side hooks of the config file
+// (DEBUX_SETUP_HOOKS, their number, and DEBUX_SETUP_HOOK_<n>), once the
+// debug container is set up and before any shell starts. Their output goes
+// to /tmp/debux-setup.log.
+const SetupHooks = `# Setup hooks of the debux config file (hooks.container)
+if [ -n "${DEBUX_SETUP_HOOKS:-}" ] && [ ! -e /tmp/debux-setup.done ]; then
+  echo "Running setup hooks (log: /tmp/debux-setup.log)..."
+  status=0 i=1
+  while [ "$i" -le "$DEBUX_SETUP_HOOKS" ]; do
+    eval "hook=\$DEBUX_SETUP_HOOK_$i"
+    sh -c "$hook" >> /tmp/debux-setup.log 2>&1 || status=$?
+    i=$((i + 1))
+  done
+  echo "$status" > /tmp/debux-setup.done
+  [ "$status" = 0 ] || echo "Warning: a setup hook failed, see /tmp/debux-setup.log"
+fi
+`
+
+// SetupHooksZshrc is the zshrc part waiting for SetupHooks, for shells
+// started while the hooks run.
+const SetupHooksZshrc = `# Wait for the setup hooks of the debux config file
+if [[ -n "${DEBUX_SETUP_HOOKS:-}" && ! -e /tmp/debux-setup.done ]]; then
+  [[ -n "${DEBUX_QUIET:-}" ]] || echo "Waiting for setup hooks (log: /tmp/debux-setup.log)..." >&2
+  while [[ ! -e /tmp/debux-setup.done ]]; do sleep 1; done
+fi
+if [[ -n "${DEBUX_SETUP_HOOKS:-}" && "$(</tmp/debux-setup.done)" != 0 ]]; then
+  echo "Warning: a setup hook failed, see /tmp/debux-setup.log" >&2
+fi
+`
+
+// HooksEnv returns the environment variables through which the debug
+// container entrypoint runs the container-side hooks.
+func HooksEnv(scripts []string) []string {
+	if len(scripts) == 0 {
+		return nil
+	}
+	env := []string{"DEBUX_SETUP_HOOKS=" + strconv.Itoa(len(scripts))}
+	for i, script := range scripts {
+		env = append(env, fmt.Sprintf("DEBUX_SETUP_HOOK_%d=%s", i+1, script))
+	}
+	return env
+}
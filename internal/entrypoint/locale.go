@@ -0,0 +1,55 @@
+package entrypoint
+
+// Timezone copies the target's /etc/localtime and /etc/timezone into the
+// debug container, so that dates read the same as in the target's logs. An
+// absolute /etc/localtime symlink points into the target's own root.
+const Timezone = `# The target's time zone
+if [ -n "$DEBUX_TARGET_ROOT" ]; then
+  tz="$DEBUX_TARGET_ROOT/etc/localtime"
+  if [ -L "$tz" ]; then
+    link=$(readlink "$tz")
+    case "$link" in /*) tz="$DEBUX_TARGET_ROOT$link" ;; esac
+  fi
+  if [ -f "$tz" ]; then
+    { cp -f "$tz" /etc/.localtime.debux && mv -f /etc/.localtime.debux /etc/localtime; } 2>/dev/null || true
+  fi
+  if [ -f "$DEBUX_TARGET_ROOT/etc/timezone" ]; then
+    cp -f "$DEBUX_TARGET_ROOT/etc/timezone" /etc/timezone 2>/dev/null || true
+  fi
+fi
+`
+
+// LocaleZshrc is the zshrc part giving shells the target's locale and time
+// zone data, which the debug image lacks, so that non-ASCII text and local
+// times show right. LANG and LC_* are only taken from the target when its
+// locales come along; otherwise C.UTF-8, built into glibc, is used. It also
+// checks that the terminal debux passes in TERM is known, from the terminfo
+// bundled in the debug image or the target's, and falls back to
+// xterm-256color.
+const LocaleZshrc = `# The target's time zone and locales
+if [[ -n "$DEBUX_TARGET_ROOT" ]]; then
+  if [[ -z "${TZDIR:-}" && -d $DEBUX_TARGET_ROOT/usr/share/zoneinfo ]]; then
+    export TZDIR=$DEBUX_TARGET_ROOT/usr/share/zoneinfo
+  fi
+  _debux_locales=($DEBUX_TARGET_ROOT/usr/lib/locale/*/LC_CTYPE(N[1]))
+  if [[ -f $DEBUX_TARGET_ROOT/usr/lib/locale/locale-archive ]]; then
+    export LOCALE_ARCHIVE=$DEBUX_TARGET_ROOT/usr/lib/locale/locale-archive
+  elif (( ${#_debux_locales} )); then
+    export LOCPATH=$DEBUX_TARGET_ROOT/usr/lib/locale
+  fi
+  if [[ -n "${LOCALE_ARCHIVE:-}${LOCPATH:-}" && -z "${DEBUX_NO_TARGET_ENV:-}" && -r /proc/${DEBUX_TARGET_PID:-1}/environ ]]; then
+    for _debux_entry in ${(0)"$(</proc/${DEBUX_TARGET_PID:-1}/environ)"}; do
+      [[ "$_debux_entry" == (LANG|LANGUAGE|LC_*)=* ]] && export "$_debux_entry"
+    done
+  fi
+  unset _debux_locales _debux_entry
+fi
+[[ -n "${LANG:-}${LC_ALL:-}" ]] || export LANG=C.UTF-8
+
+# The local terminal (TERM and COLORTERM come from debux)
+export TERMINFO_DIRS=":${HOME:-/tmp}/.nix-profile/share/terminfo:/root/.nix-profile/share/terminfo${DEBUX_TARGET_ROOT:+:$DEBUX_TARGET_ROOT/usr/share/terminfo:$DEBUX_TARGET_ROOT/lib/terminfo}"
+if [[ -n "${TERM:-}" && "$TERM" != dumb ]] && (( $+commands[infocmp] )) && ! infocmp "$TERM" &>/dev/null; then
+  [[ -n "${DEBUX_QUIET:-}" ]] || print -r -- "debux: no terminfo for $TERM in the debug container, using xterm-256color" >&2
+  export TERM=xterm-256color
+fi
+`
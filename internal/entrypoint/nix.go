@@ -0,0 +1,35 @@
+package entrypoint
+
+import "strings"
+
+// NixConf applies the binary cache settings passed by debux (config file and
+// --substituter/--trusted-public-key, see config.Nix.Env) to Nix. They go to
+// their own file included from nix.conf, so restarts don't pile them up.
+const NixConf = `# Extra Nix binary caches (debux config file / --substituter)
+if [ -n "${DEBUX_NIX_SUBSTITUTERS:-}${DEBUX_NIX_TRUSTED_PUBLIC_KEYS:-}" ]; then
+  {
+    if [ -n "${DEBUX_NIX_SUBSTITUTERS:-}" ]; then
+      if [ "${DEBUX_NIX_REPLACE_SUBSTITUTERS:-}" = 1 ]; then
+        echo "substituters = $DEBUX_NIX_SUBSTITUTERS"
+      else
+        echo "extra-substituters = $DEBUX_NIX_SUBSTITUTERS"
+      fi
+    fi
+    if [ -n "${DEBUX_NIX_TRUSTED_PUBLIC_KEYS:-}" ]; then
+      echo "extra-trusted-public-keys = $DEBUX_NIX_TRUSTED_PUBLIC_KEYS"
+    fi
+  } > /etc/nix/debux.conf 2>/dev/null &&
+    { grep -qx '!include debux.conf' /etc/nix/nix.conf || echo '!include debux.conf' >> /etc/nix/nix.conf; } 2>/dev/null ||
+    echo "Warning: could not configure Nix binary caches"
+fi
+`
+
+// Dctl returns a shell script that applies NixConf and runs dctl with args,
+// for package operations started from the host.
+func Dctl(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return NixConf + "dctl " + strings.Join(quoted, " ")
+}
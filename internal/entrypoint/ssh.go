@@ -0,0 +1,61 @@
+package entrypoint
+
+import "strings"
+
+// SSHDir holds the sshd configuration, host key and authorized keys of a
+// debug container (debux ssh).
+const SSHDir = "/run/debux/ssh"
+
+// SSHD runs sshd on its stdin/stdout, one process per connection (inetd
+// mode), so it never listens on a port: debux tunnels each connection
+// through an exec in the debug container.
+const SSHD = `exec "$(command -v sshd)" -i -f ` + SSHDir + `/sshd_config`
+
+// SSHSetup returns a script that prepares sshd in a debug container for the
+// given public key and prints the host public key. Only public key logins are
+// accepted, as root; the shell is zsh with the session's configuration.
+func SSHSetup(authorizedKey string) string {
+	key := "'" + strings.ReplaceAll(authorizedKey, "'", `'\''`) + "'"
+	return `set -e
+command -v sshd >/dev/null || { echo "sshd not found in the debug image" >&2; exit 1; }
+d=` + SSHDir + `
+mkdir -p "$d" /var/empty
+chmod 700 "$d"
+[ -f "$d/host_key" ] || ssh-keygen -q -t ed25519 -N "" -f "$d/host_key" >/dev/null
+touch "$d/authorized_keys"
+grep -qxF ` + key + ` "$d/authorized_keys" || printf '%s\n' ` + key + ` >> "$d/authorized_keys"
+chmod 600 "$d/authorized_keys"
+
+# Privilege separation user, and zsh as root's login shell
+grep -q '^sshd:' /etc/passwd || echo 'sshd:x:74:74:sshd privsep:/var/empty:/bin/false' >> /etc/passwd
+zsh=$(command -v zsh)
+awk -F: -v OFS=: -v zsh="$zsh" '$1 == "root" { $7 = zsh } 1' /etc/passwd > /etc/passwd.debux && cat /etc/passwd.debux > /etc/passwd && rm -f /etc/passwd.debux
+
+{
+  echo "HostKey $d/host_key"
+  echo "AuthorizedKeysFile $d/authorized_keys"
+  echo "PubkeyAuthentication yes"
+  echo "PasswordAuthentication no"
+  echo "KbdInteractiveAuthentication no"
+  echo "PermitRootLogin prohibit-password"
+  echo "StrictModes no"
+  echo "AllowAgentForwarding no"
+  echo "AllowTcpForwarding local"
+  echo "GatewayPorts no"
+  echo "PermitTunnel no"
+  echo "X11Forwarding no"
+  echo "PermitUserEnvironment no"
+  echo "PidFile none"
+  echo "Subsystem sftp internal-sftp"
+  # sshd starts sessions with a clean environment: keep the session's own
+  env_line=""
+  for v in PATH DEBUX_TARGET DEBUX_TARGET_ROOT DEBUX_FLAKE DEBUX_NIXPKGS DEBUX_WORKDIR DEBUX_ENV_KEYS DEBUX_NO_TARGET_ENV DEBUX_NO_WRAPPERS DEBUX_ENV_REDACT DEBUX_ENV_KEEP DEBUX_READ_ONLY_TARGET DEBUX_OFFLINE; do
+    eval "isset=\${$v+1} val=\${$v-}"
+    case "$isset:$val" in :*|*[[:space:]]*) ;; *) env_line="$env_line $v=$val" ;; esac
+  done
+  echo "SetEnv$env_line"
+} > "$d/sshd_config"
+
+cat "$d/host_key.pub"
+`
+}
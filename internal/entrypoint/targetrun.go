@@ -0,0 +1,77 @@
+package entrypoint
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetRunPath is where the target-run helper is installed in image debug
+// containers.
+const TargetRunPath = "/usr/local/bin/target-run"
+
+// TargetRun renders the target-run helper, which starts an image's original
+// ENTRYPOINT/CMD chrooted into $DEBUX_TARGET_ROOT with the image's env,
+// working directory and user, optionally traced with strace or ltrace:
+//
+//	target-run [--strace|--ltrace] [args...]
+//
+// Arguments replace the image CMD, like with "docker run". The chroot,
+// chdir and user switch are done by util-linux unshare (without creating any
+// namespace) so they happen in the right order for distroless images, which
+// have no shell of their own.
+func TargetRun(entrypoint, cmd, env []string, workdir, user string) string {
+	if workdir == "" {
+		workdir = "/"
+	}
+
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+# Run the target image's entrypoint chrooted into the image filesystem.
+# Usage: target-run [--strace|--ltrace] [args...]   (args replace the image CMD)
+ROOT="${DEBUX_TARGET_ROOT:-/target}"
+UNSHARE=$(command -v unshare)
+TRACER=""
+case "$1" in
+  --strace|--ltrace)
+    TRACER=$(command -v "${1#--}") || { echo "target-run: ${1#--} not found" >&2; exit 127; }
+    TRACER="$TRACER -f"
+    shift ;;
+esac
+`)
+	fmt.Fprintf(&b, "[ $# -eq 0 ] && set -- %s\n", shellQuote(cmd))
+	if len(entrypoint) > 0 {
+		fmt.Fprintf(&b, "set -- %s \"$@\"\n", shellQuote(entrypoint))
+	}
+	b.WriteString(`[ $# -eq 0 ] && { echo "target-run: the image has no ENTRYPOINT or CMD" >&2; exit 1; }
+`)
+
+	ids := ""
+	if user != "" {
+		fmt.Fprintf(&b, "USER_SPEC=%s\n", shellQuote([]string{user}))
+		b.WriteString(`# Resolve user[:group] against the image's own passwd/group files
+lookup() { awk -F: -v k="$2" -v f="$3" '$1 == k || $3 == k { print $f; exit }' "$ROOT/etc/$1" 2>/dev/null; }
+u="${USER_SPEC%%:*}"
+case "$USER_SPEC" in *:*) g="${USER_SPEC#*:}" ;; *) g="" ;; esac
+case "$u" in *[!0-9]*) uid=$(lookup passwd "$u" 3) ;; *) uid="$u" ;; esac
+[ -n "$uid" ] || { echo "target-run: unknown user $u" >&2; exit 1; }
+if [ -z "$g" ]; then gid=$(lookup passwd "$uid" 4); gid="${gid:-0}"
+else case "$g" in *[!0-9]*) gid=$(lookup group "$g" 3) ;; *) gid="$g" ;; esac; fi
+[ -n "$gid" ] || { echo "target-run: unknown group $g" >&2; exit 1; }
+`)
+		ids = ` --setgid="$gid" --setuid="$uid"`
+	}
+
+	// $TRACER is split on purpose: "<path> -f".
+	fmt.Fprintf(&b, "exec env -i %s $TRACER \"$UNSHARE\" --root=\"$ROOT\" --wd=%s%s -- \"$@\"\n",
+		shellQuote(env), shellQuote([]string{workdir}), ids)
+	return b.String()
+}
+
+// shellQuote single-quotes each word for a POSIX shell.
+func shellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
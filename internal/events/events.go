@@ -0,0 +1,110 @@
+// Package events writes machine-readable lifecycle events (--events json):
+// one JSON object per line, for wrappers and CI to follow what debux does
+// without parsing its messages.
+//
+//	{"time":"2026-10-17T09:12:03.51Z","type":"image-pull","image":"ghcr.io/clement-tourriere/debux:latest"}
+//	{"time":"2026-10-17T09:12:41.02Z","type":"container-created","target":"my-app","container":"debux-my-app"}
+//	{"time":"2026-10-17T09:12:42.37Z","type":"session-started","target":"my-app","container":"debux-my-app"}
+//	{"time":"2026-10-17T09:20:05.80Z","type":"session-ended","target":"my-app","container":"debux-my-app","exit_code":0}
+//
+// Event types and fields are only ever added.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	ImagePull        = "image-pull"        // pulling the debug image (Docker)
+	ImagePulled      = "image-pulled"      // the debug image is pulled, with its digest
+	ContainerCreated = "container-created" // a debug container or pod was created
+	ContainerReused  = "container-reused"  // a running debug container is reused
+	WaitingReason    = "waiting-reason"    // the debug container waits to start, e.g. ContainerCreating (Kubernetes)
+	SessionStarted   = "session-started"   // a shell or command started in the debug container
+	SessionEnded     = "session-ended"     // it ended, with its exit code or error
+	Cleanup          = "cleanup"           // a debug container or pod is removed or stopped
+)
+
+// Event is a lifecycle event. Fields that don't apply to its type are left
+// out.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Target    string    `json:"target,omitempty"` // as passed to debux
+	Container string    `json:"container,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Platform  string    `json:"platform,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Command   []string  `json:"command,omitempty"` // commands run without a shell
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var (
+	mu          sync.Mutex
+	out         io.Writer
+	subscribers []func(Event)
+)
+
+// SetOutput starts writing events to w, or stops with nil.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// AddOutput also writes events to w, besides the current output.
+func AddOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out != nil {
+		w = io.MultiWriter(out, w)
+	}
+	out = w
+}
+
+// Subscribe calls f with every event from now on, whether events are
+// written or not, e.g. for the metrics of debux daemon. f must not block.
+func Subscribe(f func(Event)) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscribers = append(subscribers, f)
+}
+
+// Emit writes an event, if events are on, and passes it to subscribers.
+func Emit(e Event) {
+	mu.Lock()
+	defer mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for _, f := range subscribers {
+		f(e)
+	}
+	if out == nil {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, _ = out.Write(append(data, '\n'))
+}
+
+// Ended returns the session-ended event of a session: its exit code, or its
+// error.
+func Ended(target, container string, code int, err error) Event {
+	e := Event{Type: SessionEnded, Target: target, Container: container}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.ExitCode = &code
+	}
+	return e
+}
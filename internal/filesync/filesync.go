@@ -0,0 +1,176 @@
+// Package filesync pushes a local directory to a target as it changes, for
+// debux sync: it snapshots the directory, tells what changed between two
+// snapshots, and packs the changed files in a tar archive, which tar
+// unpacks in the debug container.
+package filesync
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// File is the state of a file of a snapshot.
+type File struct {
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// Snapshot maps the slash-separated paths of a directory's files,
+// directories and symlinks, relative to it, to their state.
+type Snapshot map[string]File
+
+// Scan snapshots dir, skipping the files and directories whose name or
+// relative path matches one of the exclude patterns (path.Match syntax).
+func Scan(dir string, exclude []string) (Snapshot, error) {
+	snap := Snapshot{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files removed while walking are picked up by the next scan
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if Excluded(rel, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&fs.ModeSymlink == 0 {
+			return nil // sockets, pipes, devices
+		}
+		f := File{Mode: info.Mode(), ModTime: info.ModTime()}
+		if !info.IsDir() {
+			f.Size = info.Size()
+		}
+		snap[rel] = f
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning %s: %w", dir, err)
+	}
+	return snap, nil
+}
+
+// Excluded reports whether the relative path rel matches one of the
+// patterns, by its name or whole.
+func Excluded(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns the paths of next that are new or changed since prev,
+// and the ones of prev that next doesn't have, both sorted. Removed
+// directories hide their contents, which go with them.
+func Changes(prev, next Snapshot) (changed, removed []string) {
+	for p, f := range next {
+		if old, ok := prev[p]; !ok || old != f && !(f.Mode.IsDir() && old.Mode == f.Mode) {
+			changed = append(changed, p)
+		}
+	}
+	for p := range prev {
+		if _, ok := next[p]; ok {
+			continue
+		}
+		if parent := path.Dir(p); parent != "." {
+			if f, ok := prev[parent]; ok && f.Mode.IsDir() {
+				if _, ok := next[parent]; !ok {
+					continue
+				}
+			}
+		}
+		removed = append(removed, p)
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
+	return changed, removed
+}
+
+// WriteTar writes a tar archive of the paths of dir to w, owned by uid and
+// gid, with their mode and modification time.
+func WriteTar(w io.Writer, dir string, paths []string, uid, gid int) error {
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		local := filepath.Join(dir, filepath.FromSlash(p))
+		info, err := os.Lstat(local)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed since the scan
+			}
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(local); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("archiving %s: %w", p, err)
+		}
+		hdr.Name = p
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = uid, gid
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(tw, local, hdr.Size); err != nil {
+			return fmt.Errorf("archiving %s: %w", p, err)
+		}
+	}
+	return tw.Close()
+}
+
+// copyFile copies size bytes of the file to w: the header has the size of
+// the file when it was archived, whatever it became since.
+func copyFile(w io.Writer, name string, size int64) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	n, err := io.Copy(w, io.LimitReader(f, size))
+	if err != nil {
+		return err
+	}
+	if n < size {
+		// Truncated meanwhile: pad, the next scan sends it again
+		_, err = w.Write(make([]byte, size-n))
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package filesync
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExcluded(t *testing.T) {
+	tests := []struct {
+		rel      string
+		patterns []string
+		want     bool
+	}{
+		{"node_modules", []string{"node_modules"}, true},
+		{"web/node_modules", []string{"node_modules"}, true},
+		{"app.pyc", []string{"*.pyc"}, true},
+		{"pkg/cache/app.pyc", []string{"*.pyc"}, true},
+		{"build/out", []string{"build/*"}, true},
+		{"src/build/out", []string{"build/*"}, false},
+		{"main.go", []string{"*.pyc", ".git"}, false},
+		{"main.go", nil, false},
+	}
+	for _, tt := range tests {
+		if got := Excluded(tt.rel, tt.patterns); got != tt.want {
+			t.Errorf("Excluded(%s, %q) = %v, want %v", tt.rel, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"main.go":            "package main",
+		"src/lib.go":         "package src",
+		".git/HEAD":          "ref: refs/heads/main",
+		"src/cache/data.pyc": "bytecode",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("main.go", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := Scan(dir, []string{".git", "*.pyc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for p := range snap {
+		got = append(got, p)
+	}
+	slices.Sort(got)
+	if want := []string{"link", "main.go", "src", "src/cache", "src/lib.go"}; !slices.Equal(got, want) {
+		t.Errorf("paths = %q, want %q", got, want)
+	}
+	if f := snap["main.go"]; f.Size != int64(len("package main")) || !f.Mode.IsRegular() {
+		t.Errorf("main.go = %+v", f)
+	}
+	if f := snap["src"]; f.Size != 0 || !f.Mode.IsDir() {
+		t.Errorf("src = %+v", f)
+	}
+	if f := snap["link"]; f.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("link = %+v", f)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	then := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := then.Add(time.Minute)
+	file := func(size int64, mod time.Time) File { return File{Mode: 0o644, Size: size, ModTime: mod} }
+	dir := func(mod time.Time) File { return File{Mode: fs.ModeDir | 0o755, ModTime: mod} }
+
+	tests := []struct {
+		name             string
+		prev, next       Snapshot
+		changed, removed []string
+	}{
+		{
+			name: "nothing",
+			prev: Snapshot{"a": file(1, then), "d": dir(then)},
+			next: Snapshot{"a": file(1, then), "d": dir(then)},
+		},
+		{
+			name:    "new and modified files",
+			prev:    Snapshot{"a": file(1, then), "b": file(2, then)},
+			next:    Snapshot{"a": file(1, now), "b": file(2, then), "c": file(3, now)},
+			changed: []string{"a", "c"},
+		},
+		{
+			name:    "a directory touched by its contents doesn't change",
+			prev:    Snapshot{"d": dir(then), "d/a": file(1, then)},
+			next:    Snapshot{"d": dir(now), "d/a": file(1, then), "d/b": file(1, now)},
+			changed: []string{"d/b"},
+		},
+		{
+			name:    "directory mode",
+			prev:    Snapshot{"d": dir(then)},
+			next:    Snapshot{"d": {Mode: fs.ModeDir | 0o700, ModTime: then}},
+			changed: []string{"d"},
+		},
+		{
+			name:    "file replaced by a directory",
+			prev:    Snapshot{"x": file(1, then)},
+			next:    Snapshot{"x": dir(then)},
+			changed: []string{"x"},
+		},
+		{
+			name:    "removed file",
+			prev:    Snapshot{"d": dir(then), "d/a": file(1, then), "d/b": file(1, then)},
+			next:    Snapshot{"d": dir(now), "d/a": file(1, then)},
+			removed: []string{"d/b"},
+		},
+		{
+			name:    "removed directory hides its contents",
+			prev:    Snapshot{"d": dir(then), "d/a": file(1, then), "d/e": dir(then), "d/e/b": file(1, then), "c": file(1, then)},
+			next:    Snapshot{"c": file(1, then)},
+			removed: []string{"d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, removed := Changes(tt.prev, tt.next)
+			if !slices.Equal(changed, tt.changed) {
+				t.Errorf("changed = %q, want %q", changed, tt.changed)
+			}
+			if !slices.Equal(removed, tt.removed) {
+				t.Errorf("removed = %q, want %q", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Whatever the umask
+	if err := os.Chmod(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "lib.go"), []byte("package src"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("src/lib.go", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTar(&buf, dir, []string{"src", "src/lib.go", "link", "gone"}, 1000, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		name, link, body string
+		typ              byte
+		mode             int64
+	}
+	want := []entry{
+		{name: "src/", typ: tar.TypeDir, mode: 0o755},
+		{name: "src/lib.go", typ: tar.TypeReg, mode: 0o600, body: "package src"},
+		{name: "link", typ: tar.TypeSymlink, mode: 0o777, link: "src/lib.go"},
+	}
+	tr := tar.NewReader(&buf)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("%d entries, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Fatalf("unexpected entry %s", hdr.Name)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := entry{name: hdr.Name, link: hdr.Linkname, body: string(body), typ: hdr.Typeflag, mode: hdr.Mode & 0o777}
+		if got != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want[i])
+		}
+		if hdr.Uid != 1000 || hdr.Gid != 2000 || hdr.Uname != "" || hdr.Gname != "" {
+			t.Errorf("%s is owned by %d:%d (%q:%q)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+		}
+	}
+}
+
+func TestCopyFileTruncated(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(name, []byte("abc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{3, "abc"},
+		{2, "ab"},
+		{5, "abc\x00\x00"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := copyFile(&buf, name, tt.size); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("copyFile(%d) = %q, want %q", tt.size, buf.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package history keeps a local history of debux sessions, to start them
+// again with the same options.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// MaxEntries is how many sessions the history keeps.
+const MaxEntries = 500
+
+// Entry is a session in the history.
+type Entry struct {
+	ID        int       `json:"id"`
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Runtime   string    `json:"runtime"`
+	Target    string    `json:"target"`
+	Context   string    `json:"context,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	// Flags are the flags set, as in the audit log.
+	Flags []string `json:"flags,omitempty"`
+	// Args are the arguments of debux to start the session again.
+	Args []string `json:"args"`
+}
+
+// Path returns the history file, in the debux configuration directory.
+func Path() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "debux", "history.jsonl"), nil
+}
+
+// Load returns the sessions of the history, oldest first. A missing
+// history is empty.
+func Load() ([]Entry, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var entries []Entry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e Entry
+		// Skip lines a crash left half-written
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	return entries, nil
+}
+
+// Add appends e to the history with the next id, which it returns, and
+// drops the oldest sessions past MaxEntries.
+func Add(e Entry) (int, error) {
+	entries, err := Load()
+	if err != nil {
+		return 0, err
+	}
+	e.ID = 1
+	if len(entries) > 0 {
+		e.ID = entries[len(entries)-1].ID + 1
+	}
+	entries = append(entries, e)
+
+	path, err := Path()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, fmt.Errorf("writing history: %w", err)
+	}
+	if len(entries) > MaxEntries {
+		return e.ID, rewrite(path, entries[len(entries)-MaxEntries:])
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("writing history: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		return 0, fmt.Errorf("writing history: %w", err)
+	}
+	return e.ID, nil
+}
+
+// rewrite replaces the history with entries.
+func rewrite(path string, entries []Entry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".history-*")
+	if err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	enc := json.NewEncoder(tmp)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("writing history: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing history: %w", err)
+	}
+	return nil
+}
+
+// Find returns the session of the history with an id, or the last one when
+// id is empty.
+func Find(id string) (*Entry, error) {
+	entries, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no sessions in the history yet")
+	}
+	if id == "" {
+		return &entries[len(entries)-1], nil
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session id %q", id)
+	}
+	for i := range entries {
+		if entries[i].ID == n {
+			return &entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no session %d in the history (see debux history)", n)
+}
@@ -0,0 +1,278 @@
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Reference prefixes for image archives on the local filesystem.
+const (
+	OCIArchivePrefix    = "oci-archive:"
+	DockerArchivePrefix = "docker-archive:"
+)
+
+// IsArchiveRef reports whether ref points at a local image archive
+// (oci-archive:<path> or docker-archive:<path>) rather than an image
+// known to the Docker daemon or a registry.
+func IsArchiveRef(ref string) bool {
+	return strings.HasPrefix(ref, OCIArchivePrefix) || strings.HasPrefix(ref, DockerArchivePrefix)
+}
+
+// OpenArchive loads an image from an OCI archive or a `docker save` tarball
+// without going through a container daemon. For multi-platform OCI archives,
+// platform selects the image ("" picks the first one). The returned cleanup
+// function removes any temporary files and must be called once the image is
+// no longer needed.
+func OpenArchive(ref, platform string) (v1.Image, func(), error) {
+	noop := func() {}
+
+	switch {
+	case strings.HasPrefix(ref, DockerArchivePrefix):
+		path := strings.TrimPrefix(ref, DockerArchivePrefix)
+		img, err := tarball.ImageFromPath(path, nil)
+		if err != nil {
+			return nil, noop, fmt.Errorf("reading docker archive %s: %w", path, err)
+		}
+		return img, noop, nil
+
+	case strings.HasPrefix(ref, OCIArchivePrefix):
+		path := strings.TrimPrefix(ref, OCIArchivePrefix)
+		dir, err := os.MkdirTemp("", "debux-oci-")
+		if err != nil {
+			return nil, noop, fmt.Errorf("creating temp directory: %w", err)
+		}
+		cleanup := func() { _ = os.RemoveAll(dir) }
+
+		f, err := os.Open(path)
+		if err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("opening OCI archive: %w", err)
+		}
+		err = ExtractTar(f, dir)
+		_ = f.Close()
+		if err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("unpacking OCI archive %s: %w", path, err)
+		}
+
+		want, err := ParsePlatform(platform)
+		if err != nil {
+			cleanup()
+			return nil, noop, err
+		}
+		img, err := imageFromLayout(dir, want)
+		if err != nil {
+			cleanup()
+			return nil, noop, fmt.Errorf("reading OCI archive %s: %w", path, err)
+		}
+		return img, cleanup, nil
+
+	default:
+		return nil, noop, fmt.Errorf("not an image archive reference: %s", ref)
+	}
+}
+
+// imageFromLayout returns the first image found in an OCI image layout that
+// matches the wanted platform (nil matches any), descending into nested
+// indexes (multi-platform archives) as needed.
+func imageFromLayout(dir string, want *v1.Platform) (v1.Image, error) {
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	img, err := findImage(idx, want)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		if want != nil {
+			return nil, fmt.Errorf("no image for platform %s in index", want)
+		}
+		return nil, fmt.Errorf("no image manifest found in index")
+	}
+	return img, nil
+}
+
+func findImage(idx v1.ImageIndex, want *v1.Platform) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.MediaType.IsImage() {
+			if want != nil && desc.Platform != nil && !desc.Platform.Satisfies(*want) {
+				continue
+			}
+			return idx.Image(desc.Digest)
+		}
+		if desc.MediaType.IsIndex() {
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			img, err := findImage(child, want)
+			if err != nil || img != nil {
+				return img, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Flatten returns a tar stream of the image's merged root filesystem, with
+// whiteouts from upper layers applied. The layers of Windows images keep
+// the filesystem under Files/, next to registry hives: only the files are
+// kept, moved to the root.
+func Flatten(img v1.Image) io.ReadCloser {
+	rc := mutate.Extract(img)
+	if !IsWindows(img) {
+		return rc
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := windowsFiles(rc, pw)
+		_ = rc.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// windowsFiles copies the Files/ entries of a Windows filesystem tar stream
+// to w, without that prefix.
+func windowsFiles(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		name, ok := strings.CutPrefix(strings.TrimPrefix(hdr.Name, "./"), "Files/")
+		if !ok || name == "" {
+			continue
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(strings.TrimPrefix(hdr.Linkname, "./"), "Files/")
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ExtractTar unpacks a tar stream into dir. Entries that would escape dir
+// are rejected; device nodes and other special files are skipped.
+func ExtractTar(r io.Reader, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if dest == dir {
+			continue
+		}
+		if !strings.HasPrefix(dest, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry %q escapes destination", hdr.Name)
+		}
+		if !resolvesInside(root, filepath.Dir(dest)) {
+			return fmt.Errorf("tar entry %q is below a symlink leaving the destination", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				return err
+			}
+			// Never write through a symlink or a hard link left by an
+			// earlier entry.
+			_ = os.Remove(dest)
+			f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0o777|0o200)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+				return err
+			}
+			_ = os.Remove(dest)
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			src := filepath.Join(dir, filepath.Clean("/"+hdr.Linkname))
+			if !strings.HasPrefix(src, dir+string(os.PathSeparator)) {
+				return fmt.Errorf("tar link %q escapes destination", hdr.Linkname)
+			}
+			// Links resolve their source's parents: a planted symlink would
+			// link a file from outside, for later entries to write to.
+			if !resolvesInside(root, filepath.Dir(src)) {
+				return fmt.Errorf("tar link %q is below a symlink leaving the destination", hdr.Linkname)
+			}
+			_ = os.Remove(dest)
+			if err := os.Link(src, dest); err != nil {
+				return err
+			}
+		default:
+			// Device nodes, FIFOs etc. are not needed for browsing.
+		}
+	}
+}
+
+// resolvesInside reports whether the deepest existing ancestor of path, with
+// symlinks resolved, lies within root. This stops archives from writing
+// through a symlink they planted earlier.
+func resolvesInside(root, path string) bool {
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return resolved == root || strings.HasPrefix(resolved, root+string(os.PathSeparator))
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,185 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// entry is an entry of a test archive.
+type entry struct {
+	name, link string
+	typ        byte
+	body       string
+}
+
+func tarOf(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0o644, Size: int64(len(e.body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		files   map[string]string // path in the destination: content
+		outside map[string]string // path next to the destination: content, which must stay
+		err     string
+	}{
+		{
+			name: "files and directories",
+			entries: []entry{
+				{name: "./etc/", typ: tar.TypeDir},
+				{name: "./etc/hostname", typ: tar.TypeReg, body: "api"},
+				{name: "usr/share/doc/README", typ: tar.TypeReg, body: "docs"},
+			},
+			files: map[string]string{"etc/hostname": "api", "usr/share/doc/README": "docs"},
+		},
+		{
+			name:    "dot-dot stays in the destination",
+			entries: []entry{{name: "../../evil", typ: tar.TypeReg, body: "x"}},
+			files:   map[string]string{"evil": "x"},
+		},
+		{
+			name:    "absolute name stays in the destination",
+			entries: []entry{{name: "/etc/passwd", typ: tar.TypeReg, body: "root"}},
+			files:   map[string]string{"etc/passwd": "root"},
+		},
+		{
+			name: "symlink inside",
+			entries: []entry{
+				{name: "usr/lib/libc.so", typ: tar.TypeReg, body: "ELF"},
+				{name: "lib", typ: tar.TypeSymlink, link: "usr/lib"},
+				{name: "lib/libm.so", typ: tar.TypeReg, body: "ELF"},
+			},
+			files: map[string]string{"lib/libc.so": "ELF", "usr/lib/libm.so": "ELF"},
+		},
+		{
+			name: "write below a symlink leaving the destination",
+			entries: []entry{
+				{name: "escape", typ: tar.TypeSymlink, link: "/"},
+				{name: "escape/tmp/evil", typ: tar.TypeReg, body: "x"},
+			},
+			err: `tar entry "escape/tmp/evil" is below a symlink leaving the destination`,
+		},
+		{
+			name: "write below a relative symlink leaving the destination",
+			entries: []entry{
+				{name: "up", typ: tar.TypeSymlink, link: "../.."},
+				{name: "up/evil", typ: tar.TypeReg, body: "x"},
+			},
+			err: "is below a symlink leaving the destination",
+		},
+		{
+			name: "file replacing a symlink",
+			entries: []entry{
+				{name: "passwd", typ: tar.TypeSymlink, link: "../passwd"},
+				{name: "passwd", typ: tar.TypeReg, body: "mine"},
+			},
+			files: map[string]string{"passwd": "mine"},
+		},
+		{
+			name: "hard link inside",
+			entries: []entry{
+				{name: "bin/busybox", typ: tar.TypeReg, body: "ELF"},
+				{name: "bin/sh", typ: tar.TypeLink, link: "bin/busybox"},
+			},
+			files: map[string]string{"bin/sh": "ELF"},
+		},
+		{
+			name: "hard link with dot-dot",
+			entries: []entry{
+				{name: "etc/passwd", typ: tar.TypeReg, body: "root"},
+				{name: "copy", typ: tar.TypeLink, link: "../../etc/passwd"},
+			},
+			files: map[string]string{"copy": "root"},
+		},
+		{
+			name: "file replacing a hard link",
+			entries: []entry{
+				{name: "etc/passwd", typ: tar.TypeReg, body: "root"},
+				{name: "copy", typ: tar.TypeLink, link: "etc/passwd"},
+				{name: "copy", typ: tar.TypeReg, body: "mine"},
+			},
+			files: map[string]string{"etc/passwd": "root", "copy": "mine"},
+		},
+		{
+			name: "hard link below a symlink leaving the destination",
+			entries: []entry{
+				{name: "evil", typ: tar.TypeSymlink, link: ".."},
+				{name: "x", typ: tar.TypeLink, link: "evil/victim"},
+				{name: "x", typ: tar.TypeReg, body: "mine"},
+			},
+			outside: map[string]string{"victim": "theirs"},
+			err:     `tar link "evil/victim" is below a symlink leaving the destination`,
+		},
+		{
+			name:    "device skipped",
+			entries: []entry{{name: "dev/null", typ: tar.TypeChar}},
+			files:   map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "root")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range tt.outside {
+				if err := os.WriteFile(filepath.Join(parent, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := ExtractTar(tarOf(t, tt.entries...), dir)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ExtractTar() error = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.files {
+				got, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("reading %s: %v", name, err)
+				} else if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			// Nothing lands next to the destination
+			siblings, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.outside {
+				if got, err := os.ReadFile(filepath.Join(parent, name)); err != nil || string(got) != want {
+					t.Errorf("ExtractTar changed %s next to the destination: %q, %v", name, got, err)
+				}
+			}
+			if len(siblings) != 1+len(tt.outside) {
+				t.Errorf("ExtractTar wrote outside the destination: %v", siblings)
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "dev", "null")); err == nil {
+				t.Errorf("ExtractTar created a device node")
+			}
+		})
+	}
+}
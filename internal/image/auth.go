@@ -0,0 +1,60 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RegistryAuth, when set to "user:password" (or "user:token"), is used for
+// every registry instead of the credentials in the Docker config. It is the
+// escape hatch for registries the local Docker config can't log into.
+var RegistryAuth string
+
+// keychain returns where registry credentials come from: RegistryAuth, or
+// the Docker config including credential helpers.
+func keychain() authn.Keychain {
+	if RegistryAuth == "" {
+		return authn.DefaultKeychain
+	}
+	user, password, _ := strings.Cut(RegistryAuth, ":")
+	return staticKeychain{&authn.Basic{Username: user, Password: password}}
+}
+
+type staticKeychain struct{ authn.Authenticator }
+
+func (k staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.Authenticator, nil
+}
+
+// pullAuth returns the encoded credentials for pulling ref through the Docker
+// daemon, which doesn't read the client's Docker config by itself. It returns
+// "" for anonymous pulls.
+func pullAuth(ref string) (string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("parsing image reference %q: %w", ref, err)
+	}
+	auth, err := keychain().Resolve(parsed.Context())
+	if err != nil {
+		return "", fmt.Errorf("reading credentials for %s: %w", parsed.Context().RegistryStr(), err)
+	}
+	cfg, err := auth.Authorization()
+	if err != nil {
+		return "", fmt.Errorf("reading credentials for %s: %w", parsed.Context().RegistryStr(), err)
+	}
+	if *cfg == (authn.AuthConfig{}) {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+		ServerAddress: parsed.Context().RegistryStr(),
+	})
+}
@@ -0,0 +1,294 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// runtimePaths are created or bind-mounted by Docker in every container (the
+// "init" layer) and must never end up in a committed image.
+var runtimePaths = map[string]bool{
+	"/.dockerenv":      true,
+	"/etc/hostname":    true,
+	"/etc/hosts":       true,
+	"/etc/resolv.conf": true,
+	"/dev":             true,
+	"/proc":            true,
+	"/sys":             true,
+}
+
+func isRuntimePath(p string) bool {
+	for dir := p; dir != "/"; dir = path.Dir(dir) {
+		if runtimePaths[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangesLayer compares a modified copy of base's root filesystem, given as a
+// tar file at snapshot (entry names relative to prefix, see indexTar), with
+// base itself and writes a layer tar to w holding only the differences:
+// added and changed entries, plus whiteouts for removed paths. It returns the
+// number of changes written.
+func ChangesLayer(base v1.Image, snapshot, prefix string, w io.Writer) (int, error) {
+	before, _, err := indexFilesystem(base)
+	if err != nil {
+		return 0, fmt.Errorf("reading base image: %w", err)
+	}
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	after, _, err := indexTar(f, prefix)
+	_ = f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("reading modified filesystem: %w", err)
+	}
+
+	changed := func(p string, e fileEntry) bool {
+		if p == "/" || isRuntimePath(p) {
+			return false
+		}
+		old, ok := before[p]
+		return !ok || entryDifference(old, e) != ""
+	}
+
+	f, err = os.Open(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	tw := tar.NewWriter(w)
+	written := make(map[string]bool)
+	count := 0
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		p := entryPath(hdr.Name, prefix)
+		e, ok := after[p]
+		if !ok || !changed(p, e) {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeLink && !written[e.link] {
+			// A hard link can only point at a file within the same layer.
+			if err := copyEntry(tw, snapshot, prefix, e.link); err != nil {
+				return 0, err
+			}
+			written[e.link] = true
+		}
+
+		hdr.Name = strings.TrimPrefix(p, "/")
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(e.link, "/")
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return 0, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, tr); err != nil {
+				return 0, err
+			}
+		}
+		written[p] = true
+		count++
+	}
+
+	// Whiteouts for removed paths. Children of a removed directory are
+	// covered by the directory's own whiteout.
+	var removed []string
+	for p := range before {
+		if _, ok := after[p]; ok || p == "/" || isRuntimePath(p) {
+			continue
+		}
+		if parent := path.Dir(p); parent != "/" {
+			if _, ok := after[parent]; !ok {
+				continue
+			}
+		}
+		removed = append(removed, p)
+	}
+	sort.Strings(removed)
+	for _, p := range removed {
+		wh := path.Join(path.Dir(p), ".wh."+path.Base(p))
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(wh, "/"),
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+		}); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, tw.Close()
+}
+
+// copyEntry writes the snapshot entry at path p (header and content) to tw.
+func copyEntry(tw *tar.Writer, snapshot, prefix, p string) error {
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("hard link target %s not found", p)
+		}
+		if err != nil {
+			return err
+		}
+		if entryPath(hdr.Name, prefix) != p {
+			continue
+		}
+		hdr.Name = strings.TrimPrefix(p, "/")
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, tr)
+		return err
+	}
+}
+
+// AppendLayer returns base with the uncompressed layer tar at layerPath added
+// on top. The image configuration (entrypoint, env, user, ...) is preserved;
+// a history entry with the given description records where the layer came from.
+func AppendLayer(base v1.Image, layerPath, createdBy string) (v1.Image, error) {
+	layer, err := tarball.LayerFromFile(layerPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading layer: %w", err)
+	}
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   v1.Time{Time: time.Now().UTC()},
+			CreatedBy: createdBy,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("appending layer: %w", err)
+	}
+	return img, nil
+}
+
+// Save writes img to ref: archive references (docker-archive:<path>,
+// oci-archive:<path>) produce a file, anything else is loaded into the
+// Docker daemon under that tag.
+func Save(ctx context.Context, cli *client.Client, img v1.Image, ref string) error {
+	switch {
+	case strings.HasPrefix(ref, DockerArchivePrefix):
+		path := strings.TrimPrefix(ref, DockerArchivePrefix)
+		if err := tarball.WriteToFile(path, nil, img); err != nil {
+			return fmt.Errorf("writing docker archive %s: %w", path, err)
+		}
+		return nil
+
+	case strings.HasPrefix(ref, OCIArchivePrefix):
+		path := strings.TrimPrefix(ref, OCIArchivePrefix)
+		if err := writeOCIArchive(img, path); err != nil {
+			return fmt.Errorf("writing OCI archive %s: %w", path, err)
+		}
+		return nil
+	}
+
+	tag, err := name.NewTag(ref)
+	if err != nil {
+		return fmt.Errorf("parsing image tag %q: %w", ref, err)
+	}
+	if _, err := daemon.Write(tag, img, daemon.WithClient(cli), daemon.WithContext(ctx)); err != nil {
+		return fmt.Errorf("loading image into Docker: %w", err)
+	}
+	return nil
+}
+
+// writeOCIArchive writes img as an OCI image layout packed into a tar file.
+func writeOCIArchive(img v1.Image, file string) error {
+	dir, err := os.MkdirTemp("", "debux-oci-")
+	if err != nil {
+		return fmt.Errorf("creating temp directory: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return err
+	}
+	if err := lp.AppendImage(img); err != nil {
+		return err
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(out)
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = src.Close() }()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
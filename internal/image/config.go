@@ -0,0 +1,41 @@
+package image
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/client"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// RunConfig returns the runtime configuration of an image: entrypoint, cmd,
+// env, working directory and user. Images in the Docker daemon are inspected
+// in place; archives and direct pulls are read client-side.
+func RunConfig(ctx context.Context, cli *client.Client, ref string, direct bool, platform string) (*v1.Config, error) {
+	if direct || IsArchiveRef(ref) {
+		img, cleanup, err := Load(ctx, ref, platform)
+		defer cleanup()
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("reading image config: %w", err)
+		}
+		return &cfg.Config, nil
+	}
+
+	info, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting image %q: %w", ref, err)
+	}
+	cfg := &v1.Config{}
+	if info.Config != nil {
+		cfg.Entrypoint = info.Config.Entrypoint
+		cfg.Cmd = info.Config.Cmd
+		cfg.Env = info.Config.Env
+		cfg.WorkingDir = info.Config.WorkingDir
+		cfg.User = info.Config.User
+	}
+	return cfg, nil
+}
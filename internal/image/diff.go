@@ -0,0 +1,237 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// File change kinds reported by Diff.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// FileChange is a single filesystem difference between two images.
+type FileChange struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	SizeA  int64  `json:"sizeA,omitempty"`
+	SizeB  int64  `json:"sizeB,omitempty"`
+	Detail string `json:"detail,omitempty"` // what changed: content, mode, type, link target
+}
+
+// ConfigChange is a difference in the image configuration (env, entrypoint, ...).
+type ConfigChange struct {
+	Field string `json:"field"`
+	A     string `json:"a,omitempty"`
+	B     string `json:"b,omitempty"`
+}
+
+// DiffReport summarizes the differences between two images.
+type DiffReport struct {
+	ImageA     string         `json:"imageA"`
+	ImageB     string         `json:"imageB"`
+	SizeA      int64          `json:"sizeA"` // total bytes of regular files
+	SizeB      int64          `json:"sizeB"`
+	Files      []FileChange   `json:"files"`
+	Config     []ConfigChange `json:"config"`
+	NumAdded   int            `json:"added"`
+	NumRemoved int            `json:"removed"`
+	NumChanged int            `json:"changed"`
+}
+
+// fileEntry is what Diff records about each path of a flattened filesystem.
+type fileEntry struct {
+	typeflag byte
+	mode     int64
+	size     int64
+	link     string
+	digest   string
+}
+
+// Diff compares the merged filesystems and configurations of two images.
+func Diff(a, b v1.Image) (*DiffReport, error) {
+	filesA, sizeA, err := indexFilesystem(a)
+	if err != nil {
+		return nil, fmt.Errorf("reading first image: %w", err)
+	}
+	filesB, sizeB, err := indexFilesystem(b)
+	if err != nil {
+		return nil, fmt.Errorf("reading second image: %w", err)
+	}
+
+	report := &DiffReport{SizeA: sizeA, SizeB: sizeB, Files: []FileChange{}}
+
+	for p, ea := range filesA {
+		eb, ok := filesB[p]
+		if !ok {
+			report.Files = append(report.Files, FileChange{Path: p, Kind: ChangeRemoved, SizeA: ea.size})
+			report.NumRemoved++
+			continue
+		}
+		if detail := entryDifference(ea, eb); detail != "" {
+			report.Files = append(report.Files, FileChange{Path: p, Kind: ChangeChanged, SizeA: ea.size, SizeB: eb.size, Detail: detail})
+			report.NumChanged++
+		}
+	}
+	for p, eb := range filesB {
+		if _, ok := filesA[p]; !ok {
+			report.Files = append(report.Files, FileChange{Path: p, Kind: ChangeAdded, SizeB: eb.size})
+			report.NumAdded++
+		}
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Path < report.Files[j].Path })
+
+	cfgA, err := a.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading first image config: %w", err)
+	}
+	cfgB, err := b.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading second image config: %w", err)
+	}
+	report.Config = diffConfig(cfgA, cfgB)
+
+	return report, nil
+}
+
+// indexFilesystem walks the flattened filesystem of img, hashing regular files.
+func indexFilesystem(img v1.Image) (map[string]fileEntry, int64, error) {
+	rc := Flatten(img)
+	defer func() { _ = rc.Close() }()
+	return indexTar(rc, "")
+}
+
+// indexTar records every entry of a filesystem tar stream by its absolute
+// path, hashing regular files. Entry names are taken relative to the prefix
+// directory (e.g. "target" for a "docker cp" of /target); "" means the root.
+func indexTar(r io.Reader, prefix string) (map[string]fileEntry, int64, error) {
+	files := make(map[string]fileEntry)
+	var total int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		p := entryPath(hdr.Name, prefix)
+		e := fileEntry{typeflag: hdr.Typeflag, mode: hdr.Mode & 0o7777, link: hdr.Linkname}
+		if hdr.Typeflag == tar.TypeLink {
+			e.link = entryPath(hdr.Linkname, prefix)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			n, err := io.Copy(h, tr)
+			if err != nil {
+				return nil, 0, err
+			}
+			e.size = n
+			e.digest = hex.EncodeToString(h.Sum(nil))
+			total += n
+		}
+		files[p] = e
+	}
+	return files, total, nil
+}
+
+// entryPath turns a tar entry name into an absolute path relative to prefix.
+func entryPath(name, prefix string) string {
+	p := path.Clean("/" + name)
+	if prefix == "" {
+		return p
+	}
+	root := path.Clean("/" + prefix)
+	if p == root {
+		return "/"
+	}
+	return strings.TrimPrefix(p, root)
+}
+
+func entryDifference(a, b fileEntry) string {
+	var parts []string
+	if a.typeflag != b.typeflag {
+		parts = append(parts, "type")
+	}
+	if a.digest != b.digest {
+		parts = append(parts, "content")
+	}
+	if a.link != b.link {
+		parts = append(parts, "link target")
+	}
+	if a.mode != b.mode {
+		parts = append(parts, fmt.Sprintf("mode %o→%o", a.mode, b.mode))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func diffConfig(a, b *v1.ConfigFile) []ConfigChange {
+	changes := []ConfigChange{}
+	add := func(field, va, vb string) {
+		if va != vb {
+			changes = append(changes, ConfigChange{Field: field, A: va, B: vb})
+		}
+	}
+
+	add("Platform", a.OS+"/"+a.Architecture, b.OS+"/"+b.Architecture)
+	add("Entrypoint", strings.Join(a.Config.Entrypoint, " "), strings.Join(b.Config.Entrypoint, " "))
+	add("Cmd", strings.Join(a.Config.Cmd, " "), strings.Join(b.Config.Cmd, " "))
+	add("WorkingDir", a.Config.WorkingDir, b.Config.WorkingDir)
+	add("User", a.Config.User, b.Config.User)
+
+	envA, envB := keyValues(a.Config.Env), keyValues(b.Config.Env)
+	for _, k := range unionKeys(envA, envB) {
+		add("Env."+k, envA[k], envB[k])
+	}
+	for _, k := range unionKeys(a.Config.Labels, b.Config.Labels) {
+		add("Label."+k, a.Config.Labels[k], b.Config.Labels[k])
+	}
+
+	portsA, portsB := map[string]string{}, map[string]string{}
+	for p := range a.Config.ExposedPorts {
+		portsA[p] = "exposed"
+	}
+	for p := range b.Config.ExposedPorts {
+		portsB[p] = "exposed"
+	}
+	for _, k := range unionKeys(portsA, portsB) {
+		add("ExposedPort."+k, portsA[k], portsB[k])
+	}
+
+	return changes
+}
+
+func keyValues(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func unionKeys(a, b map[string]string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []map[string]string{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,45 +2,113 @@ package image
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 
+	"github.com/clement-tourriere/debux/internal/events"
+	"github.com/clement-tourriere/debux/internal/telemetry"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
 )
 
-// EnsureImage pulls the image if it's not already present locally.
-func EnsureImage(ctx context.Context, cli *client.Client, ref string) error {
-	_, _, err := cli.ImageInspectWithRaw(ctx, ref)
-	if err == nil {
-		return nil // image already present
+// Status receives progress messages such as pull progress. It defaults to
+// stdout; commands with machine-readable output point it elsewhere.
+var Status io.Writer = os.Stdout
+
+// expectedDigests maps image references to the digest they must have
+// (--expect-digest).
+var expectedDigests = map[string]string{}
+
+// ExpectDigest makes EnsureImage fail unless ref resolves to digest
+// ("sha256:..."), whether the image is pulled or already present.
+func ExpectDigest(ref, digest string) error {
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hex) != 64 || strings.Trim(hex, "0123456789abcdef") != "" {
+		return fmt.Errorf("invalid digest %q: expected sha256:<64 hex digits>", digest)
+	}
+	expectedDigests[ref] = digest
+	return nil
+}
+
+// EnsureImage pulls the image if it's not already present locally, or with
+// Pull set to PullAlways if its registry has another digest. When a platform
+// (e.g. "linux/arm64") is given, a local image for another platform doesn't
+// count as present.
+func EnsureImage(ctx context.Context, cli *client.Client, ref, platform string) (err error) {
+	ctx, span := telemetry.Start(ctx, "debux.ensure-image", telemetry.Image(ref))
+	defer func() { telemetry.End(span, err) }()
+	info, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	present := err == nil && platformMatches(info, platform)
+	switch {
+	case present && Pull == PullAlways:
+		current, err := upToDate(ctx, ref, info.RepoDigests)
+		if err != nil {
+			Statusf("Warning: %v; using the local image\n", err)
+			return checkDigest(ref, info.RepoDigests)
+		}
+		if current {
+			return checkDigest(ref, info.RepoDigests)
+		}
+	case present:
+		return checkDigest(ref, info.RepoDigests)
+	case Pull == PullNever && Offline:
+		return fmt.Errorf("image %s is not present locally, and --offline doesn't pull: load it first (docker load, or debux image with an archive)", ref)
+	case Pull == PullNever:
+		return fmt.Errorf("image %s is not present locally and --pull is never", ref)
 	}
 
-	fmt.Printf("Pulling image %s...\n", ref)
-	reader, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	events.Emit(events.Event{Type: events.ImagePull, Image: ref, Platform: platform})
+	if platform != "" {
+		Statusf("Pulling image %s (%s)...\n", ref, platform)
+	} else {
+		Statusf("Pulling image %s...\n", ref)
+	}
+	auth, err := pullAuth(ref)
+	if err != nil {
+		Statusf("Warning: %v; pulling anonymously\n", err)
+	}
+	reader, err := cli.ImagePull(ctx, ref, image.PullOptions{Platform: platform, RegistryAuth: auth})
 	if err != nil {
 		return fmt.Errorf("pulling image: %w", err)
 	}
 	defer func() { _ = reader.Close() }()
 
-	// Consume the pull output (docker requires reading the response)
-	dec := json.NewDecoder(reader)
-	for {
-		var msg map[string]any
-		if err := dec.Decode(&msg); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("reading pull response: %w", err)
-		}
-		if status, ok := msg["status"].(string); ok {
-			if progress, ok := msg["progress"].(string); ok && progress != "" {
-				fmt.Printf("\r  %s %s", status, progress)
-			}
+	// Docker requires reading the response for the pull to complete
+	digest, err := newPullProgress(Status, ref).consume(reader)
+	if err != nil {
+		return err
+	}
+	if digest != "" {
+		Statusf("Pulled %s (%s)\n", ref, digest)
+		if platform == "" {
+			cacheDigest(ref, digest)
 		}
 	}
-	fmt.Println()
+	events.Emit(events.Event{Type: events.ImagePulled, Image: ref, Platform: platform, Digest: digest})
 
-	return nil
+	info, _, err = cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("inspecting pulled image: %w", err)
+	}
+	return checkDigest(ref, info.RepoDigests)
+}
+
+// checkDigest verifies the digest expected for ref, if any, against the
+// image's repo digests ("repo@sha256:...").
+func checkDigest(ref string, repoDigests []string) error {
+	want, ok := expectedDigests[ref]
+	if !ok {
+		return nil
+	}
+	for _, rd := range repoDigests {
+		if _, d, _ := strings.Cut(rd, "@"); d == want {
+			return nil
+		}
+	}
+	if len(repoDigests) == 0 {
+		return fmt.Errorf("image %s has no registry digest, expected %s", ref, want)
+	}
+	return fmt.Errorf("image %s has digest %s, expected %s", ref, strings.Join(repoDigests, ", "), want)
 }
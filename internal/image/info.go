@@ -0,0 +1,265 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	dockerimage "github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// InfoPath is where debug sessions find the Info of their target's image,
+// which target-history prints.
+const InfoPath = "/run/debux/image-info.json"
+
+// Info is the provenance of an image: its identity, runtime configuration
+// and build history, as written to InfoPath.
+type Info struct {
+	Ref         string        `json:"ref"`
+	ID          string        `json:"id,omitempty"`
+	RepoDigests []string      `json:"repo_digests,omitempty"`
+	Platform    string        `json:"platform,omitempty"`
+	Created     time.Time     `json:"created,omitzero"`
+	Author      string        `json:"author,omitempty"`
+	Config      InfoConfig    `json:"config"`
+	History     []InfoHistory `json:"history"`
+}
+
+// InfoConfig is the runtime configuration of an image.
+type InfoConfig struct {
+	Entrypoint   []string          `json:"entrypoint,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          []string          `json:"env,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	ExposedPorts []string          `json:"exposed_ports,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// InfoHistory is a step of the build of an image, oldest first. Steps that
+// produced a filesystem layer carry its 1-based index, bottom layer first,
+// and size: compressed for registry and archive images, uncompressed for
+// images of the Docker daemon.
+type InfoHistory struct {
+	Created    time.Time `json:"created,omitzero"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+	Layer      int       `json:"layer,omitempty"`
+	DiffID     string    `json:"diff_id,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Dir        string    `json:"dir,omitempty"` // the layer's files, in sessions mounting the layers
+}
+
+// Layers returns the number of filesystem layers in the history.
+func (info *Info) Layers() int {
+	n := 0
+	for _, h := range info.History {
+		if h.Layer > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// ImageInfo returns the Info of an image. Images in the Docker daemon are
+// inspected in place; archives and direct pulls are read client-side, as
+// by RunConfig.
+func ImageInfo(ctx context.Context, cli *client.Client, ref string, direct bool, platform string) (*Info, error) {
+	if direct || IsArchiveRef(ref) {
+		img, cleanup, err := Load(ctx, ref, platform)
+		defer cleanup()
+		if err != nil {
+			return nil, err
+		}
+		return InfoOf(ref, img)
+	}
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting image %q: %w", ref, err)
+	}
+	history, err := cli.ImageHistory(ctx, inspect.ID)
+	if err != nil {
+		return nil, fmt.Errorf("reading the history of image %q: %w", ref, err)
+	}
+	return daemonInfo(ref, inspect, history), nil
+}
+
+// InfoOf returns the Info of an image read client-side, e.g. from a
+// registry, where only its config and manifest are fetched.
+func InfoOf(ref string, img v1.Image) (*Info, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading image config: %w", err)
+	}
+	info := &Info{
+		Ref:      ref,
+		Platform: cfg.OS + "/" + cfg.Architecture,
+		Created:  cfg.Created.Time,
+		Author:   cfg.Author,
+		Config: InfoConfig{
+			Entrypoint:   cfg.Config.Entrypoint,
+			Cmd:          cfg.Config.Cmd,
+			Env:          cfg.Config.Env,
+			WorkingDir:   cfg.Config.WorkingDir,
+			User:         cfg.Config.User,
+			ExposedPorts: sortedKeys(cfg.Config.ExposedPorts),
+			Labels:       cfg.Config.Labels,
+		},
+	}
+	if cfg.Variant != "" {
+		info.Platform += "/" + cfg.Variant
+	}
+	if id, err := img.ConfigName(); err == nil {
+		info.ID = id.String()
+	}
+	if !IsArchiveRef(ref) {
+		if parsed, err := name.ParseReference(ref); err == nil {
+			if d, err := img.Digest(); err == nil {
+				info.RepoDigests = []string{parsed.Context().Digest(d.String()).String()}
+			}
+		}
+	}
+
+	var sizes []int64
+	if layers, err := img.Layers(); err == nil {
+		for _, l := range layers {
+			size, _ := l.Size()
+			sizes = append(sizes, size)
+		}
+	}
+	layer := 0
+	for _, h := range cfg.History {
+		step := InfoHistory{
+			Created:    h.Created.Time,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer && layer < len(cfg.RootFS.DiffIDs) {
+			step.DiffID = cfg.RootFS.DiffIDs[layer].String()
+			if layer < len(sizes) {
+				step.Size = sizes[layer]
+			}
+			layer++
+			step.Layer = layer
+		}
+		info.History = append(info.History, step)
+	}
+	return info, nil
+}
+
+// daemonInfo builds the Info of an image of the Docker daemon, whose history
+// (newest first) doesn't tell empty steps from empty layers: steps are
+// paired with layers by size, or else by instruction, as long as that
+// accounts for every layer.
+func daemonInfo(ref string, inspect types.ImageInspect, history []dockerimage.HistoryResponseItem) *Info {
+	info := &Info{
+		Ref:         ref,
+		ID:          inspect.ID,
+		RepoDigests: inspect.RepoDigests,
+		Platform:    PlatformOf(inspect),
+		Author:      inspect.Author,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, inspect.Created); err == nil {
+		info.Created = t
+	}
+	if c := inspect.Config; c != nil {
+		var ports []string
+		for p := range c.ExposedPorts {
+			ports = append(ports, string(p))
+		}
+		sort.Strings(ports)
+		info.Config = InfoConfig{
+			Entrypoint:   c.Entrypoint,
+			Cmd:          c.Cmd,
+			Env:          c.Env,
+			WorkingDir:   c.WorkingDir,
+			User:         c.User,
+			ExposedPorts: ports,
+			Labels:       c.Labels,
+		}
+	}
+
+	steps := make([]dockerimage.HistoryResponseItem, len(history))
+	for i, h := range history {
+		steps[len(history)-1-i] = h
+	}
+	diffIDs := inspect.RootFS.Layers
+	bySize := func(h dockerimage.HistoryResponseItem) bool { return h.Size > 0 }
+	byInstruction := func(h dockerimage.HistoryResponseItem) bool { return h.Size > 0 || !metadataStep(h.CreatedBy) }
+	var hasLayer func(dockerimage.HistoryResponseItem) bool
+	for _, f := range []func(dockerimage.HistoryResponseItem) bool{bySize, byInstruction} {
+		n := 0
+		for _, h := range steps {
+			if f(h) {
+				n++
+			}
+		}
+		if n == len(diffIDs) {
+			hasLayer = f
+			break
+		}
+	}
+
+	layer := 0
+	for _, h := range steps {
+		step := InfoHistory{
+			CreatedBy: h.CreatedBy,
+			Comment:   h.Comment,
+		}
+		if h.Created > 0 {
+			step.Created = time.Unix(h.Created, 0).UTC()
+		}
+		switch {
+		case hasLayer == nil:
+			// Unpaired: sizes are all there is
+			step.Size = h.Size
+		case hasLayer(h):
+			step.DiffID = diffIDs[layer]
+			step.Size = h.Size
+			layer++
+			step.Layer = layer
+		default:
+			step.EmptyLayer = true
+		}
+		info.History = append(info.History, step)
+	}
+	return info
+}
+
+// metadataStep reports whether a build step only changes the image config,
+// e.g. ENV or CMD, and so produced no layer.
+func metadataStep(createdBy string) bool {
+	s := strings.TrimSpace(createdBy)
+	nop := false
+	if rest, ok := strings.CutPrefix(s, "/bin/sh -c #(nop)"); ok {
+		s, nop = strings.TrimSpace(rest), true
+	}
+	instruction, _, _ := strings.Cut(s, " ")
+	switch strings.ToUpper(instruction) {
+	case "ADD", "COPY", "RUN", "WORKDIR":
+		return false
+	case "ENV", "CMD", "ENTRYPOINT", "LABEL", "EXPOSE", "USER", "ARG", "VOLUME",
+		"STOPSIGNAL", "HEALTHCHECK", "SHELL", "ONBUILD", "MAINTAINER":
+		return true
+	}
+	return nop
+}
+
+// sortedKeys returns the keys of a set in order.
+func sortedKeys(set map[string]struct{}) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
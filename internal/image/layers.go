@@ -0,0 +1,124 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/docker/docker/client"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// LayerInfo describes one filesystem layer of an image.
+type LayerInfo struct {
+	Index     int       // 1-based position, bottom layer first
+	Digest    string    // compressed layer digest
+	Size      int64     // compressed size in bytes
+	CreatedBy string    // build instruction that produced the layer, if recorded
+	Created   time.Time // creation time from the image history, if recorded
+}
+
+// Open returns the image for ref from the most appropriate source: archives
+// are read from disk, direct mode pulls from the registry, and anything else
+// is exported from the Docker daemon. The cleanup function must always be called.
+func Open(ctx context.Context, cli *client.Client, ref string, direct bool, platform string) (v1.Image, func(), error) {
+	if direct || IsArchiveRef(ref) {
+		return Load(ctx, ref, platform)
+	}
+	return FromDaemon(ctx, cli, ref, platform)
+}
+
+// FromDaemon exports an image from the Docker daemon (like `docker save`) into
+// a temporary file and opens it. The image is pulled first if needed.
+func FromDaemon(ctx context.Context, cli *client.Client, ref, platform string) (v1.Image, func(), error) {
+	noop := func() {}
+
+	if info, _, err := cli.ImageInspectWithRaw(ctx, ref); err != nil || !platformMatches(info, platform) {
+		if err := EnsureImage(ctx, cli, ref, platform); err != nil {
+			return nil, noop, fmt.Errorf("image %q not found locally and could not be pulled: %w", ref, err)
+		}
+	}
+
+	f, err := os.CreateTemp("", "debux-save-*.tar")
+	if err != nil {
+		return nil, noop, fmt.Errorf("creating temp file: %w", err)
+	}
+	cleanup := func() { _ = os.Remove(f.Name()) }
+
+	fmt.Fprintf(os.Stderr, "Exporting %s from Docker...\n", ref)
+	rc, err := cli.ImageSave(ctx, []string{ref})
+	if err != nil {
+		_ = f.Close()
+		cleanup()
+		return nil, noop, fmt.Errorf("saving image: %w", err)
+	}
+	_, err = io.Copy(f, rc)
+	_ = rc.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("saving image: %w", err)
+	}
+
+	img, err := tarball.ImageFromPath(f.Name(), nil)
+	if err != nil {
+		cleanup()
+		return nil, noop, fmt.Errorf("reading saved image: %w", err)
+	}
+	return img, cleanup, nil
+}
+
+// Layers lists the image's filesystem layers, pairing each with the history
+// entry that created it. Empty history entries (ENV, CMD, ...) are skipped.
+func Layers(img v1.Image) ([]LayerInfo, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("reading layers: %w", err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("reading image config: %w", err)
+	}
+
+	var history []v1.History
+	for _, h := range cfg.History {
+		if !h.EmptyLayer {
+			history = append(history, h)
+		}
+	}
+
+	result := make([]LayerInfo, len(layers))
+	for i, l := range layers {
+		info := LayerInfo{Index: i + 1}
+		if d, err := l.Digest(); err == nil {
+			info.Digest = d.String()
+		}
+		if size, err := l.Size(); err == nil {
+			info.Size = size
+		}
+		if i < len(history) {
+			info.CreatedBy = history[i].CreatedBy
+			info.Created = history[i].Created.Time
+		}
+		result[i] = info
+	}
+	return result, nil
+}
+
+// LayerTar returns the uncompressed tar stream of the layer at the given
+// 1-based index. Whiteout entries are kept as-is so deletions stay visible.
+func LayerTar(img v1.Image, index int) (io.ReadCloser, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("reading layers: %w", err)
+	}
+	if index < 1 || index > len(layers) {
+		return nil, fmt.Errorf("layer %d out of range (image has %d layers)", index, len(layers))
+	}
+	return layers[index-1].Uncompressed()
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ParsePlatform parses an "os/arch[/variant]" platform string such as
+// "linux/arm64" or "linux/arm/v7". An empty string returns nil.
+func ParsePlatform(s string) (*v1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p, err := v1.ParsePlatform(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %q: %w", s, err)
+	}
+	if p.OS == "" || p.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+	return p, nil
+}
+
+// OCIPlatform converts a platform string into the form expected by the Docker
+// ContainerCreate API. An empty or invalid string returns nil (daemon default).
+func OCIPlatform(s string) *ocispec.Platform {
+	p, err := ParsePlatform(s)
+	if err != nil || p == nil {
+		return nil
+	}
+	return &ocispec.Platform{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant}
+}
+
+// PlatformOf returns the "os/arch[/variant]" string of a local image.
+func PlatformOf(info types.ImageInspect) string {
+	s := info.Os + "/" + info.Architecture
+	if info.Variant != "" {
+		s += "/" + info.Variant
+	}
+	return s
+}
+
+// platformMatches reports whether a local image satisfies the requested
+// platform. An empty platform matches anything.
+func platformMatches(info types.ImageInspect, platform string) bool {
+	want, err := ParsePlatform(platform)
+	if err != nil || want == nil {
+		return true
+	}
+	if !strings.EqualFold(info.Os, want.OS) || !strings.EqualFold(info.Architecture, want.Architecture) {
+		return false
+	}
+	return want.Variant == "" || strings.EqualFold(info.Variant, want.Variant)
+}
+
+// IsWindowsPlatform reports whether a platform string is a Windows one.
+func IsWindowsPlatform(s string) bool {
+	return strings.HasPrefix(s, "windows/")
+}
+
+// IsWindows reports whether img is a Windows image, which Linux debug
+// containers can only browse the filesystem of.
+func IsWindows(img v1.Image) bool {
+	cfg, err := img.ConfigFile()
+	return err == nil && cfg.OS == "windows"
+}
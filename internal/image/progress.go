@@ -0,0 +1,233 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/render"
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+)
+
+// pullMessage is one line of the Docker image pull stream.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// pullLayer is the last known state of one layer.
+type pullLayer struct {
+	id             string
+	status         string
+	current, total int64
+	done           bool
+}
+
+// pullProgress renders a Docker pull stream: one progress bar per layer plus
+// the total size and ETA on terminals, and a line per finished layer
+// elsewhere. Concurrent pulls are drawn together (see pullBoard).
+type pullProgress struct {
+	w        io.Writer
+	ref      string
+	terminal bool
+	start    time.Time
+	layers   []*pullLayer
+	byID     map[string]*pullLayer
+	drawn    time.Time
+	digest   string
+	done     bool
+	failed   bool
+}
+
+func newPullProgress(w io.Writer, ref string) *pullProgress {
+	p := &pullProgress{w: w, ref: ref, start: time.Now(), byID: make(map[string]*pullLayer)}
+	if f, ok := w.(*os.File); ok {
+		_, p.terminal = term.GetFdInfo(f)
+	}
+	return p
+}
+
+// pullBoard is the progress of the pulls running at once, redrawn in place
+// below the messages printed meanwhile.
+var pullBoard struct {
+	sync.Mutex
+	pulls []*pullProgress
+	lines int // lines drawn by the last render
+}
+
+// Statusf prints a progress message to Status, above the progress bars of
+// the pulls running meanwhile, with its Warning: or Note: prefix styled.
+func Statusf(format string, args ...any) {
+	pullBoard.Lock()
+	defer pullBoard.Unlock()
+	var b strings.Builder
+	if pullBoard.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA\x1b[J", pullBoard.lines)
+		pullBoard.lines = 0
+	}
+	b.WriteString(render.Status(Status, fmt.Sprintf(format, args...)))
+	_, _ = io.WriteString(Status, b.String())
+	drawPulls()
+}
+
+// consume reads the pull stream until its end and returns the digest
+// reported by the registry.
+func (p *pullProgress) consume(r io.Reader) (_ string, err error) {
+	if p.terminal {
+		pullBoard.Lock()
+		pullBoard.pulls = append(pullBoard.pulls, p)
+		pullBoard.Unlock()
+	}
+	defer func() { p.finish(err != nil) }()
+
+	dec := json.NewDecoder(r)
+	for {
+		var msg pullMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", fmt.Errorf("reading pull response: %w", err)
+		}
+		if msg.Error != "" {
+			return "", fmt.Errorf("pulling image: %s", msg.Error)
+		}
+		p.update(msg)
+	}
+	return p.digest, nil
+}
+
+// finish draws the final state of the pull, and leaves the board to the
+// messages that follow once no pull runs anymore.
+func (p *pullProgress) finish(failed bool) {
+	if !p.terminal {
+		return
+	}
+	pullBoard.Lock()
+	defer pullBoard.Unlock()
+	p.done, p.failed = true, failed
+	drawPulls()
+	for _, q := range pullBoard.pulls {
+		if !q.done {
+			return
+		}
+	}
+	pullBoard.pulls, pullBoard.lines = nil, 0
+}
+
+func (p *pullProgress) update(msg pullMessage) {
+	if d, ok := strings.CutPrefix(msg.Status, "Digest: "); ok {
+		p.digest = d
+		return
+	}
+	// Messages without an ID ("Pulling from ...", "Status: ...") aren't
+	// about a layer.
+	if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") {
+		return
+	}
+
+	pullBoard.Lock()
+	defer pullBoard.Unlock()
+	l, ok := p.byID[msg.ID]
+	if !ok {
+		l = &pullLayer{id: msg.ID}
+		p.byID[msg.ID] = l
+		p.layers = append(p.layers, l)
+	}
+	l.status = msg.Status
+	switch msg.Status {
+	case "Downloading":
+		l.current, l.total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+	case "Download complete", "Verifying Checksum", "Extracting":
+		if l.total > 0 {
+			l.current = l.total
+		}
+	case "Pull complete", "Already exists":
+		if l.total > 0 {
+			l.current = l.total
+		}
+		if !l.done && !p.terminal {
+			fmt.Fprintf(p.w, "  %s: %s\n", l.id, msg.Status)
+		}
+		l.done = true
+	}
+	// Redraw at most every 100ms
+	if p.terminal && time.Since(p.drawn) >= 100*time.Millisecond {
+		p.drawn = time.Now()
+		drawPulls()
+	}
+}
+
+// drawPulls redraws the progress bars of the running pulls in place, with
+// the image of each when there are several. The board must be locked.
+func drawPulls() {
+	if len(pullBoard.pulls) == 0 {
+		return
+	}
+	var b strings.Builder
+	if pullBoard.lines > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", pullBoard.lines)
+	}
+	lines := 0
+	for _, p := range pullBoard.pulls {
+		var current, total int64
+		for _, l := range p.layers {
+			current += l.current
+			total += l.total
+			b.WriteString("\x1b[2K  " + l.id + ": " + l.status)
+			if l.total > 0 && !l.done {
+				fmt.Fprintf(&b, " %s %s/%s", bar(l.current, l.total, 30), units.HumanSize(float64(l.current)), units.HumanSize(float64(l.total)))
+			}
+			b.WriteString("\n")
+		}
+		summary := p.summary(current, total, p.done)
+		if len(pullBoard.pulls) > 1 {
+			summary = p.ref + ": " + summary
+		}
+		b.WriteString("\x1b[2K  " + summary + "\n")
+		lines += len(p.layers) + 1
+	}
+	pullBoard.lines = lines
+	_, _ = io.WriteString(Status, b.String())
+}
+
+// summary describes the overall progress: size downloaded and ETA, or the
+// time taken once final.
+func (p *pullProgress) summary(current, total int64, final bool) string {
+	elapsed := time.Since(p.start)
+	switch {
+	case final && p.failed:
+		return fmt.Sprintf("Failed after %s", elapsed.Round(100*time.Millisecond))
+	case final:
+		return fmt.Sprintf("Done in %s, %s downloaded", elapsed.Round(100*time.Millisecond), units.HumanSize(float64(total)))
+	case total == 0:
+		return "Waiting for layers..."
+	}
+	s := fmt.Sprintf("Total %s/%s", units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+	if current > 0 && current < total && elapsed > time.Second {
+		rate := float64(current) / elapsed.Seconds()
+		eta := time.Duration(float64(total-current) / rate * float64(time.Second))
+		s += fmt.Sprintf(", %s/s, ETA %s", units.HumanSize(rate), eta.Round(time.Second))
+	}
+	return s
+}
+
+// bar draws a progress bar of the given width.
+func bar(current, total int64, width int) string {
+	n := int(float64(width) * float64(current) / float64(total))
+	n = max(0, min(n, width))
+	if n == width {
+		return "[" + strings.Repeat("=", width) + "]"
+	}
+	return "[" + strings.Repeat("=", n) + ">" + strings.Repeat(" ", width-n-1) + "]"
+}
@@ -0,0 +1,146 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pull modes of EnsureImage (--pull), as with docker run.
+const (
+	// PullMissing pulls images that aren't present locally.
+	PullMissing = "missing"
+	// PullAlways pulls images whose registry digest changed.
+	PullAlways = "always"
+	// PullNever only uses images present locally.
+	PullNever = "never"
+)
+
+// Pull is how EnsureImage pulls images.
+var Pull = PullMissing
+
+// Offline keeps debux from reaching image registries (--offline): only
+// local images are used, and what needs a registry fails with ErrOffline.
+var Offline bool
+
+// ErrOffline is the error of operations that need a registry in offline mode.
+var ErrOffline = errors.New("not available with --offline: it needs network access")
+
+// DigestCheckInterval is how long a registry digest checked with
+// --pull=always is trusted, so that sessions started in a row don't each
+// ask the registry.
+const DigestCheckInterval = time.Minute
+
+// ParsePull validates a --pull mode.
+func ParsePull(mode string) (string, error) {
+	switch mode {
+	case PullMissing, PullAlways, PullNever:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid --pull %q: expected always, missing or never", mode)
+}
+
+// cachedDigest is the registry digest of an image reference when it was
+// last checked.
+type cachedDigest struct {
+	Digest  string    `json:"digest"`
+	Checked time.Time `json:"checked"`
+}
+
+// digestCacheMu serializes the digest cache of concurrent pulls.
+var digestCacheMu sync.Mutex
+
+// digestCachePath returns the digest cache, in the debux cache directory.
+func digestCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "debux", "image-digests.json"), nil
+}
+
+// loadDigestCache returns the digest cache. A missing or damaged cache is
+// empty: it only saves registry requests.
+func loadDigestCache() map[string]cachedDigest {
+	cache := map[string]cachedDigest{}
+	path, err := digestCachePath()
+	if err != nil {
+		return cache
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		_ = json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+// cacheDigest records the registry digest of ref, checked now. Failures are
+// ignored: the next check asks the registry again.
+func cacheDigest(ref, digest string) {
+	digestCacheMu.Lock()
+	defer digestCacheMu.Unlock()
+	path, err := digestCachePath()
+	if err != nil {
+		return
+	}
+	cache := loadDigestCache()
+	cache[ref] = cachedDigest{Digest: digest, Checked: time.Now()}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".image-digests-*")
+	if err != nil {
+		return
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return
+	}
+	if tmp.Close() == nil {
+		_ = os.Rename(tmp.Name(), path)
+	}
+}
+
+// registryDigest returns the digest of ref in its registry ("sha256:..."),
+// from the cache when it was checked less than DigestCheckInterval ago.
+func registryDigest(ctx context.Context, ref string) (string, error) {
+	digestCacheMu.Lock()
+	cached, ok := loadDigestCache()[ref]
+	digestCacheMu.Unlock()
+	if ok && time.Since(cached.Checked) < DigestCheckInterval {
+		return cached.Digest, nil
+	}
+	resolved, err := resolveDigest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	_, digest, _ := strings.Cut(resolved, "@")
+	cacheDigest(ref, digest)
+	return digest, nil
+}
+
+// upToDate reports whether a local image with repoDigests is the one its
+// registry has for ref.
+func upToDate(ctx context.Context, ref string, repoDigests []string) (bool, error) {
+	digest, err := registryDigest(ctx, ref)
+	if err != nil {
+		return false, err
+	}
+	for _, rd := range repoDigests {
+		if _, d, _ := strings.Cut(rd, "@"); d == digest {
+			return true, nil
+		}
+	}
+	return false, nil
+}
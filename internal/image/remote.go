@@ -0,0 +1,92 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	goruntime "runtime"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Load returns the image for ref without involving a container daemon.
+// Archive references are read from disk; anything else is pulled straight
+// from its registry using credentials from the Docker config (including
+// credential helpers) or RegistryAuth. For multi-platform images, platform selects the variant
+// ("" means the registry default, usually linux/amd64). The cleanup function
+// must always be called.
+func Load(ctx context.Context, ref, platform string) (v1.Image, func(), error) {
+	if IsArchiveRef(ref) {
+		return OpenArchive(ref, platform)
+	}
+	img, err := PullRemote(ctx, ref, platform)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return img, func() {}, nil
+}
+
+// PullRemote fetches an image manifest and config from its registry. Layers
+// are downloaded lazily as they are read.
+func PullRemote(ctx context.Context, ref, platform string) (v1.Image, error) {
+	if Offline {
+		return nil, fmt.Errorf("fetching %s from its registry: %w", ref, ErrOffline)
+	}
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("parsing image reference %q: %w", ref, err)
+	}
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(keychain()),
+	}
+	p, err := ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		opts = append(opts, remote.WithPlatform(*p))
+	}
+	desc, err := remote.Get(parsed, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from registry: %w", ref, err)
+	}
+	if p == nil && desc.MediaType.IsIndex() {
+		// Windows-only images have no variant for the default linux/amd64
+		if img, err := windowsOnly(desc); img != nil || err != nil {
+			return img, err
+		}
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from registry: %w", ref, err)
+	}
+	return img, nil
+}
+
+// windowsOnly returns the Windows image of an index that only has Windows
+// ones, preferring the local architecture, or nil.
+func windowsOnly(desc *remote.Descriptor) (v1.Image, error) {
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	var pick *v1.Descriptor
+	for i, m := range manifest.Manifests {
+		if m.Platform == nil || m.Platform.OS != "windows" {
+			return nil, nil
+		}
+		if pick == nil || m.Platform.Architecture == goruntime.GOARCH {
+			pick = &manifest.Manifests[i]
+		}
+	}
+	if pick == nil {
+		return nil, nil
+	}
+	return idx.Image(pick.Digest)
+}
@@ -0,0 +1,89 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Signer is who must have signed an image: the owner of a cosign key, or a
+// keyless (Fulcio certificate) identity.
+type Signer struct {
+	Key      string // public key file or KMS URI, e.g. awskms://...
+	Identity string // regular expression matching the certificate identity
+	Issuer   string // OIDC issuer of the certificate
+}
+
+// DefaultSigner signs the released debug images: the Docker workflow of the
+// debux repository, keyless.
+var DefaultSigner = Signer{
+	Identity: `^https://github\.com/clement-tourriere/debux/\.github/workflows/docker\.yml@refs/`,
+	Issuer:   "https://token.actions.githubusercontent.com",
+}
+
+// Verify checks the cosign signature of ref by signer with the cosign CLI,
+// and returns ref pinned to the verified digest, so that nothing else gets
+// pulled in its place later.
+func Verify(ctx context.Context, ref string, signer Signer) (string, error) {
+	if IsArchiveRef(ref) {
+		return "", fmt.Errorf("verifying %s: only registry images carry signatures", ref)
+	}
+	if Offline {
+		return "", fmt.Errorf("verifying %s: signatures are fetched from its registry, %w", ref, ErrOffline)
+	}
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return "", fmt.Errorf("verifying %s: cosign is not installed (https://docs.sigstore.dev/cosign/system_config/installation/)", ref)
+	}
+	pinned, err := resolveDigest(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"verify"}
+	switch {
+	case signer.Key != "":
+		args = append(args, "--key", signer.Key)
+	case signer.Identity != "" && signer.Issuer != "":
+		args = append(args, "--certificate-identity-regexp", signer.Identity, "--certificate-oidc-issuer", signer.Issuer)
+	default:
+		return "", fmt.Errorf("verifying %s: no signer: set a key, or an identity and its issuer", ref)
+	}
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, "cosign", append(args, pinned)...)
+	c.Stdout = io.Discard
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", fmt.Errorf("signature verification of %s failed: %s", pinned, msg)
+	}
+	return pinned, nil
+}
+
+// resolveDigest returns ref as repository@digest, asking the registry for
+// the digest of tags.
+func resolveDigest(ctx context.Context, ref string) (string, error) {
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		return "", fmt.Errorf("parsing image reference %q: %w", ref, err)
+	}
+	if d, ok := parsed.(name.Digest); ok {
+		return d.String(), nil
+	}
+	if Offline {
+		return "", fmt.Errorf("resolving the digest of %s: %w", ref, ErrOffline)
+	}
+	desc, err := remote.Head(parsed, remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain()))
+	if err != nil {
+		return "", fmt.Errorf("resolving the digest of %s: %w", ref, err)
+	}
+	return parsed.Context().Digest(desc.Digest.String()).String(), nil
+}
@@ -0,0 +1,98 @@
+// Package jvm finds the JVMs of a target from its debug container, which
+// shares the target's PID namespace, and drives them with jattach: thread
+// dumps, heap dumps and Flight Recorder recordings, without a JDK in the
+// target image.
+package jvm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DetectScript is the shell script printing a "<pid>\t<uid>\t<command line>"
+// line per JVM: processes running a java binary, or with libjvm mapped
+// (launchers like Tomcat's jsvc, or native images embedding a JVM).
+const DetectScript = `for d in /proc/[0-9]*; do
+  pid=${d#/proc/}
+  [ "$pid" = "$$" ] && continue
+  cmd=$(tr '\0' ' ' < "$d/cmdline" 2>/dev/null)
+  [ -n "$cmd" ] || continue
+  exe=$(readlink "$d/exe" 2>/dev/null)
+  case "${exe:-${cmd%% *}}" in
+    */java|java) ;;
+    *) grep -q libjvm "$d/maps" 2>/dev/null || continue ;;
+  esac
+  printf '%s\t%s\t%s\n' "$pid" "$(stat -c %u "$d")" "$cmd"
+done
+`
+
+// Process is a JVM of the target.
+type Process struct {
+	PID     int    `json:"pid"`
+	UID     int    `json:"uid"`
+	Command string `json:"command"`
+}
+
+// ParseProcesses parses the output of DetectScript.
+func ParseProcesses(out []byte) []Process {
+	var procs []Process
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		uid, _ := strconv.Atoi(fields[1])
+		procs = append(procs, Process{PID: pid, UID: uid, Command: strings.TrimSpace(fields[2])})
+	}
+	return procs
+}
+
+// Main returns what the JVM runs: its main class, or "-jar <jar>" or
+// "-m <module>".
+func (p Process) Main() string {
+	args := strings.Fields(p.Command)
+	for i := 1; i < len(args); i++ {
+		switch a := args[i]; a {
+		case "-jar", "-m", "--module":
+			if i+1 < len(args) {
+				return a + " " + path.Base(args[i+1])
+			}
+		case "-cp", "-classpath", "--class-path", "-p", "--module-path", "--add-opens", "--add-exports", "--add-modules":
+			i++ // skip the value
+		default:
+			if !strings.HasPrefix(a, "-") {
+				return a
+			}
+		}
+	}
+	return path.Base(args[0])
+}
+
+// Script returns the shell script running jattach with args on the JVM
+// pid, installing jattach with dctl first when the debug image lacks it.
+// jattach switches to the JVM's user and reaches its attach socket through
+// /proc/<pid>/root, so the JVM needs no JDK tools.
+func Script(pid int, args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return fmt.Sprintf(`set -e
+export PATH="/nix/var/debux-profile/bin:$PATH"
+if ! command -v jattach >/dev/null 2>&1; then
+  echo "Installing jattach..." >&2
+  dctl install jattach >&2
+fi
+exec jattach %d %s
+`, pid, strings.Join(quoted, " "))
+}
@@ -0,0 +1,197 @@
+// Package mcp serves tools over the Model Context Protocol: JSON-RPC 2.0
+// messages, one per line, on stdin and stdout of a process started by the
+// client (the stdio transport). It implements what tool servers need:
+// initialization, ping, and listing and calling tools.
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// LatestVersion is the protocol version offered to clients that ask for one
+// this package doesn't know.
+const LatestVersion = "2025-06-18"
+
+var versions = []string{"2024-11-05", "2025-03-26", LatestVersion}
+
+// Tool is a function the client can call.
+type Tool struct {
+	Name        string
+	Description string
+	// InputSchema is the JSON schema of the arguments, an object.
+	InputSchema map[string]any
+	// ReadOnly tells clients the tool doesn't modify its environment.
+	ReadOnly bool
+	// Call runs the tool with its JSON arguments and returns its text
+	// result. Errors are reported to the model as the result of the call.
+	Call func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// Server answers the requests of a client.
+type Server struct {
+	Name         string
+	Version      string
+	Instructions string // how to use the tools, for the model
+	Tools        []Tool
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error codes.
+const (
+	errParse          = -32700
+	errInvalidRequest = -32600
+	errMethodNotFound = -32601
+	errInvalidParams  = -32602
+)
+
+// Serve answers the requests read from r on w until r ends or ctx is done.
+// Requests run concurrently, so that pings are answered during long tool
+// calls.
+func (s *Server) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu sync.Mutex // serializes responses
+		wg sync.WaitGroup
+	)
+	send := func(resp response) {
+		resp.JSONRPC = "2.0"
+		data, err := json.Marshal(resp)
+		if err != nil {
+			data, _ = json.Marshal(response{JSONRPC: "2.0", ID: resp.ID, Error: &rpcError{Code: -32603, Message: err.Error()}})
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write(append(data, '\n'))
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var req request
+		if err := json.Unmarshal(line, &req); err != nil {
+			send(response{ID: json.RawMessage("null"), Error: &rpcError{Code: errParse, Message: err.Error()}})
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			if req.ID != nil {
+				send(response{ID: req.ID, Error: &rpcError{Code: errInvalidRequest, Message: "invalid JSON-RPC 2.0 request"}})
+			}
+			continue
+		}
+		if req.ID == nil {
+			// Notifications (initialized, cancelled...) need no answer
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, rerr := s.handle(ctx, req)
+			send(response{ID: req.ID, Result: result, Error: rerr})
+		}()
+	}
+	cancel()
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading requests: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) handle(ctx context.Context, req request) (any, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := LatestVersion
+		if slices.Contains(versions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		result := map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": s.Name, "version": s.Version},
+		}
+		if s.Instructions != "" {
+			result["instructions"] = s.Instructions
+		}
+		return result, nil
+
+	case "ping":
+		return map[string]any{}, nil
+
+	case "tools/list":
+		tools := make([]map[string]any, 0, len(s.Tools))
+		for _, t := range s.Tools {
+			tool := map[string]any{
+				"name":        t.Name,
+				"description": t.Description,
+				"inputSchema": t.InputSchema,
+			}
+			if t.ReadOnly {
+				tool["annotations"] = map[string]any{"readOnlyHint": true}
+			}
+			tools = append(tools, tool)
+		}
+		return map[string]any{"tools": tools}, nil
+
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &rpcError{Code: errInvalidParams, Message: err.Error()}
+		}
+		i := slices.IndexFunc(s.Tools, func(t Tool) bool { return t.Name == params.Name })
+		if i < 0 {
+			return nil, &rpcError{Code: errInvalidParams, Message: "unknown tool: " + params.Name}
+		}
+		if len(params.Arguments) == 0 || string(params.Arguments) == "null" {
+			params.Arguments = json.RawMessage("{}")
+		}
+		text, err := s.Tools[i].Call(ctx, params.Arguments)
+		isError := false
+		if err != nil {
+			text, isError = err.Error(), true
+		}
+		return map[string]any{
+			"content": []map[string]any{{"type": "text", "text": text}},
+			"isError": isError,
+		}, nil
+
+	default:
+		return nil, &rpcError{Code: errMethodNotFound, Message: "method not found: " + req.Method}
+	}
+}
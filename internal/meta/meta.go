@@ -0,0 +1,135 @@
+// Package meta defines the ownership metadata debux attaches to the resources
+// it creates (containers, volumes, pods, ephemeral containers), and how to
+// recognize them. Discovery relies on these labels rather than on names, since
+// user containers can be named "debux-..." too.
+package meta
+
+import (
+	"os"
+	"os/user"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Version is the debux version, set at build time with
+// -ldflags "-X github.com/clement-tourriere/debux/internal/meta.Version=...".
+var Version = ""
+
+// Keys of the labels (Docker, Kubernetes) and annotations (Kubernetes).
+const (
+	ManagedByKey     = "managed-by"                   // Docker
+	KubeManagedByKey = "app.kubernetes.io/managed-by" // Kubernetes
+	ManagedBy        = "debux"
+
+	KindKey      = "debux.kind"
+	TargetKey    = "debux.target"
+	VersionKey   = "debux.version"
+	CreatorKey   = "debux.creator"
+	CreatedAtKey = "debux.created-at"
+
+	// ApprovalKeyPrefix prefixes the pod annotations of sessions waiting
+	// for an approval, followed by their ID.
+	ApprovalKeyPrefix = "debux.approval."
+)
+
+// Kinds of resources, the value of KindKey.
+const (
+	KindSidecar      = "sidecar"       // Docker debug sidecar of a running container
+	KindImageSession = "image-session" // Docker debug container of "debux image"
+	KindImageDiff    = "image-diff"    // Docker debug container of "debux image diff --shell"
+	KindImageTarget  = "image-target"  // stopped container created to export an image filesystem
+	KindMaintenance  = "maintenance"   // store maintenance container
+	KindStore        = "store"         // persistent Nix store volume
+	KindPod          = "pod"           // standalone debug pod
+	KindImagePod     = "image-pod"     // Kubernetes pod of "debux image --runtime k8s"
+	KindPrewarm      = "prewarm"       // Kubernetes DaemonSet of "debux prewarm"
+	KindLayerCache   = "layer-cache"   // Docker volume of image layers, and the containers filling it
+)
+
+// EnvManagedBy marks ephemeral containers, which carry no labels, as
+// created by debux. The other metadata is passed as DEBUX_* variables too.
+const EnvManagedBy = "DEBUX_MANAGED_BY"
+
+// BuildVersion returns Version, or the module version when built with go
+// install.
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// User returns the name of the local user running debux, "unknown" when it
+// can't be told.
+func User() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// Creator identifies who created a resource, as user@host.
+func Creator() string {
+	name := User()
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+// Labels returns the Docker labels of a new resource of the given kind,
+// debugging target ("" when there is none).
+func Labels(kind, target string) map[string]string {
+	labels := map[string]string{
+		ManagedByKey: ManagedBy,
+		KindKey:      kind,
+		VersionKey:   BuildVersion(),
+		CreatorKey:   Creator(),
+		CreatedAtKey: time.Now().UTC().Format(time.RFC3339),
+	}
+	if target != "" {
+		labels[TargetKey] = target
+	}
+	return labels
+}
+
+// KubeLabels returns the Kubernetes labels of a new resource. Label values
+// are restricted, so the rest of the metadata goes to KubeAnnotations.
+func KubeLabels(kind string) map[string]string {
+	return map[string]string{KubeManagedByKey: ManagedBy, KindKey: kind}
+}
+
+// KubeAnnotations returns the Kubernetes annotations of a new resource.
+func KubeAnnotations(target string) map[string]string {
+	annotations := Labels("", target)
+	delete(annotations, ManagedByKey)
+	delete(annotations, KindKey)
+	return annotations
+}
+
+// Env returns the metadata of an ephemeral container as environment
+// variables (DEBUX_VERSION, ...). The target is already in DEBUX_TARGET.
+func Env() []string {
+	env := []string{EnvManagedBy + "=" + ManagedBy}
+	annotations := KubeAnnotations("")
+	for _, key := range []string{VersionKey, CreatorKey, CreatedAtKey} {
+		name := strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+		env = append(env, name+"="+annotations[key])
+	}
+	return env
+}
+
+// IsManaged reports whether Docker or Kubernetes labels mark a resource as
+// created by debux.
+func IsManaged(labels map[string]string) bool {
+	return labels[ManagedByKey] == ManagedBy || labels[KubeManagedByKey] == ManagedBy
+}
+
+// IsKind reports whether labels mark a debux resource of the given kind.
+func IsKind(labels map[string]string, kind string) bool {
+	return IsManaged(labels) && labels[KindKey] == kind
+}
@@ -0,0 +1,281 @@
+// Package netcheck runs the network checklist of an incident from inside a
+// target's network namespace: DNS configuration and resolution, routes, path
+// MTU, and TCP and TLS connectivity to given endpoints. The checks run in a
+// debug container with dig, ip, tracepath and curl; this package builds the
+// script and interprets its output, plus NetworkPolicy hints gathered from
+// the Kubernetes API.
+package netcheck
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Statuses of checks.
+const (
+	Pass = "pass"
+	Warn = "warn"
+	Fail = "fail"
+	Skip = "skip"
+)
+
+// Endpoint is a destination whose connectivity is checked.
+type Endpoint struct {
+	Name string `json:"name"` // as given to --to
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	TLS  bool   `json:"tls"` // also check a TLS handshake
+}
+
+// Check is the outcome of one check.
+type Check struct {
+	Category string `json:"category"` // dns, route, mtu, tcp, tls, policy
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// Report lists the checks run for a target.
+type Report struct {
+	Target string  `json:"target"`
+	Checks []Check `json:"checks"`
+}
+
+// Failed returns the number of failed checks.
+func (r *Report) Failed() int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == Fail {
+			n++
+		}
+	}
+	return n
+}
+
+// Policy is a NetworkPolicy selecting the target pod.
+type Policy struct {
+	Name      string
+	Ingress   bool // restricts ingress
+	Egress    bool // restricts egress
+	AllowsDNS bool // some egress rule allows port 53
+}
+
+// ParseEndpoint parses a --to endpoint: host:port, [ipv6]:port, or
+// tls://host[:port] and https://host[:port] (port 443 by default). Port 443
+// always gets a TLS check. Kubernetes services (svc/<name>[:port]) are
+// resolved by the caller.
+func ParseEndpoint(s string) (Endpoint, error) {
+	e := Endpoint{Name: s}
+	rest := s
+	for _, scheme := range []string{"tls://", "https://"} {
+		if r, ok := strings.CutPrefix(s, scheme); ok {
+			rest, e.TLS = strings.TrimSuffix(r, "/"), true
+			if _, _, err := net.SplitHostPort(rest); err != nil {
+				rest = net.JoinHostPort(strings.Trim(rest, "[]"), "443")
+			}
+		}
+	}
+	host, port, err := net.SplitHostPort(rest)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %q: expected host:port, tls://host[:port] or svc/<name>[:port]", s)
+	}
+	e.Host = host
+	if e.Port, err = strconv.Atoi(port); err != nil || e.Port <= 0 || e.Port > 65535 {
+		return Endpoint{}, fmt.Errorf("invalid port in endpoint %q", s)
+	}
+	if e.Port == 443 {
+		e.TLS = true
+	}
+	return e, nil
+}
+
+// Args returns the arguments of Script for endpoints.
+func Args(endpoints []Endpoint) []string {
+	args := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		tls := "0"
+		if e.TLS {
+			tls = "1"
+		}
+		args = append(args, e.Name+" "+e.Host+" "+strconv.Itoa(e.Port)+" "+tls)
+	}
+	return args
+}
+
+// Script returns the zsh script running the checks, with the endpoints of
+// Args as its arguments. DNS is checked against the target's resolv.conf
+// ($DEBUX_TARGET_ROOT/etc/resolv.conf), which a Docker sidecar sharing its
+// network namespace doesn't share. Each check is printed as
+// "CHECK\t<category>\t<name>\t<status>\t<detail>".
+func Script() string {
+	return `root="${DEBUX_TARGET_ROOT:-/proc/1/root}"
+resolv="$root/etc/resolv.conf"
+[ -r "$resolv" ] || resolv=/etc/resolv.conf
+report() { printf 'CHECK\t%s\t%s\t%s\t%s\n' "$1" "$2" "$3" "$4"; }
+now() { date +%s%3N; }
+zmodload zsh/net/tcp 2>/dev/null
+
+# DNS configuration and servers
+nameservers=($(awk '$1 == "nameserver" { print $2 }' "$resolv" 2>/dev/null))
+search=($(awk '$1 == "search" || $1 == "domain" { for (i = 2; i <= NF; i++) print $i }' "$resolv" 2>/dev/null))
+ndots=$(sed -n 's/^options.*ndots:\([0-9]*\).*/\1/p' "$resolv" 2>/dev/null | tail -1)
+ndots=${ndots:-1}
+if (( ${#nameservers} == 0 )); then
+  report dns resolv.conf fail "no nameserver in /etc/resolv.conf"
+else
+  report dns resolv.conf pass "nameservers ${nameservers[*]}; search ${search[*]:-(none)}; ndots $ndots"
+fi
+for ns in $nameservers; do
+  t=$(now)
+  if dig @"$ns" +time=2 +tries=1 +short debux-netcheck.invalid >/dev/null 2>&1; then
+    report dns "server $ns" pass "answered in $(( $(now) - t ))ms"
+  else
+    report dns "server $ns" fail "no answer within 2s"
+  fi
+done
+
+# resolve <host>: prints the first address, trying the search domains as
+# the target's resolver does
+resolve() {
+  local host=$1 name addr names=() dots=${#1//[^.]/}
+  if [[ $host == <->.<->.<->.<-> || $host == *:* ]]; then
+    print -r -- "$host"; return 0
+  fi
+  if [[ $host == *. ]]; then
+    names=($host)
+  elif (( dots >= ndots )); then
+    names=($host ${search/#/$host.})
+  else
+    names=(${search/#/$host.} $host)
+  fi
+  for name in $names; do
+    addr=$(dig @"${nameservers[1]:-127.0.0.1}" +time=2 +tries=1 +short "$name" A "$name" AAAA 2>/dev/null | grep -v '\.$' | head -1)
+    if [[ -n $addr ]]; then
+      print -r -- "$addr $name"; return 0
+    fi
+  done
+  return 1
+}
+
+# Routes
+default=$(ip route show default 2>/dev/null | head -1)
+routes=$(ip route show 2>/dev/null | wc -l)
+if [[ -n $default ]]; then
+  report route default pass "$default ($routes routes)"
+elif ip -6 route show default 2>/dev/null | grep -q .; then
+  report route default pass "$(ip -6 route show default | head -1) (IPv6 only)"
+else
+  report route default fail "no default route ($routes routes)"
+fi
+dev=$(print -r -- "$default" | awk '{ for (i = 1; i < NF; i++) if ($i == "dev") print $(i + 1) }')
+mtu=$(ip -o link show dev "${dev:-eth0}" 2>/dev/null | sed -n 's/.* mtu \([0-9]*\).*/\1/p')
+[[ -n $mtu ]] && report mtu "interface ${dev:-eth0}" pass "mtu $mtu"
+
+# Endpoints
+for endpoint in "$@"; do
+  read -r name host port tls <<<"$endpoint"
+  resolved=$(resolve "$host")
+  if [[ -z $resolved ]]; then
+    report dns "$name" fail "$host doesn't resolve"
+    continue
+  fi
+  addr=${resolved%% *}
+  [[ $resolved == *" "* ]] && report dns "$name" pass "${resolved#* } → $addr"
+
+  t=$(now)
+  if err=$(timeout 5 zsh -c 'zmodload zsh/net/tcp && ztcp "$1" "$2" && ztcp -c' tcp "$addr" "$port" 2>&1); then
+    report tcp "$name" pass "connected to $addr:$port in $(( $(now) - t ))ms"
+  elif [[ -z $err ]]; then
+    report tcp "$name" fail "no answer from $addr:$port within 5s (filtered?)"
+  else
+    report tcp "$name" fail "$addr:$port: ${err##*: }"
+  fi
+
+  if (( tls )); then
+    out=$(curl -sS -o /dev/null --connect-timeout 5 --max-time 10 --resolve "$host:$port:$addr" "https://$host:$port/" 2>&1)
+    case $? in
+      35|51|53|54|58|59|60|64|66|77|80|82|83|90|91)
+        report tls "$name" fail "${out#curl: }" ;;
+      6|7|28)
+        report tls "$name" skip "no connection" ;;
+      *)
+        report tls "$name" pass "certificate of $host verified" ;;
+    esac
+  fi
+
+  if command -v tracepath >/dev/null; then
+    pmtu=$(timeout 15 tracepath -n -m 8 "$addr" 2>/dev/null | sed -n 's/.*pmtu \([0-9]*\).*/\1/p' | tail -1)
+    if [[ -z $pmtu ]]; then
+      report mtu "$name" skip "path MTU not discovered"
+    elif [[ -n $mtu ]] && (( pmtu < mtu )); then
+      report mtu "$name" warn "path MTU $pmtu is below the interface's $mtu: large packets may be dropped"
+    else
+      report mtu "$name" pass "path MTU $pmtu"
+    fi
+  fi
+done
+exit 0
+`
+}
+
+// Parse turns the script output into a report.
+func Parse(output []byte) *Report {
+	report := &Report{Checks: []Check{}}
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 5)
+		if len(fields) < 4 || fields[0] != "CHECK" {
+			continue
+		}
+		c := Check{Category: fields[1], Name: fields[2], Status: fields[3]}
+		if len(fields) == 5 {
+			c.Detail = fields[4]
+		}
+		report.Checks = append(report.Checks, c)
+	}
+	return report
+}
+
+// AddPolicies adds the NetworkPolicy hints of the pod's policies: which
+// restrict it, egress policies without DNS, and which may explain failed
+// connections.
+func (r *Report) AddPolicies(policies []Policy) {
+	if len(policies) == 0 {
+		r.Checks = append(r.Checks, Check{Category: "policy", Name: "networkpolicies", Status: Pass, Detail: "no NetworkPolicy selects the pod"})
+		return
+	}
+	var egress []string
+	for _, p := range policies {
+		var restricts []string
+		if p.Ingress {
+			restricts = append(restricts, "ingress")
+		}
+		if p.Egress {
+			restricts = append(restricts, "egress")
+			egress = append(egress, p.Name)
+		}
+		c := Check{Category: "policy", Name: p.Name, Status: Pass, Detail: "restricts " + strings.Join(restricts, " and ")}
+		if p.Egress && !p.AllowsDNS {
+			c.Status, c.Detail = Warn, c.Detail+"; no egress rule allows port 53 (DNS)"
+		}
+		r.Checks = append(r.Checks, c)
+	}
+	if len(egress) == 0 {
+		return
+	}
+	for _, c := range r.Checks {
+		if c.Status == Fail && (c.Category == "tcp" || c.Category == "dns") {
+			r.Checks = append(r.Checks, Check{
+				Category: "policy",
+				Name:     "egress",
+				Status:   Warn,
+				Detail:   "failures may come from the egress rules of " + strings.Join(egress, ", "),
+			})
+			return
+		}
+	}
+}
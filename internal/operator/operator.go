@@ -0,0 +1,363 @@
+// Package operator is the debux operator: an in-cluster controller that
+// injects debug containers for DebugSession resources. Users then only need
+// RBAC on DebugSessions, not on the ephemeral containers of pods, and the
+// operator enforces TTLs and the policy file server-side, records sessions
+// in the audit log and garbage-collects finished sessions.
+package operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/clement-tourriere/debux/internal/audit"
+	"github.com/clement-tourriere/debux/internal/policy"
+	"github.com/clement-tourriere/debux/internal/runtime"
+)
+
+// finalizer lets the operator stop the debug container of a running
+// session that is deleted.
+const finalizer = "debux.dev/stop-debug-container"
+
+// resync is how often every session is reconciled, for TTLs and garbage
+// collection.
+const resync = 10 * time.Second
+
+// Options configure the operator.
+type Options struct {
+	Kubeconfig string
+	Namespace  string        // namespace to watch, all when empty
+	Image      string        // debug image of sessions that don't set one
+	TTL        time.Duration // TTL of sessions that don't set one
+	MaxTTL     time.Duration // longest TTL a session may ask for
+	Retention  time.Duration // how long finished sessions are kept
+	Cluster    string        // cluster name, matched by policy contexts
+	Policy     *policy.Policy
+	Audit      *audit.Logger
+}
+
+type operator struct {
+	opts   Options
+	client dynamic.NamespaceableResourceInterface
+
+	mu       sync.Mutex
+	starting map[string]bool           // sessions whose debug container is starting, by UID
+	sessions map[string]*audit.Session // audited running sessions, by UID
+}
+
+// Run reconciles DebugSessions until ctx is done.
+func Run(ctx context.Context, opts Options) error {
+	client, err := runtime.DebugSessionClient(opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	// Targets in namespace default resolve to the current namespace, which
+	// in-cluster is the operator's own
+	if opts.Kubeconfig == "" {
+		_ = os.Setenv("POD_NAMESPACE", "default")
+	}
+	o := &operator{opts: opts, client: client, starting: map[string]bool{}, sessions: map[string]*audit.Session{}}
+	var res dynamic.ResourceInterface = client
+	if opts.Namespace != "" {
+		res = client.Namespace(opts.Namespace)
+	}
+	logf("Watching DebugSessions in %s", namespaceName(opts.Namespace))
+	for {
+		list, err := res.List(ctx, metav1.ListOptions{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("listing DebugSessions (is the CRD installed?): %w", err)
+		}
+		for i := range list.Items {
+			o.reconcile(ctx, &list.Items[i])
+		}
+		w, err := res.Watch(ctx, metav1.ListOptions{ResourceVersion: list.GetResourceVersion()})
+		if err != nil {
+			return fmt.Errorf("watching DebugSessions: %w", err)
+		}
+		o.watch(ctx, w)
+		w.Stop()
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// watch reconciles the sessions w reports, until the next resync.
+func (o *operator) watch(ctx context.Context, w watch.Interface) {
+	timer := time.NewTimer(resync)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			if u, isObj := ev.Object.(*unstructured.Unstructured); isObj && (ev.Type == watch.Added || ev.Type == watch.Modified) {
+				o.reconcile(ctx, u)
+			}
+		}
+	}
+}
+
+func (o *operator) reconcile(ctx context.Context, u *unstructured.Unstructured) {
+	s, err := runtime.DebugSessionFromUnstructured(u)
+	if err != nil {
+		logf("%v", err)
+		return
+	}
+	switch {
+	case s.DeletionTimestamp != nil:
+		o.deleted(ctx, s)
+	case s.Status.Phase == runtime.SessionPending:
+		o.mu.Lock()
+		starting := o.starting[string(s.UID)]
+		o.starting[string(s.UID)] = true
+		o.mu.Unlock()
+		if !starting {
+			// Debug containers take a while to start: don't hold up the others
+			go func() {
+				o.start(ctx, s)
+				o.mu.Lock()
+				delete(o.starting, string(s.UID))
+				o.mu.Unlock()
+			}()
+		}
+	case s.Status.Phase == runtime.SessionRunning:
+		o.check(ctx, s)
+	case s.Status.EndedAt == nil || time.Since(s.Status.EndedAt.Time) > o.opts.Retention:
+		if err := o.client.Namespace(s.Namespace).Delete(ctx, s.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logf("%s/%s: deleting: %v", s.Namespace, s.Name, err)
+		}
+	}
+}
+
+// start checks a new session against the policy and starts its debug
+// container.
+func (o *operator) start(ctx context.Context, s *runtime.DebugSession) {
+	if !slices.Contains(s.Finalizers, finalizer) {
+		s.Finalizers = append(s.Finalizers, finalizer)
+		var err error
+		if s, err = o.update(ctx, s); err != nil {
+			logf("%s/%s: adding the finalizer: %v", s.Namespace, s.Name, err)
+			return
+		}
+	}
+	ttl, err := o.ttl(s.Spec.TTL)
+	if err != nil {
+		o.finish(ctx, s, runtime.SessionFailed, err.Error())
+		return
+	}
+	if s.Spec.Image == "" {
+		s.Spec.Image = o.opts.Image
+	}
+	if s.Spec.Profile == "" {
+		s.Spec.Profile = runtime.ProfileGeneral
+	}
+	target := &runtime.Target{Runtime: "kubernetes", Name: s.Spec.Pod, Namespace: s.Namespace, Container: s.Spec.Container}
+	req := policy.Request{
+		Command:    "exec",
+		Kind:       policy.KindContainer,
+		Runtime:    "kubernetes",
+		Target:     target.String(),
+		Name:       s.Spec.Pod,
+		Context:    o.opts.Cluster,
+		Namespace:  s.Namespace,
+		Image:      s.Spec.Image,
+		Profile:    s.Spec.Profile,
+		Privileged: s.Spec.Profile == runtime.ProfileSysadmin,
+		User:       s.Spec.RequestedBy, // the creator, as the debux-session-requester admission policy checks
+	}
+	if o.opts.Policy != nil {
+		d, err := o.opts.Policy.Decide(ctx, req)
+		switch {
+		case err != nil:
+			o.finish(ctx, s, runtime.SessionFailed, err.Error())
+			return
+		case !d.Allowed:
+			o.finish(ctx, s, runtime.SessionDenied, d.Reason)
+			return
+		case d.Approval != nil:
+			o.finish(ctx, s, runtime.SessionDenied, "the policy requires an approval, which the operator doesn't collect")
+			return
+		}
+	}
+
+	logf("%s/%s: starting a debug container in %s for %s", s.Namespace, s.Name, target, s.Spec.RequestedBy)
+	name, err := runtime.KubernetesSidecar(ctx, target, runtime.DebugOpts{
+		Image:          s.Spec.Image,
+		Kubeconfig:     o.opts.Kubeconfig,
+		ShareVolumes:   s.Spec.ShareVolumes,
+		Volumes:        s.Spec.Volumes,
+		ExcludeVolumes: s.Spec.ExcludeVolumes,
+		ReadOnlyTarget: s.Spec.ReadOnlyTarget,
+		PullPolicy:     s.Spec.PullPolicy,
+		Profile:        s.Spec.Profile,
+		// Every session gets its own container, stopped at its TTL. Naming
+		// it after the session finds it again when the status update below
+		// failed, instead of starting another one at the next resync.
+		Name: sessionContainer(s),
+	})
+	if err != nil {
+		o.finish(ctx, s, runtime.SessionFailed, err.Error())
+		return
+	}
+	if o.opts.Audit != nil {
+		a, err := o.opts.Audit.Start(ctx, req, []string{"--ttl=" + ttl.String()})
+		if err != nil {
+			_ = runtime.KubernetesStopContainer(ctx, o.opts.Kubeconfig, s.Namespace, s.Spec.Pod, name)
+			o.finish(ctx, s, runtime.SessionFailed, err.Error())
+			return
+		}
+		o.mu.Lock()
+		o.sessions[string(s.UID)] = a
+		o.mu.Unlock()
+	}
+	now := metav1.Now()
+	expires := metav1.NewTime(now.Add(ttl))
+	s.Status = runtime.DebugSessionStatus{Phase: runtime.SessionRunning, Container: name, StartedAt: &now, ExpiresAt: &expires}
+	if _, err := o.updateStatus(ctx, s); err != nil {
+		logf("%s/%s: %v", s.Namespace, s.Name, err)
+	}
+}
+
+// check stops the debug container of a running session past its TTL, and
+// ends sessions whose debug container is gone.
+func (o *operator) check(ctx context.Context, s *runtime.DebugSession) {
+	if s.Status.ExpiresAt != nil && time.Now().After(s.Status.ExpiresAt.Time) {
+		logf("%s/%s: TTL elapsed, stopping %s", s.Namespace, s.Name, s.Status.Container)
+		if err := o.stop(ctx, s); err != nil {
+			logf("%s/%s: stopping %s: %v", s.Namespace, s.Name, s.Status.Container, err)
+			return
+		}
+		o.finish(ctx, s, runtime.SessionExpired, "the TTL elapsed")
+		return
+	}
+	running, err := runtime.KubernetesContainerRunning(ctx, o.opts.Kubeconfig, s.Namespace, s.Spec.Pod, s.Status.Container)
+	if err != nil {
+		logf("%s/%s: %v", s.Namespace, s.Name, err)
+		return
+	}
+	if !running {
+		o.finish(ctx, s, runtime.SessionEnded, "the debug container or its pod is gone")
+	}
+}
+
+// deleted stops the debug container of a deleted session, then lets
+// Kubernetes delete it.
+func (o *operator) deleted(ctx context.Context, s *runtime.DebugSession) {
+	if !slices.Contains(s.Finalizers, finalizer) {
+		return
+	}
+	if s.Status.Phase == runtime.SessionRunning {
+		if err := o.stop(ctx, s); err != nil {
+			logf("%s/%s: stopping %s: %v", s.Namespace, s.Name, s.Status.Container, err)
+		}
+		o.endAudit(s, nil)
+	}
+	s.Finalizers = slices.DeleteFunc(s.Finalizers, func(f string) bool { return f == finalizer })
+	if _, err := o.update(ctx, s); err != nil && !apierrors.IsNotFound(err) {
+		logf("%s/%s: removing the finalizer: %v", s.Namespace, s.Name, err)
+	}
+}
+
+// stop stops the debug container of s, unless its pod is already gone.
+func (o *operator) stop(ctx context.Context, s *runtime.DebugSession) error {
+	running, err := runtime.KubernetesContainerRunning(ctx, o.opts.Kubeconfig, s.Namespace, s.Spec.Pod, s.Status.Container)
+	if err != nil || !running {
+		return err
+	}
+	return runtime.KubernetesStopContainer(ctx, o.opts.Kubeconfig, s.Namespace, s.Spec.Pod, s.Status.Container)
+}
+
+// finish moves s to a final phase.
+func (o *operator) finish(ctx context.Context, s *runtime.DebugSession, phase, message string) {
+	logf("%s/%s: %s: %s", s.Namespace, s.Name, phase, message)
+	if s.Status.Phase == runtime.SessionRunning {
+		var err error
+		if phase != runtime.SessionEnded {
+			err = fmt.Errorf("%s", message)
+		}
+		o.endAudit(s, err)
+	}
+	now := metav1.Now()
+	s.Status.Phase, s.Status.Message, s.Status.EndedAt = phase, message, &now
+	if _, err := o.updateStatus(ctx, s); err != nil {
+		logf("%s/%s: %v", s.Namespace, s.Name, err)
+	}
+}
+
+func (o *operator) endAudit(s *runtime.DebugSession, err error) {
+	o.mu.Lock()
+	a := o.sessions[string(s.UID)]
+	delete(o.sessions, string(s.UID))
+	o.mu.Unlock()
+	a.End(err)
+}
+
+// ttl returns the TTL of a session asking for ttl, capped to MaxTTL.
+func (o *operator) ttl(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return o.opts.TTL, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", ttl)
+	}
+	return min(d, o.opts.MaxTTL), nil
+}
+
+func (o *operator) update(ctx context.Context, s *runtime.DebugSession) (*runtime.DebugSession, error) {
+	u, err := s.Unstructured()
+	if err != nil {
+		return s, err
+	}
+	u, err = o.client.Namespace(s.Namespace).Update(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return s, err
+	}
+	return runtime.DebugSessionFromUnstructured(u)
+}
+
+func (o *operator) updateStatus(ctx context.Context, s *runtime.DebugSession) (*runtime.DebugSession, error) {
+	u, err := s.Unstructured()
+	if err != nil {
+		return s, err
+	}
+	u, err = o.client.Namespace(s.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return s, fmt.Errorf("updating the status: %w", err)
+	}
+	return runtime.DebugSessionFromUnstructured(u)
+}
+
+// sessionContainer returns the name of the debug container of s.
+func sessionContainer(s *runtime.DebugSession) string {
+	return "debux-session-" + string(s.UID)
+}
+
+func namespaceName(namespace string) string {
+	if namespace == "" {
+		return "all namespaces"
+	}
+	return "namespace " + namespace
+}
+
+func logf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
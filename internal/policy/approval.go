@@ -0,0 +1,147 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Approval makes sessions wait until someone else approves them, through
+// the webhook, or with an annotation on the pod (debux approve) for
+// sessions on Kubernetes pods that opt into it.
+type Approval struct {
+	// Approvers are the Kubernetes users (globs) who may approve sessions
+	// with debux approve, anyone but the requester when empty.
+	Approvers []string `json:"approvers,omitempty"`
+	// Webhook is POSTed the pending session as an ApprovalRequest, and
+	// answers it with its status, until it's no longer pending. It replaces
+	// pod annotations.
+	Webhook string            `json:"webhook,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Annotations lets sessions on pods wait for debux approve without a
+	// webhook. Nothing authenticates who writes the answer: anyone who can
+	// patch the pod can approve in any approver's name.
+	Annotations bool `json:"annotations,omitempty"`
+	// Timeout is how long sessions wait for an approval, 15m by default.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// DefaultApprovalTimeout is how long sessions wait for an approval without
+// a timeout in the policy.
+const DefaultApprovalTimeout = 15 * time.Minute
+
+// Statuses of approval requests.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+)
+
+// ApprovalRequest is a session waiting for an approval, as sent to the
+// webhook and stored in pod annotations.
+type ApprovalRequest struct {
+	ID        string    `json:"id"`
+	Requested time.Time `json:"requested"`
+	Request
+	// Requester is the Kubernetes user who asked, for sessions approved
+	// with debux approve.
+	Requester string   `json:"requester,omitempty"`
+	Approvers []string `json:"approvers,omitempty"`
+	Status    string   `json:"status"`
+	Approver  string   `json:"approver,omitempty"` // who approved or denied it
+	Reason    string   `json:"reason,omitempty"`
+}
+
+func (a *Approval) validate() error {
+	if _, err := a.timeout(); err != nil {
+		return err
+	}
+	for _, g := range a.Approvers {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("invalid approver pattern %q", g)
+		}
+	}
+	return nil
+}
+
+func (a *Approval) timeout() (time.Duration, error) {
+	if a.Timeout == "" {
+		return DefaultApprovalTimeout, nil
+	}
+	d, err := time.ParseDuration(a.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid approval timeout %q", a.Timeout)
+	}
+	return d, nil
+}
+
+// Deadline returns how long to wait for the approval.
+func (a *Approval) Deadline() time.Duration {
+	d, _ := a.timeout()
+	return d
+}
+
+// MayApprove reports whether approver, a Kubernetes user, may approve r:
+// anyone matching the approvers, but not the requester.
+func (r ApprovalRequest) MayApprove(approver string) error {
+	if approver == "" {
+		return fmt.Errorf("the session's approver is unknown")
+	}
+	if r.Requester == "" {
+		return fmt.Errorf("the session's requester is unknown")
+	}
+	if approver == r.Requester {
+		return fmt.Errorf("%s can't approve their own session", approver)
+	}
+	if len(r.Approvers) > 0 && !matchAny(r.Approvers, approver) {
+		return fmt.Errorf("%s is not an approver of this session (approvers: %s)", approver, strings.Join(r.Approvers, ", "))
+	}
+	return nil
+}
+
+// Ask sends r to the webhook and returns its answer. Header values expand
+// environment variables, so that tokens can stay out of the policy file.
+func (a *Approval) Ask(ctx context.Context, r ApprovalRequest) (ApprovalRequest, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Webhook, bytes.NewReader(data))
+	if err != nil {
+		return r, fmt.Errorf("approval webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range a.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return r, fmt.Errorf("approval webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return r, fmt.Errorf("approval webhook: %s returned %s", a.Webhook, resp.Status)
+	}
+	var answer struct {
+		Status   string `json:"status"`
+		Approver string `json:"approver"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return r, fmt.Errorf("approval webhook: invalid answer: %w", err)
+	}
+	switch answer.Status {
+	case StatusPending, StatusApproved, StatusDenied:
+	default:
+		return r, fmt.Errorf("approval webhook: invalid status %q", answer.Status)
+	}
+	r.Status, r.Approver, r.Reason = answer.Status, answer.Approver, answer.Reason
+	return r, nil
+}
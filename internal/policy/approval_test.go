@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMayApprove(t *testing.T) {
+	tests := []struct {
+		name      string
+		requester string
+		approvers []string
+		approver  string
+		err       string
+	}{
+		{
+			name:      "anyone without approvers",
+			requester: "alice@example.com",
+			approver:  "bob@example.com",
+		},
+		{
+			name:      "matching approver",
+			requester: "alice@example.com",
+			approvers: []string{"*@sre.example.com"},
+			approver:  "bob@sre.example.com",
+		},
+		{
+			name:      "other matching approver",
+			requester: "alice@example.com",
+			approvers: []string{"carol@example.com", "*@sre.example.com"},
+			approver:  "carol@example.com",
+		},
+		{
+			name:      "not an approver",
+			requester: "alice@example.com",
+			approvers: []string{"*@sre.example.com"},
+			approver:  "bob@example.com",
+			err:       "bob@example.com is not an approver of this session (approvers: *@sre.example.com)",
+		},
+		{
+			name:      "own session",
+			requester: "bob@sre.example.com",
+			approvers: []string{"*@sre.example.com"},
+			approver:  "bob@sre.example.com",
+			err:       "can't approve their own session",
+		},
+		{
+			name:      "own session without approvers",
+			requester: "alice@example.com",
+			approver:  "alice@example.com",
+			err:       "can't approve their own session",
+		},
+		{
+			name:      "unknown requester",
+			approvers: []string{"*"},
+			approver:  "bob@example.com",
+			err:       "the session's requester is unknown",
+		},
+		{
+			name:      "unknown approver",
+			requester: "alice@example.com",
+			approvers: []string{"*"},
+			err:       "the session's approver is unknown",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ApprovalRequest{Requester: tt.requester, Approvers: tt.approvers}
+			err := r.MayApprove(tt.approver)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("MayApprove(%q) = %v, want nil", tt.approver, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("MayApprove(%q) = %v, want %q", tt.approver, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+// Package policy enforces the guardrails platform teams distribute with
+// debux: which targets may be debugged, with which profiles and images, and
+// which sessions are recorded. The policy file lives at $DEBUX_POLICY, or
+// /etc/debux/policy.yaml:
+//
+//	default: deny
+//	log: /var/log/debux/policy.jsonl
+//	rules:
+//	  - name: no-kube-system
+//	    match: {namespaces: [kube-system]}
+//	    deny: true
+//	    message: ask the platform team
+//	  - name: prod
+//	    match: {contexts: [prod-*]}
+//	    profiles: [general, baseline, restricted]
+//	    deny-privileged: true
+//	    capabilities: [NET_ADMIN, NET_RAW, SYS_PTRACE]
+//	    mounts: []
+//	    record: true
+//	    approval: {webhook: https://approvals.example.com/debux, timeout: 10m}
+//	  - name: dev
+//	    match: {contexts: [dev-*, kind-*]}
+//	  - name: local
+//	    match: {runtimes: [docker]}
+//	command: [opa, eval, --fail-defined, --stdin-input, -d, /etc/debux/policy.rego, "data.debux.deny[_]"]
+//
+// Every rule whose match fits a session applies to it. Policies are
+// enforced client-side: they keep honest users on the paved road, they
+// don't stop anyone with their own build of debux.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultPath is where the policy file is looked for without $DEBUX_POLICY.
+const DefaultPath = "/etc/debux/policy.yaml"
+
+// Policy restricts debux sessions.
+type Policy struct {
+	// Default decides sessions no rule matches: "allow" (the default) or
+	// "deny".
+	Default string `json:"default,omitempty"`
+	// Log is a file where every decision is appended, one JSON object per
+	// line, along with the lifecycle events of recorded sessions.
+	Log string `json:"log,omitempty"`
+	// Command is run for sessions the rules allow, with the session as JSON
+	// on stdin. A non-zero exit denies the session, with its output as the
+	// reason; "opa eval --fail-defined" evaluates Rego policies this way.
+	Command []string `json:"command,omitempty"`
+	Rules   []Rule   `json:"rules,omitempty"`
+}
+
+// Rule applies to the sessions it matches.
+type Rule struct {
+	Name  string `json:"name,omitempty"`
+	Match Match  `json:"match,omitempty"`
+	// Deny refuses the sessions, with Message as the reason.
+	Deny    bool   `json:"deny,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Profiles are the allowed security profiles, all when empty. Debug
+	// containers with SYS_ADMIN, every capability or no seccomp or AppArmor
+	// confinement count as sysadmin, whatever their profile.
+	Profiles []string `json:"profiles,omitempty"`
+	// DenyPrivileged refuses privileged debug containers, and those counting
+	// as sysadmin.
+	DenyPrivileged bool `json:"deny-privileged,omitempty"`
+	// Images are the allowed debug images (globs), all when empty.
+	Images []string `json:"images,omitempty"`
+	// Capabilities, Seccomp, AppArmor and Mounts are the allowed --cap-add
+	// capabilities, --seccomp-profile and --apparmor values and --mount host
+	// paths (globs), all when unset, none when empty. ALL is only allowed
+	// by name.
+	Capabilities []string `json:"capabilities,omitempty"`
+	Seccomp      []string `json:"seccomp,omitempty"`
+	AppArmor     []string `json:"apparmor,omitempty"`
+	Mounts       []string `json:"mounts,omitempty"`
+	// Record appends the lifecycle events of the sessions to Log.
+	Record bool `json:"record,omitempty"`
+	// Approval makes the sessions wait until someone else approves them.
+	Approval *Approval `json:"approval,omitempty"`
+}
+
+// Match selects sessions. Every non-empty list must contain a glob matching
+// the session; an empty match selects every session.
+type Match struct {
+	Commands   []string `json:"commands,omitempty"`   // debux commands: exec, scan, pod...
+	Kinds      []string `json:"kinds,omitempty"`      // container, image, pod
+	Runtimes   []string `json:"runtimes,omitempty"`   // docker, kubernetes...
+	Contexts   []string `json:"contexts,omitempty"`   // kubeconfig contexts
+	Namespaces []string `json:"namespaces,omitempty"` // Kubernetes namespaces
+	Targets    []string `json:"targets,omitempty"`    // container, pod or image names
+	Users      []string `json:"users,omitempty"`      // user@host of whoever runs debux, the Kubernetes user for the operator
+}
+
+// Kinds of sessions.
+const (
+	KindContainer = "container" // a running container or pod
+	KindImage     = "image"     // an image, with debux image or scan
+	KindPod       = "pod"       // a standalone debug pod
+)
+
+// Request is a session to decide on.
+type Request struct {
+	Command    string `json:"command"`
+	Kind       string `json:"kind"`
+	Runtime    string `json:"runtime"`
+	Target     string `json:"target,omitempty"` // as passed to debux
+	Name       string `json:"name,omitempty"`   // container, pod or image name
+	Context    string `json:"context,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Image      string `json:"image"`
+	Profile    string `json:"profile,omitempty"` // security profile of the debug container
+	Privileged bool   `json:"privileged"`
+	// The confinement and capabilities of the debug container on top of
+	// its profile, and the host paths mounted into it
+	CapAdd     []string `json:"capAdd,omitempty"`
+	Seccomp    string   `json:"seccomp,omitempty"`
+	AppArmor   string   `json:"apparmor,omitempty"`
+	Mounts     []string `json:"mounts,omitempty"`
+	User       string   `json:"user"`
+	Kubeconfig string   `json:"-"` // to reach the cluster, for approvals
+}
+
+// profileSysadmin is the profile of privileged debug containers.
+const profileSysadmin = "sysadmin"
+
+// privileged reports whether the debug container is privileged, or as good
+// as: it may remount or reach anything on the host.
+func (r Request) privileged() bool {
+	return r.Privileged || r.Profile == profileSysadmin ||
+		slices.Contains(r.CapAdd, "SYS_ADMIN") || slices.Contains(r.CapAdd, "ALL") ||
+		r.Seccomp == "unconfined" || r.AppArmor == "unconfined" ||
+		slices.Contains(r.Mounts, "/")
+}
+
+// profile returns the profile the request counts as: sysadmin when it's
+// privileged.
+func (r Request) profile() string {
+	if r.privileged() {
+		return profileSysadmin
+	}
+	return r.Profile
+}
+
+// Decision is the outcome of a request.
+type Decision struct {
+	Allowed bool
+	Reason  string // why the session is denied, e.g. "sessions are not allowed here"
+	Rule    string // the rule that denied it, "command" for the policy command
+	Record  bool   // whether its lifecycle events are recorded
+	// Approval is the approval the session waits for before it starts,
+	// that of the first matching rule asking for one.
+	Approval *Approval
+}
+
+// Path returns the policy file location.
+func Path() string {
+	if p := os.Getenv("DEBUX_POLICY"); p != "" {
+		return p
+	}
+	return DefaultPath
+}
+
+// Load reads the policy file. Without one, it returns nil: everything is
+// allowed.
+func Load() (*Policy, error) {
+	p := Path()
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) && os.Getenv("DEBUX_POLICY") == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %w", err)
+	}
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, fmt.Errorf("parsing policy %s: %w", p, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", p, err)
+	}
+	return &policy, nil
+}
+
+func (p *Policy) validate() error {
+	switch p.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("default must be allow or deny, got %q", p.Default)
+	}
+	for i, r := range p.Rules {
+		if r.Record && p.Log == "" {
+			return fmt.Errorf("rule %s records sessions but the policy sets no log", ruleName(r, i))
+		}
+		globs := slices.Concat(r.Images, r.Capabilities, r.Seccomp, r.AppArmor, r.Mounts, r.Match.Commands, r.Match.Kinds, r.Match.Runtimes,
+			r.Match.Contexts, r.Match.Namespaces, r.Match.Targets, r.Match.Users)
+		for _, g := range globs {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid pattern %q", ruleName(r, i), g)
+			}
+		}
+		if r.Approval != nil {
+			if err := r.Approval.validate(); err != nil {
+				return fmt.Errorf("rule %s: %w", ruleName(r, i), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Decide decides on a request, then logs the decision. Errors running the
+// command or writing the log deny the session.
+func (p *Policy) Decide(ctx context.Context, req Request) (Decision, error) {
+	d := p.evaluate(req)
+	if d.Allowed && len(p.Command) > 0 {
+		if reason, err := p.run(ctx, req); err != nil {
+			return Decision{}, err
+		} else if reason != "" {
+			d = Decision{Reason: reason, Rule: "command"}
+		}
+	}
+	if err := p.log(req, d); err != nil {
+		return Decision{}, err
+	}
+	return d, nil
+}
+
+func (p *Policy) evaluate(req Request) Decision {
+	d := Decision{Allowed: true}
+	matched := false
+	for i, r := range p.Rules {
+		if !r.Match.matches(req) {
+			continue
+		}
+		matched = true
+		name := ruleName(r, i)
+		deny := func(reason string) Decision {
+			return Decision{Reason: reason, Rule: name}
+		}
+		switch {
+		case r.Deny:
+			if r.Message != "" {
+				return deny(r.Message)
+			}
+			return deny("sessions are not allowed here")
+		case len(r.Profiles) > 0 && req.profile() != "" && !slices.Contains(r.Profiles, req.profile()):
+			if req.profile() != req.Profile {
+				return deny(fmt.Sprintf("profile %s with %s counts as sysadmin, which is not allowed here (allowed: %s)", req.Profile, req.escalation(), strings.Join(r.Profiles, ", ")))
+			}
+			return deny(fmt.Sprintf("profile %s is not allowed here (allowed: %s)", req.Profile, strings.Join(r.Profiles, ", ")))
+		case r.DenyPrivileged && req.privileged():
+			if e := req.escalation(); e != "" {
+				return deny(fmt.Sprintf("privileged debug containers are not allowed here (%s)", e))
+			}
+			return deny("privileged debug containers are not allowed here")
+		case len(r.Images) > 0 && !matchAny(r.Images, req.Image):
+			return deny(fmt.Sprintf("debug image %s is not allowed here (allowed: %s)", req.Image, strings.Join(r.Images, ", ")))
+		}
+		if reason := r.security(req); reason != "" {
+			return deny(reason)
+		}
+		d.Record = d.Record || r.Record
+		if d.Approval == nil {
+			d.Approval = r.Approval
+		}
+	}
+	if !matched && p.Default == "deny" {
+		return Decision{Reason: "no rule allows it"}
+	}
+	return d
+}
+
+// escalation describes the options making a debug container of a
+// non-privileged profile count as privileged, "" when there are none.
+func (r Request) escalation() string {
+	var opts []string
+	for _, c := range r.CapAdd {
+		if c == "SYS_ADMIN" || c == "ALL" {
+			opts = append(opts, "--cap-add "+c)
+		}
+	}
+	if r.Seccomp == "unconfined" {
+		opts = append(opts, "--seccomp-profile unconfined")
+	}
+	if r.AppArmor == "unconfined" {
+		opts = append(opts, "--apparmor unconfined")
+	}
+	if slices.Contains(r.Mounts, "/") {
+		opts = append(opts, "--mount src=/")
+	}
+	return strings.Join(opts, ", ")
+}
+
+// security returns why the rule refuses the capabilities, confinement or
+// mounts of a request, "" when it allows them.
+func (r Rule) security(req Request) string {
+	allowed := func(globs []string) string {
+		if len(globs) == 0 {
+			return "none"
+		}
+		return strings.Join(globs, ", ")
+	}
+	if r.Capabilities != nil {
+		for _, c := range req.CapAdd {
+			if c == "ALL" && !slices.Contains(r.Capabilities, c) || !matchAny(r.Capabilities, c) {
+				return fmt.Sprintf("--cap-add %s is not allowed here (allowed: %s)", c, allowed(r.Capabilities))
+			}
+		}
+	}
+	if r.Seccomp != nil && req.Seccomp != "" && !matchAny(r.Seccomp, req.Seccomp) {
+		return fmt.Sprintf("--seccomp-profile %s is not allowed here (allowed: %s)", req.Seccomp, allowed(r.Seccomp))
+	}
+	if r.AppArmor != nil && req.AppArmor != "" && !matchAny(r.AppArmor, req.AppArmor) {
+		return fmt.Sprintf("--apparmor %s is not allowed here (allowed: %s)", req.AppArmor, allowed(r.AppArmor))
+	}
+	if r.Mounts != nil {
+		for _, m := range req.Mounts {
+			if !matchAny(r.Mounts, m) {
+				return fmt.Sprintf("--mount of %s is not allowed here (allowed: %s)", m, allowed(r.Mounts))
+			}
+		}
+	}
+	return ""
+}
+
+func (m Match) matches(req Request) bool {
+	for _, f := range []struct {
+		globs []string
+		value string
+	}{
+		{m.Commands, req.Command},
+		{m.Kinds, req.Kind},
+		{m.Runtimes, req.Runtime},
+		{m.Contexts, req.Context},
+		{m.Namespaces, req.Namespace},
+		{m.Targets, req.Name},
+		{m.Users, req.User},
+	} {
+		if len(f.globs) > 0 && !matchAny(f.globs, f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(globs []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(g, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleName(r Rule, i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// run runs the policy command, returning why it denies the request, or ""
+// when it allows it.
+func (p *Policy) run(ctx context.Context, req Request) (string, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	c := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	c.Stdin = bytes.NewReader(input)
+	c.Stdout = &out
+	c.Stderr = &out
+	err = c.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		reason := strings.TrimSpace(out.String())
+		if reason == "" {
+			reason = fmt.Sprintf("%s exited with status %d", p.Command[0], exitErr.ExitCode())
+		}
+		return reason, nil
+	default:
+		return "", fmt.Errorf("running the policy command: %w", err)
+	}
+}
+
+// entry is a decision in the log.
+type entry struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"` // "policy", unlike the lifecycle events next to it
+	Decision string    `json:"decision"`
+	Rule     string    `json:"rule,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Record   bool      `json:"record,omitempty"`
+	Approval bool      `json:"approval,omitempty"` // the session waits for an approval
+	Request
+}
+
+var logMu sync.Mutex
+
+func (p *Policy) log(req Request, d Decision) error {
+	if p.Log == "" {
+		return nil
+	}
+	e := entry{Time: time.Now().UTC(), Type: "policy", Decision: "allow", Rule: d.Rule, Reason: d.Reason, Record: d.Record, Approval: d.Approval != nil, Request: req}
+	if !d.Allowed {
+		e.Decision = "deny"
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	f, err := p.OpenLog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("writing the policy log: %w", err)
+	}
+	return nil
+}
+
+// OpenLog opens the log for appending, to record sessions.
+func (p *Policy) OpenLog() (*os.File, error) {
+	f, err := os.OpenFile(p.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening the policy log: %w", err)
+	}
+	return f, nil
+}
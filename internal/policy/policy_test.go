@@ -0,0 +1,320 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	exec := Request{Command: "exec", Kind: KindContainer, Runtime: "kubernetes", Namespace: "prod", Name: "api-7d9f",
+		Image: "ghcr.io/debux/debug:latest", Profile: "general", User: "alice@laptop"}
+	with := func(f func(*Request)) Request {
+		r := exec
+		f(&r)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		req    Request
+		allow  bool
+		rule   string
+		reason string // part of the reason
+		record bool
+	}{
+		{
+			name:  "no rules",
+			req:   exec,
+			allow: true,
+		},
+		{
+			name:   "default deny without a matching rule",
+			policy: Policy{Default: "deny", Rules: []Rule{{Match: Match{Namespaces: []string{"dev-*"}}}}},
+			req:    exec,
+			reason: "no rule allows it",
+		},
+		{
+			name:   "default deny with a matching rule",
+			policy: Policy{Default: "deny", Rules: []Rule{{Match: Match{Namespaces: []string{"prod"}}, Record: true}}},
+			req:    exec,
+			allow:  true,
+			record: true,
+		},
+		{
+			name:   "deny rule",
+			policy: Policy{Rules: []Rule{{Name: "no-prod", Match: Match{Namespaces: []string{"prod*"}}, Deny: true}}},
+			req:    exec,
+			rule:   "no-prod",
+			reason: "sessions are not allowed here",
+		},
+		{
+			name:   "deny rule message",
+			policy: Policy{Rules: []Rule{{Match: Match{Targets: []string{"api-*"}}, Deny: true, Message: "ask #sre"}}},
+			req:    exec,
+			rule:   "#1",
+			reason: "ask #sre",
+		},
+		{
+			name:   "command matched",
+			policy: Policy{Rules: []Rule{{Match: Match{Commands: []string{"exec", "ssh"}}, Deny: true}}},
+			req:    exec,
+			rule:   "#1",
+		},
+		{
+			name:   "command not matched",
+			policy: Policy{Rules: []Rule{{Match: Match{Commands: []string{"scan"}}, Deny: true}}},
+			req:    exec,
+			allow:  true,
+		},
+		{
+			name:   "command glob",
+			policy: Policy{Rules: []Rule{{Match: Match{Commands: []string{"s*"}}, Deny: true}}},
+			req:    with(func(r *Request) { r.Command = "secrets" }),
+			rule:   "#1",
+		},
+		{
+			name:   "every field of the match must match",
+			policy: Policy{Rules: []Rule{{Match: Match{Namespaces: []string{"prod"}, Users: []string{"bob@*"}}, Deny: true}}},
+			req:    exec,
+			allow:  true,
+		},
+		{
+			name:   "empty values match no glob",
+			policy: Policy{Rules: []Rule{{Match: Match{Contexts: []string{"*"}}, Deny: true}}},
+			req:    exec,
+			allow:  true,
+		},
+		{
+			name:   "profile not allowed",
+			policy: Policy{Rules: []Rule{{Profiles: []string{"restricted", "baseline"}}}},
+			req:    exec,
+			rule:   "#1",
+			reason: "profile general is not allowed here",
+		},
+		{
+			name:   "SYS_ADMIN counts as sysadmin",
+			policy: Policy{Rules: []Rule{{Profiles: []string{"general"}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"SYS_ADMIN"} }),
+			rule:   "#1",
+			reason: "counts as sysadmin",
+		},
+		{
+			name:   "privileged denied",
+			policy: Policy{Rules: []Rule{{DenyPrivileged: true}}},
+			req:    with(func(r *Request) { r.Privileged = true }),
+			rule:   "#1",
+			reason: "privileged debug containers are not allowed here",
+		},
+		{
+			name:   "unconfined seccomp is privileged",
+			policy: Policy{Rules: []Rule{{DenyPrivileged: true}}},
+			req:    with(func(r *Request) { r.Seccomp = "unconfined" }),
+			rule:   "#1",
+			reason: "--seccomp-profile unconfined",
+		},
+		{
+			name:   "host root mount is privileged",
+			policy: Policy{Rules: []Rule{{DenyPrivileged: true}}},
+			req:    with(func(r *Request) { r.Mounts = []string{"/"} }),
+			rule:   "#1",
+			reason: "--mount src=/",
+		},
+		{
+			name:   "image not allowed",
+			policy: Policy{Rules: []Rule{{Images: []string{"registry.internal/*"}}}},
+			req:    exec,
+			rule:   "#1",
+			reason: "debug image ghcr.io/debux/debug:latest is not allowed here",
+		},
+		{
+			name:   "image glob",
+			policy: Policy{Rules: []Rule{{Images: []string{"ghcr.io/debux/*"}}}},
+			req:    exec,
+			allow:  true,
+		},
+		{
+			name:   "capability glob",
+			policy: Policy{Rules: []Rule{{Capabilities: []string{"NET_*"}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"NET_ADMIN", "NET_RAW"} }),
+			allow:  true,
+		},
+		{
+			name:   "capability not allowed",
+			policy: Policy{Rules: []Rule{{Capabilities: []string{"NET_*"}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"NET_ADMIN", "SYS_PTRACE"} }),
+			rule:   "#1",
+			reason: "--cap-add SYS_PTRACE is not allowed here (allowed: NET_*)",
+		},
+		{
+			name:   "ALL only allowed by name",
+			policy: Policy{Rules: []Rule{{Capabilities: []string{"*"}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"ALL"} }),
+			rule:   "#1",
+			reason: "--cap-add ALL",
+		},
+		{
+			name:   "no capabilities allowed",
+			policy: Policy{Rules: []Rule{{Capabilities: []string{}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"NET_RAW"} }),
+			rule:   "#1",
+			reason: "(allowed: none)",
+		},
+		{
+			name:   "any capability without a list",
+			policy: Policy{Rules: []Rule{{Profiles: []string{"general"}}}},
+			req:    with(func(r *Request) { r.CapAdd = []string{"NET_RAW"} }),
+			allow:  true,
+		},
+		{
+			name:   "apparmor not allowed",
+			policy: Policy{Rules: []Rule{{AppArmor: []string{"runtime/default"}}}},
+			req:    with(func(r *Request) { r.AppArmor = "localhost/custom" }),
+			rule:   "#1",
+			reason: "--apparmor localhost/custom",
+		},
+		{
+			name:   "mount glob",
+			policy: Policy{Rules: []Rule{{Mounts: []string{"/var/log/*"}}}},
+			req:    with(func(r *Request) { r.Mounts = []string{"/var/log/nginx"} }),
+			allow:  true,
+		},
+		{
+			name:   "mount not allowed",
+			policy: Policy{Rules: []Rule{{Mounts: []string{"/var/log/*"}}}},
+			req:    with(func(r *Request) { r.Mounts = []string{"/etc"} }),
+			rule:   "#1",
+			reason: "--mount of /etc is not allowed here",
+		},
+		{
+			name: "first denying rule wins",
+			policy: Policy{Rules: []Rule{
+				{Name: "record", Record: true},
+				{Name: "images", Images: []string{"registry.internal/*"}},
+				{Name: "deny", Deny: true},
+			}},
+			req:    exec,
+			rule:   "images",
+			reason: "is not allowed here",
+		},
+		{
+			name: "every matching rule applies",
+			policy: Policy{Rules: []Rule{
+				{Match: Match{Kinds: []string{KindImage}}, Deny: true},
+				{Match: Match{Runtimes: []string{"kube*"}}, Record: true},
+			}},
+			req:    exec,
+			allow:  true,
+			record: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.policy.evaluate(tt.req)
+			if d.Allowed != tt.allow {
+				t.Fatalf("allowed = %v, want %v (reason: %q)", d.Allowed, tt.allow, d.Reason)
+			}
+			if d.Rule != tt.rule {
+				t.Errorf("rule = %q, want %q", d.Rule, tt.rule)
+			}
+			if !strings.Contains(d.Reason, tt.reason) {
+				t.Errorf("reason = %q, want it to contain %q", d.Reason, tt.reason)
+			}
+			if d.Record != tt.record {
+				t.Errorf("record = %v, want %v", d.Record, tt.record)
+			}
+		})
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		globs []string
+		value string
+		want  bool
+	}{
+		{[]string{"prod"}, "prod", true},
+		{[]string{"prod"}, "prod-eu", false},
+		{[]string{"prod-*"}, "prod-eu", true},
+		{[]string{"dev", "prod-*"}, "prod-eu", true},
+		{[]string{"*"}, "", false},
+		{[]string{"*@sre.example.com"}, "alice@sre.example.com", true},
+		{[]string{"*@sre.example.com"}, "alice@example.com", false},
+		{[]string{"ghcr.io/*"}, "ghcr.io/debux/debug", false},
+		{[]string{"ghcr.io/*/*"}, "ghcr.io/debux/debug", true},
+		{[]string{"api-?"}, "api-1", true},
+		{[]string{"["}, "[", false},
+		{nil, "prod", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.globs, tt.value); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.globs, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+		req  Request
+		deny bool
+	}{
+		{
+			name: "empty mounts deny every mount",
+			yaml: "rules:\n- mounts: []\n",
+			req:  Request{Mounts: []string{"/var/log"}},
+			deny: true,
+		},
+		{
+			name: "no mounts allow every mount",
+			yaml: "rules:\n- images: ['*']\n",
+			req:  Request{Image: "debug", Mounts: []string{"/var/log"}},
+		},
+		{
+			name: "invalid pattern",
+			yaml: "rules:\n- match:\n    namespaces: ['[']\n",
+			err:  `rule #1: invalid pattern "["`,
+		},
+		{
+			name: "invalid default",
+			yaml: "default: maybe\n",
+			err:  "default must be allow or deny",
+		},
+		{
+			name: "record without a log",
+			yaml: "rules:\n- name: audit\n  record: true\n",
+			err:  "rule audit records sessions but the policy sets no log",
+		},
+		{
+			name: "unknown field",
+			yaml: "rules:\n- mount: ['/']\n",
+			err:  "parsing policy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yaml")
+			if err := os.WriteFile(file, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("DEBUX_POLICY", file)
+			p, err := Load()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := p.evaluate(tt.req); d.Allowed == tt.deny {
+				t.Errorf("allowed = %v, want %v (reason: %q)", d.Allowed, !tt.deny, d.Reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Package render styles what debux prints for people: progress messages,
+// warnings, errors, tables and banners. Colors only go to terminals, so
+// that logs and pipes get plain text, and are turned off altogether by
+// --no-color, $NO_COLOR (https://no-color.org) or TERM=dumb.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/moby/term"
+)
+
+// Style is a set of SGR attributes, e.g. "1;33" for bold yellow.
+type Style string
+
+const (
+	Bold   Style = "1"
+	Dim    Style = "2"
+	Red    Style = "31"
+	Green  Style = "32"
+	Yellow Style = "33"
+	Cyan   Style = "36"
+)
+
+// noColor is set by Disable.
+var noColor bool
+
+// Disable turns colors off for good (--no-color).
+func Disable() {
+	noColor = true
+}
+
+// Disabled reports whether colors are turned off by --no-color or
+// $NO_COLOR, which debug shells then get too.
+func Disabled() bool {
+	return noColor || os.Getenv("NO_COLOR") != ""
+}
+
+// Enabled reports whether text written to w may be colored: w is a
+// terminal, and colors aren't turned off.
+func Enabled(w io.Writer) bool {
+	if Disabled() || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	_, isTerminal := term.GetFdInfo(f)
+	return isTerminal
+}
+
+// Sprint returns text in style s for w, or as is when w gets no colors.
+func (s Style) Sprint(w io.Writer, text string) string {
+	if text == "" || !Enabled(w) {
+		return text
+	}
+	return "\x1b[" + string(s) + "m" + text + "\x1b[0m"
+}
+
+// sgr matches the SGR escape sequences of colored text, but not the cursor
+// movements of progress lines.
+var sgr = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// Strip removes the colors of s.
+func Strip(s string) string {
+	return sgr.ReplaceAllString(s, "")
+}
+
+// prefixes are the styles of the messages starting with them.
+var prefixes = []struct {
+	prefix string
+	style  Style
+}{
+	{"Error:", Bold + ";" + Red},
+	{"Warning:", Bold + ";" + Yellow},
+	{"Note:", Cyan},
+}
+
+// Status styles a progress message for w: its Error:, Warning: or Note:
+// prefix, if any, is colored, and colors are stripped when w gets none.
+func Status(w io.Writer, msg string) string {
+	if !Enabled(w) {
+		return Strip(msg)
+	}
+	lead := len(msg) - len(strings.TrimLeft(msg, "\r\n"))
+	for _, p := range prefixes {
+		if strings.HasPrefix(msg[lead:], p.prefix) {
+			return msg[:lead] + p.style.Sprint(w, p.prefix) + msg[lead+len(p.prefix):]
+		}
+	}
+	return msg
+}
+
+// Warnf prints a warning to w.
+func Warnf(w io.Writer, format string, args ...any) {
+	_, _ = io.WriteString(w, Status(w, "Warning: "+fmt.Sprintf(format, args...)+"\n"))
+}
+
+// Errorf prints an error to w, as debux does before exiting on one.
+func Errorf(w io.Writer, format string, args ...any) {
+	_, _ = io.WriteString(w, Status(w, "Error: "+fmt.Sprintf(format, args...)+"\n"))
+}
+
+// Table lays out tab-separated rows in columns, like the tabwriter of the
+// listings of debux, and prints its first row, the header, in bold.
+type Table struct {
+	w      io.Writer
+	buf    bytes.Buffer
+	tw     *tabwriter.Writer
+	headed bool // the header is printed
+	mark   func(cell string) Style
+}
+
+// NewTable returns a table printed to w by Flush.
+func NewTable(w io.Writer) *Table {
+	t := &Table{w: w}
+	t.tw = tabwriter.NewWriter(&t.buf, 0, 0, 2, ' ', 0)
+	return t
+}
+
+func (t *Table) Write(p []byte) (int, error) {
+	return t.tw.Write(p)
+}
+
+// Mark styles the first cell of the rows, e.g. by status or severity, with
+// the style returned for it, if any.
+func (t *Table) Mark(style func(cell string) Style) {
+	t.mark = style
+}
+
+// Flush prints the rows written so far.
+func (t *Table) Flush() error {
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+	out := t.buf.String()
+	t.buf.Reset()
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(out, "\n") {
+		switch {
+		case line == "":
+		case !t.headed:
+			line = Bold.Sprint(t.w, strings.TrimRight(line, " \n")) + "\n"
+			t.headed = true
+		case t.mark != nil:
+			// The cell is styled after the layout, which its padding keeps
+			cell := line
+			if i := strings.IndexAny(line, " \n"); i >= 0 {
+				cell = line[:i]
+			}
+			if style := t.mark(cell); style != "" {
+				line = style.Sprint(t.w, cell) + line[len(cell):]
+			}
+		}
+		b.WriteString(line)
+	}
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
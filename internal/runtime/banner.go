@@ -0,0 +1,233 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/render"
+)
+
+// banner is the summary of a target printed as its debug shell opens, so
+// that its image, command, limits, addresses and volumes are at hand without
+// docker inspect or kubectl describe in another terminal.
+type banner [][2]string
+
+// add adds a line to the banner, unless value is empty.
+func (b *banner) add(key, value string) {
+	if value != "" {
+		*b = append(*b, [2]string{key, value})
+	}
+}
+
+// print prints the banner with the progress messages, its keys in color.
+func (b banner) print() {
+	width := 0
+	for _, line := range b {
+		width = max(width, len(line[0]))
+	}
+	var sb strings.Builder
+	for _, line := range b {
+		key := render.Cyan.Sprint(status, line[0]) + strings.Repeat(" ", width-len(line[0]))
+		fmt.Fprintf(&sb, "  %s  %s\n", key, line[1])
+	}
+	statusf("%s", sb.String())
+}
+
+// dockerBanner returns the banner of a Docker target.
+func dockerBanner(ctx context.Context, cli *client.Client, info types.ContainerJSON) banner {
+	var b banner
+	image := info.Config.Image
+	if img, _, err := cli.ImageInspectWithRaw(ctx, info.Image); err == nil && len(img.RepoDigests) > 0 {
+		_, digest, _ := strings.Cut(img.RepoDigests[0], "@")
+		image += " (" + shortDigest(digest) + ")"
+	}
+	b.add("Image", image)
+	b.add("Command", strings.Join(append(append([]string{}, info.Config.Entrypoint...), info.Config.Cmd...), " "))
+
+	started := ""
+	if t, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil && !t.IsZero() {
+		started = units.HumanDuration(time.Since(t)) + " ago"
+	}
+	if info.RestartCount > 0 {
+		started += fmt.Sprintf(", restarted %d times", info.RestartCount)
+	}
+	if info.State.Health != nil {
+		started += ", " + info.State.Health.Status
+	}
+	b.add("Started", started)
+
+	var limits []string
+	if hc := info.HostConfig; hc != nil {
+		if hc.NanoCPUs > 0 {
+			limits = append(limits, fmt.Sprintf("cpu %g", float64(hc.NanoCPUs)/1e9))
+		}
+		if hc.Memory > 0 {
+			limits = append(limits, "memory "+units.BytesSize(float64(hc.Memory)))
+		}
+		if hc.PidsLimit != nil && *hc.PidsLimit > 0 {
+			limits = append(limits, fmt.Sprintf("pids %d", *hc.PidsLimit))
+		}
+	}
+	b.add("Limits", strings.Join(limits, ", "))
+
+	if info.NetworkSettings != nil {
+		var ips []string
+		for name, n := range info.NetworkSettings.Networks {
+			if n != nil && n.IPAddress != "" {
+				ips = append(ips, fmt.Sprintf("%s (%s)", n.IPAddress, name))
+			}
+		}
+		sort.Strings(ips)
+		b.add("IPs", strings.Join(ips, ", "))
+	}
+
+	var volumes []string
+	for _, m := range info.Mounts {
+		source := m.Name
+		if source == "" {
+			source = m.Source
+		}
+		v := m.Destination + " ← " + source
+		if !m.RW {
+			v += " (ro)"
+		}
+		volumes = append(volumes, v)
+	}
+	b.add("Volumes", strings.Join(volumes, ", "))
+	return b
+}
+
+// kubeBanner returns the banner of a container of a pod.
+func kubeBanner(pod *corev1.Pod, name string) banner {
+	var b banner
+	var spec *corev1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			spec = &pod.Spec.Containers[i]
+		}
+	}
+	if spec == nil {
+		return nil
+	}
+	var status *corev1.ContainerStatus
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == name {
+			status = &pod.Status.ContainerStatuses[i]
+		}
+	}
+
+	image := spec.Image
+	if status != nil {
+		if _, digest, ok := strings.Cut(status.ImageID, "@"); ok {
+			image += " (" + shortDigest(digest) + ")"
+		}
+	}
+	b.add("Image", image)
+	b.add("Command", strings.Join(append(append([]string{}, spec.Command...), spec.Args...), " "))
+
+	if status != nil {
+		started := ""
+		if r := status.State.Running; r != nil {
+			started = units.HumanDuration(time.Since(r.StartedAt.Time)) + " ago"
+		}
+		if status.RestartCount > 0 {
+			started += fmt.Sprintf(", restarted %d times", status.RestartCount)
+			if t := status.LastTerminationState.Terminated; t != nil {
+				started += fmt.Sprintf(" (last: %s, exit %d)", t.Reason, t.ExitCode)
+			}
+		}
+		b.add("Started", strings.TrimPrefix(started, ", "))
+	}
+
+	var limits []string
+	for _, r := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		req, hasReq := spec.Resources.Requests[r]
+		limit, hasLimit := spec.Resources.Limits[r]
+		switch {
+		case hasReq && hasLimit:
+			limits = append(limits, fmt.Sprintf("%s %s/%s", r, req.String(), limit.String()))
+		case hasLimit:
+			limits = append(limits, fmt.Sprintf("%s -/%s", r, limit.String()))
+		case hasReq:
+			limits = append(limits, fmt.Sprintf("%s %s/-", r, req.String()))
+		}
+	}
+	if len(limits) > 0 {
+		b.add("Resources", strings.Join(limits, ", ")+" (request/limit)")
+	}
+
+	b.add("Node", pod.Spec.NodeName)
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	b.add("IPs", strings.Join(ips, ", "))
+
+	sources := map[string]string{}
+	for _, v := range pod.Spec.Volumes {
+		sources[v.Name] = kubeVolumeSource(v)
+	}
+	var volumes []string
+	for _, m := range spec.VolumeMounts {
+		v := m.MountPath + " ← " + sources[m.Name]
+		if m.ReadOnly {
+			v += " (ro)"
+		}
+		volumes = append(volumes, v)
+	}
+	b.add("Volumes", strings.Join(volumes, ", "))
+	return b
+}
+
+// kubeDebuggers lists the other users debugging a pod: the creators of its
+// running debux ephemeral containers, own excepted unless someone else
+// created it. It's empty when nobody else is there.
+func kubeDebuggers(pod *corev1.Pod, own string) string {
+	running := make(map[string]bool)
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		running[cs.Name] = cs.State.Running != nil
+	}
+	user := meta.User()
+	var others []string
+	for _, c := range pod.Spec.EphemeralContainers {
+		if !running[c.Name] || !isDebuxEphemeral(c) || ephemeralCreator(c) == user {
+			continue
+		}
+		creator := ephemeralEnv(c, "DEBUX_CREATOR")
+		if creator == "" {
+			creator = "unknown"
+		}
+		if c.Name == own {
+			others = append(others, creator+" (this container)")
+		} else {
+			others = append(others, creator+" ("+c.Name+")")
+		}
+	}
+	return strings.Join(others, ", ")
+}
+
+// kubeVolumeSource describes where a pod volume comes from.
+func kubeVolumeSource(v corev1.Volume) string {
+	typ, source := kubeVolumeType(v)
+	if typ == "hostPath" {
+		return "host:" + source
+	}
+	return typ + "/" + source
+}
+
+// shortDigest abbreviates a "sha256:..." digest as docker images does.
+func shortDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[:len("sha256:")+12]
+	}
+	return digest
+}
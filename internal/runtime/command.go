@@ -0,0 +1,34 @@
+package runtime
+
+import "strconv"
+
+// ShellCommand returns the command running a command line in the debug
+// shell of a debug container, with the target's environment and wrappers
+// set up as in interactive shells. With quiet, the shell configuration
+// prints no progress messages. A pid other than 0 and 1 aims the shell at
+// that process of the target (see DebugOpts.Pid).
+func ShellCommand(line string, quiet bool, pid int) []string {
+	script := `export DEBUX_TARGET_ROOT="${DEBUX_TARGET_ROOT:-/proc/1/root}"; ` + volumeRoot + `; ` + targetProcess + `; exec zsh -ic "$1"`
+	if quiet {
+		script = "export DEBUX_QUIET=1; " + script
+	}
+	if env := pidEnv(pid); len(env) > 0 {
+		script = "export " + env[0] + "; " + script
+	}
+	return []string{"sh", "-c", script, "debux", line}
+}
+
+// volumeRoot points DEBUX_TARGET_ROOT at the tree of the target's volumes
+// the entrypoint of Kubernetes debug containers builds, when the target's
+// root filesystem is out of reach: a debug container running as another
+// user than the target, without CAP_SYS_PTRACE, can't follow /proc/1/root.
+const volumeRoot = `{ ls "$DEBUX_TARGET_ROOT/" >/dev/null 2>&1 || [ ! -d /tmp/debux-target ] || DEBUX_TARGET_ROOT=/tmp/debux-target; }`
+
+// pidEnv returns the environment of debug shells aiming at another process
+// of the target than PID 1, which their configuration reads.
+func pidEnv(pid int) []string {
+	if pid <= 1 {
+		return nil
+	}
+	return []string{"DEBUX_TARGET_PID=" + strconv.Itoa(pid)}
+}
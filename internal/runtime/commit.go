@@ -0,0 +1,175 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// DockerImageCommit packs the /target filesystem of a running image debug
+// session into a new image. The session container is found by name, or when
+// name is empty, as the only image session currently running.
+func DockerImageCommit(ctx context.Context, name, newRef string, opts ImageOpts) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if name == "" {
+		name, err = findImageSession(ctx, cli)
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := cli.ContainerInspect(ctx, name)
+	if err != nil {
+		return fmt.Errorf("inspecting debug container %q: %w", name, err)
+	}
+	var ref string
+	for _, e := range info.Config.Env {
+		if v, ok := strings.CutPrefix(e, "DEBUX_TARGET="); ok {
+			ref = v
+		}
+		if e == "DEBUX_NO_COMMIT=1" {
+			return fmt.Errorf("%s doesn't hold a plain copy of the image (--include/--exclude or extracted layers), refusing to commit it", name)
+		}
+	}
+	if ref == "" || !isImageSession(strings.TrimPrefix(info.Name, "/"), info.Config.Labels) {
+		return fmt.Errorf("%s is not an image debug session", name)
+	}
+
+	return commitImageSession(ctx, cli, info.ID, ref, "target", newRef, opts)
+}
+
+// isImageSession reports whether a container is a single-image debug session
+// (as opposed to a diff session or a helper container). Containers created
+// before debux labeled them are recognized by name.
+func isImageSession(name string, labels map[string]string) bool {
+	if meta.IsManaged(labels) {
+		return labels[meta.KindKey] == meta.KindImageSession
+	}
+	return strings.HasPrefix(name, "debux-image-") &&
+		!strings.HasPrefix(name, "debux-image-diff-") &&
+		!strings.HasPrefix(name, "debux-image-target-")
+}
+
+// findImageSession returns the name of the only running image debug session.
+func findImageSession(ctx context.Context, cli *client.Client) (string, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("listing containers: %w", err)
+	}
+	var names []string
+	for _, c := range containers {
+		if len(c.Names) > 0 && isImageSession(strings.TrimPrefix(c.Names[0], "/"), c.Labels) {
+			names = append(names, strings.TrimPrefix(c.Names[0], "/"))
+		}
+	}
+	switch len(names) {
+	case 0:
+		return "", fmt.Errorf("no running image debug session found (start one with: debux image <image-ref>)")
+	case 1:
+		return names[0], nil
+	default:
+		return "", fmt.Errorf("several image debug sessions are running, pick one with --container: %s", strings.Join(names, ", "))
+	}
+}
+
+// commitImageSession builds a new image from the original image ref plus one
+// layer holding the changes made under /<dir> in the debug container, and
+// saves it as newRef. Running containers are read through tar inside the
+// container (so overlay mounts are seen); stopped ones through the API.
+func commitImageSession(ctx context.Context, cli *client.Client, containerID, ref, dir, newRef string, opts ImageOpts) error {
+	snapshot, err := os.CreateTemp("", "debux-commit-*.tar")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer func() { _ = os.Remove(snapshot.Name()) }()
+
+	statusf("Reading /%s from the debug container...\n", dir)
+	prefix, err := snapshotTarget(ctx, cli, containerID, dir, snapshot)
+	if cerr := snapshot.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	base, cleanup, err := dbximage.Open(ctx, cli, ref, opts.Direct, opts.Platform)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	layer, err := os.CreateTemp("", "debux-layer-*.tar")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer func() { _ = os.Remove(layer.Name()) }()
+
+	statusf("Comparing with %s...\n", ref)
+	n, err := dbximage.ChangesLayer(base, snapshot.Name(), prefix, layer)
+	if cerr := layer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("computing changes: %w", err)
+	}
+	if n == 0 {
+		statusf("No changes under /%s, nothing to commit\n", dir)
+		return nil
+	}
+
+	img, err := dbximage.AppendLayer(base, layer.Name(), fmt.Sprintf("debux image commit (from %s)", ref))
+	if err != nil {
+		return err
+	}
+	statusf("Writing %s...\n", newRef)
+	if err := dbximage.Save(ctx, cli, img, newRef); err != nil {
+		return err
+	}
+	statusf("Committed %d change(s) to %s\n", n, newRef)
+	return nil
+}
+
+// snapshotTarget writes a tar of /<dir> in the debug container to w and
+// returns the directory prefix of its entry names.
+func snapshotTarget(ctx context.Context, cli *client.Client, containerID, dir string, w io.Writer) (string, error) {
+	info, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("inspecting debug container: %w", err)
+	}
+
+	if info.State.Running {
+		var stderr bytes.Buffer
+		code, err := runInContainer(ctx, cli, containerID, []string{"tar", "-C", "/" + dir, "-cf", "-", "."}, w, &stderr)
+		if err != nil {
+			return "", err
+		}
+		if code != 0 {
+			return "", fmt.Errorf("archiving /%s failed: %s", dir, strings.TrimSpace(stderr.String()))
+		}
+		return "", nil
+	}
+
+	rc, _, err := cli.CopyFromContainer(ctx, containerID, "/"+dir)
+	if err != nil {
+		return "", fmt.Errorf("copying /%s from debug container: %w", dir, err)
+	}
+	defer func() { _ = rc.Close() }()
+	if _, err := io.Copy(w, rc); err != nil {
+		return "", fmt.Errorf("copying /%s from debug container: %w", dir, err)
+	}
+	return dir, nil
+}
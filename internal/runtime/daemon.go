@@ -0,0 +1,104 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/client"
+)
+
+// rootlessDocs explains how to set up rootless Docker for resource limits.
+const rootlessDocs = "https://docs.docker.com/engine/security/rootless/#limiting-resources"
+
+// daemonMode describes Docker daemon setups that change how a sidecar can
+// join its target: rootless daemons and user namespace remapping.
+type daemonMode struct {
+	Rootless      bool
+	UsernsRemap   bool
+	CgroupVersion string
+	CPULimits     bool // the daemon can enforce --cpus
+	MemoryLimits  bool // the daemon can enforce --memory
+	Windows       bool // the daemon runs Windows containers
+}
+
+// dockerDaemonMode inspects the daemon. When that fails, the usual rootful
+// setup is assumed and Docker reports any problem itself.
+func dockerDaemonMode(ctx context.Context, cli *client.Client) daemonMode {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return daemonMode{CPULimits: true, MemoryLimits: true}
+	}
+	mode := daemonMode{CgroupVersion: info.CgroupVersion, CPULimits: info.CPUCfsQuota, MemoryLimits: info.MemoryLimit, Windows: info.OSType == "windows"}
+	opts, _ := system.DecodeSecurityOptions(info.SecurityOptions)
+	for _, opt := range opts {
+		switch opt.Name {
+		case "rootless":
+			mode.Rootless = true
+		case "userns":
+			mode.UsernsRemap = true
+		}
+	}
+	return mode
+}
+
+// checkOptions rejects options the daemon can't honor, with what to do
+// about it.
+func (m daemonMode) checkOptions(opts DebugOpts) error {
+	if m.Windows {
+		return errWindowsDaemon
+	}
+	if opts.CPUs > 0 && !m.CPULimits {
+		if m.Rootless {
+			return fmt.Errorf("--cpus: rootless Docker can't enforce CPU limits without cgroup v2 and a delegated cpu controller (see %s)", rootlessDocs)
+		}
+		return fmt.Errorf("--cpus: the Docker daemon doesn't support CPU limits (no CFS quota)")
+	}
+	if opts.Memory > 0 && !m.MemoryLimits {
+		if m.Rootless {
+			return fmt.Errorf("--memory: rootless Docker can't enforce memory limits without cgroup v2 and a delegated memory controller (see %s)", rootlessDocs)
+		}
+		return fmt.Errorf("--memory: the Docker daemon doesn't support memory limits")
+	}
+	if m.Rootless && m.CgroupVersion == "1" && slices.Contains(opts.Share, "cgroup") {
+		return fmt.Errorf("--share cgroup: rootless Docker can't share cgroups on cgroup v1 hosts; drop cgroup from --share")
+	}
+	return nil
+}
+
+// adjustSidecar adapts the sidecar to the daemon mode.
+//
+// With userns-remap, a remapped sidecar can't join the namespaces of a target
+// running in the host user namespace (--userns=host), and Docker only allows
+// --privileged in the host user namespace. In both cases the sidecar runs in
+// the host user namespace, whose root can join remapped namespaces too.
+//
+// Rootless daemons run everything in the daemon's user namespace, so the
+// sidecar joins its target fine, but --privileged doesn't give host-level
+// capabilities.
+func (m daemonMode) adjustSidecar(hostConfig *container.HostConfig, target types.ContainerJSON) {
+	if m.UsernsRemap {
+		targetHost := target.HostConfig != nil && target.HostConfig.UsernsMode.IsHost()
+		if targetHost || hostConfig.Privileged {
+			hostConfig.UsernsMode = "host"
+		}
+	}
+	if m.Rootless && hostConfig.Privileged {
+		statusf("Note: Docker runs rootless; --privileged only grants capabilities inside its user namespace, so host-wide tools (perf, bpftrace, ...) won't work\n")
+	}
+}
+
+// explain adds to a sidecar start failure what the daemon mode may have to
+// do with it.
+func (m daemonMode) explain(err error) error {
+	switch {
+	case m.Rootless:
+		return fmt.Errorf("%w (Docker runs rootless: the sidecar only gets what the daemon's user namespace allows)", err)
+	case m.UsernsRemap:
+		return fmt.Errorf("%w (Docker uses userns-remap: joining the target's namespaces requires the same or the host user namespace)", err)
+	}
+	return err
+}
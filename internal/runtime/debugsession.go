@@ -0,0 +1,212 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// DebugSessionResource is the DebugSession custom resource, through which
+// the debux operator injects debug containers on behalf of users who can't
+// (deploy/operator.yaml).
+var DebugSessionResource = schema.GroupVersionResource{Group: "debux.dev", Version: "v1alpha1", Resource: "debugsessions"}
+
+// DebugSession is a request for a debug container in a pod.
+type DebugSession struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              DebugSessionSpec   `json:"spec"`
+	Status            DebugSessionStatus `json:"status,omitempty"`
+}
+
+// DebugSessionSpec is the debug container to inject.
+type DebugSessionSpec struct {
+	Pod            string   `json:"pod"`
+	Container      string   `json:"container,omitempty"` // the target container, the pod's first by default
+	Image          string   `json:"image,omitempty"`
+	Profile        string   `json:"profile,omitempty"`
+	PullPolicy     string   `json:"pullPolicy,omitempty"`
+	ShareVolumes   bool     `json:"shareVolumes,omitempty"`
+	Volumes        []string `json:"volumes,omitempty"`
+	ExcludeVolumes []string `json:"excludeVolumes,omitempty"`
+	ReadOnlyTarget bool     `json:"readOnlyTarget,omitempty"`
+	// TTL is how long the debug container may run, capped by the operator.
+	TTL string `json:"ttl,omitempty"`
+	// RequestedBy is the Kubernetes user who asked for the session, which
+	// the operator's policy decides on. The ValidatingAdmissionPolicy of
+	// deploy/operator.yaml makes sure it's whoever created the session.
+	RequestedBy string `json:"requestedBy,omitempty"`
+}
+
+// Phases of a DebugSession.
+const (
+	SessionPending = ""        // the operator hasn't handled it yet
+	SessionRunning = "Running" // the debug container runs
+	SessionDenied  = "Denied"  // the operator's policy refused it
+	SessionFailed  = "Failed"  // the debug container couldn't start
+	SessionExpired = "Expired" // its TTL elapsed and the debug container was stopped
+	SessionEnded   = "Ended"   // the pod or the debug container is gone
+)
+
+// DebugSessionStatus is the state of a DebugSession, set by the operator.
+type DebugSessionStatus struct {
+	Phase     string       `json:"phase,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	Container string       `json:"container,omitempty"` // the debug container
+	StartedAt *metav1.Time `json:"startedAt,omitempty"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	EndedAt   *metav1.Time `json:"endedAt,omitempty"`
+}
+
+// Done reports whether the session reached a final phase.
+func (s DebugSessionStatus) Done() bool {
+	return s.Phase != SessionPending && s.Phase != SessionRunning
+}
+
+// DebugSessionFromUnstructured converts a DebugSession from the dynamic
+// client.
+func DebugSessionFromUnstructured(u *unstructured.Unstructured) (*DebugSession, error) {
+	var s DebugSession
+	if err := kruntime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &s); err != nil {
+		return nil, fmt.Errorf("invalid DebugSession %s/%s: %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return &s, nil
+}
+
+// Unstructured converts s for the dynamic client.
+func (s *DebugSession) Unstructured() (*unstructured.Unstructured, error) {
+	s.APIVersion = DebugSessionResource.GroupVersion().String()
+	s.Kind = "DebugSession"
+	obj, err := kruntime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+// debugSessionTimeout is how long debux waits for the operator to start a
+// debug container, image pull included.
+const debugSessionTimeout = 5 * time.Minute
+
+// requestDebugSession creates a DebugSession for the target and waits for
+// the operator to run its debug container, whose name it returns.
+func requestDebugSession(ctx context.Context, config *rest.Config, namespace, targetContainer string, target *Target, opts DebugOpts) (string, error) {
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("creating Kubernetes client: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("creating Kubernetes client: %w", err)
+	}
+	user, err := kubernetesUser(ctx, clientset)
+	if err != nil {
+		return "", err
+	}
+	s := &DebugSession{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "debux-",
+			Namespace:    namespace,
+			Labels:       map[string]string{meta.KubeManagedByKey: meta.ManagedBy},
+		},
+		Spec: DebugSessionSpec{
+			Pod:            target.Name,
+			Container:      targetContainer,
+			Image:          opts.Image,
+			Profile:        opts.Profile,
+			PullPolicy:     opts.PullPolicy,
+			ShareVolumes:   opts.ShareVolumes,
+			Volumes:        opts.Volumes,
+			ExcludeVolumes: opts.ExcludeVolumes,
+			ReadOnlyTarget: opts.ReadOnlyTarget,
+			RequestedBy:    user,
+		},
+	}
+	u, err := s.Unstructured()
+	if err != nil {
+		return "", err
+	}
+	res := client.Resource(DebugSessionResource).Namespace(namespace)
+	created, err := res.Create(ctx, u, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("creating a DebugSession (is the debux operator installed?): %w", err)
+	}
+	name := created.GetName()
+	statusf("Waiting for the debux operator to start DebugSession %s...\n", name)
+
+	ctx, cancel := context.WithTimeout(ctx, debugSessionTimeout)
+	defer cancel()
+	for {
+		u, err := res.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("getting DebugSession %s: %w", name, err)
+		}
+		s, err := DebugSessionFromUnstructured(u)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case s.Status.Phase == SessionRunning:
+			if s.Status.ExpiresAt != nil {
+				statusf("Debug container %q runs until %s\n", s.Status.Container, s.Status.ExpiresAt.Local().Format(time.TimeOnly))
+			}
+			return s.Status.Container, nil
+		case s.Status.Done():
+			return "", fmt.Errorf("DebugSession %s: %s: %s", name, s.Status.Phase, s.Status.Message)
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return "", fmt.Errorf("DebugSession %s: the operator didn't start it within %s", name, debugSessionTimeout)
+			}
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// KubernetesContainerRunning reports whether a debug container of a pod
+// runs. A missing pod isn't an error: its containers don't run.
+func KubernetesContainerRunning(ctx context.Context, kubeconfig, namespace, pod, name string) (bool, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return false, err
+	}
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("getting pod %s/%s: %w", namespace, pod, err)
+	}
+	for _, st := range p.Status.EphemeralContainerStatuses {
+		if st.Name == name {
+			return st.State.Running != nil, nil
+		}
+	}
+	return false, nil
+}
+
+// DebugSessionClient returns the client of DebugSessions.
+func DebugSessionClient(kubeconfig string) (dynamic.NamespaceableResourceInterface, error) {
+	config, _, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("creating Kubernetes client: %w", err)
+	}
+	return client.Resource(DebugSessionResource), nil
+}
@@ -0,0 +1,106 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KubeDNSServers returns the resolvers dnsq compares for a pod, as
+// "<label>=<ip>": the kube-dns service, each CoreDNS pod directly, and the
+// upstreams CoreDNS forwards to when its Corefile lists them by address.
+func KubeDNSServers(ctx context.Context, kubeconfig string) ([]string, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	if svc, err := clientset.CoreV1().Services("kube-system").Get(ctx, "kube-dns", metav1.GetOptions{}); err == nil && net.ParseIP(svc.Spec.ClusterIP) != nil {
+		servers = append(servers, "kube-dns-service="+svc.Spec.ClusterIP)
+	}
+	pods, err := clientset.CoreV1().Pods("kube-system").List(ctx, metav1.ListOptions{LabelSelector: "k8s-app=kube-dns"})
+	if err != nil {
+		return nil, fmt.Errorf("listing CoreDNS pods: %w", err)
+	}
+	for _, p := range pods.Items {
+		if p.Status.Phase == corev1.PodRunning && p.Status.PodIP != "" {
+			servers = append(servers, "coredns/"+p.Name+"="+p.Status.PodIP)
+		}
+	}
+	if cm, err := clientset.CoreV1().ConfigMaps("kube-system").Get(ctx, "coredns", metav1.GetOptions{}); err == nil {
+		for _, ip := range corefileUpstreams(cm.Data["Corefile"]) {
+			servers = append(servers, "upstream="+ip)
+		}
+	}
+	return servers, nil
+}
+
+// corefileUpstreams returns the addresses of the "forward ." lines of a
+// Corefile. Upstreams read from a resolv.conf file are left out: that file
+// is the node's, out of reach of pods.
+func corefileUpstreams(corefile string) []string {
+	var ips []string
+	for _, line := range strings.Split(corefile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "forward" || fields[1] != "." {
+			continue
+		}
+		for _, f := range fields[2:] {
+			if f == "{" {
+				break
+			}
+			host := strings.TrimPrefix(strings.TrimPrefix(f, "dns://"), "tls://")
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) != nil {
+				ips = append(ips, host)
+			}
+		}
+	}
+	return ips
+}
+
+// DockerDNSServers returns the resolvers of the Docker host for dnsq, as
+// "host=<ip>": those of its resolv.conf, or of systemd-resolved's when the
+// host only lists its local stub. Containers on the default bridge use them;
+// those on user networks go through Docker's embedded DNS (127.0.0.11),
+// which forwards to them.
+func DockerDNSServers() []string {
+	servers := resolvConfServers("/etc/resolv.conf")
+	if len(servers) == 0 {
+		servers = resolvConfServers("/run/systemd/resolve/resolv.conf")
+	}
+	for i, ip := range servers {
+		servers[i] = "host=" + ip
+	}
+	return servers
+}
+
+// resolvConfServers returns the nameservers of a resolv.conf file, but
+// loopback ones, unreachable from containers.
+func resolvConfServers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && !ip.IsLoopback() {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
@@ -4,21 +4,28 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"io"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/events"
 	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/meta"
 	"github.com/clement-tourriere/debux/internal/store"
+	"github.com/clement-tourriere/debux/internal/telemetry"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/moby/term"
+	"golang.org/x/sync/errgroup"
 )
 
 // ContainerInfo holds metadata about a running Docker container.
@@ -43,15 +50,11 @@ func DockerList(ctx context.Context) ([]ContainerInfo, error) {
 		return nil, fmt.Errorf("listing containers: %w", err)
 	}
 
-	// Collect names of running debux sidecars to mark active sessions
+	// Collect targets of running debux sidecars to mark active sessions
 	debuxTargets := make(map[string]bool)
 	for _, c := range containers {
-		name := ""
-		if len(c.Names) > 0 {
-			name = strings.TrimPrefix(c.Names[0], "/")
-		}
-		if strings.HasPrefix(name, "debux-") && c.State == "running" {
-			debuxTargets[strings.TrimPrefix(name, "debux-")] = true
+		if target, ok := sidecarTarget(c); ok && c.State == "running" {
+			debuxTargets[target] = true
 		}
 	}
 
@@ -64,8 +67,8 @@ func DockerList(ctx context.Context) ([]ContainerInfo, error) {
 		if len(c.Names) > 0 {
 			name = strings.TrimPrefix(c.Names[0], "/")
 		}
-		// Skip debux sidecars themselves
-		if strings.HasPrefix(name, "debux-") {
+		// Skip debux's own containers
+		if isDebuxContainer(c) {
 			continue
 		}
 		result = append(result, ContainerInfo{
@@ -79,6 +82,83 @@ func DockerList(ctx context.Context) ([]ContainerInfo, error) {
 	return result, nil
 }
 
+// isDebuxContainer reports whether a container was created by debux. Those
+// created before debux labeled its containers are recognized by their
+// "debux-" name and their entrypoint script.
+func isDebuxContainer(c types.Container) bool {
+	if meta.IsManaged(c.Labels) {
+		return true
+	}
+	return len(c.Names) > 0 && strings.HasPrefix(strings.TrimPrefix(c.Names[0], "/"), "debux-") &&
+		strings.Contains(c.Command, "DEBUX_")
+}
+
+// debuxOwned reports whether an inspected container was created by debux
+// (older, unlabeled ones are recognized by their environment or command).
+func debuxOwned(info types.ContainerJSON) bool {
+	if info.Config == nil {
+		return false
+	}
+	if meta.IsManaged(info.Config.Labels) {
+		return true
+	}
+	for _, env := range info.Config.Env {
+		if strings.HasPrefix(env, "DEBUX_TARGET=") {
+			return true
+		}
+	}
+	// Target containers of image sessions, created but never started
+	return strings.HasPrefix(info.Name, "/debux-image-target-") && slices.Equal(info.Config.Cmd, []string{"true"})
+}
+
+// removeDebuxContainer removes a leftover debux container before one with
+// the same name is created, and refuses to touch someone else's container.
+func removeDebuxContainer(ctx context.Context, cli *client.Client, name string) error {
+	info, err := cli.ContainerInspect(ctx, name)
+	if client.IsErrNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("inspecting container %q: %w", name, err)
+	}
+	if !debuxOwned(info) {
+		return fmt.Errorf("a container named %q already exists and was not created by debux", name)
+	}
+	return cli.ContainerRemove(ctx, info.ID, container.RemoveOptions{Force: true})
+}
+
+// sidecarTarget returns the name of the container a debug sidecar was
+// created for.
+func sidecarTarget(c types.Container) (string, bool) {
+	if meta.IsKind(c.Labels, meta.KindSidecar) {
+		return c.Labels[meta.TargetKey], true
+	}
+	if !meta.IsManaged(c.Labels) && isDebuxContainer(c) {
+		name, ok := strings.CutPrefix(strings.TrimPrefix(c.Names[0], "/"), "debux-")
+		return name, ok && !strings.HasPrefix(name, "image-") && !strings.HasPrefix(name, "store-")
+	}
+	return "", false
+}
+
+// DockerContainerRunning reports whether a Docker container with the given
+// name or ID is running.
+func DockerContainerRunning(ctx context.Context, name string) (bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	info, err := cli.ContainerInspect(ctx, name)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inspecting container %q: %w", name, err)
+	}
+	return info.State.Running, nil
+}
+
 // DockerExec launches a debug sidecar sharing namespaces with the target container.
 // The sidecar runs in daemon mode (tail -f /dev/null) and persists between sessions,
 // matching K8s ephemeral container behavior. Interactive shells are started via exec.
@@ -89,36 +169,220 @@ func DockerExec(ctx context.Context, target *Target, opts DebugOpts) error {
 	}
 	defer func() { _ = cli.Close() }()
 
+	for {
+		id, containerName, err := ensureDockerSidecar(ctx, cli, target, opts)
+		if err != nil {
+			return err
+		}
+		if opts.Detach {
+			statusf("Debug container %q is running; attach with: debux attach %s\n", containerName, target.Name)
+			return nil
+		}
+		targetInfo, err := cli.ContainerInspect(ctx, target.Name)
+		if err != nil {
+			return fmt.Errorf("inspecting target container %q: %w", target.Name, err)
+		}
+
+		var user string
+		if opts.AsTargetUser && opts.User == "" {
+			if user, err = dockerTargetUser(ctx, cli, id, targetInfo); err != nil {
+				return err
+			}
+			statusf("Running as the target's user (%s)\n", user)
+		}
+
+		statusf("Debugging %s (container: %s)\n", target.Name, containerName)
+		info := dockerImageInfo(ctx, cli, id, targetInfo.Image, targetInfo.Config.Image)
+		if !opts.NoBanner {
+			b := dockerBanner(ctx, cli, targetInfo)
+			b.add("History", imageHistory(info))
+			b.print()
+		}
+		events.Emit(events.Event{Type: events.SessionStarted, Target: target.String(), Container: containerName})
+
+		// End the session when the target dies instead of leaving the shell
+		// hanging in dead namespaces.
+		session, cancel := limitSession(ctx, opts)
+		watchTarget(session, cli, targetInfo.ID, func() {
+			_, _ = fmt.Fprintf(os.Stdout, "\r\n[debux] %s stopped; its namespaces are gone.\r\n", target.Name)
+			cancel()
+		})
+		code, err := execInContainer(session, cli, id, user, pidEnv(opts.Pid)...)
+		cancel()
+		events.Emit(events.Ended(target.String(), containerName, code, err))
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !targetReplaced(ctx, cli, target.Name, targetInfo) {
+			return exitStatus(code, err)
+		}
+		if err := waitForTarget(ctx, cli, target.Name); err != nil {
+			return err
+		}
+		if !confirmReconnect(ctx, target.Name) {
+			return fmt.Errorf("target container %q restarted", target.Name)
+		}
+		// The old sidecar joined the namespaces of the previous run.
+		opts.Fresh = true
+		opts.Attach = false
+	}
+}
+
+// DockerPipe runs a command without a TTY in the debug sidecar of a Docker
+// container (creating the sidecar if needed), with stdin fed to it, and
+// returns its exit code. The target's root filesystem is at
+// $DEBUX_TARGET_ROOT inside the sidecar.
+func DockerPipe(ctx context.Context, target *Target, opts DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return -1, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	id, name, err := ensureDockerSidecar(ctx, cli, target, opts)
+	if err != nil {
+		return -1, err
+	}
+	events.Emit(events.Event{Type: events.SessionStarted, Target: target.String(), Container: name, Command: cmd})
+	code, err := pipeInContainer(ctx, cli, id, cmd, stdin, stdout, stderr)
+	events.Emit(events.Ended(target.String(), name, code, err))
+	return code, err
+}
+
+// DockerCopy extracts a tar archive into a directory of a Docker container,
+// like docker cp: no sidecar is involved.
+func DockerCopy(ctx context.Context, target *Target, dir string, archive io.Reader) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if err := cli.CopyToContainer(ctx, target.Name, dir, archive, container.CopyToContainerOptions{CopyUIDGID: true}); err != nil {
+		return fmt.Errorf("copying to %s:%s: %w", target.Name, dir, err)
+	}
+	return nil
+}
+
+// DockerSidecar returns the name of the running debug sidecar of a Docker
+// container, creating it if needed, for tools that attach to it themselves.
+func DockerSidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	_, name, err := ensureDockerSidecar(ctx, cli, target, opts)
+	return name, err
+}
+
+// ensureDockerSidecar returns the ID and name of a running debug sidecar for
+// the target container, reusing an existing one unless opts.Fresh is set.
+func ensureDockerSidecar(ctx context.Context, cli *client.Client, target *Target, opts DebugOpts) (_, _ string, err error) {
+	ctx, span := telemetry.Start(ctx, "debux.debug-container", telemetry.Target(target.String()))
+	defer func() { telemetry.End(span, err) }()
 	// Verify target container exists and is running
 	targetInfo, err := cli.ContainerInspect(ctx, target.Name)
 	if err != nil {
-		return fmt.Errorf("inspecting target container %q: %w", target.Name, err)
+		return "", "", fmt.Errorf("inspecting target container %q: %w", target.Name, err)
 	}
 	if !targetInfo.State.Running {
-		return fmt.Errorf("target container %q is not running", target.Name)
+		return "", "", fmt.Errorf("target container %q is not running", target.Name)
+	}
+	if targetInfo.Platform == "windows" {
+		return "", "", windowsTargetError(target.Name)
 	}
 
 	targetID := targetInfo.ID
 	targetName := strings.TrimPrefix(targetInfo.Name, "/")
 	containerName := fmt.Sprintf("debux-%s", targetName)
 
-	// Try to reuse an existing running debux sidecar
-	if !opts.Fresh {
-		if info, err := cli.ContainerInspect(ctx, containerName); err == nil && info.State.Running {
-			fmt.Printf("Reusing debug container %q\n", containerName)
-			fmt.Printf("Debugging %s (container: %s)\n", target.Name, containerName)
-			return execInContainer(ctx, cli, info.ID)
+	mode := dockerDaemonMode(ctx, cli)
+	if err := mode.checkOptions(opts); err != nil {
+		return "", "", err
+	}
+
+	share := opts.Share
+	if len(share) == 0 {
+		share = DefaultShare
+	}
+	profile := effectiveProfile(opts.Profile, opts.Privileged)
+
+	// Try to reuse an existing running debux sidecar sharing the same
+	// namespaces (sidecars from older versions carry no label and share the
+	// default ones). Attaching joins it whatever its options.
+	if opts.Fresh && !opts.Attach {
+		if info, err := cli.ContainerInspect(ctx, containerName); err == nil && info.State.Running && debuxOwned(info) {
+			if shells := runningExecs(ctx, cli, info); shells > 0 {
+				statusf("Replacing debug container %q, which closes its %d open shell(s)\n", containerName, shells)
+			} else {
+				statusf("Replacing debug container %q\n", containerName)
+			}
+		}
+	} else {
+		if info, err := cli.ContainerInspect(ctx, containerName); err == nil && info.State.Running && debuxOwned(info) && !sidecarStale(info, targetInfo) {
+			shared := info.Config.Labels[shareLabel]
+			if shared == "" {
+				shared = strings.Join(DefaultShare, ",")
+			}
+			switch {
+			case opts.Attach:
+				statusf("Attaching to debug container %q\n", containerName)
+				events.Emit(events.Event{Type: events.ContainerReused, Target: target.String(), Container: containerName})
+				return info.ID, containerName, nil
+			case shared != strings.Join(share, ","):
+				statusf("Replacing debug container %q, which shares other namespaces (%s)\n", containerName, shared)
+			case cmp.Or(info.Config.Labels[profileLabel], ProfileGeneral) != profile:
+				statusf("Replacing debug container %q, which runs another profile (%s)\n", containerName, cmp.Or(info.Config.Labels[profileLabel], ProfileGeneral))
+			case info.Config.Labels[optionsLabel] != sidecarOptions(opts):
+				statusf("Replacing debug container %q, which was created with other --mount/-e/--workdir options\n", containerName)
+			default:
+				statusf("Reusing debug container %q\n", containerName)
+				if err := updateSidecarResources(ctx, cli, info, opts); err != nil {
+					return "", "", err
+				}
+				events.Emit(events.Event{Type: events.ContainerReused, Target: target.String(), Container: containerName})
+				return info.ID, containerName, nil
+			}
 		}
 	}
 
-	// Ensure debug image is available
-	if err := dbximage.EnsureImage(ctx, cli, opts.Image); err != nil {
-		return fmt.Errorf("ensuring debug image: %w", err)
+	if opts.Attach {
+		return "", "", fmt.Errorf("no running debug container for %s; start one with: debux exec %s --detach", target.Name, target.Name)
 	}
 
-	// Ensure persistent nix volumes
-	if err := store.EnsureVolumes(ctx, cli); err != nil {
-		return fmt.Errorf("ensuring store volumes: %w", err)
+	// Prepare the debug image, the store volumes and the name of the sidecar
+	// at once: on a cold machine, each can take a while.
+	platform := opts.Platform
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		// Run the debug image for the target's platform unless told
+		// otherwise, so target binaries can be executed through the chroot
+		// wrappers.
+		if platform == "" {
+			if imgInfo, _, err := cli.ImageInspectWithRaw(gctx, targetInfo.Image); err == nil {
+				platform = dbximage.PlatformOf(imgInfo)
+			}
+		}
+		if err := dbximage.EnsureImage(gctx, cli, opts.Image, platform); err != nil {
+			return fmt.Errorf("ensuring debug image: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		if err := store.EnsureVolumes(gctx, cli, opts.StoreName); err != nil {
+			return fmt.Errorf("ensuring store volumes: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		// Remove any existing (stopped) debug container with the same name
+		return removeDebuxContainer(gctx, cli, containerName)
+	})
+	if err := g.Wait(); err != nil {
+		return "", "", err
 	}
 
 	config := &container.Config{
@@ -128,77 +392,91 @@ func DockerExec(ctx context.Context, target *Target, opts DebugOpts) error {
 		Env: []string{
 			fmt.Sprintf("DEBUX_TARGET=%s", target.Name),
 			fmt.Sprintf("DEBUX_TARGET_ID=%s", targetID),
-			"DEBUX_TARGET_ROOT=/proc/1/root",
 			"DEBUX_DAEMON=1",
 		},
+		WorkingDir: opts.Workdir,
+		Labels:     meta.Labels(meta.KindSidecar, targetName),
 	}
-
-	// Share IPC only if the target allows it
-	ipcMode := container.IpcMode(fmt.Sprintf("container:%s", targetID))
-	if targetInfo.HostConfig != nil && targetInfo.HostConfig.IpcMode != "" && targetInfo.HostConfig.IpcMode != "shareable" {
-		ipcMode = "private"
-	}
+	config.Labels[shareLabel] = strings.Join(share, ",")
+	config.Labels[profileLabel] = profile
+	config.Labels[optionsLabel] = sidecarOptions(opts)
+	config.Env = append(config.Env, userEnv(opts)...)
 
 	hostConfig := &container.HostConfig{
-		NetworkMode: container.NetworkMode(fmt.Sprintf("container:%s", targetID)),
-		PidMode:     container.PidMode(fmt.Sprintf("container:%s", targetID)),
-		IpcMode:     ipcMode,
-		CapAdd:      []string{"SYS_PTRACE"},
 		Mounts: []mount.Mount{
 			{
 				Type:   mount.TypeVolume,
-				Source: store.NixStoreVolume,
+				Source: store.StoreVolume(opts.StoreName),
 				Target: "/nix/store",
 			},
 			{
 				Type:   mount.TypeVolume,
-				Source: store.NixVarVolume,
+				Source: store.VarVolume(opts.StoreName),
 				Target: "/nix/var",
 			},
 		},
-		Privileged: opts.Privileged,
+		Resources: sidecarResources(opts),
+	}
+	if config.User, err = dockerProfile(hostConfig, profile, opts.User, []string{"SYS_PTRACE"}, opts.Security); err != nil {
+		return "", "", err
 	}
 
 	// Share target container's volumes
 	if opts.ShareVolumes {
-		shared := targetMounts(targetInfo)
+		shared, skipped := targetMounts(targetInfo, volumeFilter(opts), opts.ReadOnlyTarget)
+		if skipped > 0 {
+			statusf("Not sharing %d volume(s) of %s left out by --volumes or --exclude-volumes\n", skipped, targetName)
+		}
 		if len(shared) > 0 {
-			fmt.Printf("Sharing %d volume(s) from %s\n", len(shared), targetName)
+			if opts.ReadOnlyTarget {
+				statusf("Sharing %d volume(s) from %s read-only\n", len(shared), targetName)
+			} else {
+				statusf("Sharing %d volume(s) from %s\n", len(shared), targetName)
+			}
 			hostConfig.Mounts = append(hostConfig.Mounts, shared...)
 		}
 	}
 
-	if opts.User != "" {
-		config.User = opts.User
-	}
+	config.Env = append(config.Env, "DEBUX_TARGET_ROOT="+applyShare(hostConfig, targetInfo, opts.Share))
+	mode.adjustSidecar(hostConfig, targetInfo)
+	hostConfig.Mounts = append(hostConfig.Mounts, dockerMounts(opts.Mounts)...)
 
-	// Remove any existing (stopped) debug container with the same name
-	_ = cli.ContainerRemove(ctx, containerName, container.RemoveOptions{Force: true})
+	nix, flakeMount, err := dockerFlake(opts.Nix)
+	if err != nil {
+		return "", "", err
+	}
+	config.Env = append(config.Env, nix.Env()...)
+	config.Env = append(config.Env, entrypoint.HooksEnv(opts.SetupHooks)...)
+	if flakeMount != nil {
+		hostConfig.Mounts = append(hostConfig.Mounts, *flakeMount)
+	}
 
-	fmt.Printf("Creating debug container for %s...\n", target.Name)
+	statusf("Creating debug container for %s...\n", target.Name)
 
-	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, containerName)
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, dbximage.OCIPlatform(platform), containerName)
 	if err != nil {
-		return fmt.Errorf("creating debug container: %w", err)
+		return "", "", fmt.Errorf("creating debug container: %w", err)
 	}
 
 	// Start the sidecar in daemon mode (entrypoint does setup, then tail -f /dev/null)
 	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
 		_ = cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
-		return fmt.Errorf("starting debug container: %w", err)
+		return "", "", fmt.Errorf("starting debug container: %w", mode.explain(err))
 	}
+	events.Emit(events.Event{Type: events.ContainerCreated, Target: target.String(), Container: containerName, Image: opts.Image})
 
 	// Show entrypoint output (volumes, warnings)
 	showEntrypointOutput(ctx, cli, resp.ID)
 
-	fmt.Printf("Debugging %s (container: %s)\n", target.Name, containerName)
-
-	return execInContainer(ctx, cli, resp.ID)
+	return resp.ID, containerName, nil
 }
 
 // runInteractiveContainer attaches to a created container, starts it, streams
 // I/O (with raw terminal mode and TTY resize), and waits for it to exit.
 func runInteractiveContainer(ctx context.Context, cli *client.Client, containerID string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	attachOpts := container.AttachOptions{
 		Stream: true,
 		Stdin:  true,
@@ -228,7 +506,7 @@ func runInteractiveContainer(ctx context.Context, cli *client.Client, containerI
 	}
 
 	if isTerminal {
-		resizeTTY(ctx, cli, containerID, stdinFd)
+		resizeTTY(ctx, stdinFd, containerID, cli.ContainerResize)
 	}
 
 	outputDone := make(chan error, 1)
@@ -272,60 +550,135 @@ func runInteractiveContainer(ctx context.Context, cli *client.Client, containerI
 // DockerImage debugs a Docker image by copying its filesystem into a debug container.
 // This works for ALL images including scratch/distroless — the target image is never started.
 func DockerImage(ctx context.Context, imageRef string, opts ImageOpts) error {
+	targets := []imageTarget{{Ref: imageRef, Dir: "target"}}
+	name := fmt.Sprintf("debux-image-%s", sanitizeImageRef(imageRef))
+	return dockerImageSession(ctx, targets, imageRef, name, nil, opts, nil)
+}
+
+// DockerImageRun runs a command without a TTY in a temporary debug container
+// holding the image filesystem at /target ($DEBUX_TARGET_ROOT), and returns
+// its exit code.
+func DockerImageRun(ctx context.Context, imageRef string, opts ImageOpts, cmd []string, stdout, stderr io.Writer) (int, error) {
+	targets := []imageTarget{{Ref: imageRef, Dir: "target"}}
+	name := fmt.Sprintf("debux-image-run-%s", sanitizeImageRef(imageRef))
+	env := []string{"DEBUX_TARGET_ROOT=/target"}
+	opts.AutoRemove = false
+
+	code := -1
+	err := dockerImageSession(ctx, targets, imageRef, name, env, opts, func(ctx context.Context, cli *client.Client, containerID string) error {
+		var err error
+		code, err = runInContainer(ctx, cli, containerID, cmd, stdout, stderr)
+		return err
+	})
+	return code, err
+}
+
+// DockerImageDiff starts a debug session with two images side by side, the
+// first under /target-a and the second under /target-b.
+func DockerImageDiff(ctx context.Context, refA, refB string, opts ImageOpts) error {
+	targets := []imageTarget{{Ref: refA, Dir: "target-a"}, {Ref: refB, Dir: "target-b"}}
+	name := fmt.Sprintf("debux-image-diff-%s-%s", sanitizeImageRef(refA), sanitizeImageRef(refB))
+	env := []string{"DEBUX_TARGET_ROOT=/target-b"}
+	statusf("Comparing images: /target-a = %s, /target-b = %s\n", refA, refB)
+	return dockerImageSession(ctx, targets, refA+".."+refB, name, env, opts, nil)
+}
+
+// imageTarget is an image whose filesystem is copied to /<Dir> in the debug container.
+type imageTarget struct {
+	Ref string
+	Dir string
+}
+
+// sessionFunc runs in place of the interactive shell of an image session,
+// once the debug container is running with the target filesystems in place.
+type sessionFunc func(ctx context.Context, cli *client.Client, containerID string) error
+
+// dockerImageSession creates a debug container, copies each target image's
+// filesystem into it, and runs an interactive shell until it exits (or run,
+// when not nil).
+func dockerImageSession(ctx context.Context, targets []imageTarget, label, debugName string, env []string, opts ImageOpts, run sessionFunc) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("connecting to Docker: %w", err)
 	}
 	defer func() { _ = cli.Close() }()
-
-	// Check if the target image exists locally; if not, try pulling it.
-	// Unlike the debug image, the target may be a local-only build that
-	// should never be pulled from a registry.
-	_, _, inspectErr := cli.ImageInspectWithRaw(ctx, imageRef)
-	if inspectErr != nil {
-		// Image not found locally — attempt a pull (works for remote images)
-		if pullErr := dbximage.EnsureImage(ctx, cli, imageRef); pullErr != nil {
-			return fmt.Errorf("image %q not found locally and could not be pulled: %w", imageRef, pullErr)
-		}
+	if dockerDaemonMode(ctx, cli).Windows {
+		return errWindowsDaemon
+	}
+	if err := windowsImageOpts(ctx, cli, targets, &opts); err != nil {
+		return err
+	}
+	// --platform windows/... only applies to the targets
+	debugPlatform := opts.Platform
+	if dbximage.IsWindowsPlatform(debugPlatform) {
+		debugPlatform = ""
 	}
 
-	// Create a stopped container from the target image to access its filesystem.
-	// We use "true" as the command — it's never started, we just need the container layer.
-	targetName := fmt.Sprintf("debux-image-target-%s", sanitizeImageRef(imageRef))
-	_ = cli.ContainerRemove(ctx, targetName, container.RemoveOptions{Force: true})
+	// Ensure debug image and nix volumes, and pull the targets, at once
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := dbximage.EnsureImage(gctx, cli, opts.DebugImage, debugPlatform); err != nil {
+			return fmt.Errorf("ensuring debug image: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		if err := store.EnsureVolumes(gctx, cli, opts.StoreName); err != nil {
+			return fmt.Errorf("ensuring store volumes: %w", err)
+		}
+		return nil
+	})
 
-	fmt.Printf("Creating target container from %s...\n", imageRef)
-	targetResp, err := cli.ContainerCreate(ctx, &container.Config{
-		Image: imageRef,
-		Cmd:   []string{"true"},
-	}, nil, nil, nil, targetName)
-	if err != nil {
-		return fmt.Errorf("creating target container: %w", err)
+	// Fast path, with --mount-layers: assemble target filesystems from their
+	// overlay2 layers inside the debug container rather than copying them
+	// through the API. Mounting takes SYS_ADMIN without AppArmor confinement,
+	// which could remount the host's layers read-write, so it's opt-in; the
+	// CLI rejects it with path filters, confinement options and the
+	// confining profiles.
+	profile := effectiveProfile(opts.Profile, opts.Privileged)
+	mountLayers := opts.MountLayers
+	prepared := make([]*imageOverlay, len(targets))
+	if mountLayers {
+		for i, t := range targets {
+			g.Go(func() error {
+				var err error
+				prepared[i], err = prepareOverlay(gctx, cli, t, opts)
+				return err
+			})
+		}
 	}
-	targetID := targetResp.ID
-	defer func() {
-		_ = cli.ContainerRemove(context.Background(), targetID, container.RemoveOptions{Force: true})
-	}()
-
-	// Stream the entire target filesystem
-	fmt.Printf("Copying filesystem from %s...\n", imageRef)
-	tarReader, _, err := cli.CopyFromContainer(ctx, targetID, "/")
-	if err != nil {
-		return fmt.Errorf("copying filesystem from target: %w", err)
+	err = g.Wait()
+
+	// Other images come from the layer cache, where only the layers it
+	// doesn't have yet are copied
+	if err == nil && mountLayers {
+		for i, t := range targets {
+			if prepared[i] == nil {
+				if prepared[i], err = prepareLayerCache(ctx, cli, t, opts); err != nil {
+					break
+				}
+			}
+		}
 	}
-	defer func() { _ = tarReader.Close() }()
-
-	// Ensure debug image and nix volumes
-	if err := dbximage.EnsureImage(ctx, cli, opts.DebugImage); err != nil {
-		return fmt.Errorf("ensuring debug image: %w", err)
+	var overlays []*imageOverlay
+	for _, o := range prepared {
+		if o != nil {
+			defer o.cleanup()
+			overlays = append(overlays, o)
+		}
 	}
-	if err := store.EnsureVolumes(ctx, cli); err != nil {
-		return fmt.Errorf("ensuring store volumes: %w", err)
+	if err != nil {
+		return err
 	}
 
 	// Create the debug container
-	debugName := fmt.Sprintf("debux-image-%s", sanitizeImageRef(imageRef))
-	_ = cli.ContainerRemove(ctx, debugName, container.RemoveOptions{Force: true})
+	kind := meta.KindImageSession
+	if len(targets) > 1 {
+		kind = meta.KindImageDiff
+	}
+	if err := removeDebuxContainer(ctx, cli, debugName); err != nil {
+		return err
+	}
 
 	config := &container.Config{
 		Image:        opts.DebugImage,
@@ -335,57 +688,427 @@ func DockerImage(ctx context.Context, imageRef string, opts ImageOpts) error {
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		Env: []string{
-			fmt.Sprintf("DEBUX_TARGET=%s", imageRef),
-		},
+		Env: append(append([]string{
+			fmt.Sprintf("DEBUX_TARGET=%s", label),
+		}, terminalEnv()...), env...),
+		Labels: meta.Labels(kind, label),
 	}
 
 	hostConfig := &container.HostConfig{
 		Mounts: []mount.Mount{
 			{
 				Type:   mount.TypeVolume,
-				Source: store.NixStoreVolume,
+				Source: store.StoreVolume(opts.StoreName),
 				Target: "/nix/store",
 			},
 			{
 				Type:   mount.TypeVolume,
-				Source: store.NixVarVolume,
+				Source: store.VarVolume(opts.StoreName),
 				Target: "/nix/var",
 			},
 		},
 		AutoRemove: opts.AutoRemove,
-		Privileged: opts.Privileged,
+	}
+	if config.User, err = dockerProfile(hostConfig, profile, opts.User, nil, opts.Security); err != nil {
+		return err
+	}
+
+	nix, flakeMount, err := dockerFlake(opts.Nix)
+	if err != nil {
+		return err
+	}
+	config.Env = append(config.Env, nix.Env()...)
+	config.Env = append(config.Env, entrypoint.HooksEnv(opts.SetupHooks)...)
+	if flakeMount != nil {
+		hostConfig.Mounts = append(hostConfig.Mounts, *flakeMount)
+	}
+
+	if len(opts.Include) > 0 || len(opts.Exclude) > 0 || len(opts.Layers) > 0 {
+		// /target is partial or holds extracted layers: it can't be committed.
+		config.Env = append(config.Env, "DEBUX_NO_COMMIT=1")
+	}
+	if opts.RunEntrypoint {
+		// Picked up by the zshrc, which runs target-run in the first shell.
+		config.Env = append(config.Env, "DEBUX_RUN_ENTRYPOINT="+cmp.Or(opts.Trace, "1"))
+	}
+	if opts.Commit != "" {
+		// The container must outlive the shell so /target can be read back.
+		hostConfig.AutoRemove = false
+	}
+
+	if run != nil {
+		// Nothing to attach: keep the container alive for exec. The TTY stays
+		// so that showEntrypointOutput can read plain (non-multiplexed) logs.
+		config.Env = append(config.Env, "DEBUX_DAEMON=1")
+		config.OpenStdin, config.AttachStdin, config.AttachStdout, config.AttachStderr = false, false, false, false
+		hostConfig.AutoRemove = false
 	}
 
-	if opts.User != "" {
-		config.User = opts.User
+	if len(overlays) > 0 {
+		return dockerImageMountSession(ctx, cli, config, hostConfig, debugName, label, targets, overlays, opts, run)
 	}
 
-	debugResp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, debugName)
+	debugResp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, dbximage.OCIPlatform(debugPlatform), debugName)
 	if err != nil {
 		return fmt.Errorf("creating debug container: %w", err)
 	}
 	debugID := debugResp.ID
 
-	if !opts.AutoRemove {
+	if !hostConfig.AutoRemove {
 		defer func() {
 			_ = cli.ContainerRemove(context.Background(), debugID, container.RemoveOptions{Force: true})
 		}()
 	}
 
-	// Create /target directory inside the debug container via a tar archive
-	if err := mkdirViaTar(ctx, cli, debugID, "target"); err != nil {
-		return fmt.Errorf("creating /target directory: %w", err)
+	for _, t := range targets {
+		if err := copyImageFilesystem(ctx, cli, debugID, t, opts); err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Layers) > 0 {
+		if err := copyLayers(ctx, cli, debugID, targets[0].Ref, targets[0].Dir, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.RunEntrypoint {
+		if err := installTargetRun(ctx, cli, debugID, targets[0].Ref, opts); err != nil {
+			return err
+		}
+	}
+	info := imageSessionInfo(ctx, cli, debugID, targets[0], nil, opts)
+
+	if run != nil {
+		if err := cli.ContainerStart(ctx, debugID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("starting debug container: %w", err)
+		}
+		showEntrypointOutput(ctx, cli, debugID)
+		return run(ctx, cli, debugID)
+	}
+
+	statusf("Debugging image %s (container: %s)\n", label, debugName)
+	if info != nil && len(targets) == 1 && !opts.NoBanner {
+		imageBanner(info).print()
+	}
+	events.Emit(events.Event{Type: events.SessionStarted, Target: label, Container: debugName})
+
+	err = runInteractiveContainer(ctx, cli, debugID)
+	events.Emit(events.Ended(label, debugName, 0, err))
+	if err != nil {
+		return err
+	}
+	if opts.Commit != "" {
+		return commitImageSession(ctx, cli, debugID, targets[0].Ref, targets[0].Dir, opts.Commit, opts)
+	}
+	return nil
+}
+
+// dockerImageMountSession runs an image debug session whose target filesystems
+// are overlay-mounted by the entrypoint from bind-mounted image layers. The
+// container runs in daemon mode so that any target whose mount failed (or that
+// has no overlay) can still be copied in before the shell is started via exec.
+func dockerImageMountSession(ctx context.Context, cli *client.Client, config *container.Config, hostConfig *container.HostConfig,
+	debugName, label string, targets []imageTarget, overlays []*imageOverlay, opts ImageOpts, run sessionFunc) error {
+	config.Env = append(config.Env, "DEBUX_DAEMON=1", "DEBUX_OVERLAYS="+overlaySpec(overlays))
+	config.OpenStdin, config.AttachStdin, config.AttachStdout, config.AttachStderr = false, false, false, false
+	// Mounting overlayfs needs CAP_SYS_ADMIN, and Docker's default AppArmor
+	// profile denies mount(2) regardless of capabilities.
+	hostConfig.CapAdd = append(hostConfig.CapAdd, "SYS_ADMIN")
+	hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor=unconfined")
+	hostConfig.Tmpfs = map[string]string{"/run/debux/rw": ""}
+	hostConfig.Mounts = append(hostConfig.Mounts, overlayMounts(overlays)...)
+	hostConfig.AutoRemove = false
+
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, dbximage.OCIPlatform(opts.Platform), debugName)
+	if err != nil {
+		return fmt.Errorf("creating debug container: %w", err)
+	}
+	debugID := resp.ID
+	defer func() {
+		_ = cli.ContainerRemove(context.Background(), debugID, container.RemoveOptions{Force: true})
+	}()
+
+	// Copies into a running container can't see mounts made inside it, so
+	// individual layers are staged before start and bound into place by the
+	// entrypoint once the overlay is mounted.
+	if len(opts.Layers) > 0 {
+		if err := copyLayers(ctx, cli, debugID, targets[0].Ref, "run/debux/staged", opts); err != nil {
+			return err
+		}
+	}
+	if opts.RunEntrypoint {
+		if err := installTargetRun(ctx, cli, debugID, targets[0].Ref, opts); err != nil {
+			return err
+		}
+	}
+	var layerDirs []string
+	for _, o := range overlays {
+		if o.target.Dir == targets[0].Dir {
+			layerDirs = o.mountDirs()
+		}
+	}
+	info := imageSessionInfo(ctx, cli, debugID, targets[0], layerDirs, opts)
+
+	if err := cli.ContainerStart(ctx, debugID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("starting debug container: %w", err)
+	}
+	showEntrypointOutput(ctx, cli, debugID)
+
+	mounted := make(map[string]*imageOverlay)
+	for _, o := range overlays {
+		if overlayMounted(ctx, cli, debugID, o.target.Dir) {
+			mounted[o.target.Dir] = o
+			continue
+		}
+		// The mount failed: copy the filesystem from the container we already created.
+		statusf("Could not mount %s layers, falling back to copy\n", o.target.Ref)
+		if o.containerID == "" {
+			if err := copyImageFilesystem(ctx, cli, debugID, o.target, opts); err != nil {
+				return err
+			}
+			mounted[o.target.Dir] = o
+			continue
+		}
+		rc, err := containerFilesystem(ctx, cli, o.containerID, o.target.Ref)
+		if err != nil {
+			return err
+		}
+		err = copyToTarget(ctx, cli, debugID, o.target.Dir, o.target.Ref, rc, opts)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+		mounted[o.target.Dir] = o
+	}
+
+	for _, t := range targets {
+		if mounted[t.Dir] != nil {
+			continue
+		}
+		if err := copyImageFilesystem(ctx, cli, debugID, t, opts); err != nil {
+			return err
+		}
+	}
+
+	if run != nil {
+		return run(ctx, cli, debugID)
+	}
+
+	statusf("Debugging image %s (container: %s)\n", label, debugName)
+	if info != nil && len(targets) == 1 && !opts.NoBanner {
+		imageBanner(info).print()
+	}
+	events.Emit(events.Event{Type: events.SessionStarted, Target: label, Container: debugName})
+
+	code, err := execInContainer(ctx, cli, debugID, "")
+	events.Emit(events.Ended(label, debugName, code, err))
+	if err != nil {
+		return err
+	}
+	if opts.Commit != "" {
+		if err := commitImageSession(ctx, cli, debugID, targets[0].Ref, targets[0].Dir, opts.Commit, opts); err != nil {
+			return err
+		}
 	}
+	return exitStatus(code, nil)
+}
+
+// copyImageFilesystem copies the target image's filesystem to /<t.Dir> inside
+// the (not yet started) debug container.
+func copyImageFilesystem(ctx context.Context, cli *client.Client, containerID string, t imageTarget, opts ImageOpts) error {
+	tarReader, cleanup, err := targetFilesystem(ctx, cli, t.Ref, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	defer func() { _ = tarReader.Close() }()
 
-	// Copy the target filesystem into /target inside the debug container
-	if err := cli.CopyToContainer(ctx, debugID, "/target", tarReader, container.CopyToContainerOptions{}); err != nil {
-		return fmt.Errorf("copying filesystem to debug container: %w", err)
+	// Create the directory inside the debug container via a tar archive
+	if err := mkdirViaTar(ctx, cli, containerID, t.Dir); err != nil {
+		return fmt.Errorf("creating /%s directory: %w", t.Dir, err)
+	}
+
+	// Copy the target filesystem into it
+	return copyToTarget(ctx, cli, containerID, t.Dir, t.Ref, tarReader, opts)
+}
+
+// ImageDiff compares the filesystems and configurations of two images.
+func ImageDiff(ctx context.Context, refA, refB string, opts ImageOpts) (*dbximage.DiffReport, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Docker: %w", err)
 	}
+	defer func() { _ = cli.Close() }()
 
-	fmt.Printf("Debugging image %s (container: %s)\n", imageRef, debugName)
+	imgA, cleanupA, err := dbximage.Open(ctx, cli, refA, opts.Direct, opts.Platform)
+	defer cleanupA()
+	if err != nil {
+		return nil, err
+	}
+	imgB, cleanupB, err := dbximage.Open(ctx, cli, refB, opts.Direct, opts.Platform)
+	defer cleanupB()
+	if err != nil {
+		return nil, err
+	}
 
-	return runInteractiveContainer(ctx, cli, debugID)
+	fmt.Fprintf(os.Stderr, "Comparing %s and %s...\n", refA, refB)
+	report, err := dbximage.Diff(imgA, imgB)
+	if err != nil {
+		return nil, err
+	}
+	report.ImageA, report.ImageB = refA, refB
+	return report, nil
+}
+
+// targetFilesystem returns a tar stream of the target image's root filesystem
+// and a cleanup function releasing any resources created to produce it.
+//
+// Image archives (oci-archive:, docker-archive:) and, in direct mode, registry
+// images are unpacked client-side and never touch the daemon. Other references
+// go through a stopped container created from the image.
+func targetFilesystem(ctx context.Context, cli *client.Client, imageRef string, opts ImageOpts) (io.ReadCloser, func(), error) {
+	if opts.Direct || dbximage.IsArchiveRef(imageRef) {
+		img, cleanup, err := dbximage.Load(ctx, imageRef, opts.Platform)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		statusf("Unpacking filesystem from %s...\n", imageRef)
+		return dbximage.Flatten(img), cleanup, nil
+	}
+
+	targetID, cleanup, err := createTargetContainer(ctx, cli, imageRef, opts.Platform)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tarReader, err := containerFilesystem(ctx, cli, targetID, imageRef)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return tarReader, cleanup, nil
+}
+
+// createTargetContainer creates a stopped container from the target image to
+// access its filesystem, pulling the image first if it's not present locally.
+// The returned cleanup function removes the container.
+func createTargetContainer(ctx context.Context, cli *client.Client, imageRef, platform string) (string, func(), error) {
+	// Check if the target image exists locally; if not, try pulling it.
+	// Unlike the debug image, the target may be a local-only build that
+	// should never be pulled from a registry.
+	_, _, inspectErr := cli.ImageInspectWithRaw(ctx, imageRef)
+	if inspectErr != nil || platform != "" {
+		// Image not found locally (or maybe not for this platform) — attempt a
+		// pull (works for remote images)
+		if pullErr := dbximage.EnsureImage(ctx, cli, imageRef, platform); pullErr != nil {
+			return "", nil, fmt.Errorf("image %q not found locally and could not be pulled: %w", imageRef, pullErr)
+		}
+	}
+
+	// We use "true" as the command — it's never started, we just need the container layer.
+	targetName := fmt.Sprintf("debux-image-target-%s", sanitizeImageRef(imageRef))
+	if err := removeDebuxContainer(ctx, cli, targetName); err != nil {
+		return "", nil, err
+	}
+
+	statusf("Creating target container from %s...\n", imageRef)
+	targetResp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  imageRef,
+		Cmd:    []string{"true"},
+		Labels: meta.Labels(meta.KindImageTarget, imageRef),
+	}, nil, nil, dbximage.OCIPlatform(platform), targetName)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating target container: %w", err)
+	}
+	targetID := targetResp.ID
+	cleanup := func() {
+		_ = cli.ContainerRemove(context.Background(), targetID, container.RemoveOptions{Force: true})
+	}
+	return targetID, cleanup, nil
+}
+
+// containerFilesystem streams the entire filesystem of a (stopped) container.
+func containerFilesystem(ctx context.Context, cli *client.Client, containerID, imageRef string) (io.ReadCloser, error) {
+	statusf("Copying filesystem from %s...\n", imageRef)
+	tarReader, _, err := cli.CopyFromContainer(ctx, containerID, "/")
+	if err != nil {
+		return nil, fmt.Errorf("copying filesystem from target: %w", err)
+	}
+	return tarReader, nil
+}
+
+// ImageLayers returns the filesystem layers of an image along with the build
+// instruction that created each one.
+func ImageLayers(ctx context.Context, imageRef string, opts ImageOpts) ([]dbximage.LayerInfo, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	img, cleanup, err := dbximage.Open(ctx, cli, imageRef, opts.Direct, opts.Platform)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+	return dbximage.Layers(img)
+}
+
+// copyLayers extracts the requested individual layers of the target image into
+// /<baseDir>/layer-N inside the (not yet started) debug container.
+func copyLayers(ctx context.Context, cli *client.Client, containerID, imageRef, baseDir string, opts ImageOpts) error {
+	img, cleanup, err := dbximage.Open(ctx, cli, imageRef, opts.Direct, opts.Platform)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range opts.Layers {
+		rc, err := dbximage.LayerTar(img, n)
+		if err != nil {
+			return err
+		}
+		dir := fmt.Sprintf("%s/layer-%d", baseDir, n)
+		statusf("Extracting layer %d...\n", n)
+		if err := mkdirViaTar(ctx, cli, containerID, dir); err != nil {
+			_ = rc.Close()
+			return fmt.Errorf("creating /%s: %w", dir, err)
+		}
+		err = cli.CopyToContainer(ctx, containerID, "/"+dir, rc, container.CopyToContainerOptions{})
+		_ = rc.Close()
+		if err != nil {
+			return fmt.Errorf("copying layer %d to debug container: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// ExtractImage unpacks an image's root filesystem into a local directory
+// without a container daemon. Registry images are pulled directly, so this
+// works in CI containers and on hosts without Docker.
+func ExtractImage(ctx context.Context, imageRef, dir, platform string) error {
+	img, cleanup, err := dbximage.Load(ctx, imageRef, platform)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", dir, err)
+	}
+
+	if dbximage.IsWindows(img) {
+		statusf("%s is a Windows image: extracting the files of its layers, without their registry hives\n", imageRef)
+	}
+	statusf("Extracting filesystem from %s to %s...\n", imageRef, dir)
+	rc := dbximage.Flatten(img)
+	defer func() { _ = rc.Close() }()
+	if err := dbximage.ExtractTar(rc, dir); err != nil {
+		return fmt.Errorf("extracting filesystem: %w", err)
+	}
+	return nil
 }
 
 // mkdirViaTar creates a directory at /<name> inside a stopped container by
@@ -406,6 +1129,37 @@ func mkdirViaTar(ctx context.Context, cli *client.Client, containerID, name stri
 	return cli.CopyToContainer(ctx, containerID, "/", &buf, container.CopyToContainerOptions{})
 }
 
+// installTargetRun writes the target-run helper for the target image's
+// entrypoint into the (not yet started) debug container.
+func installTargetRun(ctx context.Context, cli *client.Client, containerID, imageRef string, opts ImageOpts) error {
+	cfg, err := dbximage.RunConfig(ctx, cli, imageRef, opts.Direct, opts.Platform)
+	if err != nil {
+		return err
+	}
+	script := entrypoint.TargetRun(cfg.Entrypoint, cfg.Cmd, cfg.Env, cfg.WorkingDir, cfg.User)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(entrypoint.TargetRunPath, "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     0o755,
+		Size:     int64(len(script)),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(script)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cli.CopyToContainer(ctx, containerID, "/", &buf, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("installing target-run: %w", err)
+	}
+	return nil
+}
+
 // sanitizeImageRef converts an image reference into a valid container name suffix.
 // e.g. "gcr.io/distroless/static:latest" → "gcr-io-distroless-static-latest"
 func sanitizeImageRef(ref string) string {
@@ -415,14 +1169,16 @@ func sanitizeImageRef(ref string) string {
 		".", "-",
 		"@", "-",
 	)
-	return replacer.Replace(ref)
+	return strings.Trim(replacer.Replace(ref), "-")
 }
 
 // targetMounts extracts the target container's mounts and converts them to
-// mount.Mount entries for the debug container, skipping paths reserved by debux.
-func targetMounts(info types.ContainerJSON) []mount.Mount {
+// mount.Mount entries for the debug container, skipping paths reserved by debux
+// and those filter leaves out, which it counts. With readOnly, every mount is
+// read-only, whatever the target's.
+func targetMounts(info types.ContainerJSON, filter pathFilter, readOnly bool) ([]mount.Mount, int) {
 	if info.Mounts == nil {
-		return nil
+		return nil, 0
 	}
 	// Paths used by the debug container itself — skip conflicts
 	reserved := map[string]bool{
@@ -430,14 +1186,19 @@ func targetMounts(info types.ContainerJSON) []mount.Mount {
 		"/nix/var":   true,
 	}
 	var mounts []mount.Mount
+	skipped := 0
 	for _, mp := range info.Mounts {
 		if reserved[mp.Destination] {
 			continue
 		}
+		if !filter.keep(mp.Destination, false) {
+			skipped++
+			continue
+		}
 		m := mount.Mount{
 			Type:     mp.Type,
 			Target:   mp.Destination,
-			ReadOnly: !mp.RW,
+			ReadOnly: !mp.RW || readOnly,
 		}
 		switch mp.Type {
 		case mount.TypeVolume:
@@ -454,32 +1215,40 @@ func targetMounts(info types.ContainerJSON) []mount.Mount {
 		}
 		mounts = append(mounts, m)
 	}
-	return mounts
+	return mounts, skipped
 }
 
-func resizeTTY(ctx context.Context, cli *client.Client, containerID string, fd uintptr) {
-	resize := func() {
+// resizeTTY keeps the TTY of a container or exec session (resize is
+// ContainerResize or ContainerExecResize) at the size of the local terminal:
+// now, and on every SIGWINCH until ctx is done. The first resize is retried,
+// as Docker rejects it until the process has started, which would leave
+// full-screen programs drawing at 80x24.
+func resizeTTY(ctx context.Context, fd uintptr, id string, resize func(context.Context, string, container.ResizeOptions) error) {
+	apply := func() error {
 		size, err := term.GetWinsize(fd)
 		if err != nil || size == nil {
-			return
+			return nil
 		}
-		_ = cli.ContainerResize(ctx, containerID, container.ResizeOptions{
+		return resize(ctx, id, container.ResizeOptions{
 			Height: uint(size.Height),
 			Width:  uint(size.Width),
 		})
 	}
 
-	// Initial resize
-	resize()
-
-	// Watch for terminal resize signals
 	sigCh, stopSig := watchSIGWINCH()
 	go func() {
 		defer stopSig()
+		for i := 0; i < 10 && apply() != nil; i++ {
+			select {
+			case <-time.After(time.Duration(i+1) * 10 * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+		}
 		for {
 			select {
 			case <-sigCh:
-				resize()
+				_ = apply()
 			case <-ctx.Done():
 				return
 			}
@@ -487,29 +1256,54 @@ func resizeTTY(ctx context.Context, cli *client.Client, containerID string, fd u
 	}()
 }
 
+// pipedShell is the debug shell without a TTY: zsh reading commands from
+// stdin without prompts, started by an interactive one for the shell
+// configuration (target environment, wrappers, working directory).
+var pipedShell = []string{"zsh", "-ic", "exec zsh -s"}
+
 // execInContainer starts an interactive zsh session inside a running container
 // using docker exec, similar to how K8s uses exec into daemon ephemeral containers.
-func execInContainer(ctx context.Context, cli *client.Client, containerID string) error {
-	resp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+// A non-empty user ("uid:gid") runs the shell as that user, with env in its
+// environment. It returns the shell's exit code.
+func execInContainer(ctx context.Context, cli *client.Client, containerID, user string, env ...string) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Without a terminal (piped input, scripts), the shell gets no TTY so
+	// that its stderr stays apart from its stdout
+	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
+	execOpts := container.ExecOptions{
 		Cmd:          []string{"zsh"},
 		AttachStdin:  true,
 		AttachStdout: true,
 		AttachStderr: true,
-		Tty:          true,
-	})
+		Tty:          isTerminal,
+	}
+	if !isTerminal {
+		execOpts.Cmd = pipedShell
+	} else {
+		execOpts.Env = terminalEnv()
+	}
+	if user != "" && !isRootUser(user) {
+		// The user likely has no home in the debug image: read the shell
+		// configuration from the entrypoint's world-readable copy.
+		execOpts.User = user
+		execOpts.Env = append(execOpts.Env, "ZDOTDIR="+targetUserZdotdir, "HOME=/tmp")
+	}
+	execOpts.Env = append(execOpts.Env, env...)
+	resp, err := cli.ContainerExecCreate(ctx, containerID, execOpts)
 	if err != nil {
-		return fmt.Errorf("creating exec session: %w", err)
+		return -1, fmt.Errorf("creating exec session: %w", err)
 	}
 
 	hijacked, err := cli.ContainerExecAttach(ctx, resp.ID, container.ExecAttachOptions{
-		Tty: true,
+		Tty: isTerminal,
 	})
 	if err != nil {
-		return fmt.Errorf("attaching to exec session: %w", err)
+		return -1, fmt.Errorf("attaching to exec session: %w", err)
 	}
 	defer hijacked.Close()
 
-	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
 	if isTerminal {
 		oldState, err := term.SetRawTerminal(stdinFd)
 		if err == nil {
@@ -521,41 +1315,28 @@ func execInContainer(ctx context.Context, cli *client.Client, containerID string
 	}
 
 	if isTerminal {
-		resizeExec := func() {
-			size, err := term.GetWinsize(stdinFd)
-			if err == nil && size != nil {
-				_ = cli.ContainerExecResize(ctx, resp.ID, container.ResizeOptions{
-					Height: uint(size.Height),
-					Width:  uint(size.Width),
-				})
-			}
-		}
-		resizeExec()
-
-		sigCh, stopSig := watchSIGWINCH()
-		go func() {
-			defer stopSig()
-			for {
-				select {
-				case <-sigCh:
-					resizeExec()
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
+		resizeTTY(ctx, stdinFd, resp.ID, cli.ContainerExecResize)
 	}
 
 	outputDone := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(os.Stdout, hijacked.Reader)
+		var err error
+		if isTerminal {
+			_, err = io.Copy(sessionOutput(), hijacked.Reader)
+		} else {
+			_, err = stdcopy.StdCopy(sessionOutput(), os.Stderr, hijacked.Reader)
+		}
 		outputDone <- err
 	}()
 
 	inputDone := make(chan struct{})
 	go func() {
 		defer close(inputDone)
-		_, _ = io.Copy(hijacked.Conn, os.Stdin)
+		_, _ = io.Copy(hijacked.Conn, newStdinReader(ctx))
+		if !isTerminal {
+			// The end of the input ends the shell
+			_ = hijacked.CloseWrite()
+		}
 	}()
 
 	select {
@@ -569,10 +1350,14 @@ func execInContainer(ctx context.Context, cli *client.Client, containerID string
 		case <-outputDone:
 		case <-time.After(2 * time.Second):
 		}
-		return ctx.Err()
+		return -1, context.Cause(ctx)
 	}
 
-	return nil
+	inspect, err := cli.ContainerExecInspect(ctx, resp.ID)
+	if err != nil {
+		return -1, fmt.Errorf("inspecting exec session: %w", err)
+	}
+	return inspect.ExitCode, nil
 }
 
 // showEntrypointOutput streams the sidecar's entrypoint output (volume listing,
@@ -600,6 +1385,6 @@ func showEntrypointOutput(ctx context.Context, cli *client.Client, containerID s
 		if strings.TrimRight(line, "\r") == "" {
 			break
 		}
-		fmt.Println(strings.TrimRight(line, "\r"))
+		statusf("%s\n", strings.TrimRight(line, "\r"))
 	}
 }
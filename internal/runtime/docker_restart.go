@@ -0,0 +1,107 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/moby/term"
+)
+
+// targetWaitTimeout bounds how long a session waits for a stopped target to
+// come back before giving up.
+const targetWaitTimeout = 2 * time.Minute
+
+// watchTarget calls stopped when the target container dies. The sidecar's
+// joined namespaces die with it, which otherwise leaves the shell hanging.
+func watchTarget(ctx context.Context, cli *client.Client, targetID string, stopped func()) {
+	msgs, errs := cli.Events(ctx, events.ListOptions{Filters: filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("container", targetID),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("event", string(events.ActionDestroy)),
+	)})
+	go func() {
+		select {
+		case <-msgs:
+			stopped()
+		case <-errs:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// targetReplaced reports whether the target container is no longer the one
+// described by before: stopped, removed, recreated under the same name or
+// restarted.
+func targetReplaced(ctx context.Context, cli *client.Client, name string, before types.ContainerJSON) bool {
+	info, err := cli.ContainerInspect(ctx, name)
+	if err != nil {
+		return true
+	}
+	return !info.State.Running || info.ID != before.ID || info.State.StartedAt != before.State.StartedAt
+}
+
+// sidecarStale reports whether a sidecar was started for an earlier run of
+// the target (its namespaces are gone since the target restarted) or for
+// another container with the same name.
+func sidecarStale(sidecar, target types.ContainerJSON) bool {
+	var targetID string
+	if sidecar.Config != nil {
+		for _, env := range sidecar.Config.Env {
+			if id, ok := strings.CutPrefix(env, "DEBUX_TARGET_ID="); ok {
+				targetID = id
+			}
+		}
+	}
+	if targetID != "" && targetID != target.ID {
+		return true
+	}
+	sidecarStart, err1 := time.Parse(time.RFC3339Nano, sidecar.State.StartedAt)
+	targetStart, err2 := time.Parse(time.RFC3339Nano, target.State.StartedAt)
+	return err1 == nil && err2 == nil && sidecarStart.Before(targetStart)
+}
+
+// waitForTarget waits until a container named name runs again.
+func waitForTarget(ctx context.Context, cli *client.Client, name string) error {
+	statusf("Waiting for %s to come back (Ctrl-C to quit)...\n", name)
+	ctx, cancel := context.WithTimeout(ctx, targetWaitTimeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if info, err := cli.ContainerInspect(ctx, name); err == nil && info.State.Running {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("target container %q did not come back within %s", name, targetWaitTimeout)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// confirmReconnect asks whether to open a new session on the restarted
+// target. Without a terminal there is nobody to ask, and the session ends.
+func confirmReconnect(ctx context.Context, name string) bool {
+	if _, isTerminal := term.GetFdInfo(os.Stdin); !isTerminal {
+		return false
+	}
+	statusf("%s is running again. Reconnect? [Y/n] ", name)
+	line, err := bufio.NewReader(newStdinReader(ctx)).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "" || answer == "y" || answer == "yes"
+}
@@ -0,0 +1,334 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/clement-tourriere/debux/internal/netcheck"
+)
+
+// Driver debugs the targets of a runtime. Every command reaches a runtime
+// through its driver, so adding one (see Register) makes its targets work
+// everywhere.
+type Driver interface {
+	// List returns the running targets, in a namespace for runtimes that
+	// have them.
+	List(ctx context.Context, namespace string, opts DebugOpts) ([]TargetInfo, error)
+	// Sessions returns the running debug containers, in a namespace like List.
+	Sessions(ctx context.Context, namespace string, opts DebugOpts) ([]Session, error)
+	// Exec opens a debug shell on the local terminal (debux <target>),
+	// honoring opts.Attach and opts.Detach.
+	Exec(ctx context.Context, target *Target, opts DebugOpts) error
+	// Pipe runs a command without a TTY in the debug container, creating it
+	// if needed, and returns its exit code. The target's root filesystem is
+	// at $DEBUX_TARGET_ROOT.
+	Pipe(ctx context.Context, target *Target, opts DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	// Shell runs the debug shell on a remote terminal.
+	Shell(ctx context.Context, target *Target, opts DebugOpts, t Terminal) error
+	// Sidecar returns the name of the running debug container, creating it
+	// if needed.
+	Sidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error)
+	// Cleanup removes or stops the debug container.
+	Cleanup(ctx context.Context, target *Target, opts DebugOpts) error
+	// Copy extracts a tar archive into the directory dir of the target's
+	// filesystem, keeping the owners and modes it holds.
+	Copy(ctx context.Context, target *Target, opts DebugOpts, dir string, archive io.Reader) error
+	// PortForward forwards the local address listen to port on the
+	// target's loopback until ctx ends, calling ready once listening. It
+	// fails with errors.ErrUnsupported when the runtime can't, for callers
+	// to relay connections through the debug container instead.
+	PortForward(ctx context.Context, target *Target, opts DebugOpts, listen string, port int, ready func()) error
+}
+
+// Standalone is implemented by drivers that start debug environments of
+// their own, not attached to a target (debux pod).
+type Standalone interface {
+	Pod(ctx context.Context, opts PodOpts) error
+}
+
+// DNSResolvers is implemented by drivers that know resolvers of their
+// targets only the host can find, which debux dnsq compares too.
+type DNSResolvers interface {
+	// DNSServers returns the resolvers as <label>=<ip>.
+	DNSServers(ctx context.Context, opts DebugOpts) ([]string, error)
+}
+
+// Services is implemented by drivers whose targets reach services by name,
+// which debux netcheck checks.
+type Services interface {
+	// ServiceEndpoints resolves svc/<name>[:port] to an endpoint per port
+	// of the service, or for the given port.
+	ServiceEndpoints(ctx context.Context, target *Target, opts DebugOpts, svc string) ([]netcheck.Endpoint, error)
+	// DefaultEndpoints are checked when no endpoint is given.
+	DefaultEndpoints() []netcheck.Endpoint
+	// NetworkPolicies returns the policies that select the target.
+	NetworkPolicies(ctx context.Context, target *Target, opts DebugOpts) ([]netcheck.Policy, error)
+}
+
+// Ptracer is implemented by drivers whose debug containers only get
+// SYS_PTRACE when they're created with it, which commands tracing the
+// target's processes (strace, jvm) then ask for.
+type Ptracer interface {
+	PtraceNeedsCapability() bool
+}
+
+// TargetInfo describes a running target.
+type TargetInfo struct {
+	Target     string // as passed to debux, e.g. k8s://prod/api-7d9f
+	Name       string
+	Namespace  string
+	Detail     string // image, or namespace
+	Status     string
+	Containers []string // for targets made of several containers
+	Session    bool     // a debug container is running
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver) // by runtime name
+	schemes   = make(map[string]string) // target scheme → runtime name
+)
+
+func init() {
+	Register("docker", dockerDriver{}, "docker")
+	Register("kubernetes", kubernetesDriver{}, "k8s")
+	Register("containerd", containerdDriver{}, "containerd", "nerdctl")
+}
+
+// Register adds the driver of a runtime, for the targets of the given
+// schemes (scheme://<name>). It replaces any driver of the same runtime.
+func Register(rt string, d Driver, targetSchemes ...string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[rt] = d
+	for _, s := range targetSchemes {
+		schemes[s] = rt
+	}
+}
+
+// DriverFor returns the driver of a runtime.
+func DriverFor(rt string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[rt]
+	if !ok {
+		return nil, fmt.Errorf("unsupported runtime: %s", rt)
+	}
+	return d, nil
+}
+
+// Schemes returns the registered target schemes.
+func Schemes() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	var names []string
+	for s := range schemes {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SchemeOf returns the first target scheme of a runtime, in order, or ""
+// if it has none.
+func SchemeOf(rt string) string {
+	for _, s := range Schemes() {
+		if r, _ := schemeRuntime(s); r == rt {
+			return s
+		}
+	}
+	return ""
+}
+
+// schemeRuntime returns the runtime of a target scheme.
+func schemeRuntime(scheme string) (string, bool) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	rt, ok := schemes[scheme]
+	return rt, ok
+}
+
+type dockerDriver struct{}
+
+func (dockerDriver) List(ctx context.Context, _ string, _ DebugOpts) ([]TargetInfo, error) {
+	containers, err := DockerList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetInfo
+	for _, c := range containers {
+		targets = append(targets, TargetInfo{Target: c.Name, Name: c.Name, Detail: c.Image, Status: c.Status, Session: c.HasDebuxSession})
+	}
+	return targets, nil
+}
+
+func (dockerDriver) Sessions(ctx context.Context, _ string, _ DebugOpts) ([]Session, error) {
+	return DockerSessions(ctx)
+}
+
+func (dockerDriver) Exec(ctx context.Context, target *Target, opts DebugOpts) error {
+	return DockerExec(ctx, target, opts)
+}
+
+func (dockerDriver) Pipe(ctx context.Context, target *Target, opts DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return DockerPipe(ctx, target, opts, cmd, stdin, stdout, stderr)
+}
+
+func (dockerDriver) Shell(ctx context.Context, target *Target, opts DebugOpts, t Terminal) error {
+	return DockerShell(ctx, target, opts, t)
+}
+
+func (dockerDriver) Sidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error) {
+	return DockerSidecar(ctx, target, opts)
+}
+
+func (dockerDriver) Cleanup(ctx context.Context, target *Target, _ DebugOpts) error {
+	return DockerCleanup(ctx, target)
+}
+
+func (dockerDriver) Copy(ctx context.Context, target *Target, _ DebugOpts, dir string, archive io.Reader) error {
+	return DockerCopy(ctx, target, dir, archive)
+}
+
+func (dockerDriver) PortForward(context.Context, *Target, DebugOpts, string, int, func()) error {
+	return fmt.Errorf("forwarding ports of Docker containers: %w", errors.ErrUnsupported)
+}
+
+func (dockerDriver) DNSServers(context.Context, DebugOpts) ([]string, error) {
+	// Only a local daemon's host is this one
+	if host := os.Getenv("DOCKER_HOST"); host != "" && !strings.HasPrefix(host, "unix://") {
+		return nil, nil
+	}
+	return DockerDNSServers(), nil
+}
+
+type kubernetesDriver struct{}
+
+func (kubernetesDriver) List(ctx context.Context, namespace string, opts DebugOpts) ([]TargetInfo, error) {
+	pods, err := KubernetesList(ctx, opts.Kubeconfig, KubeListOpts{Namespace: namespace, Selector: opts.Selector, CacheTTL: opts.ListCache})
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetInfo
+	for _, p := range pods {
+		targets = append(targets, TargetInfo{Target: "k8s://" + p.Namespace + "/" + p.Name, Name: p.Name, Namespace: p.Namespace, Detail: p.Namespace, Status: p.Status, Containers: p.Containers, Session: p.HasDebuxSession})
+	}
+	return targets, nil
+}
+
+func (kubernetesDriver) Sessions(ctx context.Context, namespace string, opts DebugOpts) ([]Session, error) {
+	return KubernetesSessions(ctx, opts.Kubeconfig, namespace)
+}
+
+func (kubernetesDriver) Exec(ctx context.Context, target *Target, opts DebugOpts) error {
+	return KubernetesExec(ctx, target, opts)
+}
+
+func (kubernetesDriver) Pipe(ctx context.Context, target *Target, opts DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return KubernetesPipe(ctx, target, opts, cmd, stdin, stdout, stderr)
+}
+
+func (kubernetesDriver) Shell(ctx context.Context, target *Target, opts DebugOpts, t Terminal) error {
+	return KubernetesShell(ctx, target, opts, t)
+}
+
+func (kubernetesDriver) Sidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error) {
+	return KubernetesSidecar(ctx, target, opts)
+}
+
+func (kubernetesDriver) Cleanup(ctx context.Context, target *Target, opts DebugOpts) error {
+	return KubernetesCleanup(ctx, target, opts.Kubeconfig)
+}
+
+func (d kubernetesDriver) Copy(ctx context.Context, target *Target, opts DebugOpts, dir string, archive io.Reader) error {
+	return PipeCopy(ctx, d, target, opts, dir, archive)
+}
+
+func (kubernetesDriver) PortForward(ctx context.Context, target *Target, opts DebugOpts, listen string, port int, ready func()) error {
+	return KubernetesPortForward(ctx, target, opts.Kubeconfig, listen, port, ready)
+}
+
+func (kubernetesDriver) Pod(ctx context.Context, opts PodOpts) error {
+	return KubernetesPod(ctx, opts)
+}
+
+func (kubernetesDriver) ServiceEndpoints(ctx context.Context, target *Target, opts DebugOpts, svc string) ([]netcheck.Endpoint, error) {
+	return KubeServiceEndpoints(ctx, target, opts.Kubeconfig, svc)
+}
+
+func (kubernetesDriver) DefaultEndpoints() []netcheck.Endpoint {
+	return []netcheck.Endpoint{{Name: "apiserver", Host: "kubernetes.default.svc", Port: 443, TLS: true}}
+}
+
+func (kubernetesDriver) NetworkPolicies(ctx context.Context, target *Target, opts DebugOpts) ([]netcheck.Policy, error) {
+	return KubeNetworkPolicies(ctx, target, opts.Kubeconfig)
+}
+
+func (kubernetesDriver) DNSServers(ctx context.Context, opts DebugOpts) ([]string, error) {
+	return KubeDNSServers(ctx, opts.Kubeconfig)
+}
+
+// Ephemeral containers can't gain capabilities, and the general profile
+// doesn't add SYS_PTRACE.
+func (kubernetesDriver) PtraceNeedsCapability() bool { return true }
+
+// PipeCopy is Copy for drivers without a copy API of their own: tar
+// extracts the archive in the debug container, through Pipe.
+func PipeCopy(ctx context.Context, d Driver, target *Target, opts DebugOpts, dir string, archive io.Reader) error {
+	var stderr bytes.Buffer
+	script := `cd "${DEBUX_TARGET_ROOT:-/proc/1/root}$1" && exec tar -x --same-owner -p -f -`
+	code, err := d.Pipe(ctx, target, opts, []string{"sh", "-c", script, "copy", dir}, archive, io.Discard, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("copying to %s: %s", dir, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// containerdDriver only explains that containerd isn't supported yet.
+type containerdDriver struct{}
+
+func (containerdDriver) List(context.Context, string, DebugOpts) ([]TargetInfo, error) {
+	return nil, fmt.Errorf("containerd runtime is not yet supported (planned for v0.2)")
+}
+
+func (containerdDriver) Sessions(context.Context, string, DebugOpts) ([]Session, error) {
+	return nil, fmt.Errorf("containerd runtime is not yet supported (planned for v0.2)")
+}
+
+func (containerdDriver) Exec(ctx context.Context, target *Target, opts DebugOpts) error {
+	return ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) Pipe(ctx context.Context, target *Target, opts DebugOpts, _ []string, _ io.Reader, _, _ io.Writer) (int, error) {
+	return -1, ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) Shell(ctx context.Context, target *Target, opts DebugOpts, _ Terminal) error {
+	return ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) Sidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error) {
+	return "", ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) Cleanup(ctx context.Context, target *Target, opts DebugOpts) error {
+	return ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) Copy(ctx context.Context, target *Target, opts DebugOpts, _ string, _ io.Reader) error {
+	return ContainerdExec(ctx, target, opts)
+}
+
+func (containerdDriver) PortForward(ctx context.Context, target *Target, opts DebugOpts, _ string, _ int, _ func()) error {
+	return ContainerdExec(ctx, target, opts)
+}
@@ -0,0 +1,38 @@
+package runtime
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types/mount"
+
+	"github.com/clement-tourriere/debux/internal/config"
+)
+
+// flakeDir is where a local --flake directory is mounted in debug containers.
+const flakeDir = "/run/debux/flake"
+
+// dockerFlake bind-mounts a local --flake directory (read-only) into the
+// debug container and points the flake reference at it. Remote references
+// are returned unchanged, with no mount.
+func dockerFlake(nix config.Nix) (config.Nix, *mount.Mount, error) {
+	if nix.Flake == "" {
+		return nix, nil, nil
+	}
+	dir, attr, local, err := config.LocalFlake(nix.Flake)
+	if err != nil || !local {
+		return nix, nil, err
+	}
+	nix.Flake = "path:" + flakeDir + attr
+	return nix, &mount.Mount{Type: mount.TypeBind, Source: dir, Target: flakeDir, ReadOnly: true}, nil
+}
+
+// kubeFlake rejects local --flake directories, which can't reach a pod.
+func kubeFlake(nix config.Nix) error {
+	if nix.Flake == "" {
+		return nil
+	}
+	if _, _, local, _ := config.LocalFlake(nix.Flake); local {
+		return fmt.Errorf("local flake %s is not available in Kubernetes; push it and use a remote reference (e.g. github:org/repo#shell)", nix.Flake)
+	}
+	return nil
+}
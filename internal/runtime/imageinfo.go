@@ -0,0 +1,169 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+)
+
+// kubeImageInfoTimeout bounds the registry round trips fetching the config
+// of the image of a pod's container, which the shell doesn't wait longer for.
+const kubeImageInfoTimeout = 10 * time.Second
+
+// installImageInfo writes the provenance of the target's image to
+// dbximage.InfoPath in a debug container, started or not, for target-history.
+func installImageInfo(ctx context.Context, cli *client.Client, containerID string, info *dbximage.Info) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := strings.TrimPrefix(dbximage.InfoPath, "/")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: path, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cli.CopyToContainer(ctx, containerID, "/", &buf, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("installing %s: %w", dbximage.InfoPath, err)
+	}
+	return nil
+}
+
+// imageSessionInfo installs the provenance of the image of an image session
+// (of its first target) in the debug container, and returns it. Sessions go
+// on without it. layerDirs are the directories of the mounted image layers,
+// topmost first, if any, which tell target-history where each file comes from.
+func imageSessionInfo(ctx context.Context, cli *client.Client, containerID string, t imageTarget, layerDirs []string, opts ImageOpts) *dbximage.Info {
+	info, err := dbximage.ImageInfo(ctx, cli, t.Ref, opts.Direct, opts.Platform)
+	if err != nil {
+		return nil
+	}
+	// The layers of the image are the bottom ones, under those a container adds
+	if n := info.Layers(); n > 0 && len(layerDirs) >= n {
+		for i, h := range info.History {
+			if h.Layer > 0 {
+				info.History[i].Dir = layerDirs[len(layerDirs)-h.Layer]
+			}
+		}
+	}
+	if installImageInfo(ctx, cli, containerID, info) != nil {
+		return nil
+	}
+	return info
+}
+
+// dockerImageInfo installs the provenance of the image of a Docker target
+// in its debug sidecar, and returns it, or nil if it can't.
+func dockerImageInfo(ctx context.Context, cli *client.Client, sidecarID, imageID, ref string) *dbximage.Info {
+	info, err := dbximage.ImageInfo(ctx, cli, imageID, false, "")
+	if err != nil {
+		return nil
+	}
+	info.Ref = ref
+	if installImageInfo(ctx, cli, sidecarID, info) != nil {
+		return nil
+	}
+	return info
+}
+
+// kubeImageInfo installs the provenance of the image of a pod's container
+// in its debux ephemeral container, and returns it, or nil if it can't.
+// Nodes don't hand out images: their config is fetched from the registry
+// by the digest the pod runs, with the local credentials, for the
+// platform of the node when debux may read it.
+func kubeImageInfo(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, pod *corev1.Pod, name, debugContainer string) *dbximage.Info {
+	var spec *corev1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			spec = &pod.Spec.Containers[i]
+		}
+	}
+	var digest string
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == name {
+			_, digest, _ = strings.Cut(cs.ImageID, "@")
+		}
+	}
+	if spec == nil || digest == "" || dbximage.Offline {
+		return nil
+	}
+	ref := spec.Image
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, kubeImageInfoTimeout)
+	defer cancel()
+	platform := ""
+	if node, err := clientset.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{}); err == nil {
+		platform = node.Status.NodeInfo.OperatingSystem + "/" + node.Status.NodeInfo.Architecture
+	}
+	img, err := dbximage.PullRemote(ctx, ref+"@"+digest, platform)
+	if err != nil {
+		return nil
+	}
+	info, err := dbximage.InfoOf(spec.Image, img)
+	if err != nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil
+	}
+	cmd := []string{"sh", "-c", "mkdir -p /run/debux && cat > " + dbximage.InfoPath}
+	if code, err := pipeInPod(ctx, config, clientset, pod.Namespace, pod.Name, debugContainer, cmd, bytes.NewReader(data), io.Discard, io.Discard); err != nil || code != 0 {
+		return nil
+	}
+	return info
+}
+
+// imageHistory summarizes the build of an image for banners, e.g. "12
+// layers, built 3 weeks ago (target-history)".
+func imageHistory(info *dbximage.Info) string {
+	if info == nil {
+		return ""
+	}
+	s := fmt.Sprintf("%d layers", info.Layers())
+	if !info.Created.IsZero() && info.Created.Year() > 1970 {
+		s += ", built " + units.HumanDuration(time.Since(info.Created)) + " ago"
+	}
+	return s + " (target-history)"
+}
+
+// imageBanner returns the banner of the image of an image session.
+func imageBanner(info *dbximage.Info) banner {
+	var b banner
+	image := info.Ref
+	if len(info.RepoDigests) > 0 {
+		if _, digest, ok := strings.Cut(info.RepoDigests[0], "@"); ok {
+			image += " (" + shortDigest(digest) + ")"
+		}
+	}
+	b.add("Image", image)
+	b.add("Platform", info.Platform)
+	b.add("Command", strings.Join(append(append([]string{}, info.Config.Entrypoint...), info.Config.Cmd...), " "))
+	b.add("User", info.Config.User)
+	b.add("History", imageHistory(info))
+	return b
+}
@@ -0,0 +1,562 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Inspector is implemented by drivers that describe their targets in the
+// runtime-independent format of debux inspect.
+type Inspector interface {
+	Inspect(ctx context.Context, target *Target, opts DebugOpts) (*Inspection, error)
+}
+
+// DefaultRedactEnv are the target variables that look like secrets, whose
+// values debug shells and debux inspect leave out (opts.RedactEnv adds to
+// them, opts.KeepEnv makes exceptions). They match names ignoring case.
+var DefaultRedactEnv = []string{
+	"*TOKEN*", "*SECRET*", "*PASSWORD*", "*PASSWD*", "*PASSPHRASE*", "*CREDENTIAL*",
+	"*API_KEY*", "*APIKEY*", "*PRIVATE_KEY*", "*ACCESS_KEY*", "*DSN*",
+}
+
+// credentialURL matches values with credentials in a URL, such as
+// postgres://user:pass@db/app, which are redacted whatever their name.
+var credentialURL = regexp.MustCompile(`[[:alpha:]][[:alnum:]+.-]*://[^/?#@\s:]*:[^/?#@\s]+@`)
+
+// Redacted replaces the values of redacted variables.
+const Redacted = "<redacted>"
+
+// Inspection describes a target the same way whatever its runtime.
+type Inspection struct {
+	Target     string            `json:"target"`
+	Runtime    string            `json:"runtime"`
+	Name       string            `json:"name"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Container  string            `json:"container,omitempty"`
+	Image      InspectImage      `json:"image"`
+	Command    []string          `json:"command,omitempty"` // entrypoint
+	Args       []string          `json:"args,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	State      InspectState      `json:"state"`
+	Env        []InspectEnv      `json:"env,omitempty"`
+	Mounts     []InspectMount    `json:"mounts,omitempty"`
+	Namespaces InspectNamespaces `json:"namespaces"`
+	Security   InspectSecurity   `json:"security"`
+	Network    InspectNetwork    `json:"network"`
+	Resources  InspectResources  `json:"resources,omitzero"`
+	Probes     []InspectProbe    `json:"probes,omitempty"`
+}
+
+// InspectImage is the image of a target.
+type InspectImage struct {
+	Ref    string `json:"ref"`
+	Digest string `json:"digest,omitempty"`
+	ID     string `json:"id,omitempty"`
+}
+
+// InspectState is the state of a target.
+type InspectState struct {
+	Status       string    `json:"status"`
+	StartedAt    time.Time `json:"startedAt,omitzero"`
+	RestartCount int       `json:"restartCount"`
+	Node         string    `json:"node,omitempty"`
+}
+
+// InspectEnv is a variable of a target. Value is Redacted for variables
+// that look like secrets; From says where variables set from other objects
+// come from (Kubernetes).
+type InspectEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	From  string `json:"from,omitempty"`
+}
+
+// InspectMount is a filesystem mounted in a target.
+type InspectMount struct {
+	Destination string `json:"destination"`
+	Type        string `json:"type"` // bind, volume, tmpfs, configMap, secret, pvc, emptyDir...
+	Source      string `json:"source,omitempty"`
+	ReadOnly    bool   `json:"readOnly"`
+}
+
+// InspectNamespaces says how a target shares each namespace: "private",
+// "host", "pod" (with the other containers of its pod) or
+// "container:<name>".
+type InspectNamespaces struct {
+	PID     string `json:"pid"`
+	Network string `json:"network"`
+	IPC     string `json:"ipc"`
+	UTS     string `json:"uts"`
+	User    string `json:"user"`
+}
+
+// InspectSecurity is the security context of a target.
+type InspectSecurity struct {
+	User                   string   `json:"user,omitempty"`
+	Privileged             bool     `json:"privileged"`
+	ReadOnlyRootFilesystem bool     `json:"readOnlyRootFilesystem"`
+	NoNewPrivileges        bool     `json:"noNewPrivileges"`
+	CapAdd                 []string `json:"capAdd,omitempty"`
+	CapDrop                []string `json:"capDrop,omitempty"`
+	Seccomp                string   `json:"seccomp,omitempty"`
+	AppArmor               string   `json:"apparmor,omitempty"`
+}
+
+// InspectNetwork is the network of a target.
+type InspectNetwork struct {
+	Hostname string        `json:"hostname,omitempty"`
+	IPs      []string      `json:"ips,omitempty"`
+	Ports    []InspectPort `json:"ports,omitempty"`
+}
+
+// InspectPort is a port a target exposes, published on HostPort if any.
+type InspectPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Name     string `json:"name,omitempty"`
+	HostPort int    `json:"hostPort,omitempty"`
+}
+
+// InspectResources are the resources of a target, in Kubernetes quantities.
+type InspectResources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+// InspectProbe is a health check of a target: a Kubernetes liveness,
+// readiness or startup probe, or a Docker healthcheck.
+type InspectProbe struct {
+	Kind             string `json:"kind"`
+	Check            string `json:"check"` // exec: <command>, http: <url>, tcp: <port> or grpc: <port>
+	PeriodSeconds    int    `json:"periodSeconds,omitempty"`
+	TimeoutSeconds   int    `json:"timeoutSeconds,omitempty"`
+	FailureThreshold int    `json:"failureThreshold,omitempty"`
+}
+
+// redactEnv reports whether the value of the variable key is left out,
+// as the debug shell does with the target's environment.
+func redactEnv(key, value string, opts DebugOpts) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(strings.ToUpper(p), strings.ToUpper(key)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return !match(opts.KeepEnv) && (match(DefaultRedactEnv) || match(opts.RedactEnv) || credentialURL.MatchString(value))
+}
+
+func (dockerDriver) Inspect(ctx context.Context, target *Target, opts DebugOpts) (*Inspection, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	info, err := cli.ContainerInspect(ctx, target.Name)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting container %q: %w", target.Name, err)
+	}
+	return dockerInspection(ctx, cli, target, info, opts), nil
+}
+
+// dockerInspection describes a Docker container.
+func dockerInspection(ctx context.Context, cli *client.Client, target *Target, info types.ContainerJSON, opts DebugOpts) *Inspection {
+	hc := info.HostConfig
+	in := &Inspection{
+		Target:     target.String(),
+		Runtime:    "docker",
+		Name:       strings.TrimPrefix(info.Name, "/"),
+		Image:      InspectImage{Ref: info.Config.Image, ID: info.Image},
+		Command:    info.Config.Entrypoint,
+		Args:       info.Config.Cmd,
+		WorkingDir: info.Config.WorkingDir,
+		State:      InspectState{Status: info.State.Status, RestartCount: info.RestartCount},
+	}
+	if img, _, err := cli.ImageInspectWithRaw(ctx, info.Image); err == nil && len(img.RepoDigests) > 0 {
+		_, in.Image.Digest, _ = strings.Cut(img.RepoDigests[0], "@")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil && !t.IsZero() {
+		in.State.StartedAt = t
+	}
+
+	for _, e := range info.Config.Env {
+		k, v, _ := strings.Cut(e, "=")
+		if redactEnv(k, v, opts) {
+			v = Redacted
+		}
+		in.Env = append(in.Env, InspectEnv{Name: k, Value: v})
+	}
+
+	for _, m := range info.Mounts {
+		source := m.Name
+		if source == "" {
+			source = m.Source
+		}
+		in.Mounts = append(in.Mounts, InspectMount{Destination: m.Destination, Type: string(m.Type), Source: source, ReadOnly: !m.RW})
+	}
+
+	mode := func(m string) string {
+		if m == "" || m == "private" || m == "shareable" {
+			return "private"
+		}
+		return m
+	}
+	in.Namespaces = InspectNamespaces{
+		PID:     mode(string(hc.PidMode)),
+		Network: mode(string(hc.NetworkMode)),
+		IPC:     mode(string(hc.IpcMode)),
+		UTS:     mode(string(hc.UTSMode)),
+		User:    mode(string(hc.UsernsMode)),
+	}
+	if in.Namespaces.Network == "default" || in.Namespaces.Network == "bridge" {
+		in.Namespaces.Network = "private"
+	}
+
+	in.Security = InspectSecurity{
+		User:                   info.Config.User,
+		Privileged:             hc.Privileged,
+		ReadOnlyRootFilesystem: hc.ReadonlyRootfs,
+		CapAdd:                 hc.CapAdd,
+		CapDrop:                hc.CapDrop,
+		Seccomp:                "runtime/default",
+		AppArmor:               info.AppArmorProfile,
+	}
+	for _, o := range hc.SecurityOpt {
+		k, v, _ := strings.Cut(o, "=")
+		switch k {
+		case "seccomp":
+			if strings.HasPrefix(v, "{") {
+				v = "custom"
+			}
+			in.Security.Seccomp = v
+		case "no-new-privileges":
+			in.Security.NoNewPrivileges = v == "" || v == "true"
+		}
+	}
+
+	in.Network.Hostname = info.Config.Hostname
+	if info.NetworkSettings != nil {
+		for _, n := range info.NetworkSettings.Networks {
+			if n != nil && n.IPAddress != "" {
+				in.Network.IPs = append(in.Network.IPs, n.IPAddress)
+			}
+		}
+		sort.Strings(in.Network.IPs)
+		for p, bindings := range info.NetworkSettings.Ports {
+			port := InspectPort{Port: p.Int(), Protocol: p.Proto()}
+			if len(bindings) > 0 {
+				port.HostPort, _ = strconv.Atoi(bindings[0].HostPort)
+			}
+			in.Network.Ports = append(in.Network.Ports, port)
+		}
+		sort.Slice(in.Network.Ports, func(i, j int) bool { return in.Network.Ports[i].Port < in.Network.Ports[j].Port })
+	}
+
+	if hc.NanoCPUs > 0 || hc.Memory > 0 {
+		in.Resources.Limits = map[string]string{}
+		if hc.NanoCPUs > 0 {
+			in.Resources.Limits["cpu"] = fmt.Sprintf("%dm", hc.NanoCPUs/1e6)
+		}
+		if hc.Memory > 0 {
+			in.Resources.Limits["memory"] = strconv.FormatInt(hc.Memory, 10)
+		}
+	}
+
+	if h := info.Config.Healthcheck; h != nil && len(h.Test) > 0 && h.Test[0] != "NONE" {
+		check := strings.Join(h.Test[1:], " ")
+		in.Probes = append(in.Probes, InspectProbe{
+			Kind:             "healthcheck",
+			Check:            "exec: " + check,
+			PeriodSeconds:    int(h.Interval / time.Second),
+			TimeoutSeconds:   int(h.Timeout / time.Second),
+			FailureThreshold: h.Retries,
+		})
+	}
+	return in
+}
+
+func (kubernetesDriver) Inspect(ctx context.Context, target *Target, opts DebugOpts) (*Inspection, error) {
+	_, clientset, err := getK8sClient(opts.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	namespace := target.Namespace
+	if namespace == "default" {
+		namespace = resolveNamespace(opts.Kubeconfig)
+	}
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pod %s/%s: %w", namespace, target.Name, err)
+	}
+	name := target.Container
+	if name == "" {
+		name = defaultContainer(pod)
+	}
+	in := kubeInspection(pod, name, opts)
+	if in == nil {
+		return nil, fmt.Errorf("pod %s/%s has no container %q", namespace, target.Name, name)
+	}
+	in.Target = target.String()
+	return in, nil
+}
+
+// kubeInspection describes a container of a pod, nil if there's none named
+// name.
+func kubeInspection(pod *corev1.Pod, name string, opts DebugOpts) *Inspection {
+	var c *corev1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			c = &pod.Spec.Containers[i]
+		}
+	}
+	if c == nil {
+		return nil
+	}
+	in := &Inspection{
+		Runtime:    "kubernetes",
+		Name:       pod.Name,
+		Namespace:  pod.Namespace,
+		Container:  name,
+		Image:      InspectImage{Ref: c.Image},
+		Command:    c.Command,
+		Args:       c.Args,
+		WorkingDir: c.WorkingDir,
+		State:      InspectState{Status: string(pod.Status.Phase), Node: pod.Spec.NodeName},
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != name {
+			continue
+		}
+		in.Image.ID = cs.ImageID
+		_, in.Image.Digest, _ = strings.Cut(cs.ImageID, "@")
+		in.State.RestartCount = int(cs.RestartCount)
+		switch {
+		case cs.State.Running != nil:
+			in.State.Status = "running"
+			in.State.StartedAt = cs.State.Running.StartedAt.Time
+		case cs.State.Waiting != nil:
+			in.State.Status = "waiting: " + cs.State.Waiting.Reason
+		case cs.State.Terminated != nil:
+			in.State.Status = "terminated: " + cs.State.Terminated.Reason
+		}
+	}
+
+	for _, e := range c.EnvFrom {
+		switch {
+		case e.ConfigMapRef != nil:
+			in.Env = append(in.Env, InspectEnv{Name: e.Prefix + "*", From: "configmap/" + e.ConfigMapRef.Name})
+		case e.SecretRef != nil:
+			in.Env = append(in.Env, InspectEnv{Name: e.Prefix + "*", From: "secret/" + e.SecretRef.Name})
+		}
+	}
+	for _, e := range c.Env {
+		env := InspectEnv{Name: e.Name, Value: e.Value}
+		if redactEnv(e.Name, e.Value, opts) && env.Value != "" {
+			env.Value = Redacted
+		}
+		if f := e.ValueFrom; f != nil {
+			switch {
+			case f.SecretKeyRef != nil:
+				env.From = "secret/" + f.SecretKeyRef.Name + ":" + f.SecretKeyRef.Key
+			case f.ConfigMapKeyRef != nil:
+				env.From = "configmap/" + f.ConfigMapKeyRef.Name + ":" + f.ConfigMapKeyRef.Key
+			case f.FieldRef != nil:
+				env.From = "field:" + f.FieldRef.FieldPath
+			case f.ResourceFieldRef != nil:
+				env.From = "resource:" + f.ResourceFieldRef.Resource
+			}
+		}
+		in.Env = append(in.Env, env)
+	}
+
+	volumes := map[string]corev1.Volume{}
+	for _, v := range pod.Spec.Volumes {
+		volumes[v.Name] = v
+	}
+	for _, m := range c.VolumeMounts {
+		typ, source := kubeVolumeType(volumes[m.Name])
+		in.Mounts = append(in.Mounts, InspectMount{Destination: m.MountPath, Type: typ, Source: source, ReadOnly: m.ReadOnly})
+	}
+
+	ns := func(host bool, shared string) string {
+		if host {
+			return "host"
+		}
+		return shared
+	}
+	pidShared := "private"
+	if pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace {
+		pidShared = "pod"
+	}
+	userShared := "host"
+	if pod.Spec.HostUsers != nil && !*pod.Spec.HostUsers {
+		userShared = "pod"
+	}
+	in.Namespaces = InspectNamespaces{
+		PID:     ns(pod.Spec.HostPID, pidShared),
+		Network: ns(pod.Spec.HostNetwork, "pod"),
+		IPC:     ns(pod.Spec.HostIPC, "pod"),
+		UTS:     ns(pod.Spec.HostNetwork, "pod"),
+		User:    userShared,
+	}
+
+	in.Security = kubeInspectSecurity(pod, c)
+
+	in.Network.Hostname = pod.Spec.Hostname
+	if in.Network.Hostname == "" {
+		in.Network.Hostname = pod.Name
+	}
+	for _, ip := range pod.Status.PodIPs {
+		in.Network.IPs = append(in.Network.IPs, ip.IP)
+	}
+	for _, p := range c.Ports {
+		in.Network.Ports = append(in.Network.Ports, InspectPort{Port: int(p.ContainerPort), Protocol: strings.ToLower(string(p.Protocol)), Name: p.Name, HostPort: int(p.HostPort)})
+	}
+
+	quantities := func(l corev1.ResourceList) map[string]string {
+		if len(l) == 0 {
+			return nil
+		}
+		m := map[string]string{}
+		for k, v := range l {
+			m[string(k)] = v.String()
+		}
+		return m
+	}
+	in.Resources = InspectResources{Requests: quantities(c.Resources.Requests), Limits: quantities(c.Resources.Limits)}
+
+	for _, p := range []struct {
+		kind  string
+		probe *corev1.Probe
+	}{{"liveness", c.LivenessProbe}, {"readiness", c.ReadinessProbe}, {"startup", c.StartupProbe}} {
+		if p.probe != nil {
+			in.Probes = append(in.Probes, kubeInspectProbe(p.kind, p.probe))
+		}
+	}
+	return in
+}
+
+// kubeVolumeType returns the type of a pod volume and its source.
+func kubeVolumeType(v corev1.Volume) (string, string) {
+	switch s := v.VolumeSource; {
+	case s.PersistentVolumeClaim != nil:
+		return "pvc", s.PersistentVolumeClaim.ClaimName
+	case s.ConfigMap != nil:
+		return "configMap", s.ConfigMap.Name
+	case s.Secret != nil:
+		return "secret", s.Secret.SecretName
+	case s.HostPath != nil:
+		return "hostPath", s.HostPath.Path
+	case s.EmptyDir != nil:
+		return "emptyDir", v.Name
+	case s.Projected != nil:
+		return "projected", v.Name
+	case s.CSI != nil:
+		return "csi", s.CSI.Driver
+	case s.Ephemeral != nil:
+		return "ephemeral", v.Name
+	case s.DownwardAPI != nil:
+		return "downwardAPI", v.Name
+	}
+	return "other", v.Name
+}
+
+// kubeInspectSecurity merges the security contexts of a pod and of its
+// container c, the latter winning.
+func kubeInspectSecurity(pod *corev1.Pod, c *corev1.Container) InspectSecurity {
+	var s InspectSecurity
+	var uid *int64
+	var seccomp *corev1.SeccompProfile
+	var apparmor *corev1.AppArmorProfile
+	if psc := pod.Spec.SecurityContext; psc != nil {
+		uid, seccomp, apparmor = psc.RunAsUser, psc.SeccompProfile, psc.AppArmorProfile
+	}
+	if sc := c.SecurityContext; sc != nil {
+		if sc.RunAsUser != nil {
+			uid = sc.RunAsUser
+		}
+		if sc.SeccompProfile != nil {
+			seccomp = sc.SeccompProfile
+		}
+		if sc.AppArmorProfile != nil {
+			apparmor = sc.AppArmorProfile
+		}
+		s.Privileged = sc.Privileged != nil && *sc.Privileged
+		s.ReadOnlyRootFilesystem = sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem
+		s.NoNewPrivileges = sc.AllowPrivilegeEscalation != nil && !*sc.AllowPrivilegeEscalation
+		if caps := sc.Capabilities; caps != nil {
+			for _, c := range caps.Add {
+				s.CapAdd = append(s.CapAdd, string(c))
+			}
+			for _, c := range caps.Drop {
+				s.CapDrop = append(s.CapDrop, string(c))
+			}
+		}
+	}
+	if uid != nil {
+		s.User = strconv.FormatInt(*uid, 10)
+	}
+	if seccomp != nil {
+		s.Seccomp = kubeProfile(string(seccomp.Type), seccomp.LocalhostProfile)
+	}
+	if apparmor != nil {
+		s.AppArmor = kubeProfile(string(apparmor.Type), apparmor.LocalhostProfile)
+	} else if a := pod.Annotations[corev1.DeprecatedAppArmorBetaContainerAnnotationKeyPrefix+c.Name]; a != "" {
+		s.AppArmor = a
+	}
+	return s
+}
+
+// kubeProfile formats a seccomp or AppArmor profile as --seccomp-profile
+// and --apparmor take them.
+func kubeProfile(typ string, localhost *string) string {
+	switch typ {
+	case "RuntimeDefault":
+		return "runtime/default"
+	case "Unconfined":
+		return "unconfined"
+	case "Localhost":
+		if localhost != nil {
+			return "localhost/" + *localhost
+		}
+	}
+	return typ
+}
+
+// kubeInspectProbe describes a probe of kind.
+func kubeInspectProbe(kind string, p *corev1.Probe) InspectProbe {
+	probe := InspectProbe{
+		Kind:             kind,
+		PeriodSeconds:    int(p.PeriodSeconds),
+		TimeoutSeconds:   int(p.TimeoutSeconds),
+		FailureThreshold: int(p.FailureThreshold),
+	}
+	switch h := p.ProbeHandler; {
+	case h.Exec != nil:
+		probe.Check = "exec: " + strings.Join(h.Exec.Command, " ")
+	case h.HTTPGet != nil:
+		scheme := strings.ToLower(string(h.HTTPGet.Scheme))
+		if scheme == "" {
+			scheme = "http"
+		}
+		probe.Check = fmt.Sprintf("http: %s://:%s%s", scheme, h.HTTPGet.Port.String(), h.HTTPGet.Path)
+	case h.TCPSocket != nil:
+		probe.Check = "tcp: " + h.TCPSocket.Port.String()
+	case h.GRPC != nil:
+		probe.Check = fmt.Sprintf("grpc: %d", h.GRPC.Port)
+	}
+	return probe
+}
@@ -3,22 +3,39 @@ package runtime
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 
 	"github.com/moby/term"
+
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/events"
+	"github.com/clement-tourriere/debux/internal/meta"
+	"github.com/clement-tourriere/debux/internal/telemetry"
 )
 
 // SecurityContextForProfile returns the SecurityContext for the given profile.
@@ -71,73 +88,112 @@ type PodInfo struct {
 	HasDebuxSession bool // true if pod has a running debux ephemeral container
 }
 
-// KubernetesList returns running pods, optionally filtered by namespace.
-func KubernetesList(ctx context.Context, kubeconfig string, namespace string) ([]PodInfo, error) {
-	_, clientset, err := getK8sClient(kubeconfig)
+// KubernetesExec debugs a running pod using ephemeral containers.
+// It reuses an existing running debux container when possible, or creates a new
+// one in daemon mode (DEBUX_DAEMON=1) so it stays alive between sessions.
+func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
+	config, clientset, err := getK8sClient(opts.Kubeconfig)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Resolve namespace from kubeconfig context when using the default placeholder
-	listNs := namespace
-	if listNs == "default" {
-		listNs = resolveNamespace(kubeconfig)
+	namespace, containerName, err := ensureEphemeralContainer(ctx, clientset, target, opts)
+	if err != nil {
+		return err
 	}
 
-	pods, err := clientset.CoreV1().Pods(listNs).List(ctx, metav1.ListOptions{
-		FieldSelector: "status.phase=Running",
-	})
-	if err != nil {
-		return nil, fmt.Errorf("listing pods: %w", err)
+	if opts.Detach {
+		statusf("Debug container %q is running in %s/%s; attach with: debux attach k8s://%s/%s\n", containerName, namespace, target.Name, namespace, target.Name)
+		return nil
 	}
 
-	var result []PodInfo
-	for _, pod := range pods.Items {
-		// Skip pods with no ready containers
-		hasReady := false
-		for _, cs := range pod.Status.ContainerStatuses {
-			if cs.Ready {
-				hasReady = true
-				break
-			}
+	statusf("Debugging %s/%s (container: %s)\n", namespace, target.Name, containerName)
+	exports := append(pidEnv(opts.Pid), shellEnv(opts)...)
+	if pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, target.Name, metav1.GetOptions{}); err == nil {
+		name := target.Container
+		if name == "" {
+			name = defaultContainer(pod)
 		}
-		if !hasReady {
-			continue
+		exports = append(exports, targetContainerEnv(pod, name)...)
+		info := kubeImageInfo(ctx, config, clientset, pod, name, containerName)
+		if !opts.NoBanner {
+			b := kubeBanner(pod, name)
+			b.add("History", imageHistory(info))
+			b.add("Debuggers", kubeDebuggers(pod, containerName))
+			b.print()
 		}
+	}
+	events.Emit(events.Event{Type: events.SessionStarted, Target: target.String(), Container: containerName})
+
+	// Exec into the daemon container to start an interactive shell, whose
+	// getfile and putfile go through debux
+	session, cancel := limitSession(ctx, opts)
+	files := newPodFiles(config, clientset, namespace, target.Name, containerName)
+	go files.serve(session)
+	code, err := execInPod(session, config, clientset, namespace, target.Name, containerName, append(exports, "DEBUX_FILES="+files.dir)...)
+	cancel()
+	files.close(ctx)
+	events.Emit(events.Ended(target.String(), containerName, code, err))
+	return exitStatus(code, err)
+}
 
-		var containers []string
-		for _, c := range pod.Spec.Containers {
-			containers = append(containers, c.Name)
-		}
+// KubernetesPipe runs a command without a TTY in a debux ephemeral container
+// of the target pod (creating one if needed), with stdin fed to it, and
+// returns its exit code. The target's root filesystem is at /proc/1/root
+// ($DEBUX_TARGET_ROOT).
+func KubernetesPipe(ctx context.Context, target *Target, opts DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	config, clientset, err := getK8sClient(opts.Kubeconfig)
+	if err != nil {
+		return -1, err
+	}
 
-		hasSession := false
-		for _, cs := range pod.Status.EphemeralContainerStatuses {
-			if strings.HasPrefix(cs.Name, "debux-") && cs.State.Running != nil {
-				hasSession = true
-				break
-			}
-		}
+	namespace, containerName, err := ensureEphemeralContainer(ctx, clientset, target, opts)
+	if err != nil {
+		return -1, err
+	}
 
-		result = append(result, PodInfo{
-			Name:            pod.Name,
-			Namespace:       pod.Namespace,
-			Status:          string(pod.Status.Phase),
-			Containers:      containers,
-			HasDebuxSession: hasSession,
-		})
+	if pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, target.Name, metav1.GetOptions{}); err == nil {
+		name := target.Container
+		if name == "" {
+			name = defaultContainer(pod)
+		}
+		if env := targetContainerEnv(pod, name); len(env) > 0 {
+			cmd = append(append([]string{"env"}, env...), cmd...)
+		}
 	}
-	return result, nil
+
+	events.Emit(events.Event{Type: events.SessionStarted, Target: target.String(), Container: containerName, Command: cmd})
+	code, err := pipeInPod(ctx, config, clientset, namespace, target.Name, containerName, cmd, stdin, stdout, stderr)
+	events.Emit(events.Ended(target.String(), containerName, code, err))
+	return code, err
 }
 
-// KubernetesExec debugs a running pod using ephemeral containers.
-// It reuses an existing running debux container when possible, or creates a new
-// one in daemon mode (DEBUX_DAEMON=1) so it stays alive between sessions.
-func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
-	config, clientset, err := getK8sClient(opts.Kubeconfig)
+// KubernetesSidecar returns the name of the running debux ephemeral
+// container of a pod, creating it if needed.
+func KubernetesSidecar(ctx context.Context, target *Target, opts DebugOpts) (string, error) {
+	_, clientset, err := getK8sClient(opts.Kubeconfig)
 	if err != nil {
-		return err
+		return "", err
 	}
+	_, name, err := ensureEphemeralContainer(ctx, clientset, target, opts)
+	return name, err
+}
 
+// ensureEphemeralContainer returns the resolved namespace and the name of a
+// running debux ephemeral container in the target pod, reusing an existing one
+// unless opts.Fresh is set. New containers run in daemon mode.
+func ensureEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, target *Target, opts DebugOpts) (_, _ string, err error) {
+	ctx, span := telemetry.Start(ctx, "debux.debug-container", telemetry.Target(target.String()))
+	defer func() { telemetry.End(span, err) }()
+	if err := kubeFlake(opts.Nix); err != nil {
+		return "", "", err
+	}
+	if len(opts.Mounts) > 0 {
+		return "", "", fmt.Errorf("--mount is not supported for Kubernetes targets: ephemeral containers can only mount the pod's volumes")
+	}
+	if len(opts.Share) > 0 {
+		return "", "", fmt.Errorf("--share is only supported for Docker targets: ephemeral containers always share the pod's network and IPC namespaces, and the target container's PID namespace")
+	}
 	namespace := target.Namespace
 	if namespace == "default" {
 		namespace = resolveNamespace(opts.Kubeconfig)
@@ -147,26 +203,119 @@ func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
 	// Get the target pod
 	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("getting pod %s/%s: %w", namespace, podName, err)
+		return "", "", fmt.Errorf("getting pod %s/%s: %w", namespace, podName, err)
+	}
+	if kubeWindowsPod(pod) {
+		return "", "", windowsTargetError(namespace + "/" + podName)
 	}
 
 	// Determine the target container name
 	targetContainer := target.Container
-	if targetContainer == "" && len(pod.Spec.Containers) > 0 {
-		targetContainer = pod.Spec.Containers[0].Name
+	if targetContainer == "" {
+		targetContainer = defaultContainer(pod)
+		if len(pod.Spec.Containers) > 1 && targetContainer != pod.Spec.Containers[0].Name {
+			statusf("Targeting container %q (pick another with k8s://%s/%s/<container>)\n", targetContainer, namespace, podName)
+		}
+	}
+
+	profile := effectiveProfile(opts.Profile, opts.Privileged)
+	sc, err := SecurityContextForProfile(profile)
+	if err != nil {
+		return "", "", err
+	}
+	if sc, err = kubeSecurityContext(sc, opts.Security); err != nil {
+		return "", "", err
+	}
+	if sc, err = kubeUser(sc, opts.User, profile); err != nil {
+		return "", "", err
+	}
+
+	// Ephemeral containers can't exec as another user: with --as-target-user,
+	// the whole container runs as the target's user.
+	if opts.AsTargetUser && opts.User == "" && !opts.Attach {
+		uid, gid, err := kubeTargetUser(pod, targetContainer)
+		if err != nil {
+			return "", "", err
+		}
+		if sc == nil {
+			sc = &corev1.SecurityContext{}
+		}
+		sc.RunAsUser, sc.RunAsGroup = uid, gid
+		statusf("Running as the target's user (%d)\n", *uid)
+	}
+	var runAsUser *int64
+	if sc != nil {
+		runAsUser = sc.RunAsUser
+	}
+
+	// A named container is the one to use, whatever it runs
+	if opts.Name != "" {
+		if errs := validation.IsDNS1123Label(opts.Name); len(errs) > 0 {
+			return "", "", fmt.Errorf("invalid --name %q: %s", opts.Name, strings.Join(errs, "; "))
+		}
+		switch state := ephemeralState(pod, opts.Name); {
+		case state == "running" && !opts.Fresh:
+			statusf("Reusing debug container %q\n", opts.Name)
+			events.Emit(events.Event{Type: events.ContainerReused, Target: target.String(), Container: opts.Name})
+			return namespace, opts.Name, nil
+		case state != "":
+			return "", "", fmt.Errorf("pod %s/%s already has a %s container %q, and ephemeral containers can't be restarted or removed: pick another --name", namespace, podName, state, opts.Name)
+		case opts.Attach:
+			return "", "", fmt.Errorf("no debug container %q in pod %s/%s", opts.Name, namespace, podName)
+		}
 	}
 
 	// Try to reuse an existing running debux container
-	if !opts.Fresh {
-		if existing := findRunningDebuxContainer(pod); existing != "" {
-			fmt.Printf("Reusing debug container %q\n", existing)
-			fmt.Printf("Debugging %s/%s (container: %s)\n", namespace, podName, existing)
-			return execInPod(ctx, config, clientset, namespace, podName, existing)
+	if opts.Attach && opts.Name == "" {
+		existing := findRunningDebuxContainer(pod)
+		if opts.PerUser {
+			existing = findOwnDebuxContainer(pod, meta.User())
+		}
+		if existing == "" {
+			return "", "", fmt.Errorf("no running debug container in pod %s/%s; start one with: debux exec k8s://%s/%s --detach", namespace, podName, namespace, podName)
+		}
+		statusf("Attaching to debug container %q\n", existing)
+		events.Emit(events.Event{Type: events.ContainerReused, Target: target.String(), Container: existing})
+		return namespace, existing, nil
+	}
+	if !opts.Fresh && opts.Name == "" {
+		creator := ""
+		if opts.PerUser {
+			creator = meta.User()
+		}
+		if existing, other := findReusableDebuxContainer(pod, opts.Image, profile, runAsUser, creator, ephemeralOptions(opts)); existing != "" {
+			statusf("Reusing debug container %q\n", existing)
+			if len(opts.Env) > 0 || opts.Workdir != "" || len(opts.Volumes) > 0 || len(opts.ExcludeVolumes) > 0 {
+				statusf("Warning: -e, --workdir, --volumes and --exclude-volumes only apply to new debug containers (use --fresh)\n")
+			}
+			events.Emit(events.Event{Type: events.ContainerReused, Target: target.String(), Container: existing})
+			return namespace, existing, nil
+		} else if other != "" {
+			statusf("Debug container %q runs another image, profile, user or options, or isn't yours, creating a new one\n", other)
 		}
 	}
 
+	if opts.Operator {
+		if len(opts.Env) > 0 || opts.Workdir != "" || opts.User != "" || opts.Name != "" || !opts.Security.IsZero() {
+			return "", "", fmt.Errorf("-e, --workdir, --user, --name and the security flags don't apply to debug containers started by the debux operator")
+		}
+		config, _, err := getK8sClient(opts.Kubeconfig)
+		if err != nil {
+			return "", "", err
+		}
+		name, err := requestDebugSession(ctx, config, namespace, targetContainer, target, opts)
+		if err != nil {
+			return "", "", err
+		}
+		events.Emit(events.Event{Type: events.ContainerCreated, Target: target.String(), Container: name, Image: opts.Image})
+		return namespace, name, nil
+	}
+
 	// Create a new ephemeral container in daemon mode
-	debugContainerName := fmt.Sprintf("debux-%d", time.Now().Unix())
+	debugContainerName := opts.Name
+	if debugContainerName == "" {
+		debugContainerName = ephemeralName(profile)
+	}
 
 	ephemeralContainer := corev1.EphemeralContainer{
 		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
@@ -180,40 +329,43 @@ func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
 				{Name: "DEBUX_TARGET", Value: target.Name},
 				{Name: "DEBUX_TARGET_ROOT", Value: "/proc/1/root"},
 				{Name: "DEBUX_DAEMON", Value: "1"},
+				{Name: "DEBUX_PROFILE", Value: profile},
 				{Name: "HOME", Value: "/root"},
 			},
 		},
 		TargetContainerName: targetContainer,
 	}
+	if options := ephemeralOptions(opts); options != "" {
+		ephemeralContainer.Env = append(ephemeralContainer.Env, corev1.EnvVar{Name: ephemeralOptionsEnv, Value: options})
+	}
+	ephemeralContainer.Env = append(ephemeralContainer.Env, kubeEnv(meta.Env())...)
+	ephemeralContainer.Env = append(ephemeralContainer.Env, kubeEnv(opts.Nix.Env())...)
+	ephemeralContainer.Env = append(ephemeralContainer.Env, kubeEnv(entrypoint.HooksEnv(opts.SetupHooks))...)
+	ephemeralContainer.Env = append(ephemeralContainer.Env, kubeEnv(opts.Env)...)
+	ephemeralContainer.WorkingDir = opts.Workdir
 
-	// Share target container's volume mounts (skip ones with SubPath, not allowed on ephemeral containers)
 	if opts.ShareVolumes {
-		for _, c := range pod.Spec.Containers {
-			if c.Name == targetContainer {
-				for _, vm := range c.VolumeMounts {
-					if vm.SubPath == "" && vm.SubPathExpr == "" {
-						ephemeralContainer.VolumeMounts = append(ephemeralContainer.VolumeMounts, vm)
-					}
-				}
-				break
-			}
+		if volumes := shareKubeVolumes(&ephemeralContainer, pod, targetContainer, opts); len(volumes) > 0 {
+			ephemeralContainer.Env = append(ephemeralContainer.Env, corev1.EnvVar{Name: "DEBUX_TARGET_VOLUMES", Value: strings.Join(volumes, "\n")})
 		}
 	}
 
-	sc, err := SecurityContextForProfile(opts.Profile)
-	if err != nil {
-		return err
+	if runAsUser != nil && *runAsUser != 0 {
+		// root's home isn't writable: the entrypoint writes the shell
+		// configuration to /tmp instead
+		for i, env := range ephemeralContainer.Env {
+			if env.Name == "HOME" {
+				ephemeralContainer.Env[i].Value = "/tmp"
+			}
+		}
 	}
 	if sc != nil {
 		ephemeralContainer.SecurityContext = sc
 	}
 
-	// Add the ephemeral container to the pod spec and update via the
-	// ephemeralcontainers subresource (PUT), matching kubectl debug behavior.
-	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, ephemeralContainer)
-	patchedPod, err := clientset.CoreV1().Pods(namespace).UpdateEphemeralContainers(ctx, podName, pod, metav1.UpdateOptions{})
+	patchedPod, err := addEphemeralContainer(ctx, clientset, pod, ephemeralContainer)
 	if err != nil {
-		return fmt.Errorf("updating ephemeral containers: %w", err)
+		return "", "", fmt.Errorf("updating ephemeral containers: %w", err)
 	}
 
 	// Verify the ephemeral container actually appears in the patched pod.
@@ -226,7 +378,7 @@ func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
 		}
 	}
 	if !found {
-		return fmt.Errorf("ephemeral container %q was not created — the API server accepted the patch but the container is missing from the pod spec.\n"+
+		return "", "", fmt.Errorf("ephemeral container %q was not created — the API server accepted the patch but the container is missing from the pod spec.\n"+
 			"This typically means an admission webhook or policy (e.g. Gatekeeper, Kyverno, PodSecurity) stripped it.\n"+
 			"Check cluster events and webhook configurations:\n"+
 			"  kubectl get events -n %s --field-selector involvedObject.name=%s\n"+
@@ -234,36 +386,294 @@ func KubernetesExec(ctx context.Context, target *Target, opts DebugOpts) error {
 			debugContainerName, namespace, podName)
 	}
 
-	fmt.Printf("Waiting for debug container %q to start...\n", debugContainerName)
+	events.Emit(events.Event{Type: events.ContainerCreated, Target: target.String(), Container: debugContainerName, Image: opts.Image})
+	statusf("Waiting for debug container %q to start...\n", debugContainerName)
 
 	// Wait for the ephemeral container to be running.
 	// Pass the resourceVersion from the update response so the watch starts
 	// from the right point and we don't miss status changes that happen
 	// between the update and the watch setup.
 	if err := waitForEphemeralContainer(ctx, clientset, namespace, podName, debugContainerName, patchedPod.ResourceVersion); err != nil {
-		return err
+		return "", "", err
 	}
 
-	fmt.Printf("Debugging %s/%s (container: %s)\n", namespace, podName, debugContainerName)
+	return namespace, debugContainerName, nil
+}
 
-	// Exec into the daemon container to start an interactive shell
-	return execInPod(ctx, config, clientset, namespace, podName, debugContainerName)
+// addEphemeralContainer adds an ephemeral container to the pod spec and
+// updates it via the ephemeralcontainers subresource (PUT), matching kubectl
+// debug behavior. Admission policies of some clusters reject ephemeral
+// containers with stdin or a TTY: when the cluster refuses the container, it
+// is requested again without them, which daemon mode doesn't need since
+// shells get their TTY from exec.
+func addEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod, c corev1.EphemeralContainer) (*corev1.Pod, error) {
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, c)
+	patched, err := clientset.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(ctx, pod.Name, pod, metav1.UpdateOptions{})
+	if err == nil || (!c.Stdin && !c.TTY) || !(apierrors.IsForbidden(err) || apierrors.IsInvalid(err) || apierrors.IsBadRequest(err)) {
+		return patched, err
+	}
+	statusf("The cluster refused the debug container, retrying without stdin and TTY\n")
+	added := &pod.Spec.EphemeralContainers[len(pod.Spec.EphemeralContainers)-1]
+	added.Stdin, added.TTY = false, false
+	patched, retryErr := clientset.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(ctx, pod.Name, pod, metav1.UpdateOptions{})
+	if retryErr != nil {
+		// Whatever the policy objects to, it's not only stdin and the TTY
+		return nil, err
+	}
+	return patched, nil
 }
 
-// findRunningDebuxContainer looks for an existing running ephemeral container
-// with the "debux-" prefix on the given pod. Returns its name, or "" if none found.
+// findRunningDebuxContainer looks for an existing running debux ephemeral
+// container on the given pod. Returns its name, or "" if none found.
 func findRunningDebuxContainer(pod *corev1.Pod) string {
+	debux := make(map[string]bool)
+	for _, c := range pod.Spec.EphemeralContainers {
+		debux[c.Name] = isDebuxEphemeral(c)
+	}
 	for _, cs := range pod.Status.EphemeralContainerStatuses {
-		if strings.HasPrefix(cs.Name, "debux-") && cs.State.Running != nil {
+		if debux[cs.Name] && cs.State.Running != nil {
 			return cs.Name
 		}
 	}
 	return ""
 }
 
+// ephemeralOptionsEnv records in an ephemeral container's environment a
+// digest of the options it was created with (--seccomp-profile, --apparmor,
+// --cap-add, --cap-drop and --read-only-target), like
+// optionsLabel on Docker sidecars, so that it's only reused with the same
+// ones.
+const ephemeralOptionsEnv = "DEBUX_OPTIONS"
+
+// ephemeralOptions returns the ephemeralOptionsEnv value for opts, "" without
+// any of those options (which is also what older containers carry).
+func ephemeralOptions(opts DebugOpts) string {
+	if opts.Security.IsZero() && !opts.ReadOnlyTarget {
+		return ""
+	}
+	h := sha256.New()
+	if !opts.Security.IsZero() {
+		fmt.Fprintf(h, "seccomp\x00%s\x00apparmor\x00%s", opts.Security.Seccomp, opts.Security.AppArmor)
+		fmt.Fprintf(h, "\x00cap-add\x00%s\x00cap-drop\x00%s\x00", strings.Join(opts.Security.CapAdd, ","), strings.Join(opts.Security.CapDrop, ","))
+	}
+	if opts.ReadOnlyTarget {
+		fmt.Fprint(h, "read-only-target")
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// findReusableDebuxContainer returns a running debux ephemeral container of
+// the pod that runs image with profile and options, as uid, and that the
+// local user creator created unless it's empty; or else the name of another
+// running one, which doesn't. Containers of debux versions that didn't
+// record their profile ran the general one, the default.
+func findReusableDebuxContainer(pod *corev1.Pod, image, profile string, uid *int64, creator, options string) (reusable, other string) {
+	running := make(map[string]bool)
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		running[cs.Name] = cs.State.Running != nil
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if !running[c.Name] || !isDebuxEphemeral(c) {
+			continue
+		}
+		cProfile := ephemeralEnv(c, "DEBUX_PROFILE")
+		if cProfile == "" {
+			cProfile = ProfileGeneral
+		}
+		mine := creator == "" || ephemeralCreator(c) == creator
+		if c.Image == image && cProfile == profile && ephemeralEnv(c, ephemeralOptionsEnv) == options && ephemeralRunsAs(pod, c.Name, uid) && mine {
+			return c.Name, ""
+		}
+		if other == "" {
+			other = c.Name
+		}
+	}
+	return "", other
+}
+
+// findOwnDebuxContainer returns a running debux ephemeral container of the
+// pod that the local user creator created.
+func findOwnDebuxContainer(pod *corev1.Pod, creator string) string {
+	running := make(map[string]bool)
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		running[cs.Name] = cs.State.Running != nil
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if running[c.Name] && isDebuxEphemeral(c) && ephemeralCreator(c) == creator {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// ephemeralEnv returns the value of an environment variable of an
+// ephemeral container's spec.
+func ephemeralEnv(c corev1.EphemeralContainer, name string) string {
+	for _, env := range c.Env {
+		if env.Name == name {
+			return env.Value
+		}
+	}
+	return ""
+}
+
+// ephemeralCreator returns the local user who created a debux ephemeral
+// container, from its user@host creator.
+func ephemeralCreator(c corev1.EphemeralContainer) string {
+	creator := ephemeralEnv(c, "DEBUX_CREATOR")
+	if i := strings.LastIndex(creator, "@"); i >= 0 {
+		creator = creator[:i]
+	}
+	return creator
+}
+
+// ephemeralState returns the state of the pod's ephemeral container name:
+// "running", "waiting" or "terminated", or "" when the pod has none.
+func ephemeralState(pod *corev1.Pod, name string) string {
+	for _, cs := range pod.Status.EphemeralContainerStatuses {
+		if cs.Name != name {
+			continue
+		}
+		switch {
+		case cs.State.Running != nil:
+			return "running"
+		case cs.State.Terminated != nil:
+			return "terminated"
+		}
+		return "waiting"
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == name {
+			return "waiting"
+		}
+	}
+	return ""
+}
+
+// ephemeralName returns the name of a new debux ephemeral container,
+// debux-<user>-<profile>-<unix time>, so that the users and profiles
+// debugging a pod tell their containers apart.
+func ephemeralName(profile string) string {
+	user := meta.User()
+	if i := strings.LastIndexAny(user, `\/`); i >= 0 {
+		user = user[i+1:] // DOMAIN\user
+	}
+	user = strings.Trim(nonLabelChars.ReplaceAllString(strings.ToLower(user), "-"), "-")
+	if len(user) > 24 {
+		user = strings.TrimRight(user[:24], "-")
+	}
+	if user == "" {
+		return fmt.Sprintf("debux-%s-%d", profile, time.Now().Unix())
+	}
+	return fmt.Sprintf("debux-%s-%s-%d", user, profile, time.Now().Unix())
+}
+
+// nonLabelChars are the characters DNS labels, like container names, can't
+// have.
+var nonLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// isDebuxEphemeral reports whether an ephemeral container was created by
+// debux: they carry DEBUX_MANAGED_BY, or DEBUX_DAEMON for older versions.
+// Names aren't enough, other tools may use "debux-" too.
+func isDebuxEphemeral(c corev1.EphemeralContainer) bool {
+	for _, env := range c.Env {
+		if (env.Name == meta.EnvManagedBy && env.Value == meta.ManagedBy) || env.Name == "DEBUX_DAEMON" {
+			return true
+		}
+	}
+	return false
+}
+
+// kubeVolumeDir is where debux ephemeral containers mount the volumes the
+// target only mounts a subPath of, which ephemeral containers can't.
+const kubeVolumeDir = "/run/debux/volumes/"
+
+// shareKubeVolumes mounts the volumes of the target container in its
+// ephemeral container, at the same paths, and returns a
+// "<path in the target>=<path in the debug container>" line per volume for
+// DEBUX_TARGET_VOLUMES: the entrypoint links them in a tree standing in for
+// the target's root filesystem when /proc/1/root is out of reach. The
+// emptyDir and PVC volumes the target mounts a subPath of are mounted whole
+// under kubeVolumeDir; other subPath mounts are left out.
+func shareKubeVolumes(ec *corev1.EphemeralContainer, pod *corev1.Pod, targetContainer string, opts DebugOpts) []string {
+	sources := map[string]corev1.VolumeSource{}
+	for _, v := range pod.Spec.Volumes {
+		sources[v.Name] = v.VolumeSource
+	}
+	filter := volumeFilter(opts)
+	var lines []string
+	whole := map[string]bool{}
+	for _, c := range pod.Spec.Containers {
+		if c.Name != targetContainer {
+			continue
+		}
+		skipped := 0
+		for _, vm := range c.VolumeMounts {
+			if !filter.keep(vm.MountPath, false) {
+				skipped++
+				continue
+			}
+			if opts.ReadOnlyTarget {
+				vm.ReadOnly = true
+			}
+			if vm.SubPath == "" && vm.SubPathExpr == "" {
+				ec.VolumeMounts = append(ec.VolumeMounts, vm)
+				lines = append(lines, vm.MountPath+"="+vm.MountPath)
+				continue
+			}
+			src := sources[vm.Name]
+			if vm.SubPathExpr != "" || (src.EmptyDir == nil && src.PersistentVolumeClaim == nil) {
+				continue
+			}
+			dir := kubeVolumeDir + vm.Name
+			if !whole[vm.Name] {
+				whole[vm.Name] = true
+				ec.VolumeMounts = append(ec.VolumeMounts, corev1.VolumeMount{Name: vm.Name, MountPath: dir, ReadOnly: vm.ReadOnly})
+			}
+			lines = append(lines, vm.MountPath+"="+path.Join(dir, vm.SubPath))
+		}
+		if skipped > 0 {
+			statusf("Not sharing %d volume(s) of %s left out by --volumes or --exclude-volumes\n", skipped, targetContainer)
+		}
+	}
+	return lines
+}
+
+// podShell starts the debug shell in an ephemeral container.
+var podShell = []string{"sh", "-c", "mkdir -p /nix/var/debux-data /tmp/debux-data 2>/dev/null; export DEBUX_TARGET_ROOT=/proc/1/root; " + volumeRoot + "; " + targetProcess + "; exec zsh"}
+
+// pipedPodShell is podShell without a TTY (see pipedShell).
+var pipedPodShell = []string{"sh", "-c", "mkdir -p /nix/var/debux-data /tmp/debux-data 2>/dev/null; export DEBUX_TARGET_ROOT=/proc/1/root; " + volumeRoot + "; " + targetProcess + "; exec zsh -ic 'exec zsh -s'"}
+
+// exporting returns the sh -c command shell, exporting the NAME=value
+// exports first.
+func exporting(shell, exports []string) []string {
+	if len(exports) == 0 {
+		return shell
+	}
+	quoted := make([]string, len(exports))
+	for i, e := range exports {
+		k, v, _ := strings.Cut(e, "=")
+		quoted[i] = k + "='" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+	}
+	return []string{shell[0], shell[1], "export " + strings.Join(quoted, " ") + "; " + shell[2]}
+}
+
 // execInPod starts a new interactive zsh session inside a running container
-// using the /exec subresource (unlike attachToPod which uses /attach).
-func execInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace, podName, containerName string) error {
+// using the /exec subresource (unlike attachToPod which uses /attach), with
+// the NAME=value exports in its environment, and returns the shell's exit
+// code.
+func execInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace, podName, containerName string, exports ...string) (int, error) {
+	// Without a terminal (piped input, scripts), the shell gets no TTY so
+	// that its stderr stays apart from its stdout
+	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
+	shell := podShell
+	if !isTerminal {
+		shell = pipedPodShell
+	} else {
+		exports = append(exports, terminalEnv()...)
+	}
+	shell = exporting(shell, exports)
 	req := clientset.CoreV1().RESTClient().Post().
 		Resource("pods").
 		Name(podName).
@@ -271,20 +681,19 @@ func execInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.C
 		SubResource("exec").
 		VersionedParams(&corev1.PodExecOptions{
 			Container: containerName,
-			Command:   []string{"sh", "-c", "mkdir -p /nix/var/debux-data /tmp/debux-data 2>/dev/null; export DEBUX_TARGET_ROOT=/proc/1/root; exec zsh"},
+			Command:   shell,
 			Stdin:     true,
 			Stdout:    true,
 			Stderr:    true,
-			TTY:       true,
+			TTY:       isTerminal,
 		}, scheme.ParameterCodec)
 
 	exec, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
 	if err != nil {
-		return fmt.Errorf("creating SPDY executor: %w", err)
+		return -1, fmt.Errorf("creating SPDY executor: %w", err)
 	}
 
 	// Set terminal to raw mode
-	stdinFd, isTerminal := term.GetFdInfo(os.Stdin)
 	if isTerminal {
 		oldState, err := term.SetRawTerminal(stdinFd)
 		if err == nil {
@@ -296,22 +705,75 @@ func execInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.C
 	}
 
 	streamOpts := remotecommand.StreamOptions{
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: &bytes.Buffer{}, // TTY merges stderr into stdout
+		Stdin:  newStdinReader(ctx),
+		Stdout: sessionOutput(),
+		Stderr: os.Stderr,
+		Tty:    isTerminal,
 	}
 
 	if isTerminal {
+		streamOpts.Stderr = &bytes.Buffer{} // TTY merges stderr into stdout
 		tsq := newTerminalSizeQueue(stdinFd)
 		defer tsq.Close()
 		streamOpts.TerminalSizeQueue = tsq
 	}
 
-	return exec.StreamWithContext(ctx, streamOpts)
+	err = exec.StreamWithContext(ctx, streamOpts)
+	if ctx.Err() != nil {
+		return -1, context.Cause(ctx)
+	}
+	var exitErr utilexec.CodeExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// runInPod runs a command without a TTY in a pod container, streaming its
+// output to stdout and stderr, and returns its exit code.
+func runInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace, podName, containerName string, cmd []string, stdout, stderr io.Writer) (int, error) {
+	return pipeInPod(ctx, config, clientset, namespace, podName, containerName, cmd, nil, stdout, stderr)
+}
+
+// pipeInPod is runInPod with stdin (nil for none) fed to the command.
+func pipeInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace, podName, containerName string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   cmd,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return -1, fmt.Errorf("creating SPDY executor: %w", err)
+	}
+
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: stderr})
+	var exitErr utilexec.CodeExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
 }
 
 // KubernetesPod creates a standalone debug pod.
 func KubernetesPod(ctx context.Context, opts PodOpts) error {
+	if err := kubeFlake(opts.Nix); err != nil {
+		return err
+	}
 	config, clientset, err := getK8sClient(opts.Kubeconfig)
 	if err != nil {
 		return err
@@ -325,19 +787,20 @@ func KubernetesPod(ctx context.Context, opts PodOpts) error {
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
-			Namespace: opts.Namespace,
-			Labels: map[string]string{
-				"app.kubernetes.io/managed-by": "debux",
-			},
+			Name:        podName,
+			Namespace:   opts.Namespace,
+			Labels:      meta.KubeLabels(meta.KindPod),
+			Annotations: meta.KubeAnnotations(""),
 		},
 		Spec: corev1.PodSpec{
+			ImagePullSecrets: kubePullSecrets(opts.PullSecrets),
 			Containers: []corev1.Container{
 				{
 					Name:            "debug",
 					Image:           opts.Image,
 					ImagePullPolicy: corev1.PullPolicy(opts.PullPolicy),
-					Command:         []string{"/bin/sh", "-c", "exec zsh"},
+					Command:         []string{"/bin/sh", "-c", entrypoint.NixConf + "exec zsh"},
+					Env:             kubeEnv(append(terminalEnv(), opts.Nix.Env()...)),
 					Stdin:           true,
 					TTY:             true,
 				},
@@ -347,46 +810,52 @@ func KubernetesPod(ctx context.Context, opts PodOpts) error {
 		},
 	}
 
-	sc, err := SecurityContextForProfile(opts.Profile)
+	profile := effectiveProfile(opts.Profile, opts.Privileged)
+	sc, err := SecurityContextForProfile(profile)
 	if err != nil {
 		return err
 	}
+	if sc, err = kubeSecurityContext(sc, opts.Security); err != nil {
+		return err
+	}
+	if sc, err = kubeUser(sc, opts.User, profile); err != nil {
+		return err
+	}
 	if sc != nil {
 		pod.Spec.Containers[0].SecurityContext = sc
 	}
 
-	if opts.User != "" {
-		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
-			Name:  "DEBUX_USER",
-			Value: opts.User,
-		})
-	}
-
 	// Create the pod
 	created, err := clientset.CoreV1().Pods(opts.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 	if err != nil {
 		return fmt.Errorf("creating debug pod: %w", err)
 	}
 
+	events.Emit(events.Event{Type: events.ContainerCreated, Target: "k8s://" + opts.Namespace + "/" + podName, Container: "debug", Image: opts.Image})
+
 	// Cleanup on exit
 	if !opts.Keep {
 		defer func() {
-			fmt.Printf("Deleting debug pod %s...\n", podName)
+			statusf("Deleting debug pod %s...\n", podName)
+			events.Emit(events.Event{Type: events.Cleanup, Target: "k8s://" + opts.Namespace + "/" + podName})
 			_ = clientset.CoreV1().Pods(opts.Namespace).Delete(
 				context.Background(), podName, metav1.DeleteOptions{})
 		}()
 	}
 
-	fmt.Printf("Waiting for debug pod %q to start...\n", podName)
+	statusf("Waiting for debug pod %q to start...\n", podName)
 
 	// Wait for the pod to be running
 	if err := waitForPodRunning(ctx, clientset, opts.Namespace, created.Name); err != nil {
 		return err
 	}
 
-	fmt.Printf("Attached to debug pod %s/%s\n", opts.Namespace, podName)
+	statusf("Attached to debug pod %s/%s\n", opts.Namespace, podName)
+	events.Emit(events.Event{Type: events.SessionStarted, Target: "k8s://" + opts.Namespace + "/" + podName, Container: "debug"})
 
-	return attachToPod(ctx, config, clientset, opts.Namespace, podName, "debug")
+	err = attachToPod(ctx, config, clientset, opts.Namespace, podName, "debug")
+	events.Emit(events.Ended("k8s://"+opts.Namespace+"/"+podName, "debug", 0, err))
+	return err
 }
 
 // resolveNamespace returns the namespace from the current kubeconfig context,
@@ -405,6 +874,78 @@ func resolveNamespace(kubeconfig string) string {
 	return ns
 }
 
+// KubernetesNamespace returns the namespace of the kubeconfig's current
+// context, "default" when it has none.
+func KubernetesNamespace(kubeconfig string) string {
+	return resolveNamespace(kubeconfig)
+}
+
+// KubernetesContext returns the kubeconfig's current context, "" when it
+// can't be read.
+func KubernetesContext(kubeconfig string) string {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		loadingRules.ExplicitPath = kubeconfig
+	}
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules, &clientcmd.ConfigOverrides{},
+	).RawConfig()
+	if err != nil {
+		return ""
+	}
+	return raw.CurrentContext
+}
+
+// KubernetesUser returns the user the cluster authenticates the kubeconfig
+// as, as admission control sees it in request.userInfo.username.
+func KubernetesUser(ctx context.Context, kubeconfig string) (string, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return "", err
+	}
+	return kubernetesUser(ctx, clientset)
+}
+
+func kubernetesUser(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	review, err := clientset.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("finding your Kubernetes user: %w", err)
+	}
+	if review.Status.UserInfo.Username == "" {
+		return "", fmt.Errorf("finding your Kubernetes user: the cluster authenticates you anonymously")
+	}
+	return review.Status.UserInfo.Username, nil
+}
+
+// KubernetesAnnotations returns the annotations of a pod.
+func KubernetesAnnotations(ctx context.Context, kubeconfig, namespace, pod string) (map[string]string, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pod %s/%s: %w", namespace, pod, err)
+	}
+	return p.Annotations, nil
+}
+
+// KubernetesAnnotate sets annotations of a pod, removing those set to nil.
+func KubernetesAnnotate(ctx context.Context, kubeconfig, namespace, pod string, annotations map[string]*string) error {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	if _, err := clientset.CoreV1().Pods(namespace).Patch(ctx, pod, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("annotating pod %s/%s: %w", namespace, pod, err)
+	}
+	return nil
+}
+
 func getK8sClient(kubeconfig string) (*rest.Config, *kubernetes.Clientset, error) {
 	var config *rest.Config
 	var err error
@@ -434,7 +975,9 @@ func getK8sClient(kubeconfig string) (*rest.Config, *kubernetes.Clientset, error
 	return config, clientset, nil
 }
 
-func waitForEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName, containerName, resourceVersion string) error {
+func waitForEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName, containerName, resourceVersion string) (err error) {
+	ctx, span := telemetry.Start(ctx, "debux.wait-running", telemetry.Target("k8s://"+namespace+"/"+podName))
+	defer func() { telemetry.End(span, err) }()
 	watcher, err := clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
 		FieldSelector:   fmt.Sprintf("metadata.name=%s", podName),
 		ResourceVersion: resourceVersion,
@@ -475,11 +1018,12 @@ func waitForEphemeralContainer(ctx context.Context, clientset *kubernetes.Client
 						}
 						// Print intermediate waiting status so the user can see progress
 						if w.Reason != "" && w.Reason != lastReason {
-							fmt.Printf("  Container status: %s", w.Reason)
+							statusf("  Container status: %s", w.Reason)
 							if w.Message != "" {
-								fmt.Printf(" (%s)", w.Message)
+								statusf(" (%s)", w.Message)
 							}
-							fmt.Println()
+							statusf("\n")
+							events.Emit(events.Event{Type: events.WaitingReason, Target: "k8s://" + namespace + "/" + podName, Container: containerName, Reason: w.Reason, Message: w.Message})
 							lastReason = w.Reason
 						}
 					}
@@ -547,7 +1091,9 @@ func describeContainerFailure(ctx context.Context, clientset *kubernetes.Clients
 	return strings.Join(details, "\n")
 }
 
-func waitForPodRunning(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName string) error {
+func waitForPodRunning(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName string) (err error) {
+	ctx, span := telemetry.Start(ctx, "debux.wait-running", telemetry.Target("k8s://"+namespace+"/"+podName))
+	defer func() { telemetry.End(span, err) }()
 	watcher, err := clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
 		FieldSelector: fmt.Sprintf("metadata.name=%s", podName),
 	})
@@ -0,0 +1,237 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fileSpool is where the getfile and putfile helpers of debug shells queue
+// their transfers, in a directory per session, for debux to serve.
+const fileSpool = "/tmp/debux-files"
+
+// fileRequestsScript prints the lines appended to the requests file of the
+// session's spool directory $1, until debux goes away or removes it.
+const fileRequestsScript = `d="$1"; n=0
+mkdir -p "$d" && : > "$d/requests" || exit 1
+while [ -d "$d" ]; do
+  c=$(wc -l < "$d/requests" 2>/dev/null) || break
+  if [ "$c" -gt "$n" ]; then
+    tail -n +$((n + 1)) "$d/requests" | head -n $((c - n)) || break
+    n=$c
+  fi
+  sleep 0.2
+done`
+
+// podFiles serves the getfile and putfile requests of an interactive shell
+// in a debux ephemeral container, like kubectl cp: files are read and
+// written by the target container itself, so they are the ones its
+// processes see, whatever the mounts look like through /proc/1/root. Only
+// targets without cat or sh (distroless) go through the debug container.
+//
+// Local files are those of the directory debux runs in, so that the shell
+// can't read or overwrite anything else of the user's machine.
+type podFiles struct {
+	config    *rest.Config
+	clientset *kubernetes.Clientset
+	namespace string
+	pod       string
+	debug     string // the debux ephemeral container
+	dir       string // the session's spool directory
+}
+
+func newPodFiles(config *rest.Config, clientset *kubernetes.Clientset, namespace, pod, debug string) *podFiles {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &podFiles{config: config, clientset: clientset, namespace: namespace, pod: pod, debug: debug, dir: fileSpool + "/" + hex.EncodeToString(id)}
+}
+
+// serve handles requests until ctx is done.
+func (f *podFiles) serve(ctx context.Context) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := f.run(ctx, f.debug, []string{"sh", "-c", fileRequestsScript, "files", f.dir}, nil, pw)
+		pw.CloseWithError(err)
+	}()
+	lines := bufio.NewScanner(pr)
+	for lines.Scan() {
+		fields := strings.Split(lines.Text(), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		var msg string
+		var err error
+		switch fields[0] {
+		case "get":
+			msg, err = f.get(ctx, fields[2], fields[3])
+		case "put":
+			msg, err = f.put(ctx, fields[2], fields[3])
+		default:
+			continue
+		}
+		f.reply(ctx, fields[1], msg, err)
+	}
+	_ = pr.Close()
+}
+
+// close removes the spool directory, which ends the helpers waiting on it.
+func (f *podFiles) close(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	_, _ = f.run(ctx, f.debug, []string{"rm", "-rf", f.dir}, nil, io.Discard)
+}
+
+// reply gives the helper of request id the outcome of its transfer.
+func (f *podFiles) reply(ctx context.Context, id, msg string, err error) {
+	status := "ok\n" + msg
+	if err != nil {
+		status = "error\n" + err.Error()
+	}
+	script := `cat > "$1.tmp" && mv "$1.tmp" "$1"`
+	_, _ = f.run(ctx, f.debug, []string{"sh", "-c", script, "files", f.dir + "/" + id}, strings.NewReader(status), io.Discard)
+}
+
+// get copies the target's file p to the local file name (by default, its
+// own name).
+func (f *podFiles) get(ctx context.Context, p, name string) (string, error) {
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("%s: target paths must be absolute", p)
+	}
+	if name == "" {
+		name = path.Base(p)
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%s: local files must be in the directory debux runs in", name)
+	}
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("%s already exists on the machine running debux", name)
+		}
+		return "", err
+	}
+	n := &countingWriter{w: out}
+	err = f.inTarget(ctx, []string{"cat", "--", p}, []string{"cat", "--", "/proc/1/root" + p}, nil, n)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+		return "", fmt.Errorf("reading %s: %w", p, err)
+	}
+	abs, _ := filepath.Abs(name)
+	return fmt.Sprintf("Saved %s to %s (%s)", p, abs, units.HumanSize(float64(n.n))), nil
+}
+
+// put copies the local file name to the target's file p.
+func (f *podFiles) put(ctx context.Context, name, p string) (string, error) {
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("%s: target paths must be absolute", p)
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%s: local files must be in the directory debux runs in", name)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", name)
+	}
+	open := func() (io.ReadCloser, error) { return os.Open(name) }
+	err = f.inTarget(ctx,
+		[]string{"sh", "-c", `cat > "$1"`, "putfile", p},
+		[]string{"sh", "-c", `cat > "/proc/1/root$1"`, "putfile", p},
+		open, &countingWriter{w: io.Discard})
+	if err != nil {
+		return "", fmt.Errorf("writing %s: %w", p, err)
+	}
+	return fmt.Sprintf("Wrote %s to %s (%s)", name, p, units.HumanSize(float64(info.Size()))), nil
+}
+
+// inTarget runs cmd in the target container, or fallback in the debug
+// container when the target has no such command. stdin opens the input of
+// the command, if any, for each attempt.
+func (f *podFiles) inTarget(ctx context.Context, cmd, fallback []string, stdin func() (io.ReadCloser, error), stdout *countingWriter) error {
+	target, err := f.targetContainer(ctx)
+	if err != nil {
+		return err
+	}
+	attempt := func(container string, cmd []string) (int, string, error) {
+		var in io.Reader
+		if stdin != nil {
+			rc, err := stdin()
+			if err != nil {
+				return -1, "", err
+			}
+			defer func() { _ = rc.Close() }()
+			in = rc
+		}
+		var stderr strings.Builder
+		code, err := pipeInPod(ctx, f.config, f.clientset, f.namespace, f.pod, container, cmd, in, stdout, &stderr)
+		return code, strings.TrimSpace(stderr.String()), err
+	}
+	code, msg, err := attempt(target, cmd)
+	// exec fails, or the shell exits with 126 or 127, without the command
+	if (err != nil || code == 126 || code == 127) && stdout.n == 0 {
+		code, msg, err = attempt(f.debug, fallback)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		if msg == "" {
+			msg = fmt.Sprintf("exit status %d", code)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// targetContainer returns the container the debug container targets.
+func (f *podFiles) targetContainer(ctx context.Context) (string, error) {
+	pod, err := f.clientset.CoreV1().Pods(f.namespace).Get(ctx, f.pod, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name == f.debug && c.TargetContainerName != "" {
+			return c.TargetContainerName, nil
+		}
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return "", fmt.Errorf("pod %s has no containers", f.pod)
+	}
+	return defaultContainer(pod), nil
+}
+
+// run runs cmd in a container of the pod, without stderr.
+func (f *podFiles) run(ctx context.Context, container string, cmd []string, stdin io.Reader, stdout io.Writer) (int, error) {
+	return pipeInPod(ctx, f.config, f.clientset, f.namespace, f.pod, container, cmd, stdin, stdout, io.Discard)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,227 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// busyboxPath is the statically linked busybox shipped in the debug image. It
+// runs inside the target image, which may have no shell or tar at all.
+const busyboxPath = "/usr/local/bin/busybox-static"
+
+// unpackScript copies the target image's root filesystem into /debux-target.
+// It runs in an init container started from the target image itself.
+const unpackScript = `cd / && /debux-bin/busybox tar -cf - \
+  --exclude=./proc --exclude=./sys --exclude=./dev \
+  --exclude=./debux-bin --exclude=./debux-target . \
+| /debux-bin/busybox tar -xf - -C /debux-target`
+
+// KubernetesImage debugs an image inside the cluster: a debug pod pulls the
+// target image through the node (so node credentials, IAM roles and
+// imagePullSecrets of the namespace's default service account apply), unpacks
+// its filesystem into a shared volume and the debug shell gets it at /target.
+// The target image is never started with its own entrypoint.
+func KubernetesImage(ctx context.Context, imageRef string, opts KubeImageOpts) error {
+	if err := kubeFlake(opts.Nix); err != nil {
+		return err
+	}
+	if err := kubeWindowsImage(ctx, imageRef); err != nil {
+		return err
+	}
+	config, clientset, err := getK8sClient(opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	if opts.Namespace == "default" {
+		opts.Namespace = resolveNamespace(opts.Kubeconfig)
+	}
+
+	podName := fmt.Sprintf("debux-image-%s-%d", kubeNameSuffix(imageRef), time.Now().Unix())
+	pullPolicy := corev1.PullPolicy(opts.PullPolicy)
+	root := int64(0)
+	notNonRoot := false
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        podName,
+			Namespace:   opts.Namespace,
+			Labels:      meta.KubeLabels(meta.KindImagePod),
+			Annotations: meta.KubeAnnotations(imageRef),
+		},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: kubePullSecrets(opts.PullSecrets),
+			Volumes: []corev1.Volume{
+				{Name: "debux-bin", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "debux-target", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+			InitContainers: []corev1.Container{
+				{
+					Name:            "debux-tools",
+					Image:           opts.DebugImage,
+					ImagePullPolicy: pullPolicy,
+					Command:         []string{"/bin/sh", "-c", "cp " + busyboxPath + " /debux-bin/busybox"},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "debux-bin", MountPath: "/debux-bin"}},
+				},
+				{
+					Name:            "target",
+					Image:           imageRef,
+					ImagePullPolicy: pullPolicy,
+					Command:         []string{"/debux-bin/busybox", "sh", "-c", unpackScript},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "debux-bin", MountPath: "/debux-bin", ReadOnly: true},
+						{Name: "debux-target", MountPath: "/debux-target"},
+					},
+					// Root is needed to read every file and keep ownership.
+					SecurityContext: &corev1.SecurityContext{RunAsUser: &root, RunAsNonRoot: &notNonRoot},
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:            "debug",
+					Image:           opts.DebugImage,
+					ImagePullPolicy: pullPolicy,
+					Command:         []string{"/bin/sh", "-c", entrypoint.ImageScript},
+					Env:             append([]corev1.EnvVar{{Name: "DEBUX_TARGET", Value: imageRef}}, kubeEnv(append(append(terminalEnv(), opts.Nix.Env()...), entrypoint.HooksEnv(opts.SetupHooks)...))...),
+					VolumeMounts:    []corev1.VolumeMount{{Name: "debux-target", MountPath: "/target"}},
+					Stdin:           true,
+					TTY:             true,
+				},
+			},
+			RestartPolicy: corev1.RestartPolicyNever,
+		},
+	}
+
+	sc, err := SecurityContextForProfile(opts.Profile)
+	if err != nil {
+		return err
+	}
+	if sc, err = kubeSecurityContext(sc, opts.Security); err != nil {
+		return err
+	}
+	if sc != nil {
+		pod.Spec.Containers[0].SecurityContext = sc
+	}
+
+	if _, err := clientset.CoreV1().Pods(opts.Namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("creating debug pod: %w", err)
+	}
+
+	if !opts.Keep {
+		defer func() {
+			statusf("Deleting debug pod %s...\n", podName)
+			_ = clientset.CoreV1().Pods(opts.Namespace).Delete(
+				context.Background(), podName, metav1.DeleteOptions{})
+		}()
+	}
+
+	statusf("Pulling and unpacking %s in debug pod %q...\n", imageRef, podName)
+
+	if err := waitForImagePod(ctx, clientset, opts.Namespace, podName); err != nil {
+		return err
+	}
+
+	statusf("Debugging image %s (pod: %s/%s)\n", imageRef, opts.Namespace, podName)
+
+	return attachToPod(ctx, config, clientset, opts.Namespace, podName, "debug")
+}
+
+// waitForImagePod waits for an image debug pod to be running, reporting init
+// container progress. Pulling and unpacking large images can take a while,
+// hence the longer timeout than for plain debug pods.
+func waitForImagePod(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName string) error {
+	watcher, err := clientset.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", podName),
+	})
+	if err != nil {
+		return fmt.Errorf("watching pod: %w", err)
+	}
+	defer watcher.Stop()
+
+	var lastStatus string
+	timeout := time.After(10 * time.Minute)
+	for {
+		select {
+		case event := <-watcher.ResultChan():
+			if event.Type != watch.Modified && event.Type != watch.Added {
+				continue
+			}
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				continue
+			}
+			if pod.Status.Phase == corev1.PodRunning {
+				return nil
+			}
+			for _, cs := range pod.Status.InitContainerStatuses {
+				if t := cs.State.Terminated; t != nil && t.ExitCode != 0 {
+					return fmt.Errorf("init container %q failed: %s (exit code %d)\n%s",
+						cs.Name, t.Reason, t.ExitCode, initContainerLogs(ctx, clientset, namespace, podName, cs.Name))
+				}
+				if w := cs.State.Waiting; w != nil {
+					switch w.Reason {
+					case "ImagePullBackOff", "ErrImagePull", "InvalidImageName":
+						return fmt.Errorf("pulling image for %q failed: %s: %s", cs.Name, w.Reason, w.Message)
+					}
+				}
+				status := ""
+				switch {
+				case cs.State.Waiting != nil && cs.State.Waiting.Reason != "":
+					status = cs.State.Waiting.Reason
+				case cs.State.Running != nil && cs.Name == "target":
+					status = "Unpacking"
+				}
+				if status != "" && cs.Name+status != lastStatus {
+					statusf("  %s: %s\n", cs.Name, status)
+					lastStatus = cs.Name + status
+				}
+			}
+			if pod.Status.Phase == corev1.PodFailed {
+				return fmt.Errorf("debug pod %q failed: %s", podName, pod.Status.Message)
+			}
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for pod %q to start", podName)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// initContainerLogs returns the last lines of an init container's output.
+func initContainerLogs(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName, container string) string {
+	tail := int64(20)
+	raw, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container: container,
+		TailLines: &tail,
+	}).DoRaw(ctx)
+	if err != nil || len(raw) == 0 {
+		return "  (no logs available)"
+	}
+	return "  " + strings.ReplaceAll(strings.TrimSpace(string(raw)), "\n", "\n  ")
+}
+
+// kubeNameSuffix turns an image reference into a short string usable in a pod
+// name (lowercase alphanumerics and dashes).
+func kubeNameSuffix(ref string) string {
+	s := strings.ToLower(sanitizeImageRef(ref))
+	s = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+	if len(s) > 40 {
+		s = s[:40]
+	}
+	return strings.Trim(s, "-")
+}
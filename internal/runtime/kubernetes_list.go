@@ -0,0 +1,218 @@
+package runtime
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podListPage is how many pods each list request returns, so that large
+// clusters are listed in pages rather than one huge response.
+const podListPage = 500
+
+// namespaceListers is how many namespaces are listed at once when the pods
+// of the whole cluster can't be listed in one go.
+const namespaceListers = 8
+
+// KubeListOpts select the pods KubernetesList returns.
+type KubeListOpts struct {
+	// Namespace is the namespace of the pods, all of them when empty.
+	Namespace string
+	// Selector is a label selector the pods match, e.g. "app=api".
+	Selector string
+	// CacheTTL reuses the pods listed this long ago at most, so that
+	// pickers opened again right away don't list the cluster again.
+	CacheTTL time.Duration
+}
+
+// KubernetesList returns running pods with a ready container. Pods are
+// filtered by the API server and listed in pages; when listing all
+// namespaces at once is forbidden, the namespaces are listed one by one,
+// concurrently, skipping those that are forbidden too.
+func KubernetesList(ctx context.Context, kubeconfig string, opts KubeListOpts) ([]PodInfo, error) {
+	namespace, selector := opts.Namespace, opts.Selector
+	// Resolve namespace from kubeconfig context when using the default placeholder
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	cacheKey := KubernetesContext(kubeconfig) + "\x00" + namespace + "\x00" + selector
+	if opts.CacheTTL > 0 {
+		if pods, ok := loadPodList(cacheKey, opts.CacheTTL); ok {
+			return pods, nil
+		}
+	}
+
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := listRunningPods(ctx, clientset, namespace, selector)
+	if apierrors.IsForbidden(err) && namespace == metav1.NamespaceAll {
+		pods, err = listPodsPerNamespace(ctx, clientset, selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	if opts.CacheTTL > 0 {
+		savePodList(cacheKey, pods)
+	}
+	return pods, nil
+}
+
+// listRunningPods lists the running pods of a namespace page by page.
+func listRunningPods(ctx context.Context, clientset *kubernetes.Clientset, namespace, selector string) ([]PodInfo, error) {
+	var result []PodInfo
+	opts := metav1.ListOptions{
+		FieldSelector: "status.phase=Running",
+		LabelSelector: selector,
+		Limit:         podListPage,
+	}
+	for {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("listing pods: %w", err)
+		}
+		for i := range pods.Items {
+			if info, ok := podInfo(&pods.Items[i]); ok {
+				result = append(result, info)
+			}
+		}
+		if pods.Continue == "" {
+			return result, nil
+		}
+		opts.Continue = pods.Continue
+	}
+}
+
+// listPodsPerNamespace lists the running pods of every namespace the user
+// may list pods of.
+func listPodsPerNamespace(ctx context.Context, clientset *kubernetes.Clientset, selector string) ([]PodInfo, error) {
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing namespaces: %w", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		result []PodInfo
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(namespaceListers)
+	for _, ns := range namespaces.Items {
+		g.Go(func() error {
+			pods, err := listRunningPods(gctx, clientset, ns.Name, selector)
+			if apierrors.IsForbidden(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			result = append(result, pods...)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// podInfo returns what the picker shows of a pod, unless none of its
+// containers is ready.
+func podInfo(pod *corev1.Pod) (PodInfo, bool) {
+	hasReady := false
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Ready {
+			hasReady = true
+			break
+		}
+	}
+	if !hasReady {
+		return PodInfo{}, false
+	}
+
+	var containers []string
+	for _, c := range pod.Spec.Containers {
+		containers = append(containers, c.Name)
+	}
+	return PodInfo{
+		Name:            pod.Name,
+		Namespace:       pod.Namespace,
+		Status:          string(pod.Status.Phase),
+		Containers:      containers,
+		HasDebuxSession: findRunningDebuxContainer(pod) != "",
+	}, true
+}
+
+// podListCache is a pod list KubernetesList saved.
+type podListCache struct {
+	Time time.Time `json:"time"`
+	Pods []PodInfo `json:"pods"`
+}
+
+// podListCachePath returns where the pods listed for key are saved, in the
+// debux cache directory.
+func podListCachePath(key string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, "debux", "pods-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// loadPodList returns the pods listed for key less than ttl ago, if any.
+func loadPodList(key string, ttl time.Duration) ([]PodInfo, bool) {
+	path, err := podListCachePath(key)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var cached podListCache
+	if json.Unmarshal(data, &cached) != nil || time.Since(cached.Time) > ttl {
+		return nil, false
+	}
+	return cached.Pods, true
+}
+
+// savePodList saves the pods listed for key. Failures are ignored: the next
+// picker lists the pods again.
+func savePodList(key string, pods []PodInfo) {
+	path, err := podListCachePath(key)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(podListCache{Time: time.Now(), Pods: pods})
+	if err != nil {
+		return
+	}
+	if os.MkdirAll(filepath.Dir(path), 0o700) != nil {
+		return
+	}
+	_ = os.WriteFile(path, data, 0o600)
+}
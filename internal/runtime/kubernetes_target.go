@@ -0,0 +1,63 @@
+package runtime
+
+import (
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultContainerAnnotation names the container kubectl picks in a pod
+// when none is given.
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// meshSidecars are the containers service meshes inject in pods, which are
+// never what a user debugging the pod is after.
+var meshSidecars = []string{"istio-proxy", "linkerd-proxy", "kuma-sidecar", "consul-dataplane"}
+
+// defaultContainer returns the container of a pod to debug when none is
+// given: the one its default-container annotation names, or else its first
+// container that isn't a service mesh's sidecar.
+func defaultContainer(pod *corev1.Pod) string {
+	if name := pod.Annotations[defaultContainerAnnotation]; name != "" {
+		for _, c := range pod.Spec.Containers {
+			if c.Name == name {
+				return name
+			}
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		if !slices.Contains(meshSidecars, c.Name) {
+			return c.Name
+		}
+	}
+	if len(pod.Spec.Containers) > 0 {
+		return pod.Spec.Containers[0].Name
+	}
+	return ""
+}
+
+// targetContainerEnv returns the DEBUX_TARGET_CONTAINER export of debug
+// shells in pods sharing their process namespace, whose PID 1 is the pause
+// container's, and where the processes of every container, service mesh
+// proxies included, are visible: the ID of the target container, whose
+// processes the shell finds by their cgroup (see targetProcess).
+func targetContainerEnv(pod *corev1.Pod, name string) []string {
+	if pod.Spec.ShareProcessNamespace == nil || !*pod.Spec.ShareProcessNamespace {
+		return nil
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != name || cs.ContainerID == "" {
+			continue
+		}
+		_, id, _ := strings.Cut(cs.ContainerID, "://")
+		return []string{"DEBUX_TARGET_CONTAINER=" + id}
+	}
+	return nil
+}
+
+// targetProcess aims debug shells (DEBUX_TARGET_PID) at the first process of
+// the container of DEBUX_TARGET_CONTAINER, unless --pid already picked one
+// or PID 1 belongs to it.
+const targetProcess = `{ [ -n "${DEBUX_TARGET_PID:-}" ] || [ -z "${DEBUX_TARGET_CONTAINER:-}" ] || grep -qF "$DEBUX_TARGET_CONTAINER" /proc/1/cgroup 2>/dev/null || ` +
+	`for p in $(ls /proc | grep -E '^[0-9]+$' | sort -n); do grep -qF "$DEBUX_TARGET_CONTAINER" "/proc/$p/cgroup" 2>/dev/null && export DEBUX_TARGET_PID=$p && break; done; }`
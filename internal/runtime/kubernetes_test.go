@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// debugPod returns a pod running the given debux ephemeral containers.
+func debugPod(containers ...corev1.EphemeralContainer) *corev1.Pod {
+	pod := &corev1.Pod{}
+	for _, c := range containers {
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, c)
+		pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, corev1.ContainerStatus{
+			Name:  c.Name,
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		})
+	}
+	return pod
+}
+
+// debugContainer returns a debux ephemeral container running image with the
+// given environment.
+func debugContainer(name, image string, env ...string) corev1.EphemeralContainer {
+	c := corev1.EphemeralContainer{}
+	c.Name, c.Image = name, image
+	c.Env = append(c.Env, corev1.EnvVar{Name: "DEBUX_DAEMON", Value: "1"})
+	c.Env = append(c.Env, kubeEnv(env)...)
+	return c
+}
+
+func TestFindReusableDebuxContainer(t *testing.T) {
+	const image = "ghcr.io/clement-tourriere/debux:latest"
+	readOnly := DebugOpts{ReadOnlyTarget: true}
+	ptrace := DebugOpts{Security: Security{CapAdd: []string{"SYS_PTRACE"}}}
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		opts     DebugOpts
+		reusable string
+		other    string
+	}{
+		{
+			name:     "same options",
+			pod:      debugPod(debugContainer("debux-a", image, "DEBUX_PROFILE=general")),
+			reusable: "debux-a",
+		},
+		{
+			name:     "older container without a profile",
+			pod:      debugPod(debugContainer("debux-a", image)),
+			reusable: "debux-a",
+		},
+		{
+			name:  "other image",
+			pod:   debugPod(debugContainer("debux-a", "busybox")),
+			other: "debux-a",
+		},
+		{
+			name:  "other profile",
+			pod:   debugPod(debugContainer("debux-a", image, "DEBUX_PROFILE=sysadmin")),
+			other: "debux-a",
+		},
+		{
+			name:  "read-only container",
+			pod:   debugPod(debugContainer("debux-a", image, ephemeralOptionsEnv+"="+ephemeralOptions(readOnly))),
+			other: "debux-a",
+		},
+		{
+			name:  "read-only session",
+			pod:   debugPod(debugContainer("debux-a", image)),
+			opts:  readOnly,
+			other: "debux-a",
+		},
+		{
+			name:  "capabilities",
+			pod:   debugPod(debugContainer("debux-a", image, ephemeralOptionsEnv+"="+ephemeralOptions(ptrace))),
+			other: "debux-a",
+		},
+		{
+			name:     "same capabilities",
+			pod:      debugPod(debugContainer("debux-a", image, ephemeralOptionsEnv+"="+ephemeralOptions(ptrace))),
+			opts:     ptrace,
+			reusable: "debux-a",
+		},
+		{
+			name:  "other capabilities",
+			pod:   debugPod(debugContainer("debux-a", image, ephemeralOptionsEnv+"="+ephemeralOptions(ptrace))),
+			opts:  DebugOpts{Security: Security{CapAdd: []string{"NET_ADMIN"}}},
+			other: "debux-a",
+		},
+		{
+			name:  "seccomp",
+			pod:   debugPod(debugContainer("debux-a", image)),
+			opts:  DebugOpts{Security: Security{Seccomp: "unconfined"}},
+			other: "debux-a",
+		},
+		{
+			name: "read-only both",
+			pod: debugPod(
+				debugContainer("debux-a", image),
+				debugContainer("debux-b", image, ephemeralOptionsEnv+"="+ephemeralOptions(readOnly)),
+			),
+			opts:     readOnly,
+			reusable: "debux-b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reusable, other := findReusableDebuxContainer(tt.pod, image, ProfileGeneral, nil, "", ephemeralOptions(tt.opts))
+			if reusable != tt.reusable || other != tt.other {
+				t.Errorf("findReusableDebuxContainer() = %q, %q, want %q, %q", reusable, other, tt.reusable, tt.other)
+			}
+		})
+	}
+}
+
+func TestExporting(t *testing.T) {
+	shell := []string{"sh", "-c", "exec zsh"}
+	tests := []struct {
+		name    string
+		exports []string
+		want    string
+	}{
+		{name: "no exports", want: "exec zsh"},
+		{name: "options", exports: []string{"DEBUX_NO_TARGET_ENV=1", "DEBUX_NO_WRAPPERS=1"}, want: "export DEBUX_NO_TARGET_ENV='1' DEBUX_NO_WRAPPERS='1'; exec zsh"},
+		{name: "glob", exports: []string{"DEBUX_ENV_REDACT=*_TOKEN,AWS_*"}, want: "export DEBUX_ENV_REDACT='*_TOKEN,AWS_*'; exec zsh"},
+		{name: "quote", exports: []string{"A=it's"}, want: `export A='it'\''s'; exec zsh`},
+		{name: "empty value", exports: []string{"A="}, want: "export A=''; exec zsh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := exporting(shell, tt.exports)
+			if len(got) != 3 || got[0] != "sh" || got[1] != "-c" || got[2] != tt.want {
+				t.Errorf("exporting() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if shell[2] != "exec zsh" {
+		t.Errorf("exporting() changed its shell")
+	}
+}
@@ -0,0 +1,235 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// LayerCacheVolume keeps the layers of images debugged without the overlay2
+// fast path, extracted once each, by the digest of their content.
+const LayerCacheVolume = "debux-layer-cache"
+
+// layerCacheDir is where debug containers mount LayerCacheVolume, short so
+// that the lowerdir option of images with many layers fits in a page.
+const layerCacheDir = "/run/debux/lc"
+
+// layerComplete marks a layer of the cache as fully extracted.
+const layerComplete = ".debux-complete"
+
+// prepareLayerCache returns the overlay of t assembled from LayerCacheVolume,
+// first extracting the layers the cache doesn't have yet, so that debugging
+// an image again only transfers its changed layers. It returns nil (and no
+// error) when the cache can't be used, and the filesystem is copied instead.
+func prepareLayerCache(ctx context.Context, cli *client.Client, t imageTarget, opts ImageOpts) (*imageOverlay, error) {
+	var img v1.Image
+	cleanup := func() {}
+	defer func() { cleanup() }()
+
+	// Daemon images list their layers without being exported, which is
+	// only needed when some are missing
+	var diffIDs []string
+	if opts.Direct || dbximage.IsArchiveRef(t.Ref) {
+		var err error
+		if img, cleanup, err = dbximage.Load(ctx, t.Ref, opts.Platform); err != nil {
+			return nil, err
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("reading image config: %w", err)
+		}
+		for _, d := range cfg.RootFS.DiffIDs {
+			diffIDs = append(diffIDs, d.String())
+		}
+	} else {
+		info, _, err := cli.ImageInspectWithRaw(ctx, t.Ref)
+		if err != nil {
+			return nil, fmt.Errorf("inspecting %s: %w", t.Ref, err)
+		}
+		diffIDs = info.RootFS.Layers
+	}
+	if len(diffIDs) == 0 {
+		return nil, nil
+	}
+
+	if _, err := cli.VolumeInspect(ctx, LayerCacheVolume); err != nil {
+		if _, err := cli.VolumeCreate(ctx, volume.CreateOptions{
+			Name:   LayerCacheVolume,
+			Labels: meta.Labels(meta.KindLayerCache, ""),
+		}); err != nil {
+			return nil, fmt.Errorf("creating volume %s: %w", LayerCacheVolume, err)
+		}
+	}
+
+	// A stopped container gives access to the volume through the API
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:  opts.DebugImage,
+		Cmd:    []string{"true"},
+		Labels: meta.Labels(meta.KindLayerCache, t.Ref),
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: LayerCacheVolume, Target: "/cache"}},
+	}, nil, dbximage.OCIPlatform(opts.Platform), "")
+	if err != nil {
+		return nil, fmt.Errorf("creating layer cache container: %w", err)
+	}
+	defer func() {
+		_ = cli.ContainerRemove(context.Background(), resp.ID, container.RemoveOptions{Force: true})
+	}()
+
+	var missing []int
+	for i, d := range diffIDs {
+		if _, err := cli.ContainerStatPath(ctx, resp.ID, "/cache/"+layerKey(d)+"/"+layerComplete); err != nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) > 0 && img == nil {
+		if img, cleanup, err = dbximage.FromDaemon(ctx, cli, t.Ref, opts.Platform); err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) < len(diffIDs) {
+		statusf("Reusing %d of %d layers of %s from the layer cache\n", len(diffIDs)-len(missing), len(diffIDs), t.Ref)
+	}
+	for n, i := range missing {
+		if err := cacheLayer(ctx, cli, resp.ID, img, i, diffIDs[i], n+1, len(missing)); err != nil {
+			statusf("Warning: %v; copying %s instead\n", err, t.Ref)
+			return nil, nil
+		}
+	}
+
+	// Overlay lower directories go topmost first
+	dirs := make([]string, len(diffIDs))
+	for i, d := range diffIDs {
+		dirs[len(diffIDs)-1-i] = layerCacheDir + "/" + layerKey(d)
+	}
+	return &imageOverlay{target: t, lowerDirs: dirs, cached: true, cleanup: func() {}}, nil
+}
+
+// cacheLayer extracts layer i of img into the cache of the stopped container
+// id, converting its whiteouts to those of overlayfs.
+func cacheLayer(ctx context.Context, cli *client.Client, id string, img v1.Image, i int, diffID string, n, total int) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("reading layers: %w", err)
+	}
+	if i >= len(layers) {
+		return fmt.Errorf("image has %d layers, expected more", len(layers))
+	}
+	size := ""
+	if s, err := layers[i].Size(); err == nil {
+		size = " (" + units.HumanSize(float64(s)) + ")"
+	}
+	statusf("Caching layer %d/%d%s...\n", n, total, size)
+
+	rc, err := layers[i].Uncompressed()
+	if err != nil {
+		return fmt.Errorf("reading layer %d: %w", i+1, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	key := layerKey(diffID)
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(overlayLayerTar(rc, pw, key)) }()
+	err = cli.CopyToContainer(ctx, id, "/cache", pr, container.CopyToContainerOptions{})
+	_ = pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("caching layer %d: %w", i+1, err)
+	}
+
+	// Only complete layers are reused
+	var marker bytes.Buffer
+	tw := tar.NewWriter(&marker)
+	_ = tw.WriteHeader(&tar.Header{Name: key + "/" + layerComplete, Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Now()})
+	_ = tw.Close()
+	if err := cli.CopyToContainer(ctx, id, "/cache", &marker, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("caching layer %d: %w", i+1, err)
+	}
+	return nil
+}
+
+// overlayLayerTar copies the layer tar r to w under the directory dir, with
+// OCI whiteouts (.wh.<name>, .wh..wh..opq) turned into overlayfs ones: 0/0
+// character devices and opaque directories.
+func overlayLayerTar(r io.Reader, w io.Writer, dir string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		return err
+	}
+	// Directories written, to mark them opaque with their own metadata
+	dirs := map[string]tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		parent, base := path.Split(name)
+		switch {
+		case base == ".wh..wh..opq":
+			opaque, ok := dirs[path.Join(dir, parent)+"/"]
+			if !ok {
+				opaque = tar.Header{Name: path.Join(dir, parent) + "/", Typeflag: tar.TypeDir, Mode: 0o755}
+			}
+			opaque.Format = tar.FormatPAX
+			opaque.PAXRecords = map[string]string{"SCHILY.xattr.trusted.overlay.opaque": "y"}
+			hdr = &opaque
+		case strings.HasPrefix(base, ".wh."):
+			hdr = &tar.Header{
+				Name:     path.Join(dir, parent, strings.TrimPrefix(base, ".wh.")),
+				Typeflag: tar.TypeChar,
+				Mode:     0o600,
+			}
+		default:
+			hdr.Name = path.Join(dir, name)
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+				dirs[hdr.Name] = *hdr
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = path.Join(dir, path.Clean(strings.TrimPrefix(hdr.Linkname, "./")))
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// layerKey is the directory of a layer in the cache, the hex of its diff ID.
+func layerKey(diffID string) string {
+	_, hex, _ := strings.Cut(diffID, ":")
+	return hex
+}
+
+// layerCacheMounts returns the mount of LayerCacheVolume for the overlays
+// that use it, if any.
+func layerCacheMounts(overlays []*imageOverlay) []mount.Mount {
+	if !slices.ContainsFunc(overlays, func(o *imageOverlay) bool { return o.cached }) {
+		return nil
+	}
+	return []mount.Mount{{Type: mount.TypeVolume, Source: LayerCacheVolume, Target: layerCacheDir, ReadOnly: true}}
+}
@@ -0,0 +1,101 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSessionExpired ends interactive sessions past --idle-timeout or
+// --max-duration.
+var ErrSessionExpired = errors.New("session expired")
+
+// lastInput is when the interactive session last got input, in Unix
+// nanoseconds.
+var lastInput atomic.Int64
+
+func markInput() {
+	lastInput.Store(time.Now().UnixNano())
+}
+
+// limitWarnings are how long before a session limit its shell is warned.
+var limitWarnings = []time.Duration{5 * time.Minute, time.Minute, 10 * time.Second}
+
+// limitSession returns a context of the interactive session canceled with
+// ErrSessionExpired once it has had no input for opts.IdleTimeout, or has
+// run for opts.MaxDuration, after warnings in the shell.
+func limitSession(ctx context.Context, opts DebugOpts) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := func() { cancel(nil) }
+	if opts.IdleTimeout <= 0 && opts.MaxDuration <= 0 {
+		return ctx, stop
+	}
+	start := time.Now()
+	markInput()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		// Warnings given, per limit; typing again rearms the idle ones
+		warned := map[string]time.Duration{}
+		for {
+			var now time.Time
+			select {
+			case <-ctx.Done():
+				return
+			case now = <-ticker.C:
+			}
+
+			if opts.MaxDuration > 0 {
+				left := opts.MaxDuration - now.Sub(start)
+				if left <= 0 {
+					sessionNotice("The session reached its maximum duration (%s): closing it.", opts.MaxDuration)
+					cancel(fmt.Errorf("%w: it reached its maximum duration (%s)", ErrSessionExpired, opts.MaxDuration))
+					return
+				}
+				if w, ok := limitWarning(opts.MaxDuration, left, warned["max"]); ok {
+					warned["max"] = w
+					sessionNotice("The session reaches its maximum duration (%s) in %s.", opts.MaxDuration, w)
+				}
+			}
+			if opts.IdleTimeout > 0 {
+				left := opts.IdleTimeout - now.Sub(time.Unix(0, lastInput.Load()))
+				if left <= 0 {
+					sessionNotice("No input for %s: closing the session.", opts.IdleTimeout)
+					cancel(fmt.Errorf("%w: no input for %s", ErrSessionExpired, opts.IdleTimeout))
+					return
+				}
+				if left > warned["idle"] {
+					delete(warned, "idle")
+				}
+				if w, ok := limitWarning(opts.IdleTimeout, left, warned["idle"]); ok {
+					warned["idle"] = w
+					sessionNotice("No input for a while: the session closes in %s unless you type something.", w)
+				}
+			}
+		}
+	}()
+	return ctx, stop
+}
+
+// limitWarning returns the warning due for a limit with left to go, given
+// the last one (0 for none), if any. Warnings longer than the limit itself
+// are skipped.
+func limitWarning(limit, left, last time.Duration) (time.Duration, bool) {
+	for i := len(limitWarnings) - 1; i >= 0; i-- {
+		w := limitWarnings[i]
+		if left <= w && w < limit && (last == 0 || w < last) {
+			return w, true
+		}
+	}
+	return 0, false
+}
+
+// sessionNotice prints a message of debux in the interactive shell, whose
+// terminal may be in raw mode.
+func sessionNotice(format string, args ...any) {
+	_, _ = fmt.Fprintf(os.Stderr, "\r\n[debux] "+format+"\r\n", args...)
+}
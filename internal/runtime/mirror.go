@@ -0,0 +1,38 @@
+package runtime
+
+import (
+	"io"
+	"os"
+)
+
+// Mirror receives a copy of the output of interactive debug shells and
+// supplies keystrokes from elsewhere (debux share).
+type Mirror interface {
+	io.Writer
+	Input() <-chan []byte
+}
+
+// mirror is the session mirror, nil when the session isn't shared.
+var mirror Mirror
+
+// SetSessionMirror shares the interactive debug shells of this process.
+func SetSessionMirror(m Mirror) {
+	mirror = m
+}
+
+// sessionOutput returns where the output of an interactive shell goes.
+func sessionOutput() io.Writer {
+	if mirror == nil {
+		return os.Stdout
+	}
+	return io.MultiWriter(os.Stdout, mirror)
+}
+
+// mirrorInput returns the keystrokes of session participants, or nil (which
+// never delivers) when the session isn't shared.
+func mirrorInput() <-chan []byte {
+	if mirror == nil {
+		return nil
+	}
+	return mirror.Input()
+}
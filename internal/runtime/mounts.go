@@ -0,0 +1,159 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+// Mount is a host path mounted into the debug container (--mount).
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ParseMount parses a --mount value: "src=<host path>,dst=<path>[,ro]"
+// (source/target/destination and readonly are accepted too) or the short
+// form "<host path>:<path>[:ro]".
+func ParseMount(s string) (Mount, error) {
+	var m Mount
+	if !strings.Contains(s, "=") {
+		parts := strings.Split(s, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw") {
+			return Mount{}, fmt.Errorf("invalid mount %q: expected src=<path>,dst=<path>[,ro] or <src>:<dst>[:ro]", s)
+		}
+		m = Mount{Source: parts[0], Target: parts[1], ReadOnly: len(parts) == 3 && parts[2] == "ro"}
+	} else {
+		for _, field := range strings.Split(s, ",") {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "src", "source":
+				m.Source = value
+			case "dst", "destination", "target":
+				m.Target = value
+			case "ro", "readonly":
+				m.ReadOnly = value == "" || value == "true" || value == "1"
+			default:
+				return Mount{}, fmt.Errorf("invalid mount %q: unknown field %q", s, key)
+			}
+		}
+	}
+	if m.Source == "" || m.Target == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q: both src and dst are required", s)
+	}
+	if !path.IsAbs(m.Target) {
+		return Mount{}, fmt.Errorf("invalid mount %q: dst must be an absolute path", s)
+	}
+	return m, nil
+}
+
+// dockerMounts converts --mount values to Docker bind mounts.
+func dockerMounts(mounts []Mount) []mount.Mount {
+	var out []mount.Mount
+	for _, m := range mounts {
+		out = append(out, mount.Mount{Type: mount.TypeBind, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return out
+}
+
+// optionsLabel records on a sidecar a digest of the options it was created
+// with (--mount, -e, --workdir, --seccomp-profile, --apparmor, --cap-add,
+// --cap-drop, --no-target-env, --no-wrappers, redaction patterns,
+// --read-only-target and volume patterns), so that it's only reused with the same ones.
+const optionsLabel = "debux.options"
+
+// sidecarOptions returns the optionsLabel value for opts, "" without any of
+// those options (which is also what older sidecars carry).
+func sidecarOptions(opts DebugOpts) string {
+	if len(opts.Mounts) == 0 && len(opts.Env) == 0 && opts.Workdir == "" && opts.Security.IsZero() &&
+		!opts.NoTargetEnv && !opts.NoWrappers && len(opts.RedactEnv) == 0 && len(opts.KeepEnv) == 0 && !opts.ReadOnlyTarget &&
+		len(opts.Volumes) == 0 && len(opts.ExcludeVolumes) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, m := range opts.Mounts {
+		fmt.Fprintf(h, "mount\x00%s\x00%s\x00%t\x00", m.Source, m.Target, m.ReadOnly)
+	}
+	for _, e := range opts.Env {
+		fmt.Fprintf(h, "env\x00%s\x00", e)
+	}
+	fmt.Fprintf(h, "workdir\x00%s", opts.Workdir)
+	if !opts.Security.IsZero() {
+		fmt.Fprintf(h, "\x00seccomp\x00%s\x00apparmor\x00%s", opts.Security.Seccomp, opts.Security.AppArmor)
+		fmt.Fprintf(h, "\x00cap-add\x00%s\x00cap-drop\x00%s", strings.Join(opts.Security.CapAdd, ","), strings.Join(opts.Security.CapDrop, ","))
+	}
+	if opts.NoTargetEnv || len(opts.RedactEnv) > 0 || len(opts.KeepEnv) > 0 {
+		fmt.Fprintf(h, "\x00target-env\x00%t\x00%s\x00%s", !opts.NoTargetEnv, strings.Join(opts.RedactEnv, " "), strings.Join(opts.KeepEnv, " "))
+	}
+	if opts.ReadOnlyTarget {
+		fmt.Fprint(h, "\x00read-only-target")
+	}
+	if opts.NoWrappers {
+		fmt.Fprint(h, "\x00no-wrappers")
+	}
+	if len(opts.Volumes) > 0 || len(opts.ExcludeVolumes) > 0 {
+		fmt.Fprintf(h, "\x00volumes\x00%s\x00%s", strings.Join(opts.Volumes, ","), strings.Join(opts.ExcludeVolumes, ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// volumeFilter selects the target's volumes to share by their mount path:
+// with --volumes, only those at or under a matching path, never those
+// --exclude-volumes matches.
+func volumeFilter(opts DebugOpts) pathFilter {
+	return pathFilter{include: opts.Volumes, exclude: opts.ExcludeVolumes}
+}
+
+// userEnv returns the -e and --workdir variables for the debug container.
+// DEBUX_ENV_KEYS keeps the shell from overriding them with the target's
+// environment, DEBUX_WORKDIR replaces the shell's initial cd to the target's
+// working directory. shellEnv adds the shell's options.
+// DEBUX_READ_ONLY_TARGET has the entrypoint bind the target's root
+// filesystem read-only.
+func userEnv(opts DebugOpts) []string {
+	var env, keys []string
+	for _, e := range opts.Env {
+		key, _, _ := strings.Cut(e, "=")
+		keys = append(keys, key)
+		env = append(env, e)
+	}
+	if len(keys) > 0 {
+		env = append(env, "DEBUX_ENV_KEYS="+strings.Join(keys, " "))
+	}
+	if opts.Workdir != "" {
+		env = append(env, "DEBUX_WORKDIR="+opts.Workdir)
+	}
+	env = append(env, shellEnv(opts)...)
+	if opts.ReadOnlyTarget {
+		env = append(env, "DEBUX_READ_ONLY_TARGET=1")
+	}
+	return env
+}
+
+// shellEnv returns the variables of the debug shell's options:
+// DEBUX_NO_TARGET_ENV skips the import of the target's environment,
+// DEBUX_ENV_REDACT and DEBUX_ENV_KEEP select what it imports,
+// DEBUX_NO_WRAPPERS skips the wrappers of its binaries. Docker sidecars carry
+// them, Kubernetes shells get them exported, since they share the ephemeral
+// container whatever their options.
+func shellEnv(opts DebugOpts) []string {
+	var env []string
+	if opts.NoTargetEnv {
+		env = append(env, "DEBUX_NO_TARGET_ENV=1")
+	}
+	if len(opts.RedactEnv) > 0 {
+		env = append(env, "DEBUX_ENV_REDACT="+strings.Join(opts.RedactEnv, ","))
+	}
+	if len(opts.KeepEnv) > 0 {
+		env = append(env, "DEBUX_ENV_KEEP="+strings.Join(opts.KeepEnv, ","))
+	}
+	if opts.NoWrappers {
+		env = append(env, "DEBUX_NO_WRAPPERS=1")
+	}
+	return env
+}
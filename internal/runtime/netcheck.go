@@ -0,0 +1,116 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/clement-tourriere/debux/internal/netcheck"
+)
+
+// KubeServiceEndpoints resolves svc/<name>[:port] in the namespace of a
+// target pod to an endpoint per port of the service, or for the given port
+// (by number or name).
+func KubeServiceEndpoints(ctx context.Context, target *Target, kubeconfig, svc string) ([]netcheck.Endpoint, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	namespace := target.Namespace
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	name, port, _ := strings.Cut(strings.TrimPrefix(svc, "svc/"), ":")
+	service, err := clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting service %s/%s: %w", namespace, name, err)
+	}
+
+	host := name + "." + namespace + ".svc"
+	var endpoints []netcheck.Endpoint
+	for _, p := range service.Spec.Ports {
+		if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP {
+			continue
+		}
+		if port != "" && port != p.Name && port != strconv.Itoa(int(p.Port)) {
+			continue
+		}
+		endpoints = append(endpoints, netcheck.Endpoint{
+			Name: fmt.Sprintf("svc/%s:%d", name, p.Port),
+			Host: host,
+			Port: int(p.Port),
+			TLS:  p.Port == 443 || p.Name == "https" || strings.HasPrefix(p.Name, "https-") || strings.HasPrefix(p.Name, "tls"),
+		})
+	}
+	if len(endpoints) == 0 {
+		if port != "" {
+			return nil, fmt.Errorf("service %s/%s has no TCP port %s", namespace, name, port)
+		}
+		return nil, fmt.Errorf("service %s/%s has no TCP port", namespace, name)
+	}
+	return endpoints, nil
+}
+
+// KubeNetworkPolicies returns the NetworkPolicies selecting a target pod.
+func KubeNetworkPolicies(ctx context.Context, target *Target, kubeconfig string) ([]netcheck.Policy, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	namespace := target.Namespace
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting pod %s/%s: %w", namespace, target.Name, err)
+	}
+	list, err := clientset.NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing network policies: %w", err)
+	}
+
+	var policies []netcheck.Policy
+	for _, np := range list.Items {
+		selector, err := metav1.LabelSelectorAsSelector(&np.Spec.PodSelector)
+		if err != nil || !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		p := netcheck.Policy{Name: np.Name}
+		types := np.Spec.PolicyTypes
+		if len(types) == 0 {
+			// Without policyTypes, policies restrict ingress, and egress if
+			// they have egress rules
+			types = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+			if len(np.Spec.Egress) > 0 {
+				types = append(types, networkingv1.PolicyTypeEgress)
+			}
+		}
+		for _, t := range types {
+			switch t {
+			case networkingv1.PolicyTypeIngress:
+				p.Ingress = true
+			case networkingv1.PolicyTypeEgress:
+				p.Egress = true
+			}
+		}
+		for _, rule := range np.Spec.Egress {
+			if len(rule.Ports) == 0 {
+				p.AllowsDNS = true
+			}
+			for _, port := range rule.Ports {
+				if port.Port == nil || port.Port.IntValue() == 53 || port.Port.String() == "dns" {
+					p.AllowsDNS = true
+				}
+			}
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
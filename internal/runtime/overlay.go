@@ -0,0 +1,150 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+)
+
+// imageOverlay is a target image filesystem assembled inside the debug
+// container from the overlay2 layer directories of a stopped container, or
+// from the layer cache, instead of being copied through the Docker API.
+type imageOverlay struct {
+	target      imageTarget
+	containerID string   // stopped container created from the target image, if any
+	lowerDirs   []string // host layer directories (in-container ones when cached), topmost first
+	cached      bool     // layers come from LayerCacheVolume
+	cleanup     func()
+}
+
+// mountDirs returns the in-container bind mount points for the layers.
+func (o *imageOverlay) mountDirs() []string {
+	if o.cached {
+		return o.lowerDirs
+	}
+	dirs := make([]string, len(o.lowerDirs))
+	for i := range o.lowerDirs {
+		dirs[i] = fmt.Sprintf("/run/debux/layers/%s/%d", o.target.Dir, i)
+	}
+	return dirs
+}
+
+// prepareOverlay creates a stopped container from the target image and returns
+// its overlay2 layer directories. It returns nil (and no error) when the fast
+// path doesn't apply: archives, direct pulls, or a non-overlay2 storage driver.
+func prepareOverlay(ctx context.Context, cli *client.Client, t imageTarget, opts ImageOpts) (*imageOverlay, error) {
+	if opts.Direct || dbximage.IsArchiveRef(t.Ref) {
+		return nil, nil
+	}
+
+	id, cleanup, err := createTargetContainer(ctx, cli, t.Ref, opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("inspecting target container: %w", err)
+	}
+	if info.GraphDriver.Name != "overlay2" || info.GraphDriver.Data["LowerDir"] == "" {
+		cleanup()
+		return nil, nil
+	}
+
+	var dirs []string
+	if upper := info.GraphDriver.Data["UpperDir"]; upper != "" {
+		dirs = append(dirs, upper)
+	}
+	dirs = append(dirs, strings.Split(info.GraphDriver.Data["LowerDir"], ":")...)
+
+	return &imageOverlay{target: t, containerID: id, lowerDirs: dirs, cleanup: cleanup}, nil
+}
+
+// overlayMounts returns the read-only bind mounts exposing each overlay's
+// layer directories inside the debug container.
+func overlayMounts(overlays []*imageOverlay) []mount.Mount {
+	mounts := layerCacheMounts(overlays)
+	for _, o := range overlays {
+		if o.cached {
+			continue
+		}
+		for i, dir := range o.mountDirs() {
+			mounts = append(mounts, mount.Mount{
+				Type:     mount.TypeBind,
+				Source:   o.lowerDirs[i],
+				Target:   dir,
+				ReadOnly: true,
+			})
+		}
+	}
+	return mounts
+}
+
+// overlaySpec builds the DEBUX_OVERLAYS value consumed by the image entrypoint:
+// space-separated "<dir>=<lower1>:<lower2>..." entries.
+func overlaySpec(overlays []*imageOverlay) string {
+	specs := make([]string, len(overlays))
+	for i, o := range overlays {
+		specs[i] = o.target.Dir + "=" + strings.Join(o.mountDirs(), ":")
+	}
+	return strings.Join(specs, " ")
+}
+
+// overlayMounted reports whether the entrypoint managed to mount the overlay
+// for the given target directory.
+func overlayMounted(ctx context.Context, cli *client.Client, containerID, dir string) bool {
+	code, err := runInContainer(ctx, cli, containerID, []string{"test", "-e", "/run/debux/rw/" + dir + "/mounted"}, io.Discard, io.Discard)
+	return err == nil && code == 0
+}
+
+// runInContainer runs a command without a TTY inside a running container,
+// demultiplexing its output into stdout and stderr, and returns its exit code.
+func runInContainer(ctx context.Context, cli *client.Client, containerID string, cmd []string, stdout, stderr io.Writer) (int, error) {
+	return pipeInContainer(ctx, cli, containerID, cmd, nil, stdout, stderr)
+}
+
+// pipeInContainer is runInContainer with stdin (nil for none) fed to the
+// command, which sees EOF once stdin is exhausted.
+func pipeInContainer(ctx context.Context, cli *client.Client, containerID string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	resp, err := cli.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("creating exec session: %w", err)
+	}
+
+	hijacked, err := cli.ContainerExecAttach(ctx, resp.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return -1, fmt.Errorf("attaching to exec session: %w", err)
+	}
+	defer hijacked.Close()
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(hijacked.Conn, stdin)
+			_ = hijacked.CloseWrite()
+		}()
+	}
+
+	if _, err := stdcopy.StdCopy(stdout, stderr, hijacked.Reader); err != nil {
+		return -1, fmt.Errorf("reading exec output: %w", err)
+	}
+
+	inspect, err := cli.ContainerExecInspect(ctx, resp.ID)
+	if err != nil {
+		return -1, fmt.Errorf("inspecting exec session: %w", err)
+	}
+	return inspect.ExitCode, nil
+}
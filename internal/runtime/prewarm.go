@@ -0,0 +1,212 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/clement-tourriere/debux/internal/events"
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// prewarmName is the DaemonSet of debux prewarm, one per namespace, so that
+// prewarming again updates it instead of piling up.
+const prewarmName = "debux-prewarm"
+
+// prewarmPullFailures are the waiting reasons of pods that can't pull the
+// debug image.
+var prewarmPullFailures = map[string]bool{
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// DockerPrewarm pulls the debug image onto the local Docker daemon, for the
+// given platform if any, so that the first debug session starts right away.
+func DockerPrewarm(ctx context.Context, image, platform string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("creating docker client: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if err := dbximage.EnsureImage(ctx, cli, image, platform); err != nil {
+		return err
+	}
+	statusf("Debug image %s is ready on the Docker daemon\n", image)
+	return nil
+}
+
+// KubernetesPrewarm pulls the debug image onto the nodes of the cluster with
+// a DaemonSet whose pods only sleep, and deletes it once every node has the
+// image, unless opts.Keep. Nodes that fail to pull are reported at the end.
+func KubernetesPrewarm(ctx context.Context, opts PrewarmOpts) error {
+	_, clientset, err := getK8sClient(opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	if opts.Namespace == "default" {
+		opts.Namespace = resolveNamespace(opts.Kubeconfig)
+	}
+
+	ds := prewarmDaemonSet(opts)
+	daemonSets := clientset.AppsV1().DaemonSets(opts.Namespace)
+	existing, err := daemonSets.Get(ctx, prewarmName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		ds, err = daemonSets.Create(ctx, ds, metav1.CreateOptions{})
+	case err == nil:
+		existing.Spec.Template = ds.Spec.Template
+		existing.Annotations = ds.Annotations
+		ds, err = daemonSets.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("creating prewarm DaemonSet: %w", err)
+	}
+	events.Emit(events.Event{Type: events.ImagePull, Image: opts.Image, Target: "k8s://" + opts.Namespace})
+
+	if !opts.Keep {
+		defer func() {
+			statusf("Deleting DaemonSet %s/%s...\n", opts.Namespace, prewarmName)
+			background := metav1.DeletePropagationBackground
+			_ = daemonSets.Delete(context.Background(), prewarmName, metav1.DeleteOptions{PropagationPolicy: &background})
+		}()
+	}
+
+	statusf("Pulling %s on the nodes of namespace %s (DaemonSet %s)...\n", opts.Image, opts.Namespace, prewarmName)
+	if err := waitForPrewarm(ctx, clientset, ds); err != nil {
+		return err
+	}
+	events.Emit(events.Event{Type: events.ImagePulled, Image: opts.Image, Target: "k8s://" + opts.Namespace})
+	return nil
+}
+
+// prewarmDaemonSet returns the DaemonSet pulling opts.Image on every node,
+// or those of opts.NodeSelector. Its pods tolerate every taint, and sleep
+// unprivileged with next to no resources.
+func prewarmDaemonSet(opts PrewarmOpts) *appsv1.DaemonSet {
+	podLabels := meta.KubeLabels(meta.KindPrewarm)
+	podLabels["debux.prewarm"] = prewarmName
+	sc, _ := SecurityContextForProfile(ProfileRestricted)
+	var grace int64 = 1
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        prewarmName,
+			Namespace:   opts.Namespace,
+			Labels:      meta.KubeLabels(meta.KindPrewarm),
+			Annotations: meta.KubeAnnotations(opts.Image),
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"debux.prewarm": prewarmName}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+				Spec: corev1.PodSpec{
+					ImagePullSecrets:              kubePullSecrets(opts.PullSecrets),
+					NodeSelector:                  opts.NodeSelector,
+					Tolerations:                   []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+					TerminationGracePeriodSeconds: &grace,
+					Containers: []corev1.Container{
+						{
+							Name:            "prewarm",
+							Image:           opts.Image,
+							ImagePullPolicy: corev1.PullPolicy(opts.PullPolicy),
+							Command:         []string{"/bin/sh", "-c", "exec sleep infinity"},
+							SecurityContext: sc,
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("1m"),
+									corev1.ResourceMemory: resource.MustParse("8Mi"),
+								},
+								Limits: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("10m"),
+									corev1.ResourceMemory: resource.MustParse("32Mi"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// waitForPrewarm waits for the pods of the prewarm DaemonSet to run on all
+// its nodes, reporting progress, and fails once the remaining ones all fail
+// to pull the image.
+func waitForPrewarm(ctx context.Context, clientset *kubernetes.Clientset, ds *appsv1.DaemonSet) error {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	selector := labels.SelectorFromSet(ds.Spec.Selector.MatchLabels).String()
+	lastReady := -1
+
+	for {
+		current, err := clientset.AppsV1().DaemonSets(ds.Namespace).Get(ctx, ds.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting prewarm DaemonSet: %w", err)
+		}
+		pods, err := clientset.CoreV1().Pods(ds.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return fmt.Errorf("listing prewarm pods: %w", err)
+		}
+
+		st := current.Status
+		desired := int(st.DesiredNumberScheduled)
+		if current.Generation <= st.ObservedGeneration {
+			ready, failed := prewarmProgress(pods.Items, ds.Spec.Template.Spec.Containers[0].Image)
+			if ready != lastReady {
+				statusf("Pulled on %d/%d nodes\n", ready, desired)
+				lastReady = ready
+			}
+			if ready >= desired {
+				return nil
+			}
+			if ready+len(failed) >= desired {
+				return fmt.Errorf("pulling %s failed on %d of %d nodes:\n  %s",
+					ds.Spec.Template.Spec.Containers[0].Image, len(failed), desired, strings.Join(failed, "\n  "))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// prewarmProgress returns how many prewarm pods run image, and the nodes
+// whose pods can't pull it, with the reason.
+func prewarmProgress(pods []corev1.Pod, image string) (int, []string) {
+	ready := 0
+	var failed []string
+	for _, pod := range pods {
+		// Pods of an earlier prewarm are on their way out
+		if pod.DeletionTimestamp != nil || pod.Spec.Containers[0].Image != image {
+			continue
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			switch {
+			case cs.State.Running != nil:
+				ready++
+			case cs.State.Waiting != nil && prewarmPullFailures[cs.State.Waiting.Reason]:
+				failed = append(failed, fmt.Sprintf("%s: %s %s", pod.Spec.NodeName, cs.State.Waiting.Reason, cs.State.Waiting.Message))
+			}
+		}
+	}
+	sort.Strings(failed)
+	return ready, failed
+}
@@ -0,0 +1,63 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// KubernetesPortForward forwards the local address listen to port on the
+// loopback of a target pod, through the pods/portforward API like kubectl
+// port-forward, until ctx ends. It calls ready once listening. No debug
+// container is involved: every container of a pod shares its loopback.
+func KubernetesPortForward(ctx context.Context, target *Target, kubeconfig, listen string, port int, ready func()) error {
+	config, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	namespace := target.Namespace
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	host, localPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listen, err)
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return fmt.Errorf("creating SPDY transport: %w", err)
+	}
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(target.Name).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+
+	stop := make(chan struct{})
+	readyCh := make(chan struct{})
+	fw, err := portforward.NewOnAddresses(dialer, []string{host}, []string{localPort + ":" + strconv.Itoa(port)}, stop, readyCh, io.Discard, io.Discard)
+	if err != nil {
+		return fmt.Errorf("forwarding to %s/%s: %w", namespace, target.Name, err)
+	}
+	go func() {
+		select {
+		case <-readyCh:
+			ready()
+		case <-ctx.Done():
+		}
+		<-ctx.Done()
+		close(stop)
+	}()
+	if err := fw.ForwardPorts(); err != nil {
+		return fmt.Errorf("forwarding to %s/%s: %w", namespace, target.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// sidecarResources returns the Docker limits for --cpus and --memory. The
+// memory limit includes swap, so a runaway tool can't push the host into
+// swapping either.
+func sidecarResources(opts DebugOpts) container.Resources {
+	var r container.Resources
+	if opts.CPUs > 0 {
+		r.NanoCPUs = int64(opts.CPUs * 1e9)
+	}
+	if opts.Memory > 0 {
+		r.Memory = opts.Memory
+		r.MemorySwap = opts.Memory
+	}
+	return r
+}
+
+// updateSidecarResources applies --cpus and --memory to a reused sidecar
+// whose limits differ, which Docker allows on running containers.
+func updateSidecarResources(ctx context.Context, cli *client.Client, info types.ContainerJSON, opts DebugOpts) error {
+	want := sidecarResources(opts)
+	if want.NanoCPUs == 0 && want.Memory == 0 {
+		return nil
+	}
+	if info.HostConfig != nil && (want.NanoCPUs == 0 || want.NanoCPUs == info.HostConfig.NanoCPUs) &&
+		(want.Memory == 0 || want.Memory == info.HostConfig.Memory) {
+		return nil
+	}
+	if _, err := cli.ContainerUpdate(ctx, info.ID, container.UpdateConfig{Resources: want}); err != nil {
+		return fmt.Errorf("updating debug container limits: %w", err)
+	}
+	return nil
+}
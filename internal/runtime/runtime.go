@@ -6,8 +6,32 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/render"
 )
 
+// ExitError is the non-zero exit status of a debug shell or command, which
+// debux exits with.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exited with status %d", e.Code)
+}
+
+// exitStatus returns err, or an ExitError for a non-zero exit code.
+func exitStatus(code int, err error) error {
+	if err == nil && code != 0 {
+		return &ExitError{Code: code}
+	}
+	return err
+}
+
 // resetTerminalEmulator sends ANSI escape sequences to reset terminal emulator
 // state that may have been altered by the remote session. term.RestoreTerminal
 // only restores termios (stty) settings; it does not undo changes made via
@@ -40,6 +64,23 @@ func watchSIGWINCH() (<-chan os.Signal, func()) {
 	return sigCh, func() { signal.Stop(sigCh) }
 }
 
+// terminalEnv returns the TERM and COLORTERM of the local terminal, for the
+// interactive shells debux opens on it, so that their programs draw for it,
+// and NO_COLOR with --no-color.
+func terminalEnv() []string {
+	var env []string
+	for _, k := range []string{"TERM", "COLORTERM"} {
+		// Values go through a shell: skip odd ones
+		if v := os.Getenv(k); v != "" && strings.Trim(v, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._+-") == "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	if render.Disabled() {
+		env = append(env, "NO_COLOR=1")
+	}
+	return env
+}
+
 const DefaultImage = "ghcr.io/clement-tourriere/debux:latest"
 
 // Security profile constants matching kubectl debug --profile behavior.
@@ -68,17 +109,64 @@ type Target struct {
 	Container string // k8s container within pod (optional)
 }
 
+// String returns the target as passed to debux.
+func (t *Target) String() string {
+	switch t.Runtime {
+	case "docker":
+		return t.Name
+	case "kubernetes":
+		s := "k8s://" + t.Namespace + "/" + t.Name
+		if t.Container != "" {
+			s += "/" + t.Container
+		}
+		return s
+	default:
+		return SchemeOf(t.Runtime) + "://" + t.Name
+	}
+}
+
 // DebugOpts are options for debugging a running container.
 type DebugOpts struct {
-	Image        string
-	Privileged   bool
-	User         string
-	AutoRemove   bool
-	Kubeconfig   string
-	ShareVolumes bool   // share target container's volumes (default: true)
-	PullPolicy   string // Kubernetes image pull policy (Always, IfNotPresent, Never)
-	Fresh        bool   // force a new ephemeral container instead of reusing an existing one
-	Profile      string // security profile (general, baseline, restricted, netadmin, sysadmin)
+	Image          string
+	Privileged     bool // the sysadmin profile, whatever Profile is
+	User           string
+	AsTargetUser   bool // start the shell as the target's user (ignored with User)
+	AutoRemove     bool
+	Kubeconfig     string
+	ShareVolumes   bool          // share target container's volumes (default: true)
+	Volumes        []string      // only share the volumes mounted at paths matching these patterns (default: all)
+	ExcludeVolumes []string      // don't share the volumes mounted at paths matching these patterns
+	PullPolicy     string        // Kubernetes image pull policy (Always, IfNotPresent, Never)
+	Fresh          bool          // force a new debug container instead of reusing an existing one, replacing the Docker sidecar
+	RemoveOnExit   bool          // remove the Docker sidecar when its last shell closes, rather than keeping it for reuse
+	Name           string        // name of the ephemeral container to reuse or create (Kubernetes; default: generated)
+	PerUser        bool          // only reuse the ephemeral containers the local user created (Kubernetes)
+	Detach         bool          // start the debug container and return without opening a shell
+	Attach         bool          // only join an existing debug container, never create one
+	Operator       bool          // have the debux operator create debug containers, through a DebugSession (Kubernetes)
+	Profile        string        // security profile (general, baseline, restricted, netadmin, sysadmin)
+	Security       Security      // seccomp, AppArmor and capabilities overriding those of Profile
+	Platform       string        // debug image platform, e.g. linux/arm64 (Docker; default: match the target)
+	StoreName      string        // persistent Nix store to mount (Docker; default: "default")
+	Share          []string      // namespaces to share with the target (Docker; default: DefaultShare)
+	Mounts         []Mount       // host paths to mount (Docker)
+	Env            []string      // extra KEY=VALUE environment variables
+	Workdir        string        // initial working directory of the shell
+	Pid            int           // process of the target the shell aims at instead of PID 1, e.g. the child of a supervisor
+	NoBanner       bool          // don't print the target summary as the shell opens
+	NoTargetEnv    bool          // don't import the target's environment in the shell, but its PATH
+	NoWrappers     bool          // don't generate the wrappers running the target's binaries chrooted
+	RedactEnv      []string      // target variables not imported, as globs, besides the built-in ones
+	KeepEnv        []string      // target variables imported even though they look like secrets
+	ReadOnlyTarget bool          // share the target's volumes read-only, and browse its root filesystem read-only where possible
+	CPUs           float64       // CPU limit of the sidecar, 0 for none (Docker)
+	Memory         int64         // memory limit of the sidecar in bytes, 0 for none (Docker)
+	SetupHooks     []string      // scripts run by new debug containers once set up (config hooks.container)
+	IdleTimeout    time.Duration // close interactive shells without input for this long, 0 for never
+	MaxDuration    time.Duration // close interactive shells after this long, 0 for never
+	Selector       string        // label selector the listed targets match, e.g. "app=api" (Kubernetes)
+	ListCache      time.Duration // reuse the targets listed this long ago at most (Kubernetes)
+	Nix            config.Nix
 }
 
 // PodOpts are options for creating a standalone debug pod.
@@ -88,18 +176,63 @@ type PodOpts struct {
 	Kubeconfig  string
 	Keep        bool
 	HostNetwork bool
-	Privileged  bool
+	Privileged  bool // the sysadmin profile, whatever Profile is
 	User        string
 	PullPolicy  string
-	Profile     string // security profile (general, baseline, restricted, netadmin, sysadmin)
+	Profile     string   // security profile (general, baseline, restricted, netadmin, sysadmin)
+	Security    Security // seccomp, AppArmor and capabilities overriding those of Profile
+	PullSecrets []string // image pull secrets for the pod
+	Nix         config.Nix
+}
+
+// PrewarmOpts are options for pulling the debug image onto the nodes of a
+// cluster ahead of debug sessions.
+type PrewarmOpts struct {
+	Image        string
+	Namespace    string
+	Kubeconfig   string
+	PullPolicy   string
+	PullSecrets  []string
+	NodeSelector map[string]string // nodes to pull on; all of them when empty
+	Keep         bool              // keep the DaemonSet, so that nodes keep the image
 }
 
 // ImageOpts are options for debugging a Docker image directly.
 type ImageOpts struct {
-	DebugImage string
-	Privileged bool
-	User       string
-	AutoRemove bool
+	DebugImage    string
+	Privileged    bool // the sysadmin profile, whatever Profile is
+	User          string
+	AutoRemove    bool
+	Direct        bool     // pull the target from its registry client-side instead of via the daemon
+	Layers        []int    // 1-based layer indexes to also extract under /target/layer-N
+	MountLayers   bool     // mount the image layers instead of copying the filesystem, with SYS_ADMIN
+	Include       []string // only copy paths matching these globs (copy path only)
+	Exclude       []string // skip paths matching these globs (copy path only)
+	Jobs          int      // tar streams copying the filesystem at once (copy path only; default DefaultJobs)
+	Platform      string   // platform for the target and debug images, e.g. linux/arm64
+	Commit        string   // when the session ends, save /target as this image (tag or archive ref)
+	RunEntrypoint bool     // start the image's ENTRYPOINT/CMD chrooted into /target in the shell
+	Trace         string   // run the entrypoint under this tracer: strace or ltrace
+	Profile       string   // security profile of the debug container
+	Security      Security // seccomp, AppArmor and capabilities of the debug container
+	StoreName     string   // persistent Nix store to mount (default: "default")
+	SetupHooks    []string // scripts run by the debug container once set up (config hooks.container)
+	NoBanner      bool     // don't print the image's summary as the shell opens
+	Nix           config.Nix
+}
+
+// KubeImageOpts are options for debugging an image inside a Kubernetes cluster.
+type KubeImageOpts struct {
+	DebugImage  string
+	Namespace   string
+	Kubeconfig  string
+	Keep        bool
+	PullPolicy  string
+	Profile     string
+	Security    Security // seccomp, AppArmor and capabilities overriding those of Profile
+	PullSecrets []string // image pull secrets for the pod
+	SetupHooks  []string // scripts run by the debug pod once set up (config hooks.container)
+	Nix         config.Nix
 }
 
 // ParseTarget parses a target string into a Target struct.
@@ -113,6 +246,7 @@ type ImageOpts struct {
 //	k8s://<pod>                     → kubernetes (default namespace)
 //	k8s://<namespace>/<pod>         → kubernetes
 //	k8s://<namespace>/<pod>/<ctr>   → kubernetes (specific container)
+//	<scheme>://<name>               → the runtime registered for scheme
 func ParseTarget(raw string) (*Target, error) {
 	if raw == "" {
 		return nil, fmt.Errorf("empty target")
@@ -123,19 +257,14 @@ func ParseTarget(raw string) (*Target, error) {
 		schema := raw[:idx]
 		rest := raw[idx+3:]
 
-		switch schema {
-		case "docker":
-			return &Target{Runtime: "docker", Name: rest}, nil
-
-		case "containerd", "nerdctl":
-			return &Target{Runtime: "containerd", Name: rest}, nil
-
-		case "k8s":
+		rt, ok := schemeRuntime(schema)
+		if !ok {
+			return nil, fmt.Errorf("unknown schema: %s (known: %s)", schema, strings.Join(Schemes(), ", "))
+		}
+		if rt == "kubernetes" {
 			return parseK8sTarget(rest)
-
-		default:
-			return nil, fmt.Errorf("unknown schema: %s", schema)
 		}
+		return &Target{Runtime: rt, Name: rest}, nil
 	}
 
 	// No schema — default to Docker
@@ -171,3 +300,22 @@ func parseK8sTarget(rest string) (*Target, error) {
 
 	return t, nil
 }
+
+// kubePullSecrets returns references to the named image pull secrets.
+func kubePullSecrets(names []string) []corev1.LocalObjectReference {
+	var refs []corev1.LocalObjectReference
+	for _, n := range names {
+		refs = append(refs, corev1.LocalObjectReference{Name: n})
+	}
+	return refs
+}
+
+// kubeEnv converts KEY=VALUE pairs to Kubernetes environment variables.
+func kubeEnv(env []string) []corev1.EnvVar {
+	vars := make([]corev1.EnvVar, 0, len(env))
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		vars = append(vars, corev1.EnvVar{Name: k, Value: v})
+	}
+	return vars
+}
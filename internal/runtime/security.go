@@ -0,0 +1,295 @@
+package runtime
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Security are confinement options and capabilities of the debug container,
+// on top of its profile.
+type Security struct {
+	// Seccomp is "runtime/default", "unconfined", "localhost/<profile>" (a
+	// profile installed on the Kubernetes nodes) or the path of a JSON
+	// profile (Docker).
+	Seccomp string
+	// AppArmor is "runtime/default", "unconfined", or a profile loaded on
+	// the host, optionally as "localhost/<profile>".
+	AppArmor string
+	// CapAdd and CapDrop are capabilities added to and dropped from those of
+	// the profile, without the CAP_ prefix (see ParseCapabilities).
+	CapAdd  []string
+	CapDrop []string
+}
+
+// profileLabel records on a Docker sidecar the security profile it runs.
+const profileLabel = "debux.profile"
+
+const (
+	confinementDefault    = "runtime/default"
+	confinementUnconfined = "unconfined"
+	confinementLocalhost  = "localhost/"
+)
+
+// IsZero reports whether s keeps the profile's confinement.
+func (s Security) IsZero() bool {
+	return s.Seccomp == "" && s.AppArmor == "" && len(s.CapAdd) == 0 && len(s.CapDrop) == 0
+}
+
+// capabilities are the Linux capabilities, without the CAP_ prefix.
+var capabilities = []string{
+	"AUDIT_CONTROL", "AUDIT_READ", "AUDIT_WRITE", "BLOCK_SUSPEND", "BPF",
+	"CHECKPOINT_RESTORE", "CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER",
+	"FSETID", "IPC_LOCK", "IPC_OWNER", "KILL", "LEASE", "LINUX_IMMUTABLE",
+	"MAC_ADMIN", "MAC_OVERRIDE", "MKNOD", "NET_ADMIN", "NET_BIND_SERVICE",
+	"NET_BROADCAST", "NET_RAW", "PERFMON", "SETFCAP", "SETGID", "SETPCAP",
+	"SETUID", "SYSLOG", "SYS_ADMIN", "SYS_BOOT", "SYS_CHROOT", "SYS_MODULE",
+	"SYS_NICE", "SYS_PACCT", "SYS_PTRACE", "SYS_RAWIO", "SYS_RESOURCE",
+	"SYS_TIME", "SYS_TTY_CONFIG", "WAKE_ALARM",
+}
+
+// baselineCapabilities are the capabilities the baseline Pod Security
+// Standard allows adding; restricted only allows NET_BIND_SERVICE.
+var baselineCapabilities = []string{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+	"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT",
+}
+
+// ParseCapabilities normalizes --cap-add and --cap-drop values: "sys_admin"
+// and "CAP_SYS_ADMIN" are SYS_ADMIN. ALL stands for every capability.
+func ParseCapabilities(values []string) ([]string, error) {
+	var caps []string
+	for _, v := range values {
+		c := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "CAP_")
+		if c != "ALL" && !slices.Contains(capabilities, c) {
+			return nil, fmt.Errorf("unknown capability %q", v)
+		}
+		if !slices.Contains(caps, c) {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// ValidateSecurity checks s against the security profile it applies to.
+func ValidateSecurity(s Security, profile string) error {
+	for _, v := range []struct{ flag, value string }{{"--seccomp-profile", s.Seccomp}, {"--apparmor", s.AppArmor}} {
+		if v.value == confinementLocalhost {
+			return fmt.Errorf("invalid %s %q: missing the profile name", v.flag, v.value)
+		}
+		if v.value == confinementUnconfined && profile == ProfileRestricted {
+			return fmt.Errorf("%s unconfined conflicts with --profile=restricted", v.flag)
+		}
+	}
+	switch profile {
+	case ProfileSysadmin:
+		if len(s.CapAdd) > 0 || len(s.CapDrop) > 0 {
+			return fmt.Errorf("--cap-add and --cap-drop don't apply to --profile=sysadmin: privileged containers get every capability; pick another profile and --cap-add what you need")
+		}
+	case ProfileRestricted, ProfileBaseline:
+		allowed := baselineCapabilities
+		if profile == ProfileRestricted {
+			allowed = []string{"NET_BIND_SERVICE"}
+		}
+		for _, c := range s.CapAdd {
+			if !slices.Contains(allowed, c) {
+				return fmt.Errorf("--cap-add %s conflicts with --profile=%s, which only allows adding %s", c, profile, strings.Join(allowed, ", "))
+			}
+		}
+	}
+	if s.Seccomp != "" && s.Seccomp != confinementDefault && s.Seccomp != confinementUnconfined && !strings.HasPrefix(s.Seccomp, confinementLocalhost) {
+		if _, err := seccompFile(s.Seccomp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seccompFile reads a JSON seccomp profile, compacted for Docker.
+func seccompFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading the seccomp profile: %w", err)
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, data); err != nil {
+		return "", fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	return b.String(), nil
+}
+
+// dockerSecurityOpt returns the Docker security options of s.
+func dockerSecurityOpt(s Security) ([]string, error) {
+	var opts []string
+	switch {
+	case s.Seccomp == "" || s.Seccomp == confinementDefault:
+	case s.Seccomp == confinementUnconfined:
+		opts = append(opts, "seccomp=unconfined")
+	case strings.HasPrefix(s.Seccomp, confinementLocalhost):
+		return nil, fmt.Errorf("--seccomp-profile %s: localhost profiles are installed on Kubernetes nodes; pass Docker the profile file", s.Seccomp)
+	default:
+		profile, err := seccompFile(s.Seccomp)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, "seccomp="+profile)
+	}
+	switch s.AppArmor {
+	case "", confinementDefault:
+	default:
+		opts = append(opts, "apparmor="+strings.TrimPrefix(s.AppArmor, confinementLocalhost))
+	}
+	return opts, nil
+}
+
+// dockerCapabilities returns the capabilities to add to and drop from a
+// Docker debug container, which adds base to the defaults.
+func dockerCapabilities(base []string, s Security) (add, drop []string) {
+	for _, c := range base {
+		if !slices.Contains(s.CapDrop, c) && !slices.Contains(s.CapDrop, "ALL") {
+			add = append(add, c)
+		}
+	}
+	for _, c := range s.CapAdd {
+		if !slices.Contains(add, c) {
+			add = append(add, c)
+		}
+	}
+	return add, s.CapDrop
+}
+
+// kubeSecurityContext applies s to sc, the security context of the profile,
+// which may be nil.
+func kubeSecurityContext(sc *corev1.SecurityContext, s Security) (*corev1.SecurityContext, error) {
+	if s.IsZero() {
+		return sc, nil
+	}
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+	switch {
+	case s.Seccomp == "":
+	case s.Seccomp == confinementDefault:
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	case s.Seccomp == confinementUnconfined:
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+	case strings.HasPrefix(s.Seccomp, confinementLocalhost):
+		name := strings.TrimPrefix(s.Seccomp, confinementLocalhost)
+		sc.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &name}
+	default:
+		return nil, fmt.Errorf("--seccomp-profile %s: Kubernetes nodes load seccomp profiles themselves; install it on the nodes and use localhost/<profile>", s.Seccomp)
+	}
+	if len(s.CapAdd) > 0 || len(s.CapDrop) > 0 {
+		caps := &corev1.Capabilities{}
+		if sc.Capabilities != nil {
+			for _, c := range sc.Capabilities.Add {
+				if !slices.Contains(s.CapDrop, string(c)) && !slices.Contains(s.CapDrop, "ALL") {
+					caps.Add = append(caps.Add, c)
+				}
+			}
+			caps.Drop = sc.Capabilities.Drop
+		}
+		for _, c := range s.CapAdd {
+			if !slices.Contains(caps.Add, corev1.Capability(c)) {
+				caps.Add = append(caps.Add, corev1.Capability(c))
+			}
+		}
+		for _, c := range s.CapDrop {
+			if !slices.Contains(caps.Drop, corev1.Capability(c)) {
+				caps.Drop = append(caps.Drop, corev1.Capability(c))
+			}
+		}
+		sc.Capabilities = caps
+	}
+	switch s.AppArmor {
+	case "":
+	case confinementDefault:
+		sc.AppArmorProfile = &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeRuntimeDefault}
+	case confinementUnconfined:
+		sc.AppArmorProfile = &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeUnconfined}
+	default:
+		name := strings.TrimPrefix(s.AppArmor, confinementLocalhost)
+		sc.AppArmorProfile = &corev1.AppArmorProfile{Type: corev1.AppArmorProfileTypeLocalhost, LocalhostProfile: &name}
+	}
+	return sc, nil
+}
+
+// kubeUser applies --user, as uid[:gid], to sc, the security context of
+// profile, which may be nil. Kubernetes runs containers as numeric IDs
+// only, and restricted ones as non-root.
+func kubeUser(sc *corev1.SecurityContext, user, profile string) (*corev1.SecurityContext, error) {
+	if user == "" {
+		return sc, nil
+	}
+	uidStr, gidStr, hasGID := strings.Cut(user, ":")
+	uid, err := strconv.ParseInt(uidStr, 10, 64)
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("invalid --user %q: Kubernetes runs containers as numeric IDs, expected uid[:gid]", user)
+	}
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+	sc.RunAsUser = &uid
+	if hasGID {
+		gid, err := strconv.ParseInt(gidStr, 10, 64)
+		if err != nil || gid < 0 {
+			return nil, fmt.Errorf("invalid --user %q: Kubernetes runs containers as numeric IDs, expected uid[:gid]", user)
+		}
+		sc.RunAsGroup = &gid
+	}
+	if uid == 0 && sc.RunAsNonRoot != nil && *sc.RunAsNonRoot {
+		return nil, fmt.Errorf("--user 0 conflicts with --profile=%s, which runs as non-root", cmp.Or(profile, ProfileGeneral))
+	}
+	return sc, nil
+}
+
+// effectiveProfile returns the security profile a debug container runs
+// with: privileged is the sysadmin profile, and no profile the general one.
+func effectiveProfile(profile string, privileged bool) string {
+	if privileged {
+		return ProfileSysadmin
+	}
+	return cmp.Or(profile, ProfileGeneral)
+}
+
+// dockerProfile applies a security profile and s to the host config of a
+// Docker debug container, which gets base capabilities on top of Docker's
+// defaults under the general profile, and returns the user it runs as.
+// Profiles grant what kubectl debug's do: baseline adds nothing,
+// restricted drops every capability and runs as nobody unless user says
+// otherwise, without privilege escalation, netadmin adds NET_ADMIN and
+// NET_RAW, and sysadmin is privileged.
+func dockerProfile(hostConfig *container.HostConfig, profile, user string, base []string, s Security) (string, error) {
+	switch profile {
+	case ProfileBaseline:
+		base = nil
+	case ProfileRestricted:
+		name, _, _ := strings.Cut(user, ":")
+		if name == "0" || name == "root" {
+			return "", fmt.Errorf("--user %s conflicts with --profile=restricted, which runs as non-root", user)
+		}
+		base = nil
+		s.CapDrop = append(slices.Clone(s.CapDrop), "ALL")
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+		user = cmp.Or(user, "65534")
+	case ProfileNetadmin:
+		base = []string{"NET_ADMIN", "NET_RAW"}
+	case ProfileSysadmin:
+		hostConfig.Privileged = true
+	}
+	opts, err := dockerSecurityOpt(s)
+	if err != nil {
+		return "", err
+	}
+	hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, opts...)
+	hostConfig.CapAdd, hostConfig.CapDrop = dockerCapabilities(base, s)
+	return user, nil
+}
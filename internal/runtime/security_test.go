@@ -0,0 +1,73 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestKubeUser(t *testing.T) {
+	nonRoot := func() *corev1.SecurityContext {
+		yes := true
+		return &corev1.SecurityContext{RunAsNonRoot: &yes}
+	}
+	tests := []struct {
+		name    string
+		sc      *corev1.SecurityContext
+		user    string
+		profile string
+		uid     int64 // -1 when unset
+		gid     int64 // -1 when unset
+		err     string
+	}{
+		{name: "no user", uid: -1, gid: -1},
+		{name: "uid", user: "1000", uid: 1000, gid: -1},
+		{name: "uid and gid", user: "1000:2000", uid: 1000, gid: 2000},
+		{name: "root", user: "0", uid: 0, gid: -1},
+		{name: "keeps the context", sc: nonRoot(), user: "1000", uid: 1000, gid: -1},
+		{name: "name", user: "nobody", err: `invalid --user "nobody": Kubernetes runs containers as numeric IDs`},
+		{name: "negative uid", user: "-1", err: "invalid --user"},
+		{name: "group name", user: "1000:staff", err: `invalid --user "1000:staff"`},
+		{name: "negative gid", user: "1000:-5", err: "invalid --user"},
+		{name: "empty uid", user: ":1000", err: "invalid --user"},
+		{name: "root as non-root", sc: nonRoot(), user: "0", profile: ProfileRestricted, err: "--user 0 conflicts with --profile=restricted"},
+		{name: "root as non-root without profile", sc: nonRoot(), user: "0:0", err: "--user 0 conflicts with --profile=general"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := kubeUser(tt.sc, tt.user, tt.profile)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("kubeUser(%q) error = %v, want %q", tt.user, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user == "" {
+				if sc != tt.sc {
+					t.Errorf("kubeUser changed the security context without a user")
+				}
+				return
+			}
+			if got := idOf(sc.RunAsUser); got != tt.uid {
+				t.Errorf("runAsUser = %d, want %d", got, tt.uid)
+			}
+			if got := idOf(sc.RunAsGroup); got != tt.gid {
+				t.Errorf("runAsGroup = %d, want %d", got, tt.gid)
+			}
+			if tt.sc != nil && (sc != tt.sc || sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot) {
+				t.Errorf("kubeUser replaced the security context")
+			}
+		})
+	}
+}
+
+func idOf(id *int64) int64 {
+	if id == nil {
+		return -1
+	}
+	return *id
+}
@@ -0,0 +1,244 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Service describes a Kubernetes Service and the pods behind it.
+type Service struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	ClusterIP string            `json:"clusterIP,omitempty"`
+	Ports     []string          `json:"ports"` // "<name> <port>→<targetPort>/<protocol>"
+	Selector  map[string]string `json:"selector,omitempty"`
+	Backends  []ServiceBackend  `json:"backends"`
+	Problems  []string          `json:"problems,omitempty"`
+}
+
+// ServiceBackend is an endpoint of a Service, or a pod its selector matches
+// that has none.
+type ServiceBackend struct {
+	Pod  string `json:"pod,omitempty"` // empty for endpoints that aren't pods
+	IP   string `json:"ip,omitempty"`
+	Node string `json:"node,omitempty"`
+	// Endpoint is the state of the endpoint: "ready", "serving" (terminating
+	// but still serving), "not ready", or "none" when the pod has no endpoint.
+	Endpoint string `json:"endpoint"`
+	Phase    string `json:"phase,omitempty"`
+	Ready    bool   `json:"ready"` // the pod's Ready condition
+	Restarts int    `json:"restarts"`
+	// Reason says why the pod isn't ready: containers waiting, failing
+	// readiness probes, terminating...
+	Reason string `json:"reason,omitempty"`
+}
+
+// KubeService describes the service name of namespace ("default" for the
+// namespace of the kubeconfig context): its endpoints from its
+// EndpointSlices, the readiness of each backing pod, and common problems
+// (a selector matching no pods, a named targetPort the pods don't declare).
+func KubeService(ctx context.Context, kubeconfig, namespace, name string) (*Service, error) {
+	_, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	svc, err := clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting service %s/%s: %w", namespace, name, err)
+	}
+	s := &Service{
+		Namespace: namespace,
+		Name:      name,
+		Type:      string(svc.Spec.Type),
+		ClusterIP: svc.Spec.ClusterIP,
+		Selector:  svc.Spec.Selector,
+		Backends:  []ServiceBackend{},
+	}
+	for _, p := range svc.Spec.Ports {
+		port := fmt.Sprintf("%d→%s/%s", p.Port, p.TargetPort.String(), p.Protocol)
+		if p.Name != "" {
+			port = p.Name + " " + port
+		}
+		s.Ports = append(s.Ports, port)
+	}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		s.Problems = append(s.Problems, "ExternalName service: it resolves to "+svc.Spec.ExternalName+" and has no endpoints")
+		return s, nil
+	}
+
+	slices, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the endpoints of %s/%s: %w", namespace, name, err)
+	}
+	var pods []corev1.Pod
+	if len(svc.Spec.Selector) > 0 {
+		list, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing the pods of %s/%s: %w", namespace, name, err)
+		}
+		pods = list.Items
+	}
+	podsByName := map[string]*corev1.Pod{}
+	for i := range pods {
+		podsByName[pods[i].Name] = &pods[i]
+	}
+
+	seen := map[string]bool{}
+	for _, slice := range slices.Items {
+		for _, ep := range slice.Endpoints {
+			b := ServiceBackend{Endpoint: endpointState(ep.Conditions)}
+			if len(ep.Addresses) > 0 {
+				b.IP = ep.Addresses[0]
+			}
+			if ep.NodeName != nil {
+				b.Node = *ep.NodeName
+			}
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				b.Pod = ep.TargetRef.Name
+				if seen[b.Pod] {
+					continue // in the slices of each address family
+				}
+				seen[b.Pod] = true
+				if pod, ok := podsByName[b.Pod]; ok {
+					describeBackend(&b, pod)
+				}
+			}
+			s.Backends = append(s.Backends, b)
+		}
+	}
+	// Pods the selector matches without an endpoint: just created, or with
+	// no IP yet
+	for i := range pods {
+		if seen[pods[i].Name] {
+			continue
+		}
+		b := ServiceBackend{Pod: pods[i].Name, IP: pods[i].Status.PodIP, Node: pods[i].Spec.NodeName, Endpoint: "none"}
+		describeBackend(&b, &pods[i])
+		s.Backends = append(s.Backends, b)
+	}
+	sort.SliceStable(s.Backends, func(i, j int) bool {
+		if s.Backends[i].Ready != s.Backends[j].Ready {
+			return s.Backends[i].Ready
+		}
+		return s.Backends[i].Pod < s.Backends[j].Pod
+	})
+
+	switch {
+	case len(svc.Spec.Selector) == 0:
+		if len(s.Backends) == 0 {
+			s.Problems = append(s.Problems, "no selector and no endpoints: the service needs manually managed EndpointSlices")
+		}
+	case len(pods) == 0:
+		s.Problems = append(s.Problems, "the selector "+labels.SelectorFromSet(svc.Spec.Selector).String()+" matches no pods")
+	default:
+		ready := 0
+		for _, b := range s.Backends {
+			if b.Endpoint == "ready" {
+				ready++
+			}
+		}
+		if ready == 0 {
+			s.Problems = append(s.Problems, "no ready endpoints: connections to the service fail")
+		}
+		s.Problems = append(s.Problems, missingTargetPorts(svc, pods)...)
+	}
+	return s, nil
+}
+
+// endpointState summarizes the conditions of an endpoint.
+func endpointState(c discoveryv1.EndpointConditions) string {
+	switch {
+	case c.Ready == nil || *c.Ready:
+		return "ready"
+	case c.Serving != nil && *c.Serving:
+		return "serving"
+	default:
+		return "not ready"
+	}
+}
+
+// describeBackend adds the state of its pod to a backend.
+func describeBackend(b *ServiceBackend, pod *corev1.Pod) {
+	b.Phase = string(pod.Status.Phase)
+	if b.Node == "" {
+		b.Node = pod.Spec.NodeName
+	}
+	var reasons []string
+	if pod.DeletionTimestamp != nil {
+		reasons = append(reasons, "terminating")
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			b.Ready = c.Status == corev1.ConditionTrue
+		}
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		b.Restarts += int(cs.RestartCount)
+		switch {
+		case cs.State.Waiting != nil:
+			reasons = append(reasons, cs.Name+": "+cs.State.Waiting.Reason)
+		case cs.State.Terminated != nil:
+			reasons = append(reasons, cs.Name+": terminated ("+cs.State.Terminated.Reason+")")
+		case !cs.Ready:
+			reasons = append(reasons, cs.Name+": readiness probe failing")
+		}
+	}
+	if !b.Ready && len(reasons) == 0 {
+		for _, c := range pod.Status.Conditions {
+			if c.Status != corev1.ConditionTrue && c.Reason != "" {
+				reasons = append(reasons, string(c.Type)+": "+c.Reason)
+			}
+		}
+	}
+	b.Reason = strings.Join(reasons, ", ")
+}
+
+// missingTargetPorts reports the named targetPorts of a service that pods
+// don't declare: those pods get no endpoint for the port.
+func missingTargetPorts(svc *corev1.Service, pods []corev1.Pod) []string {
+	var problems []string
+	for _, p := range svc.Spec.Ports {
+		if p.TargetPort.Type != intstr.String || p.TargetPort.IntValue() != 0 {
+			continue
+		}
+		name := p.TargetPort.String()
+		var missing []string
+		for _, pod := range pods {
+			if !declaresPort(&pod, name) {
+				missing = append(missing, pod.Name)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("port %d targets %q, which %d of %d pods don't declare: %s",
+				p.Port, name, len(missing), len(pods), strings.Join(missing, ", ")))
+		}
+	}
+	return problems
+}
+
+func declaresPort(pod *corev1.Pod, name string) bool {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+	"github.com/clement-tourriere/debux/internal/events"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Session is a running debug container of a target.
+type Session struct {
+	Target    string    // as passed to debux, e.g. k8s://prod/api-7d9f
+	Container string    // debug container name
+	Started   time.Time // when the debug container started
+	Shells    int       // open shells, -1 when unknown
+}
+
+// DockerSessions returns the running debug sidecars of Docker containers.
+// Shells are the running exec sessions of each sidecar.
+func DockerSessions(ctx context.Context) ([]Session, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+
+	var sessions []Session
+	for _, c := range containers {
+		target, ok := sidecarTarget(c)
+		if !ok || c.State != "running" {
+			continue
+		}
+		s := Session{Target: target, Container: strings.TrimPrefix(c.Names[0], "/"), Started: time.Unix(c.Created, 0), Shells: -1}
+		if info, err := cli.ContainerInspect(ctx, c.ID); err == nil {
+			if started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil {
+				s.Started = started
+			}
+			s.Shells = runningExecs(ctx, cli, info)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// KubernetesSessions returns the running debux ephemeral containers of the
+// pods in namespace. Shells are counted by running pgrep in each of them.
+func KubernetesSessions(ctx context.Context, kubeconfig, namespace string) ([]Session, error) {
+	config, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{FieldSelector: "status.phase=Running"})
+	if err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+
+	var sessions []Session
+	for _, pod := range pods.Items {
+		debux := make(map[string]bool)
+		for _, c := range pod.Spec.EphemeralContainers {
+			debux[c.Name] = isDebuxEphemeral(c)
+		}
+		for _, cs := range pod.Status.EphemeralContainerStatuses {
+			if !debux[cs.Name] || cs.State.Running == nil {
+				continue
+			}
+			s := Session{Target: "k8s://" + pod.Namespace + "/" + pod.Name, Container: cs.Name, Started: cs.State.Running.StartedAt.Time, Shells: -1}
+			var out bytes.Buffer
+			code, err := runInPod(ctx, config, clientset, pod.Namespace, pod.Name, cs.Name, []string{"pgrep", "-x", "zsh"}, &out, io.Discard)
+			if err == nil && (code == 0 || code == 1) {
+				s.Shells = len(strings.Fields(out.String()))
+			}
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// runningExecs returns the number of running exec sessions, shells and
+// commands, of a container.
+func runningExecs(ctx context.Context, cli *client.Client, info types.ContainerJSON) int {
+	n := 0
+	for _, id := range info.ExecIDs {
+		if exec, err := cli.ContainerExecInspect(ctx, id); err == nil && exec.Running {
+			n++
+		}
+	}
+	return n
+}
+
+// dockerSidecarInfo inspects the debug sidecar of a Docker container.
+func dockerSidecarInfo(ctx context.Context, cli *client.Client, target *Target) (types.ContainerJSON, error) {
+	// Sidecars are named after the target's name, even when given its ID
+	name := target.Name
+	if info, err := cli.ContainerInspect(ctx, target.Name); err == nil {
+		name = strings.TrimPrefix(info.Name, "/")
+	}
+	sidecar := "debux-" + name
+	info, err := cli.ContainerInspect(ctx, sidecar)
+	if client.IsErrNotFound(err) {
+		return info, fmt.Errorf("no debug container for %q", target.Name)
+	}
+	if err != nil {
+		return info, fmt.Errorf("inspecting container %q: %w", sidecar, err)
+	}
+	if !debuxOwned(info) {
+		return info, fmt.Errorf("container %q was not created by debux", sidecar)
+	}
+	return info, nil
+}
+
+// removeMarker is the file marking a sidecar to be removed when its last
+// shell closes, when a session with --rm ended before others.
+const removeMarker = "/tmp/debux-remove-on-exit"
+
+// DockerSessionEnded removes the debug sidecar of a Docker container once
+// its last shell closed, when remove (--rm) is set for this session or was
+// for one that ended before. Sidecars otherwise stay, to be reused.
+func DockerSessionEnded(ctx context.Context, target *Target, remove bool) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	info, err := dockerSidecarInfo(ctx, cli, target)
+	if err != nil {
+		return err
+	}
+	sidecar := strings.TrimPrefix(info.Name, "/")
+	if shells := runningExecs(ctx, cli, info); shells > 0 {
+		if remove {
+			if _, err := pipeInContainer(ctx, cli, info.ID, []string{"touch", removeMarker}, nil, io.Discard, io.Discard); err != nil {
+				return err
+			}
+			statusf("Keeping debug container %q while %d other shell(s) use it, then removing it\n", sidecar, shells)
+		}
+		return nil
+	}
+	if !remove {
+		code, err := pipeInContainer(ctx, cli, info.ID, []string{"test", "-e", removeMarker}, nil, io.Discard, io.Discard)
+		if err != nil || code != 0 {
+			return err
+		}
+	}
+	statusf("Removing debug container %q\n", sidecar)
+	events.Emit(events.Event{Type: events.Cleanup, Target: target.String(), Container: sidecar})
+	return cli.ContainerRemove(ctx, info.ID, container.RemoveOptions{Force: true})
+}
+
+// DockerCleanup removes the debug sidecar of a Docker container.
+func DockerCleanup(ctx context.Context, target *Target) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	info, err := dockerSidecarInfo(ctx, cli, target)
+	if err != nil {
+		return err
+	}
+	sidecar := strings.TrimPrefix(info.Name, "/")
+	statusf("Removing debug container %q\n", sidecar)
+	events.Emit(events.Event{Type: events.Cleanup, Target: target.String(), Container: sidecar})
+	return cli.ContainerRemove(ctx, info.ID, container.RemoveOptions{Force: true})
+}
+
+// KubernetesCleanup stops the running debux ephemeral container of a pod.
+// Ephemeral containers can't be removed from a pod: it stays in the pod's
+// spec, terminated.
+func KubernetesCleanup(ctx context.Context, target *Target, kubeconfig string) error {
+	config, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	namespace := target.Namespace
+	if namespace == "default" {
+		namespace = resolveNamespace(kubeconfig)
+	}
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, target.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("getting pod %s/%s: %w", namespace, target.Name, err)
+	}
+	name := findRunningDebuxContainer(pod)
+	if name == "" {
+		return fmt.Errorf("no running debug container in pod %s/%s", namespace, target.Name)
+	}
+	statusf("Stopping debug container %q\n", name)
+	events.Emit(events.Event{Type: events.Cleanup, Target: target.String(), Container: name})
+	return stopEphemeral(ctx, config, clientset, namespace, target.Name, name)
+}
+
+// KubernetesStopContainer stops a debux ephemeral container of a pod.
+func KubernetesStopContainer(ctx context.Context, kubeconfig, namespace, pod, name string) error {
+	config, clientset, err := getK8sClient(kubeconfig)
+	if err != nil {
+		return err
+	}
+	return stopEphemeral(ctx, config, clientset, namespace, pod, name)
+}
+
+func stopEphemeral(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace, pod, name string) error {
+	var stderr bytes.Buffer
+	code, err := runInPod(ctx, config, clientset, namespace, pod, name, []string{"sh", "-c", entrypoint.StopDaemon}, io.Discard, &stderr)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("stopping debug container %q: %s", name, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package runtime
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Namespaces a Docker sidecar can share with its target (--share), and what
+// sharing each one gives the debug shell.
+var Namespaces = []struct{ Name, Description string }{
+	{"net", "the target's network interfaces, ports and hostname (uts comes with it)"},
+	{"pid", "the target's processes, and its filesystem at $DEBUX_TARGET_ROOT"},
+	{"ipc", "the target's shared memory and semaphores (if its IPC mode allows it)"},
+	{"uts", "the target's hostname; only together with net"},
+	{"cgroup", "the target's cgroup, so resource views and limits match it"},
+}
+
+// shareLabel records on a sidecar the namespaces it shares with its target.
+const shareLabel = "debux.share"
+
+// DefaultShare is the set of namespaces shared when --share isn't given.
+var DefaultShare = []string{"net", "pid", "ipc"}
+
+// NamespaceNames returns the names of the shareable namespaces.
+func NamespaceNames() []string {
+	names := make([]string, len(Namespaces))
+	for i, ns := range Namespaces {
+		names[i] = ns.Name
+	}
+	return names
+}
+
+// ParseShare validates a --share list and returns it in canonical order
+// (that of Namespaces), without duplicates.
+func ParseShare(list []string) ([]string, error) {
+	names := NamespaceNames()
+	for _, name := range list {
+		if !slices.Contains(names, strings.ToLower(strings.TrimSpace(name))) {
+			return nil, fmt.Errorf("unknown namespace %q for --share (valid: %s)", name, strings.Join(names, ", "))
+		}
+	}
+	var share []string
+	for _, name := range names {
+		if slices.ContainsFunc(list, func(s string) bool { return strings.EqualFold(strings.TrimSpace(s), name) }) {
+			share = append(share, name)
+		}
+	}
+	if len(share) == 0 {
+		return nil, fmt.Errorf("--share needs at least one namespace (valid: %s)", strings.Join(NamespaceNames(), ", "))
+	}
+	// Docker joins the target's UTS namespace through its network namespace.
+	if slices.Contains(share, "uts") && !slices.Contains(share, "net") {
+		return nil, fmt.Errorf("--share uts requires net: Docker only shares the hostname along with the network namespace")
+	}
+	return share, nil
+}
+
+// applyShare configures hostConfig to join the target's namespaces listed in
+// share (DefaultShare when empty) and returns the value of DEBUX_TARGET_ROOT.
+func applyShare(hostConfig *container.HostConfig, targetInfo types.ContainerJSON, share []string) string {
+	explicit := len(share) > 0
+	if !explicit {
+		share = DefaultShare
+	}
+	ref := "container:" + targetInfo.ID
+
+	if slices.Contains(share, "net") {
+		hostConfig.NetworkMode = container.NetworkMode(ref)
+	}
+	if slices.Contains(share, "ipc") {
+		// Share IPC only if the target allows it
+		if targetInfo.HostConfig != nil && targetInfo.HostConfig.IpcMode != "" && targetInfo.HostConfig.IpcMode != "shareable" {
+			if explicit {
+				statusf("Target's IPC namespace is not shareable (ipc mode %q); using a private one\n", targetInfo.HostConfig.IpcMode)
+			}
+			hostConfig.IpcMode = "private"
+		} else {
+			hostConfig.IpcMode = container.IpcMode(ref)
+		}
+	}
+	if slices.Contains(share, "cgroup") {
+		hostConfig.Cgroup = container.CgroupSpec(ref)
+	}
+	if !slices.Contains(share, "pid") {
+		statusf("Not sharing the PID namespace: the target's processes and filesystem are not available\n")
+		return ""
+	}
+	hostConfig.PidMode = container.PidMode(ref)
+	return "/proc/1/root"
+}
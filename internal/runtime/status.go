@@ -0,0 +1,49 @@
+package runtime
+
+import (
+	"io"
+	"os"
+
+	"github.com/moby/term"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+)
+
+// status receives progress messages ("Creating debug container...").
+var status io.Writer = os.Stdout
+
+// quiet discards progress messages whatever SetStatusOutput is given.
+var quiet bool
+
+// SetStatusOutput redirects progress messages, e.g. to os.Stderr for commands
+// whose stdout carries machine-readable output, or to io.Discard.
+func SetStatusOutput(w io.Writer) {
+	if quiet {
+		w = io.Discard
+	}
+	status = w
+	dbximage.Status = w
+}
+
+// SetQuiet discards progress messages for good (-q).
+func SetQuiet() {
+	quiet = true
+	SetStatusOutput(io.Discard)
+}
+
+// statusf prints a progress message, above the progress bars of image
+// pulls running meanwhile.
+func statusf(format string, args ...any) {
+	dbximage.Statusf(format, args...)
+}
+
+// statusIsTerminal reports whether progress messages go to a terminal, which
+// is required for in-place (\r) progress lines.
+func statusIsTerminal() bool {
+	f, ok := status.(*os.File)
+	if !ok {
+		return false
+	}
+	_, isTerminal := term.GetFdInfo(f)
+	return isTerminal
+}
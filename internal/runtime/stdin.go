@@ -0,0 +1,60 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdinChunks reads stdin from a single goroutine for the whole process. A
+// session that ends from the outside (target restart) would otherwise leave
+// a reader blocked on stdin that swallows the next keystrokes.
+var stdinChunks = sync.OnceValue(func() <-chan []byte {
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				ch <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+})
+
+// stdinReader reads stdin, and the keystrokes of session participants when
+// the session is shared, until ctx is done.
+type stdinReader struct {
+	ctx context.Context
+	buf []byte
+}
+
+func newStdinReader(ctx context.Context) *stdinReader {
+	return &stdinReader{ctx: ctx}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		select {
+		case b, ok := <-stdinChunks():
+			if !ok {
+				return 0, io.EOF
+			}
+			r.buf = b
+		case b := <-mirrorInput():
+			r.buf = b
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+	markInput()
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
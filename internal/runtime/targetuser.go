@@ -0,0 +1,118 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// targetUserZdotdir holds a copy of the shell configuration that any user can
+// read, for shells that don't run as root (the sidecar's home is root's).
+const targetUserZdotdir = "/run/debux/zsh"
+
+// numericUser matches a numeric "uid[:gid]".
+var numericUser = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+// dockerTargetUser returns the "uid:gid" the target's main process runs as.
+// With the PID namespace shared, that's read from /proc/1/status in the
+// sidecar, which also sees processes that dropped privileges after starting.
+// Otherwise the container's configured user is used, if numeric.
+func dockerTargetUser(ctx context.Context, cli *client.Client, sidecarID string, target types.ContainerJSON) (string, error) {
+	sidecar, err := cli.ContainerInspect(ctx, sidecarID)
+	if err != nil {
+		return "", fmt.Errorf("inspecting debug container: %w", err)
+	}
+	share := strings.Split(sidecar.Config.Labels[shareLabel], ",")
+	if sidecar.Config.Labels[shareLabel] == "" || slices.Contains(share, "pid") {
+		var status bytes.Buffer
+		code, err := runInContainer(ctx, cli, sidecarID, []string{"cat", "/proc/1/status"}, &status, io.Discard)
+		if err == nil && code == 0 {
+			if user, ok := procStatusUser(status.String()); ok {
+				return user, nil
+			}
+		}
+	}
+
+	user := target.Config.User
+	switch {
+	case user == "":
+		return "0:0", nil
+	case numericUser.MatchString(user):
+		return user, nil
+	}
+	return "", fmt.Errorf("--as-target-user: can't resolve user %q of %s without sharing its PID namespace (add pid to --share, or pass --user uid:gid)",
+		user, strings.TrimPrefix(target.Name, "/"))
+}
+
+// procStatusUser returns the effective "uid:gid" from /proc/<pid>/status.
+func procStatusUser(status string) (string, bool) {
+	var uid, gid string
+	for _, line := range strings.Split(status, "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			continue
+		}
+		switch key {
+		case "Uid":
+			uid = fields[1]
+		case "Gid":
+			gid = fields[1]
+		}
+	}
+	return uid + ":" + gid, uid != "" && gid != ""
+}
+
+// isRootUser reports whether a "uid[:gid]" is root, which needs no special
+// session setup.
+func isRootUser(user string) bool {
+	uid, _, _ := strings.Cut(user, ":")
+	return uid == "0" || uid == "root"
+}
+
+// kubeTargetUser returns the user and group a pod container runs as, from
+// its securityContext or the pod's. A user set only by the image isn't
+// visible in the pod spec.
+func kubeTargetUser(pod *corev1.Pod, containerName string) (uid, gid *int64, err error) {
+	if psc := pod.Spec.SecurityContext; psc != nil {
+		uid, gid = psc.RunAsUser, psc.RunAsGroup
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == containerName && c.SecurityContext != nil {
+			if c.SecurityContext.RunAsUser != nil {
+				uid = c.SecurityContext.RunAsUser
+			}
+			if c.SecurityContext.RunAsGroup != nil {
+				gid = c.SecurityContext.RunAsGroup
+			}
+		}
+	}
+	if uid == nil {
+		return nil, nil, fmt.Errorf("--as-target-user: container %q has no runAsUser in its pod spec (its image sets the user, which debux can't see)", containerName)
+	}
+	return uid, gid, nil
+}
+
+// ephemeralRunsAs reports whether an ephemeral container of the pod runs as
+// the given user (nil: as the image's user).
+func ephemeralRunsAs(pod *corev1.Pod, name string, uid *int64) bool {
+	for _, c := range pod.Spec.EphemeralContainers {
+		if c.Name != name {
+			continue
+		}
+		var runAs *int64
+		if c.SecurityContext != nil {
+			runAs = c.SecurityContext.RunAsUser
+		}
+		return (runAs == nil && uid == nil) || (runAs != nil && uid != nil && *runAs == *uid)
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/moby/term"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// Terminal is a remote terminal running a debug shell, e.g. in a browser
+// (debux serve): its keystrokes, its screen and its size changes.
+type Terminal struct {
+	In     io.Reader
+	Out    io.Writer
+	Resize <-chan TerminalSize
+}
+
+// DockerShell opens a debug shell in the sidecar of a Docker container
+// (creating it if needed) on a remote terminal, until the shell exits, the
+// terminal input ends or ctx is done.
+func DockerShell(ctx context.Context, target *Target, opts DebugOpts, t Terminal) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	id, _, err := ensureDockerSidecar(ctx, cli, target, opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := cli.ContainerExecCreate(ctx, id, container.ExecOptions{
+		Cmd:          []string{"zsh"},
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("creating exec session: %w", err)
+	}
+	hijacked, err := cli.ContainerExecAttach(ctx, resp.ID, container.ExecAttachOptions{Tty: true})
+	if err != nil {
+		return fmt.Errorf("attaching to exec session: %w", err)
+	}
+	defer hijacked.Close()
+
+	go func() {
+		for {
+			select {
+			case size, ok := <-t.Resize:
+				if !ok {
+					return
+				}
+				_ = cli.ContainerExecResize(ctx, resp.ID, container.ResizeOptions{Height: uint(size.Height), Width: uint(size.Width)})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		_, _ = io.Copy(t.Out, hijacked.Reader)
+	}()
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		_, _ = io.Copy(hijacked.Conn, t.In)
+	}()
+
+	select {
+	case <-outputDone:
+	case <-inputDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// KubernetesShell opens a debug shell in a debux ephemeral container of a pod
+// (creating one if needed) on a remote terminal.
+func KubernetesShell(ctx context.Context, target *Target, opts DebugOpts, t Terminal) error {
+	config, clientset, err := getK8sClient(opts.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	namespace, containerName, err := ensureEphemeralContainer(ctx, clientset, target, opts)
+	if err != nil {
+		return err
+	}
+
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(target.Name).
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   exporting(podShell, shellEnv(opts)),
+			Stdin:     true,
+			Stdout:    true,
+			TTY:       true,
+		}, scheme.ParameterCodec)
+
+	exec, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return fmt.Errorf("creating SPDY executor: %w", err)
+	}
+	streamOpts := remotecommand.StreamOptions{
+		Stdin:  t.In,
+		Stdout: t.Out,
+		Tty:    true,
+	}
+	if t.Resize != nil {
+		streamOpts.TerminalSizeQueue = resizeQueue(t.Resize)
+	}
+	return exec.StreamWithContext(ctx, streamOpts)
+}
+
+// resizeQueue adapts a channel of sizes to a remotecommand.TerminalSizeQueue.
+type resizeQueue <-chan TerminalSize
+
+func (q resizeQueue) Next() *remotecommand.TerminalSize {
+	size, ok := <-q
+	if !ok {
+		return nil
+	}
+	return &remotecommand.TerminalSize{Width: size.Width, Height: size.Height}
+}
+
+// LocalShell runs a shell on the local terminal, in raw mode and following
+// its size, for drivers that only implement remote terminals.
+func LocalShell(ctx context.Context, shell func(Terminal) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var resize chan TerminalSize
+	if fd, isTerminal := term.GetFdInfo(os.Stdin); isTerminal {
+		if oldState, err := term.SetRawTerminal(fd); err == nil {
+			defer func() {
+				_ = term.RestoreTerminal(fd, oldState)
+				resetTerminalEmulator()
+			}()
+		}
+		resize = make(chan TerminalSize, 1)
+		send := func() {
+			size, err := term.GetWinsize(fd)
+			if err != nil || size == nil {
+				return
+			}
+			select {
+			case <-resize: // only the latest size matters
+			default:
+			}
+			resize <- TerminalSize{Width: size.Width, Height: size.Height}
+		}
+		send()
+		sigCh, stopSig := watchSIGWINCH()
+		go func() {
+			defer stopSig()
+			for {
+				select {
+				case <-sigCh:
+					send()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return shell(Terminal{In: newStdinReader(ctx), Out: sessionOutput(), Resize: resize})
+}
@@ -0,0 +1,281 @@
+package runtime
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/klauspost/compress/gzip"
+	"golang.org/x/sync/errgroup"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+)
+
+// ValidatePathPatterns checks that --include/--exclude patterns are absolute
+// paths with valid glob syntax.
+func ValidatePathPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid path pattern %q: must be absolute (e.g. /usr/share/doc)", p)
+		}
+		if _, err := path.Match(p, "/"); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// pathFilter selects filesystem entries by glob patterns. A pattern matches a
+// path or any of its parent directories, so "/usr/share/doc" covers the whole
+// subtree. With include patterns, only matching paths (and the directories
+// leading to them) are kept; exclude patterns always win.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+func (f pathFilter) keep(p string, isDir bool) bool {
+	for _, pat := range f.exclude {
+		if matchesPathOrParent(pat, p) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pat := range f.include {
+		if matchesPathOrParent(pat, p) || (isDir && couldContain(pat, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPathOrParent reports whether pattern matches p or one of its parents.
+func matchesPathOrParent(pattern, p string) bool {
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+		p = path.Dir(p)
+	}
+}
+
+// couldContain reports whether directory dir is an ancestor of paths that
+// pattern may match, e.g. "/usr" for "/usr/share/*".
+func couldContain(pattern, dir string) bool {
+	patParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	dirParts := strings.Split(strings.Trim(dir, "/"), "/")
+	if dir == "/" {
+		return true
+	}
+	if len(dirParts) >= len(patParts) {
+		return false
+	}
+	for i, d := range dirParts {
+		if ok, _ := path.Match(patParts[i], d); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// copyProgress renders a single, periodically refreshed progress line for a
+// filesystem copy. total is an estimate and may be 0 when unknown.
+type copyProgress struct {
+	label   string
+	total   int64
+	bytes   int64
+	files   int
+	start   time.Time
+	last    time.Time
+	enabled bool
+}
+
+func newCopyProgress(label string, total int64) *copyProgress {
+	now := time.Now()
+	return &copyProgress{label: label, total: total, start: now, last: now, enabled: statusIsTerminal()}
+}
+
+func (p *copyProgress) add(bytes int64, files int) {
+	p.bytes += bytes
+	p.files += files
+	if p.enabled && time.Since(p.last) >= 200*time.Millisecond {
+		p.last = time.Now()
+		p.render()
+	}
+}
+
+func (p *copyProgress) render() {
+	elapsed := time.Since(p.start).Seconds()
+	line := fmt.Sprintf("  %s: %s", p.label, units.HumanSize(float64(p.bytes)))
+	if p.total > 0 {
+		line += " / " + units.HumanSize(float64(p.total))
+	}
+	line += fmt.Sprintf(", %d files", p.files)
+	if elapsed > 0 {
+		rate := float64(p.bytes) / elapsed
+		line += fmt.Sprintf(", %s/s", units.HumanSize(rate))
+		if p.total > p.bytes && rate > 0 {
+			eta := time.Duration(float64(p.total-p.bytes)/rate) * time.Second
+			line += ", ETA " + eta.Round(time.Second).String()
+		}
+	}
+	statusf("\r\033[K%s", line)
+}
+
+func (p *copyProgress) done() {
+	if p.enabled {
+		p.render()
+		statusf("\n")
+	}
+}
+
+// DefaultJobs is how many tar streams copy an image filesystem into the
+// debug container at once, each extracted by the daemon in parallel.
+const DefaultJobs = 4
+
+// splitTar re-streams a tar archive as jobs archives, keeping only the
+// entries accepted by the filter and reporting progress as entries pass
+// through. Each top-level directory goes whole to one archive, so that
+// parents come before their children; hard links go with their target.
+// The archives are gzipped when compress is set.
+func splitTar(src io.Reader, filter pathFilter, progress *copyProgress, jobs int, compress bool) []*io.PipeReader {
+	readers := make([]*io.PipeReader, jobs)
+	pipes := make([]*io.PipeWriter, jobs)
+	writers := make([]*tar.Writer, jobs)
+	closers := make([]io.Closer, jobs)
+	for i := range jobs {
+		readers[i], pipes[i] = io.Pipe()
+		var w io.Writer = pipes[i]
+		if compress {
+			gz, _ := gzip.NewWriterLevel(pipes[i], gzip.BestSpeed)
+			w, closers[i] = gz, gz
+		}
+		writers[i] = tar.NewWriter(w)
+	}
+	fail := func(err error) {
+		for _, pw := range pipes {
+			pw.CloseWithError(err)
+		}
+	}
+
+	go func() {
+		tr := tar.NewReader(src)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			p := path.Clean("/" + strings.TrimPrefix(hdr.Name, "./"))
+			if !filter.keep(p, hdr.Typeflag == tar.TypeDir) {
+				continue
+			}
+			stream := p
+			if hdr.Typeflag == tar.TypeLink {
+				stream = path.Clean("/" + strings.TrimPrefix(hdr.Linkname, "./"))
+			}
+			tw := writers[tarStream(stream, jobs)]
+			if err := tw.WriteHeader(hdr); err != nil {
+				fail(err)
+				return
+			}
+			n, err := io.Copy(tw, tr)
+			if err != nil {
+				fail(err)
+				return
+			}
+			progress.add(n, 1)
+		}
+		for i, tw := range writers {
+			err := tw.Close()
+			if closers[i] != nil && err == nil {
+				err = closers[i].Close()
+			}
+			pipes[i].CloseWithError(err)
+		}
+	}()
+	return readers
+}
+
+// tarStream returns which of jobs archives the entry at p goes to, by its
+// top-level directory.
+func tarStream(p string, jobs int) int {
+	top, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if jobs <= 1 || top == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(top))
+	return int(h.Sum32() % uint32(jobs))
+}
+
+// remoteDaemon reports whether the Docker daemon is reached over the network
+// (tcp://, ssh://...), where compressing archives saves more than it costs.
+func remoteDaemon(cli *client.Client) bool {
+	host := cli.DaemonHost()
+	return !strings.HasPrefix(host, "unix://") && !strings.HasPrefix(host, "npipe://")
+}
+
+// copyToTarget copies a target filesystem tar stream to /<dir> inside the
+// debug container, applying the include/exclude filters and showing progress.
+// The stream is split into opts.Jobs archives the daemon extracts in
+// parallel, gzipped for remote daemons.
+func copyToTarget(ctx context.Context, cli *client.Client, containerID, dir, imageRef string, src io.Reader, opts ImageOpts) error {
+	progress := newCopyProgress("Copying "+imageRef, imageSizeEstimate(ctx, cli, imageRef, opts.Direct))
+	filter := pathFilter{include: opts.Include, exclude: opts.Exclude}
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = DefaultJobs
+	}
+
+	readers := splitTar(src, filter, progress, jobs, remoteDaemon(cli))
+	g, gctx := errgroup.WithContext(ctx)
+	for _, rc := range readers {
+		g.Go(func() error {
+			err := cli.CopyToContainer(gctx, containerID, "/"+dir, rc, container.CopyToContainerOptions{})
+			if err != nil {
+				// Unblock the split, and with it the other copies
+				_ = rc.CloseWithError(err)
+				return err
+			}
+			// The daemon may stop reading before the end of the archive
+			_, _ = io.Copy(io.Discard, rc)
+			return nil
+		})
+	}
+	err := g.Wait()
+	progress.done()
+	if err != nil {
+		return fmt.Errorf("copying filesystem to debug container: %w", err)
+	}
+	return nil
+}
+
+// imageSizeEstimate returns the unpacked size of a daemon image, or 0 when it
+// isn't known up front (archives and direct pulls).
+func imageSizeEstimate(ctx context.Context, cli *client.Client, imageRef string, direct bool) int64 {
+	if direct || dbximage.IsArchiveRef(imageRef) {
+		return 0
+	}
+	info, _, err := cli.ImageInspectWithRaw(ctx, imageRef)
+	if err != nil {
+		return 0
+	}
+	return info.Size
+}
@@ -0,0 +1,303 @@
+package runtime
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testEntry is an entry of a test archive.
+type testEntry struct {
+	name, link string
+	typ        byte
+	body       string
+}
+
+func buildTar(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Linkname: e.link, Typeflag: e.typ, Mode: 0o644, Size: int64(len(e.body))}
+		if e.typ == tar.TypeDir {
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readSplit reads every archive of a split at once, as the daemon does, and
+// returns the names of their entries, with the links' targets after "->".
+func readSplit(t *testing.T, readers []*io.PipeReader, compress bool) [][]string {
+	t.Helper()
+	archives := make([][]string, len(readers))
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i, rc := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var r io.Reader = rc
+			if compress {
+				gz, err := gzip.NewReader(rc)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				r = gz
+			}
+			tr := tar.NewReader(r)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				name := hdr.Name
+				if hdr.Typeflag == tar.TypeLink {
+					name += "->" + hdr.Linkname
+				}
+				archives[i] = append(archives[i], name)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return archives
+}
+
+func TestValidatePathPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		err      string
+	}{
+		{patterns: nil},
+		{patterns: []string{"/usr/share/doc", "/var/log/*.log"}},
+		{patterns: []string{"usr/share"}, err: `invalid path pattern "usr/share": must be absolute`},
+		{patterns: []string{"/etc", "/var/[log"}, err: `invalid path pattern "/var/[log"`},
+	}
+	for _, tt := range tests {
+		err := ValidatePathPatterns(tt.patterns)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("ValidatePathPatterns(%q) = %v", tt.patterns, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ValidatePathPatterns(%q) error = %v, want %q", tt.patterns, err, tt.err)
+		}
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter pathFilter
+		path   string
+		isDir  bool
+		keep   bool
+	}{
+		{name: "no patterns", path: "/etc/passwd", keep: true},
+		{name: "excluded", filter: pathFilter{exclude: []string{"/usr/share/doc"}}, path: "/usr/share/doc", isDir: true},
+		{name: "below an excluded directory", filter: pathFilter{exclude: []string{"/usr/share/doc"}}, path: "/usr/share/doc/README"},
+		{name: "next to an excluded directory", filter: pathFilter{exclude: []string{"/usr/share/doc"}}, path: "/usr/share/man", isDir: true, keep: true},
+		{name: "excluded by a glob", filter: pathFilter{exclude: []string{"/var/log/*.log"}}, path: "/var/log/app.log"},
+		{name: "included", filter: pathFilter{include: []string{"/etc"}}, path: "/etc/passwd", keep: true},
+		{name: "not included", filter: pathFilter{include: []string{"/etc"}}, path: "/usr/bin/sh"},
+		{name: "root leads to includes", filter: pathFilter{include: []string{"/usr/bin/*"}}, path: "/", isDir: true, keep: true},
+		{name: "directory leading to an include", filter: pathFilter{include: []string{"/usr/bin/*"}}, path: "/usr", isDir: true, keep: true},
+		{name: "file where an include leads", filter: pathFilter{include: []string{"/usr/bin/*"}}, path: "/usr"},
+		{name: "directory beside an include", filter: pathFilter{include: []string{"/usr/bin/*"}}, path: "/usr/lib", isDir: true},
+		{name: "exclude wins over include", filter: pathFilter{include: []string{"/var"}, exclude: []string{"/var/log"}}, path: "/var/log/app.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.keep(tt.path, tt.isDir); got != tt.keep {
+				t.Errorf("keep(%s) = %v, want %v", tt.path, got, tt.keep)
+			}
+		})
+	}
+}
+
+func TestSplitTar(t *testing.T) {
+	image := []testEntry{
+		{name: "./", typ: tar.TypeDir},
+		{name: "./etc/", typ: tar.TypeDir},
+		{name: "./etc/passwd", typ: tar.TypeReg, body: "root:x:0:0::/root:/bin/sh\n"},
+		{name: "./usr/", typ: tar.TypeDir},
+		{name: "./usr/bin/", typ: tar.TypeDir},
+		{name: "./usr/bin/busybox", typ: tar.TypeReg, body: "ELF"},
+		{name: "./usr/share/doc/README", typ: tar.TypeReg, body: "docs"},
+		{name: "./bin/", typ: tar.TypeDir},
+		{name: "./bin/sh", typ: tar.TypeLink, link: "./usr/bin/busybox"},
+		{name: "./var/", typ: tar.TypeDir},
+		{name: "./var/log/", typ: tar.TypeDir},
+		{name: "./var/log/app.log", typ: tar.TypeReg, body: "log"},
+		{name: "./lib", typ: tar.TypeSymlink, link: "usr/lib"},
+	}
+
+	tests := []struct {
+		name     string
+		filter   pathFilter
+		jobs     int
+		compress bool
+		want     []string
+	}{
+		{
+			name: "one job",
+			jobs: 1,
+			want: []string{"./", "./etc/", "./etc/passwd", "./usr/", "./usr/bin/", "./usr/bin/busybox", "./usr/share/doc/README",
+				"./bin/", "./bin/sh->./usr/bin/busybox", "./var/", "./var/log/", "./var/log/app.log", "./lib"},
+		},
+		{
+			name: "several jobs",
+			jobs: 4,
+			want: []string{"./", "./etc/", "./etc/passwd", "./usr/", "./usr/bin/", "./usr/bin/busybox", "./usr/share/doc/README",
+				"./bin/", "./bin/sh->./usr/bin/busybox", "./var/", "./var/log/", "./var/log/app.log", "./lib"},
+		},
+		{
+			name:     "compressed",
+			jobs:     3,
+			compress: true,
+			want: []string{"./", "./etc/", "./etc/passwd", "./usr/", "./usr/bin/", "./usr/bin/busybox", "./usr/share/doc/README",
+				"./bin/", "./bin/sh->./usr/bin/busybox", "./var/", "./var/log/", "./var/log/app.log", "./lib"},
+		},
+		{
+			name:   "exclude",
+			jobs:   2,
+			filter: pathFilter{exclude: []string{"/usr/share/doc", "/var/log/*.log"}},
+			want: []string{"./", "./etc/", "./etc/passwd", "./usr/", "./usr/bin/", "./usr/bin/busybox",
+				"./bin/", "./bin/sh->./usr/bin/busybox", "./var/", "./var/log/", "./lib"},
+		},
+		{
+			name:   "include keeps the directories leading to matches",
+			jobs:   2,
+			filter: pathFilter{include: []string{"/usr/bin/*"}},
+			want:   []string{"./", "./usr/", "./usr/bin/", "./usr/bin/busybox"},
+		},
+		{
+			name:   "exclude wins over include",
+			jobs:   2,
+			filter: pathFilter{include: []string{"/etc", "/var"}, exclude: []string{"/var/log"}},
+			want:   []string{"./", "./etc/", "./etc/passwd", "./var/"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			progress := &copyProgress{}
+			readers := splitTar(bytes.NewReader(buildTar(t, image)), tt.filter, progress, tt.jobs, tt.compress)
+			if len(readers) != tt.jobs {
+				t.Fatalf("got %d archives, want %d", len(readers), tt.jobs)
+			}
+			archives := readSplit(t, readers, tt.compress)
+
+			var got []string
+			for _, a := range archives {
+				got = append(got, a...)
+			}
+			if !sameEntries(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+			if progress.files != len(tt.want) {
+				t.Errorf("progress counted %d files, want %d", progress.files, len(tt.want))
+			}
+			for i, a := range archives {
+				for j, entry := range a {
+					// Hard links go with their target
+					name, link, isLink := strings.Cut(entry, "->")
+					stream := name
+					if isLink {
+						stream = link
+					}
+					if want := tarStream(path.Clean("/"+strings.TrimPrefix(stream, "./")), tt.jobs); want != i {
+						t.Errorf("%s is in archive %d, want %d", entry, i, want)
+					}
+					// Parents come before their children
+					if dir := path.Dir(strings.TrimSuffix(name, "/")); dir != "." && !slices.Contains(a[:j], dir+"/") && slices.Contains(tt.want, dir+"/") {
+						t.Errorf("archive %d has %s before its directory %s/", i, entry, dir)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSplitTarError(t *testing.T) {
+	archive := buildTar(t, []testEntry{
+		{name: "./etc/", typ: tar.TypeDir},
+		{name: "./etc/passwd", typ: tar.TypeReg, body: strings.Repeat("x", 1024)},
+	})
+	// Cut in the middle of the file
+	readers := splitTar(bytes.NewReader(archive[:1024]), pathFilter{}, &copyProgress{}, 2, false)
+	var wg sync.WaitGroup
+	errs := make([]error, len(readers))
+	for i, rc := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = io.Copy(io.Discard, rc)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("archive %d: no error for a truncated source", i)
+		}
+	}
+}
+
+func TestTarStream(t *testing.T) {
+	tests := []struct {
+		a, b string
+		jobs int
+		same bool
+	}{
+		{"/usr/bin/sh", "/usr/lib/libc.so", 8, true},
+		{"/usr", "/usr/bin/sh", 8, true},
+		{"/", "/etc", 1, true},
+		{"/etc/passwd", "/usr/bin/sh", 1, true},
+	}
+	for _, tt := range tests {
+		if got := tarStream(tt.a, tt.jobs) == tarStream(tt.b, tt.jobs); got != tt.same {
+			t.Errorf("tarStream(%s) == tarStream(%s) with %d jobs = %v, want %v", tt.a, tt.b, tt.jobs, got, tt.same)
+		}
+	}
+	for _, p := range []string{"/", "/etc", "/usr/bin/sh", "/var/log/app.log"} {
+		for jobs := 1; jobs <= 8; jobs++ {
+			if s := tarStream(p, jobs); s < 0 || s >= jobs {
+				t.Errorf("tarStream(%s, %d) = %d, out of range", p, jobs, s)
+			}
+		}
+	}
+	if tarStream("/", 8) != 0 {
+		t.Errorf("the root directory goes to archive %d, want 0", tarStream("/", 8))
+	}
+}
+
+func sameEntries(got, want []string) bool {
+	got, want = slices.Clone(got), slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	return slices.Equal(got, want)
+}
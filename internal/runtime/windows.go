@@ -0,0 +1,86 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/docker/client"
+	corev1 "k8s.io/api/core/v1"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+)
+
+// windowsHint is what debux can still do for Windows containers: browse the
+// filesystem of their image.
+const windowsHint = `  Browse its image's filesystem instead: debux image <image> (or --extract <dir>)
+  For a shell in it: docker exec -it <container> powershell (or kubectl exec)`
+
+// windowsTargetError is the error of debug sessions on Windows containers:
+// debug containers join the namespaces of Linux ones, which Windows
+// containers don't have.
+func windowsTargetError(target string) error {
+	return fmt.Errorf("%s is a Windows container: debux debugs Linux containers only, by joining their namespaces\n%s", target, windowsHint)
+}
+
+// errWindowsDaemon is the error of sessions on a Docker daemon running
+// Windows containers, such as Docker Desktop in Windows containers mode,
+// where the Linux debug container can't run.
+var errWindowsDaemon = errors.New("the Docker daemon runs Windows containers, and debux debug containers are Linux ones: switch Docker Desktop to Linux containers\n  Windows images can still be browsed without a daemon: debux image <image> --extract <dir>")
+
+// kubeWindowsPod reports whether a pod runs on Windows nodes.
+func kubeWindowsPod(pod *corev1.Pod) bool {
+	if pod.Spec.OS != nil {
+		return pod.Spec.OS.Name == corev1.Windows
+	}
+	return pod.Spec.NodeSelector[corev1.LabelOSStable] == string(corev1.Windows)
+}
+
+// windowsImage reports whether imageRef is a Windows image, which the
+// Docker daemon of Linux debug containers can't pull. Images the daemon has
+// are its own kind; other ones are looked up in their registry or archive.
+func windowsImage(ctx context.Context, cli *client.Client, imageRef, platform string) bool {
+	if dbximage.IsWindowsPlatform(platform) {
+		return true
+	}
+	if !dbximage.IsArchiveRef(imageRef) {
+		if _, _, err := cli.ImageInspectWithRaw(ctx, imageRef); err == nil {
+			return false
+		}
+	}
+	img, cleanup, err := dbximage.Load(ctx, imageRef, platform)
+	defer cleanup()
+	return err == nil && dbximage.IsWindows(img)
+}
+
+// kubeWindowsImage returns an error for Windows images, which the Linux
+// nodes of debug pods can't unpack: only the image's registry is asked, and
+// failing to reach it leaves the pod to report any problem.
+func kubeWindowsImage(ctx context.Context, imageRef string) error {
+	img, cleanup, err := dbximage.Load(ctx, imageRef, "")
+	defer cleanup()
+	if err == nil && dbximage.IsWindows(img) {
+		return fmt.Errorf("%s is a Windows image, which Linux nodes can't unpack: browse it with --runtime docker, or --extract <dir>", imageRef)
+	}
+	return nil
+}
+
+// windowsImageOpts adapts image sessions to Windows images: their
+// filesystem is read client-side and copied to the debug container, and
+// nothing of them can run there.
+func windowsImageOpts(ctx context.Context, cli *client.Client, targets []imageTarget, opts *ImageOpts) error {
+	for _, t := range targets {
+		if !windowsImage(ctx, cli, t.Ref, opts.Platform) {
+			continue
+		}
+		if opts.RunEntrypoint {
+			return fmt.Errorf("--run-entrypoint: %s is a Windows image, which can't run in the Linux debug container", t.Ref)
+		}
+		if opts.Commit != "" {
+			return fmt.Errorf("--commit: %s is a Windows image, whose changes can't be saved", t.Ref)
+		}
+		statusf("%s is a Windows image: its files are under /%s, for browsing only\n", t.Ref, t.Dir)
+		opts.Direct, opts.MountLayers = true, false
+	}
+	return nil
+}
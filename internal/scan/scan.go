@@ -0,0 +1,198 @@
+// Package scan runs vulnerability scanners (grype, trivy) inside a debug
+// container against the target filesystem and normalizes their reports.
+package scan
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Supported scanners.
+const (
+	Grype = "grype"
+	Trivy = "trivy"
+)
+
+// Scanners lists the supported scanners, the default first.
+var Scanners = []string{Grype, Trivy}
+
+// Vulnerability is a single finding, independent of the scanner that found it.
+type Vulnerability struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+	Version  string `json:"version"`
+	FixedIn  string `json:"fixedIn,omitempty"`
+	Type     string `json:"type,omitempty"` // package type: deb, apk, go-module, ...
+}
+
+// Report is the normalized result of a scan.
+type Report struct {
+	Target          string          `json:"target"`
+	Scanner         string          `json:"scanner"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+	Counts          map[string]int  `json:"counts"` // by severity
+}
+
+// severityOrder ranks severities from most to least severe.
+var severityOrder = map[string]int{
+	"Critical":   0,
+	"High":       1,
+	"Medium":     2,
+	"Low":        3,
+	"Negligible": 4,
+	"Unknown":    5,
+}
+
+// Script returns the shell script that installs the scanner on demand (via
+// dctl) and scans $DEBUX_TARGET_ROOT, writing its JSON report to stdout.
+// Virtual filesystems are skipped: the root may be /proc/1/root of a live
+// container.
+func Script(scanner string) (string, error) {
+	var run string
+	switch scanner {
+	case Grype:
+		run = `grype "dir:$root" -o json --quiet --exclude './proc/**' --exclude './sys/**' --exclude './dev/**'`
+	case Trivy:
+		run = `trivy rootfs --quiet --format json --skip-dirs proc --skip-dirs sys --skip-dirs dev "$root"`
+	default:
+		return "", fmt.Errorf("unknown scanner %q: must be one of %s", scanner, strings.Join(Scanners, ", "))
+	}
+	return fmt.Sprintf(`set -e
+root="${DEBUX_TARGET_ROOT:-/target}"
+export PATH="/nix/var/debux-profile/bin:$PATH"
+if ! command -v %[1]s >/dev/null 2>&1; then
+  echo "Installing %[1]s..." >&2
+  dctl install %[1]s >&2
+fi
+exec %[2]s
+`, scanner, run), nil
+}
+
+// Parse turns a scanner's JSON output into a Report sorted by severity.
+func Parse(scanner string, data []byte) (*Report, error) {
+	var vulns []Vulnerability
+	var err error
+	switch scanner {
+	case Grype:
+		vulns, err = parseGrype(data)
+	case Trivy:
+		vulns, err = parseTrivy(data)
+	default:
+		return nil, fmt.Errorf("unknown scanner %q", scanner)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s report: %w", scanner, err)
+	}
+
+	sort.SliceStable(vulns, func(i, j int) bool {
+		si, sj := severityRank(vulns[i].Severity), severityRank(vulns[j].Severity)
+		if si != sj {
+			return si < sj
+		}
+		if vulns[i].ID != vulns[j].ID {
+			return vulns[i].ID < vulns[j].ID
+		}
+		return vulns[i].Package < vulns[j].Package
+	})
+
+	report := &Report{Scanner: scanner, Vulnerabilities: vulns, Counts: map[string]int{}}
+	for _, v := range vulns {
+		report.Counts[v.Severity]++
+	}
+	return report, nil
+}
+
+// Severities returns the severities present in counts, most severe first.
+func Severities(counts map[string]int) []string {
+	var s []string
+	for sev := range counts {
+		s = append(s, sev)
+	}
+	sort.Slice(s, func(i, j int) bool { return severityRank(s[i]) < severityRank(s[j]) })
+	return s
+}
+
+func severityRank(s string) int {
+	if r, ok := severityOrder[s]; ok {
+		return r
+	}
+	return len(severityOrder)
+}
+
+// normalizeSeverity maps scanner spellings (CRITICAL, critical, ...) to the
+// capitalized form used in reports.
+func normalizeSeverity(s string) string {
+	if s == "" {
+		return "Unknown"
+	}
+	return strings.ToUpper(s[:1]) + strings.ToLower(s[1:])
+}
+
+func parseGrype(data []byte) ([]Vulnerability, error) {
+	var doc struct {
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+				Fix      struct {
+					Versions []string `json:"versions"`
+				} `json:"fix"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+				Type    string `json:"type"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	vulns := []Vulnerability{}
+	for _, m := range doc.Matches {
+		vulns = append(vulns, Vulnerability{
+			ID:       m.Vulnerability.ID,
+			Severity: normalizeSeverity(m.Vulnerability.Severity),
+			Package:  m.Artifact.Name,
+			Version:  m.Artifact.Version,
+			FixedIn:  strings.Join(m.Vulnerability.Fix.Versions, ", "),
+			Type:     m.Artifact.Type,
+		})
+	}
+	return vulns, nil
+}
+
+func parseTrivy(data []byte) ([]Vulnerability, error) {
+	var doc struct {
+		Results []struct {
+			Type            string `json:"Type"`
+			Vulnerabilities []struct {
+				VulnerabilityID  string `json:"VulnerabilityID"`
+				PkgName          string `json:"PkgName"`
+				InstalledVersion string `json:"InstalledVersion"`
+				FixedVersion     string `json:"FixedVersion"`
+				Severity         string `json:"Severity"`
+			} `json:"Vulnerabilities"`
+		} `json:"Results"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	vulns := []Vulnerability{}
+	for _, r := range doc.Results {
+		for _, v := range r.Vulnerabilities {
+			vulns = append(vulns, Vulnerability{
+				ID:       v.VulnerabilityID,
+				Severity: normalizeSeverity(v.Severity),
+				Package:  v.PkgName,
+				Version:  v.InstalledVersion,
+				FixedIn:  v.FixedVersion,
+				Type:     r.Type,
+			})
+		}
+	}
+	return vulns, nil
+}
@@ -0,0 +1,213 @@
+// Package secrets looks for credentials left in a target filesystem: secret
+// patterns in file contents (cloud keys, tokens, private keys) and files that
+// typically hold credentials (.env, kubeconfigs, SSH keys, ...). The search
+// itself runs inside a debug container with find and grep; this package builds
+// the script and interprets its output.
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule is a content pattern. Patterns are written in the common subset of
+// POSIX ERE (grep -E) and Go regexp syntax.
+type Rule struct {
+	ID          string
+	Description string
+	Pattern     string
+}
+
+// FileRule flags files by name or path (find -name / -path glob).
+type FileRule struct {
+	ID          string
+	Description string
+	Name        string // -name glob
+	Path        string // -path glob, used when Name is empty
+}
+
+// Rules are the content patterns searched for.
+var Rules = []Rule{
+	{"aws-access-key-id", "AWS access key ID", `(AKIA|ASIA)[A-Z0-9]{16}`},
+	{"aws-secret-access-key", "AWS secret access key", `aws_secret_access_key[[:space:]]*[=:][[:space:]]*["']?[A-Za-z0-9/+=]{40}`},
+	{"private-key", "Private key", `-----BEGIN ([A-Z]+ )?PRIVATE KEY-----`},
+	{"github-token", "GitHub token", `gh[pousr]_[A-Za-z0-9]{36}`},
+	{"gitlab-token", "GitLab personal access token", `glpat-[A-Za-z0-9_-]{20}`},
+	{"slack-token", "Slack token", `xox[baprs]-[A-Za-z0-9-]{10,}`},
+	{"google-api-key", "Google API key", `AIza[0-9A-Za-z_-]{35}`},
+	{"stripe-key", "Stripe live key", `(sk|rk)_live_[0-9a-zA-Z]{24,}`},
+	{"jwt", "JSON Web Token", `eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`},
+	{"kubeconfig-credentials", "Kubernetes client key or certificate", `(client-key-data|client-certificate-data):[[:space:]]*[A-Za-z0-9+/=]{20,}`},
+}
+
+// FileRules are the file names searched for.
+var FileRules = []FileRule{
+	{ID: "dotenv", Description: "Environment file", Name: ".env"},
+	{ID: "dotenv", Description: "Environment file", Name: ".env.*"},
+	{ID: "ssh-private-key", Description: "SSH private key", Name: "id_rsa"},
+	{ID: "ssh-private-key", Description: "SSH private key", Name: "id_dsa"},
+	{ID: "ssh-private-key", Description: "SSH private key", Name: "id_ecdsa"},
+	{ID: "ssh-private-key", Description: "SSH private key", Name: "id_ed25519"},
+	{ID: "kubeconfig", Description: "Kubernetes config", Name: "kubeconfig"},
+	{ID: "kubeconfig", Description: "Kubernetes config", Path: "*/.kube/config"},
+	{ID: "aws-credentials", Description: "AWS credentials file", Path: "*/.aws/credentials"},
+	{ID: "docker-config", Description: "Docker registry credentials", Path: "*/.docker/config.json"},
+	{ID: "git-credentials", Description: "Git credentials", Name: ".git-credentials"},
+	{ID: "netrc", Description: "netrc credentials", Name: ".netrc"},
+	{ID: "npmrc", Description: "npm config (may hold tokens)", Name: ".npmrc"},
+	{ID: "pypirc", Description: "PyPI credentials", Name: ".pypirc"},
+	{ID: "keystore", Description: "Key store", Name: "*.p12"},
+	{ID: "keystore", Description: "Key store", Name: "*.pfx"},
+	{ID: "keystore", Description: "Key store", Name: "*.jks"},
+}
+
+// maxFileSize bounds the files whose contents are searched.
+const maxFileSize = "5M"
+
+// Finding is a single match.
+type Finding struct {
+	Rule        string `json:"rule"`
+	Description string `json:"description"`
+	Path        string `json:"path"`
+	Line        int    `json:"line,omitempty"` // 0 for file name matches
+	Match       string `json:"match,omitempty"`
+}
+
+// Report lists the findings for a target.
+type Report struct {
+	Target   string    `json:"target"`
+	Redacted bool      `json:"redacted"`
+	Findings []Finding `json:"findings"`
+}
+
+// Script returns the shell script searching $DEBUX_TARGET_ROOT. File name
+// matches are printed as "FILE <rule> <path>", content matches in grep's
+// "-HnoZ" format: "<path>\0<line>:<match>". Virtual filesystems are skipped:
+// the root may be /proc/1/root of a live container.
+func Script() string {
+	var b strings.Builder
+	b.WriteString(`root="${DEBUX_TARGET_ROOT:-/target}"
+cd "$root" || exit 1
+prune='( -path ./proc -o -path ./sys -o -path ./dev ) -prune'
+find . $prune -o -type f \( `)
+	for i, r := range FileRules {
+		if i > 0 {
+			b.WriteString(" -o")
+		}
+		test, glob := "-name", r.Name
+		if glob == "" {
+			test, glob = "-path", r.Path
+		}
+		fmt.Fprintf(&b, " \\( %s %s -printf %s \\)", test, quote(glob), quote("FILE "+r.ID+" %p\\n"))
+	}
+	b.WriteString(" \\) 2>/dev/null\n")
+
+	fmt.Fprintf(&b, "find . $prune -o -type f -size -%s -print0 2>/dev/null | xargs -0 -r grep -HnoIEZ", maxFileSize)
+	for _, r := range Rules {
+		fmt.Fprintf(&b, " -e %s", quote(r.Pattern))
+	}
+	b.WriteString(" 2>/dev/null\nexit 0\n")
+	return b.String()
+}
+
+// Parse turns the script output into a report, sorted by path and line.
+// With redact, matched values are masked.
+func Parse(output []byte, redact bool) (*Report, error) {
+	compiled := make([]*regexp.Regexp, len(Rules))
+	for i, r := range Rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("compiling rule %s: %w", r.ID, err)
+		}
+		compiled[i] = re
+	}
+	fileRules := make(map[string]string)
+	for _, r := range FileRules {
+		fileRules[r.ID] = r.Description
+	}
+
+	report := &Report{Redacted: redact, Findings: []Finding{}}
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+
+		if rest, ok := strings.CutPrefix(line, "FILE "); ok {
+			id, path, ok := strings.Cut(rest, " ")
+			if !ok {
+				continue
+			}
+			report.Findings = append(report.Findings, Finding{
+				Rule:        id,
+				Description: fileRules[id],
+				Path:        cleanPath(path),
+			})
+			continue
+		}
+
+		path, rest, ok := strings.Cut(line, "\x00")
+		if !ok {
+			continue
+		}
+		num, match, ok := strings.Cut(rest, ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.Atoi(num)
+		for i, re := range compiled {
+			if !re.MatchString(match) {
+				continue
+			}
+			if redact {
+				match = Redact(match)
+			}
+			report.Findings = append(report.Findings, Finding{
+				Rule:        Rules[i].ID,
+				Description: Rules[i].Description,
+				Path:        cleanPath(path),
+				Line:        n,
+				Match:       match,
+			})
+			break
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(report.Findings, func(i, j int) bool {
+		a, b := report.Findings[i], report.Findings[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+	return report, nil
+}
+
+// Redact masks a secret, keeping a short prefix so findings stay
+// recognizable (e.g. "AKIA************").
+func Redact(s string) string {
+	keep := 4
+	if strings.HasPrefix(s, "-----BEGIN") {
+		return s // key headers carry no secret material
+	}
+	if len(s) <= keep {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:keep] + strings.Repeat("*", min(len(s)-keep, 12))
+}
+
+func cleanPath(p string) string {
+	return "/" + strings.TrimPrefix(p, "./")
+}
+
+// quote single-quotes a word for a POSIX shell.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
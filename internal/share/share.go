@@ -0,0 +1,314 @@
+// Package share streams a debug session to other terminals (debux share and
+// debux join).
+//
+// The sharing side listens on TLS with a throwaway self-signed certificate.
+// The join code carries a random token and the certificate's SHA-256
+// fingerprint, so participants authenticate the server without any PKI and
+// the server only admits holders of the code. Tokens are single-use unless
+// more participants are allowed.
+//
+// After the TLS handshake, the participant sends "DEBUX-SHARE <token>\n" and
+// the server answers "OK ro\n", "OK rw\n" or "ERR <reason>\n". The
+// connection then carries the raw terminal output of the session, and for rw
+// participants their keystrokes in the other direction.
+package share
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hello       = "DEBUX-SHARE "
+	viewerQueue = 256 // output chunks buffered per participant before it's dropped
+)
+
+// Server shares a session with participants.
+type Server struct {
+	ln          net.Listener
+	token       string
+	fingerprint []byte
+	readOnly    bool
+	// Notify reports participants joining and leaving; it may be nil.
+	Notify func(msg string)
+
+	mu      sync.Mutex
+	admits  int // remaining participants the token admits
+	viewers map[chan []byte]struct{}
+	input   chan []byte
+	closed  bool
+}
+
+// Listen starts sharing on addr (host:port). With readOnly, participants
+// only watch; otherwise their keystrokes go to the session too. The token
+// admits up to participants joins.
+func Listen(addr string, readOnly bool, participants int) (*Server, error) {
+	cert, fingerprint, err := selfSigned()
+	if err != nil {
+		return nil, fmt.Errorf("generating certificate: %w", err)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", addr, err)
+	}
+	s := &Server{
+		ln:          ln,
+		token:       base64.RawURLEncoding.EncodeToString(token),
+		fingerprint: fingerprint,
+		readOnly:    readOnly,
+		admits:      participants,
+		viewers:     make(map[chan []byte]struct{}),
+		input:       make(chan []byte, 64),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the listening address.
+func (s *Server) Addr() net.Addr { return s.ln.Addr() }
+
+// Code returns the join code: the token and the certificate fingerprint.
+func (s *Server) Code() string {
+	return s.token + "." + base64.RawURLEncoding.EncodeToString(s.fingerprint)
+}
+
+// Write sends session output to every participant. It never fails: a
+// participant that can't keep up is disconnected instead of slowing the
+// session down.
+func (s *Server) Write(p []byte) (int, error) {
+	chunk := append([]byte(nil), p...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v := range s.viewers {
+		select {
+		case v <- chunk:
+		default:
+			delete(s.viewers, v)
+			close(v)
+		}
+	}
+	return len(p), nil
+}
+
+// Input returns the keystrokes of rw participants.
+func (s *Server) Input() <-chan []byte { return s.input }
+
+// Close stops sharing and disconnects every participant.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for v := range s.viewers {
+			close(v)
+		}
+		s.viewers = nil
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
+
+func (s *Server) notify(format string, args ...any) {
+	if s.Notify != nil {
+		s.Notify(fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	token, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), hello)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		_, _ = fmt.Fprint(conn, "ERR invalid code\n")
+		s.notify("rejected a participant from %s (invalid code)", conn.RemoteAddr())
+		return
+	}
+
+	s.mu.Lock()
+	if s.closed || s.admits <= 0 {
+		s.mu.Unlock()
+		_, _ = fmt.Fprint(conn, "ERR code already used\n")
+		return
+	}
+	s.admits--
+	out := make(chan []byte, viewerQueue)
+	s.viewers[out] = struct{}{}
+	s.mu.Unlock()
+
+	mode := "rw"
+	if s.readOnly {
+		mode = "ro"
+	}
+	if _, err := fmt.Fprintf(conn, "OK %s\n", mode); err != nil {
+		return
+	}
+	if s.readOnly {
+		s.notify("%s joined (watching)", conn.RemoteAddr())
+	} else {
+		s.notify("%s joined (shared control)", conn.RemoteAddr())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 && !s.readOnly {
+				select {
+				case s.input <- append([]byte(nil), buf[:n]...):
+				default: // the session isn't reading input
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case chunk, ok := <-out:
+			if !ok {
+				s.notify("%s left", conn.RemoteAddr())
+				return
+			}
+			if _, err := conn.Write(chunk); err != nil {
+				s.drop(out)
+				s.notify("%s left", conn.RemoteAddr())
+				return
+			}
+		case <-done:
+			s.drop(out)
+			s.notify("%s left", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+// drop removes a participant's output queue.
+func (s *Server) drop(out chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[out]; ok {
+		delete(s.viewers, out)
+		close(out)
+	}
+}
+
+// Dial joins a shared session at addr with a join code. It returns the
+// connection, positioned at the start of the session stream, and whether the
+// participant may type.
+func Dial(addr, code string) (net.Conn, bool, error) {
+	token, fp, ok := strings.Cut(code, ".")
+	fingerprint, err := base64.RawURLEncoding.DecodeString(fp)
+	if !ok || token == "" || err != nil || len(fingerprint) != sha256.Size {
+		return nil, false, errors.New("invalid join code")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// The certificate is self-signed: it's pinned by the join code.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], fingerprint) != 1 {
+				return errors.New("certificate doesn't match the join code")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	if _, err := fmt.Fprintf(conn, "%s%s\n", hello, token); err != nil {
+		_ = conn.Close()
+		return nil, false, err
+	}
+
+	// Read the answer byte by byte so that no session output is buffered
+	// away from the returned connection.
+	var answer []byte
+	b := make([]byte, 1)
+	for len(answer) < 256 {
+		if _, err := conn.Read(b); err != nil {
+			_ = conn.Close()
+			return nil, false, fmt.Errorf("joining session: %w", err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		answer = append(answer, b[0])
+	}
+	switch reply := string(answer); {
+	case reply == "OK rw":
+		return conn, true, nil
+	case reply == "OK ro":
+		return conn, false, nil
+	default:
+		_ = conn.Close()
+		return nil, false, fmt.Errorf("joining session: %s", strings.TrimPrefix(reply, "ERR "))
+	}
+}
+
+// selfSigned generates a certificate for this sharing session only.
+func selfSigned() (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, sum[:], nil
+}
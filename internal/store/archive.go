@@ -0,0 +1,247 @@
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveDirs are the directories under /nix held by the store volumes.
+var archiveDirs = []string{"store", "var"}
+
+// Export writes the named store (both volumes) to a tar archive at file,
+// compressed with zstd or gzip when the name ends in .zst or .gz.
+func Export(ctx context.Context, debugImage, name, file string) (err error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	id, err := createMaintenance(ctx, cli, maintenance{DebugImage: debugImage, Store: name, Task: "export", Script: "true"})
+	if err != nil {
+		return err
+	}
+	defer removeMaintenance(cli, id)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(file)
+		}
+	}()
+
+	cw, err := compressor(f, file)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	for _, dir := range archiveDirs {
+		fmt.Printf("Exporting /nix/%s...\n", dir)
+		if err := copyFromMaintenance(ctx, cli, id, "/nix/"+dir, tw); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	if fi, err := f.Stat(); err == nil {
+		fmt.Printf("Store exported to %s (%s)\n", file, units.HumanSize(float64(fi.Size())))
+	}
+	return nil
+}
+
+// Import loads a store archive written by Export into the named store's
+// volumes. An existing store is only overwritten with replace, since the
+// archive's Nix database supersedes the local one.
+func Import(ctx context.Context, debugImage, name, file string, replace bool) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if _, err := cli.VolumeInspect(ctx, StoreVolume(name)); err == nil {
+		if !replace {
+			return fmt.Errorf("a store already exists; use --replace to overwrite it")
+		}
+		active, err := activeSessions(ctx, cli, name)
+		if err != nil {
+			return err
+		}
+		if len(active) > 0 {
+			return fmt.Errorf("the store is in use by %s; stop those sessions first", strings.Join(active, ", "))
+		}
+		// A corrupt or truncated archive leaves the store as it was
+		if err := verifyArchive(file); err != nil {
+			return err
+		}
+		for _, vol := range Volumes(name) {
+			if err := cli.VolumeRemove(ctx, vol, true); err != nil {
+				return fmt.Errorf("removing volume %s: %w", vol, err)
+			}
+		}
+	}
+
+	f, r, err := openArchive(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	id, err := createMaintenance(ctx, cli, maintenance{DebugImage: debugImage, Store: name, Task: "import", Script: "true"})
+	if err != nil {
+		return err
+	}
+	defer removeMaintenance(cli, id)
+
+	fmt.Printf("Importing %s...\n", file)
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(checkArchive(r, pw)) }()
+	if err := cli.CopyToContainer(ctx, id, "/nix", pr, container.CopyToContainerOptions{}); err != nil {
+		_ = pr.CloseWithError(err)
+		return fmt.Errorf("importing store: %w", err)
+	}
+	fmt.Println("Store imported.")
+	return nil
+}
+
+// openArchive opens a store archive, decompressed.
+func openArchive(file string) (*os.File, io.Reader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := decompressor(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	return f, r, nil
+}
+
+// verifyArchive reads a whole store archive, to refuse a corrupt, truncated
+// or empty one before the store it replaces is removed.
+func verifyArchive(file string) error {
+	f, r, err := openArchive(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := checkArchive(r, io.Discard); err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	// Past the end of the tar archive: the checksum of gzip streams
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	return nil
+}
+
+// copyFromMaintenance appends the tar of path in the container to tw.
+func copyFromMaintenance(ctx context.Context, cli *client.Client, id, p string, tw *tar.Writer) error {
+	rc, _, err := cli.CopyFromContainer(ctx, id, p)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", p, err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", p, err)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkArchive copies a store archive from r to w, rejecting entries outside
+// store/ and var/, and empty archives.
+func checkArchive(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF && entries == 0 {
+			return fmt.Errorf("empty archive: not a debux store archive")
+		}
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("reading archive: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		top, _, _ := strings.Cut(name, "/")
+		if (top != "store" && top != "var") || strings.HasPrefix(name, "/") {
+			return fmt.Errorf("unexpected entry %q: not a debux store archive", hdr.Name)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressor picks the compression from the archive file name.
+func compressor(w io.Writer, file string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(file, ".zst"), strings.HasSuffix(file, ".zstd"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(file, ".gz"), strings.HasSuffix(file, ".tgz"):
+		return gzip.NewWriter(w), nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// decompressor detects zstd and gzip archives from their magic bytes.
+func decompressor(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return zstd.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	default:
+		return br, nil
+	}
+}
@@ -0,0 +1,119 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storeArchive returns a store archive with the given entries, compressed
+// after the file name as Export does.
+func storeArchive(t *testing.T, file string, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw, err := compressor(&buf, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(cw)
+	for _, name := range names {
+		body := "x"
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o444, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyArchive(t *testing.T) {
+	entries := []string{"store/abc-hello/bin/hello", "var/nix/db/db.sqlite"}
+	tests := []struct {
+		name string
+		file string
+		data func(t *testing.T, file string) []byte
+		err  string
+	}{
+		{
+			name: "tar",
+			file: "store.tar",
+			data: func(t *testing.T, file string) []byte { return storeArchive(t, file, entries...) },
+		},
+		{
+			name: "gzip",
+			file: "store.tar.gz",
+			data: func(t *testing.T, file string) []byte { return storeArchive(t, file, entries...) },
+		},
+		{
+			name: "zstd",
+			file: "store.tar.zst",
+			data: func(t *testing.T, file string) []byte { return storeArchive(t, file, entries...) },
+		},
+		{
+			name: "truncated gzip",
+			file: "store.tar.gz",
+			data: func(t *testing.T, file string) []byte {
+				data := storeArchive(t, file, entries...)
+				return data[:len(data)-4]
+			},
+			err: "unexpected EOF",
+		},
+		{
+			name: "corrupt zstd",
+			file: "store.tar.zst",
+			data: func(t *testing.T, file string) []byte {
+				data := storeArchive(t, file, entries...)
+				data[len(data)/2] ^= 0xff
+				return data
+			},
+			err: "store.tar.zst: ",
+		},
+		{
+			name: "not a store archive",
+			file: "store.tar",
+			data: func(t *testing.T, file string) []byte { return storeArchive(t, file, "etc/passwd") },
+			err:  `unexpected entry "etc/passwd": not a debux store archive`,
+		},
+		{
+			name: "empty",
+			file: "store.tar.gz",
+			data: func(t *testing.T, file string) []byte { return storeArchive(t, file) },
+			err:  "empty archive",
+		},
+		{
+			name: "not an archive",
+			file: "store.tar",
+			data: func(*testing.T, string) []byte { return []byte(strings.Repeat("not a tar file\n", 100)) },
+			err:  "invalid tar header",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, tt.data(t, tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := verifyArchive(file)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("verifyArchive() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// GCOpts configures a garbage collection of the store.
+type GCOpts struct {
+	DebugImage string
+	KeepLast   int   // dctl profile generations to keep (0 = all)
+	MaxSize    int64 // only free enough to get under this size in bytes (0 = free everything unreferenced)
+	Force      bool  // run even while debug sessions use the store
+	Store      string
+}
+
+// GC removes store paths no longer referenced by any profile generation. It
+// first drops old generations of the dctl profile, keeping the last
+// opts.KeepLast, so packages removed with "dctl remove" become collectable.
+func GC(ctx context.Context, opts GCOpts) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	if !opts.Force {
+		active, err := activeSessions(ctx, cli, opts.Store)
+		if err != nil {
+			return err
+		}
+		if len(active) > 0 {
+			return fmt.Errorf("the store is in use by %s; stop those sessions first or use --force", strings.Join(active, ", "))
+		}
+	}
+
+	return runMaintenance(ctx, cli, maintenance{DebugImage: opts.DebugImage, Store: opts.Store, Task: "gc", Script: gcScript(opts)}, os.Stdout)
+}
+
+func gcScript(opts GCOpts) string {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	if opts.KeepLast > 0 {
+		fmt.Fprintf(&b, `if [ -e %[1]s ]; then
+  echo "Keeping the last %[2]d generation(s) of the dctl profile"
+  nix-env --profile %[1]s --delete-generations +%[2]d
+fi
+`, ProfilePath, opts.KeepLast)
+	}
+	b.WriteString(`size() { du -sb /nix/store | cut -f1; }
+before=$(size)
+`)
+	if opts.MaxSize > 0 {
+		fmt.Fprintf(&b, `excess=$((before - %d))
+if [ "$excess" -le 0 ]; then
+  echo "Store size $(du -sh /nix/store | cut -f1) is already under the limit"
+  exit 0
+fi
+nix-store --gc --max-freed "$excess"
+`, opts.MaxSize)
+	} else {
+		b.WriteString("nix-store --gc\n")
+	}
+	b.WriteString(`after=$(size)
+echo "Freed $(( (before - after) / 1048576 )) MB, store is now $(( after / 1048576 )) MB"
+`)
+	return b.String()
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// Summary describes one named store.
+type Summary struct {
+	Name     string
+	Size     int64 // bytes used by both volumes, -1 when unknown
+	Sessions int64 // containers using the store, -1 when unknown
+}
+
+// List returns the existing stores, sorted by name.
+func List(ctx context.Context) ([]Summary, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	du, err := cli.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.VolumeObject}})
+	if err != nil {
+		return nil, fmt.Errorf("listing volumes: %w", err)
+	}
+
+	stores := make(map[string]*Summary)
+	for _, v := range du.Volumes {
+		if !meta.IsManaged(v.Labels) {
+			continue
+		}
+		name, isStore := v.Labels[nameLabel], strings.HasPrefix(v.Name, NixStoreVolume)
+		if name == "" {
+			name = storeNameFromVolume(v.Name)
+		}
+		if name == "" {
+			continue
+		}
+		s, ok := stores[name]
+		if !ok {
+			s = &Summary{Name: name, Sessions: -1}
+			stores[name] = s
+		}
+		if v.UsageData == nil || v.UsageData.Size < 0 || s.Size < 0 {
+			s.Size = -1
+		} else {
+			s.Size += v.UsageData.Size
+		}
+		if isStore && v.UsageData != nil {
+			s.Sessions = v.UsageData.RefCount
+		}
+	}
+
+	list := make([]Summary, 0, len(stores))
+	for _, s := range stores {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// storeNameFromVolume recovers the store name of volumes created before
+// stores were labeled with their name.
+func storeNameFromVolume(vol string) string {
+	for _, base := range []string{NixStoreVolume, NixVarVolume} {
+		if vol == base {
+			return DefaultName
+		}
+		if name, ok := strings.CutPrefix(vol, base+"-"); ok {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	dbximage "github.com/clement-tourriere/debux/internal/image"
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// ProfilePath is the Nix profile holding packages installed with dctl.
+const ProfilePath = "/nix/var/debux-profile"
+
+// prefetchPath is the profile filled by "debux store prefetch" (see dctl).
+const prefetchPath = "/nix/var/debux-prefetch"
+
+// maintenance describes a helper container working on a store.
+type maintenance struct {
+	DebugImage string
+	Store      string // store name
+	Task       string // short name used in the container name and errors
+	Script     string
+	Env        []string
+}
+
+// activeSessions returns the names of containers currently using the named
+// store.
+func activeSessions(ctx context.Context, cli *client.Client, name string) ([]string, error) {
+	list, err := cli.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("volume", StoreVolume(name))),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	var names []string
+	for _, c := range list {
+		if len(c.Names) > 0 {
+			names = append(names, strings.TrimPrefix(c.Names[0], "/"))
+		}
+	}
+	return names, nil
+}
+
+// runMaintenance runs a maintenance script in a throwaway container from the
+// debug image with the store volumes mounted, streaming its standard output to
+// stdout. Used for work on the store that must happen with Nix itself (garbage
+// collection, prefetching, usage reports).
+func runMaintenance(ctx context.Context, cli *client.Client, m maintenance, stdout io.Writer) error {
+	id, err := createMaintenance(ctx, cli, m)
+	if err != nil {
+		return err
+	}
+	defer removeMaintenance(cli, id)
+
+	if err := cli.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+		return fmt.Errorf("starting maintenance container: %w", err)
+	}
+
+	logs, err := cli.ContainerLogs(ctx, id, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return fmt.Errorf("reading maintenance container output: %w", err)
+	}
+	defer func() { _ = logs.Close() }()
+	_, _ = stdcopy.StdCopy(stdout, os.Stderr, logs)
+
+	statusCh, errCh := cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("waiting for maintenance container: %w", err)
+	case st := <-statusCh:
+		if st.StatusCode != 0 {
+			return fmt.Errorf("store %s failed (exit code %d)", m.Task, st.StatusCode)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// createMaintenance creates (without starting) a container from the debug
+// image with the store volumes mounted at /nix/store and /nix/var.
+func createMaintenance(ctx context.Context, cli *client.Client, m maintenance) (string, error) {
+	if err := dbximage.EnsureImage(ctx, cli, m.DebugImage, ""); err != nil {
+		return "", fmt.Errorf("ensuring debug image: %w", err)
+	}
+	if err := EnsureVolumes(ctx, cli, m.Store); err != nil {
+		return "", fmt.Errorf("ensuring store volumes: %w", err)
+	}
+
+	name := fmt.Sprintf("debux-store-%s-%d", m.Task, time.Now().Unix())
+	resp, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Image:      m.DebugImage,
+			Entrypoint: []string{"/bin/sh", "-c"},
+			Cmd:        []string{m.Script},
+			Env:        m.Env,
+			Labels:     meta.Labels(meta.KindMaintenance, ""),
+		},
+		&container.HostConfig{
+			Mounts: []mount.Mount{
+				{Type: mount.TypeVolume, Source: StoreVolume(m.Store), Target: "/nix/store"},
+				{Type: mount.TypeVolume, Source: VarVolume(m.Store), Target: "/nix/var"},
+			},
+		}, nil, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("creating maintenance container: %w", err)
+	}
+	return resp.ID, nil
+}
+
+func removeMaintenance(cli *client.Client, id string) {
+	_ = cli.ContainerRemove(context.Background(), id, container.RemoveOptions{Force: true})
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/docker/docker/client"
+
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/entrypoint"
+)
+
+// Presets are named package sets for "debux store prefetch --preset".
+var Presets = map[string][]string{
+	"network": {"mtr", "iperf3", "socat", "netcat-gnu", "traceroute", "ethtool", "wireshark-cli"},
+	"k8s":     {"kubectl", "k9s", "stern", "kubectx"},
+	"db":      {"postgresql", "mariadb", "redis", "sqlite"},
+	"perf":    {"sysstat", "bpftrace", "iotop"},
+}
+
+// PresetNames returns the preset names, sorted.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Prefetch downloads packages into the named store ahead of time. They
+// are kept in a dedicated profile (so gc leaves them alone) that "dctl
+// install" picks from before going to the network, which lets sessions in
+// air-gapped environments install them without internet access. Packages are
+// fetched through the binary caches configured in nix.
+func Prefetch(ctx context.Context, debugImage, name string, nix config.Nix, pkgs []string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	script := entrypoint.Dctl(append([]string{"prefetch"}, pkgs...)...)
+	return runMaintenance(ctx, cli, maintenance{DebugImage: debugImage, Store: name, Task: "prefetch", Script: script, Env: nix.Env()}, os.Stdout)
+}
+
+// Search looks up packages matching query with "dctl search", in a
+// maintenance container of the named store.
+func Search(ctx context.Context, debugImage, name string, nix config.Nix, query string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("connecting to Docker: %w", err)
+	}
+	defer func() { _ = cli.Close() }()
+
+	return runMaintenance(ctx, cli, maintenance{DebugImage: debugImage, Store: name, Task: "search", Script: entrypoint.Dctl("search", query), Env: nix.Env()}, os.Stdout)
+}
@@ -1,91 +1,170 @@
 package store
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"fmt"
+	"os"
+	"regexp"
+	"text/tabwriter"
 
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+
+	"github.com/clement-tourriere/debux/internal/meta"
 )
 
+// DefaultName is the store used when no --store-name is given. It keeps the
+// original volume names, so existing stores carry over.
+const DefaultName = "default"
+
 const (
 	NixStoreVolume = "debux-nix-store"
 	NixVarVolume   = "debux-nix-var"
 )
 
-// Volumes returns the list of volume names managed by debux.
-func Volumes() []string {
-	return []string{NixStoreVolume, NixVarVolume}
+// nameLabel records the store name on its volumes.
+const nameLabel = "debux.store"
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ValidateName checks that a store name can be used in volume names.
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid store name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// StoreVolume returns the name of the named store's /nix/store volume.
+func StoreVolume(name string) string {
+	return volumeName(NixStoreVolume, name)
+}
+
+// VarVolume returns the name of the named store's /nix/var volume.
+func VarVolume(name string) string {
+	return volumeName(NixVarVolume, name)
+}
+
+func volumeName(base, name string) string {
+	if name == "" || name == DefaultName {
+		return base
+	}
+	return base + "-" + name
+}
+
+// Volumes returns the volume names of the named store.
+func Volumes(name string) []string {
+	return []string{StoreVolume(name), VarVolume(name)}
 }
 
-// EnsureVolumes creates the persistent Nix volumes if they don't exist.
-func EnsureVolumes(ctx context.Context, cli *client.Client) error {
-	for _, name := range Volumes() {
-		if err := ensureVolume(ctx, cli, name); err != nil {
+// EnsureVolumes creates the named store's persistent Nix volumes if they
+// don't exist.
+func EnsureVolumes(ctx context.Context, cli *client.Client, name string) error {
+	for _, vol := range Volumes(name) {
+		if err := ensureVolume(ctx, cli, vol, name); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func ensureVolume(ctx context.Context, cli *client.Client, name string) error {
-	_, err := cli.VolumeInspect(ctx, name)
+func ensureVolume(ctx context.Context, cli *client.Client, vol, name string) error {
+	_, err := cli.VolumeInspect(ctx, vol)
 	if err == nil {
 		return nil
 	}
 
 	_, err = cli.VolumeCreate(ctx, volume.CreateOptions{
-		Name:   name,
-		Labels: map[string]string{"managed-by": "debux"},
+		Name:   vol,
+		Labels: storeLabels(name),
 	})
 	if err != nil {
-		return fmt.Errorf("creating volume %s: %w", name, err)
+		return fmt.Errorf("creating volume %s: %w", vol, err)
 	}
 	return nil
 }
 
-// Clean removes the persistent Nix volumes.
-func Clean(ctx context.Context) error {
+// Clean removes the named store's persistent Nix volumes.
+func Clean(ctx context.Context, name string) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("connecting to Docker: %w", err)
 	}
 	defer func() { _ = cli.Close() }()
 
-	for _, name := range Volumes() {
-		if err := cli.VolumeRemove(ctx, name, true); err != nil {
-			return fmt.Errorf("removing volume %s: %w", name, err)
+	for _, vol := range Volumes(name) {
+		if err := cli.VolumeRemove(ctx, vol, true); err != nil {
+			return fmt.Errorf("removing volume %s: %w", vol, err)
 		}
 	}
 	return nil
 }
 
-// Info prints information about the persistent Nix volumes.
-func Info(ctx context.Context) error {
+// Info prints information about the named store's persistent Nix volumes
+// and, using a short-lived helper container, what takes up space in them:
+// installed packages with their closure sizes and profile generations.
+func Info(ctx context.Context, debugImage, name string) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return fmt.Errorf("connecting to Docker: %w", err)
 	}
 	defer func() { _ = cli.Close() }()
 
-	f := filters.NewArgs(filters.Arg("label", "managed-by=debux"))
-	list, err := cli.VolumeList(ctx, volume.ListOptions{Filters: f})
-	if err != nil {
-		return fmt.Errorf("listing volumes: %w", err)
+	var vols []*volume.Volume
+	for _, vol := range Volumes(name) {
+		v, err := cli.VolumeInspect(ctx, vol)
+		if err != nil {
+			continue
+		}
+		vols = append(vols, &v)
 	}
 
-	if len(list.Volumes) == 0 {
-		fmt.Println("No debux store volumes found.")
+	if len(vols) == 0 {
+		fmt.Printf("No debux store volumes found for store %q.\n", cmp.Or(name, DefaultName))
 		return nil
 	}
 
-	fmt.Println("debux store volumes:")
-	for _, v := range list.Volumes {
+	fmt.Printf("debux store %q volumes:\n", cmp.Or(name, DefaultName))
+	for _, v := range vols {
 		fmt.Printf("  %s (driver: %s, mountpoint: %s)\n", v.Name, v.Driver, v.Mountpoint)
 		if v.UsageData != nil {
 			fmt.Printf("    size: %d MB, ref count: %d\n", v.UsageData.Size/(1024*1024), v.UsageData.RefCount)
 		}
 	}
+
+	var out bytes.Buffer
+	if err := runMaintenance(ctx, cli, maintenance{DebugImage: debugImage, Store: name, Task: "info", Script: usageScript}, &out); err != nil {
+		return err
+	}
+	u := parseUsage(out.Bytes())
+
+	fmt.Printf("\nStore size: %s (debug image tools: %s)\n", units.HumanSize(float64(u.StoreSize)), units.HumanSize(float64(u.BaseSize)))
+	for _, p := range u.Profiles {
+		fmt.Printf("\n%s:\n", profileLabel(p.Path))
+		if len(p.Packages) == 0 {
+			fmt.Println("  (no packages)")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, pkg := range p.Packages {
+			_, _ = fmt.Fprintf(w, "  %s\t%s\n", pkg.Name, units.HumanSize(float64(pkg.ClosureSize)))
+		}
+		_ = w.Flush()
+		if len(p.Generations) > 0 {
+			fmt.Printf("  generations:\n")
+			for _, g := range p.Generations {
+				fmt.Printf("    %s\n", g)
+			}
+		}
+	}
 	return nil
 }
+
+// storeLabels returns the labels of a new store volume.
+func storeLabels(name string) map[string]string {
+	labels := meta.Labels(meta.KindStore, "")
+	labels[nameLabel] = cmp.Or(name, DefaultName)
+	return labels
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Usage breaks down what the persistent store holds.
+type Usage struct {
+	StoreSize int64          // total size of /nix/store
+	BaseSize  int64          // closure size of the debug image's own tools
+	Profiles  []ProfileUsage // dctl and prefetch profiles
+}
+
+// ProfileUsage lists a profile's generations and packages.
+type ProfileUsage struct {
+	Path        string
+	Generations []string // as printed by nix-env --list-generations
+	Packages    []PackageUsage
+}
+
+// PackageUsage is an installed package and its closure size. Closures of
+// different packages overlap, so sizes don't add up to the store size.
+type PackageUsage struct {
+	Name        string
+	ClosureSize int64
+}
+
+// usageScript prints one record per line: "STORE <bytes>", "BASE <bytes>",
+// "PROFILE <path>", "GEN <generation line>" and "PKG <name> <closure bytes>".
+var usageScript = `closure() { nix path-info -S "$@" 2>/dev/null | awk '{ s += $2 } END { print s + 0 }'; }
+echo "STORE $(du -sb /nix/store | cut -f1)"
+echo "BASE $(closure "$(readlink -f /root/.nix-profile)")"
+for p in ` + ProfilePath + ` ` + prefetchPath + `; do
+  [ -e "$p/manifest.json" ] || continue
+  echo "PROFILE $p"
+  nix-env --profile "$p" --list-generations 2>/dev/null | sed 's/^ */GEN /'
+  jq -r '.elements | to_entries[] | "\(.key) \(.value.storePaths | join(" "))"' "$p/manifest.json" |
+  while read -r name paths; do
+    # shellcheck disable=SC2086
+    echo "PKG $name $(closure $paths)"
+  done
+done
+`
+
+func parseUsage(output []byte) *Usage {
+	u := &Usage{}
+	var cur *ProfileUsage
+	sc := bufio.NewScanner(bytes.NewReader(output))
+	for sc.Scan() {
+		kind, rest, _ := strings.Cut(sc.Text(), " ")
+		switch kind {
+		case "STORE":
+			u.StoreSize, _ = strconv.ParseInt(rest, 10, 64)
+		case "BASE":
+			u.BaseSize, _ = strconv.ParseInt(rest, 10, 64)
+		case "PROFILE":
+			u.Profiles = append(u.Profiles, ProfileUsage{Path: rest})
+			cur = &u.Profiles[len(u.Profiles)-1]
+		case "GEN":
+			if cur != nil {
+				cur.Generations = append(cur.Generations, strings.TrimSpace(rest))
+			}
+		case "PKG":
+			if cur == nil {
+				continue
+			}
+			name, size, _ := strings.Cut(rest, " ")
+			n, _ := strconv.ParseInt(size, 10, 64)
+			cur.Packages = append(cur.Packages, PackageUsage{Name: name, ClosureSize: n})
+		}
+	}
+	for i := range u.Profiles {
+		pkgs := u.Profiles[i].Packages
+		sort.SliceStable(pkgs, func(a, b int) bool { return pkgs[a].ClosureSize > pkgs[b].ClosureSize })
+	}
+	return u
+}
+
+func profileLabel(path string) string {
+	switch path {
+	case ProfilePath:
+		return fmt.Sprintf("Installed with dctl (%s)", path)
+	case prefetchPath:
+		return fmt.Sprintf("Prefetched (%s)", path)
+	}
+	return path
+}
@@ -0,0 +1,318 @@
+// Package telemetry is the monitoring of long-lived debux processes (debux
+// daemon and debux serve): Prometheus metrics of the sessions, debug
+// containers, image pulls and API requests, derived from lifecycle events,
+// and OpenTelemetry traces of the phases of session setup.
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/events"
+)
+
+// Buckets of the duration histograms, in seconds.
+var (
+	sessionBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400}
+	pullBuckets    = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	requestBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// Metrics are the Prometheus metrics of a debux process, served in the text
+// exposition format by Handler. Labels never carry target names, which
+// would make series grow with every pod.
+type Metrics struct {
+	mu      sync.Mutex
+	metrics []*metric
+	byName  map[string]*metric
+
+	sessions map[string][]time.Time // start of the open sessions, by target and container
+	pulls    map[string]time.Time   // start of the running pulls, by image and platform
+}
+
+// NewMetrics returns the metrics of the lifecycle events emitted from now on.
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: map[string]*metric{}, sessions: map[string][]time.Time{}, pulls: map[string]time.Time{}}
+	m.define("debux_sessions_started_total", "Debug shells and commands started.", "counter", nil, "runtime")
+	m.define("debux_sessions_ended_total", "Debug shells and commands ended, by result: ok, exit-code (non-zero) or error.", "counter", nil, "runtime", "result")
+	m.define("debux_session_duration_seconds", "Duration of debug shells and commands.", "histogram", sessionBuckets, "runtime")
+	m.define("debux_failures_total", "Failed operations, by operation and reason.", "counter", nil, "operation", "reason")
+	m.define("debux_containers_created_total", "Debug containers and pods created.", "counter", nil, "runtime")
+	m.define("debux_containers_reused_total", "Running debug containers reused.", "counter", nil, "runtime")
+	m.define("debux_container_waiting_total", "Debug containers seen waiting to start, by reason (Kubernetes).", "counter", nil, "reason")
+	m.define("debux_cleanups_total", "Debug containers and pods removed or stopped.", "counter", nil, "runtime")
+	m.define("debux_image_pulls_started_total", "Image pulls started.", "counter", nil)
+	m.define("debux_image_pull_duration_seconds", "Duration of the image pulls that succeeded.", "histogram", pullBuckets)
+	m.define("debux_api_requests_total", "API requests, by operation and HTTP status code.", "counter", nil, "operation", "code")
+	m.define("debux_api_request_duration_seconds", "Duration of API requests, streamed output included.", "histogram", requestBuckets, "operation")
+	events.Subscribe(m.observe)
+	return m
+}
+
+// observe updates the metrics with a lifecycle event.
+func (m *Metrics) observe(e events.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rt := runtimeOf(e.Target)
+	switch e.Type {
+	case events.SessionStarted:
+		key := e.Target + "\x00" + e.Container
+		m.sessions[key] = append(m.sessions[key], e.Time)
+		m.add("debux_sessions_started_total", 1, rt)
+	case events.SessionEnded:
+		result := "ok"
+		switch {
+		case e.Error != "":
+			result = "error"
+			m.add("debux_failures_total", 1, "session", Reason(e.Error))
+		case e.ExitCode != nil && *e.ExitCode != 0:
+			result = "exit-code"
+		}
+		m.add("debux_sessions_ended_total", 1, rt, result)
+		key := e.Target + "\x00" + e.Container
+		if started := m.sessions[key]; len(started) > 0 {
+			m.observeDuration("debux_session_duration_seconds", e.Time.Sub(started[0]), rt)
+			if m.sessions[key] = started[1:]; len(m.sessions[key]) == 0 {
+				delete(m.sessions, key)
+			}
+		}
+	case events.ContainerCreated:
+		m.add("debux_containers_created_total", 1, rt)
+	case events.ContainerReused:
+		m.add("debux_containers_reused_total", 1, rt)
+	case events.WaitingReason:
+		m.add("debux_container_waiting_total", 1, e.Reason)
+	case events.Cleanup:
+		m.add("debux_cleanups_total", 1, rt)
+	case events.ImagePull:
+		m.pulls[e.Image+"\x00"+e.Platform] = e.Time
+		m.add("debux_image_pulls_started_total", 1)
+	case events.ImagePulled:
+		key := e.Image + "\x00" + e.Platform
+		if started, ok := m.pulls[key]; ok {
+			m.observeDuration("debux_image_pull_duration_seconds", e.Time.Sub(started))
+			delete(m.pulls, key)
+		}
+	}
+}
+
+// Failure counts a failed operation, e.g. a browser shell of debux serve
+// that couldn't start.
+func (m *Metrics) Failure(operation string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add("debux_failures_total", 1, operation, Reason(err.Error()))
+}
+
+// Instrument counts the requests h serves, by the pattern of their route
+// (e.g. "POST /v1/exec"), with their status code and duration. Server
+// errors, and streams ended by a Debux-Error trailer, are failures too.
+func (m *Metrics) Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		op := r.Pattern
+		if op == "" {
+			op = "other"
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.add("debux_api_requests_total", 1, op, strconv.Itoa(rec.code))
+		m.observeDuration("debux_api_request_duration_seconds", time.Since(start), op)
+		switch msg := rec.Header().Get("Debux-Error"); {
+		case rec.code >= 500:
+			m.add("debux_failures_total", 1, op, Reason(rec.body.String()))
+		case msg != "":
+			m.add("debux_failures_total", 1, op, Reason(msg))
+		}
+	})
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(w)
+	})
+}
+
+// Reason sorts an error message into the reasons of debux_failures_total,
+// from its wording, since errors come from Docker, Kubernetes, registries
+// and the policy alike.
+func Reason(msg string) string {
+	msg = strings.ToLower(msg)
+	switch {
+	case msg == "":
+		return "unknown"
+	case strings.Contains(msg, "context canceled"):
+		return "canceled"
+	case strings.Contains(msg, "deadline exceeded"), strings.Contains(msg, "timed out"), strings.Contains(msg, "timeout"):
+		return "timeout"
+	case strings.Contains(msg, "offline"):
+		return "offline"
+	case strings.Contains(msg, "denied"), strings.Contains(msg, "forbidden"), strings.Contains(msg, "unauthorized"), strings.Contains(msg, "approval"):
+		return "denied"
+	case strings.Contains(msg, "pull"), strings.Contains(msg, "manifest unknown"):
+		return "image-pull"
+	case strings.Contains(msg, "not found"), strings.Contains(msg, "no such"), strings.Contains(msg, "not running"):
+		return "not-found"
+	case strings.Contains(msg, "connecting to"), strings.Contains(msg, "cannot connect"), strings.Contains(msg, "connection refused"):
+		return "unreachable"
+	}
+	return "other"
+}
+
+// runtimeOf returns the runtime label of a target.
+func runtimeOf(target string) string {
+	switch {
+	case strings.HasPrefix(target, "k8s://"):
+		return "kubernetes"
+	case strings.HasPrefix(target, "containerd://"), strings.HasPrefix(target, "nerdctl://"):
+		return "containerd"
+	case target == "":
+		return "unknown"
+	}
+	return "docker"
+}
+
+// metric is a counter or histogram, with its series by label values.
+type metric struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+	series          map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64  // counters
+	counts []uint64 // histograms, by bucket, cumulated on output
+	sum    float64
+	count  uint64
+}
+
+func (m *Metrics) define(name, help, typ string, buckets []float64, labels ...string) {
+	mt := &metric{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*series{}}
+	m.metrics = append(m.metrics, mt)
+	m.byName[name] = mt
+}
+
+// get returns the series of a metric with these label values, m.mu held.
+func (m *Metrics) get(name string, values []string) *series {
+	mt := m.byName[name]
+	key := strings.Join(values, "\x00")
+	s, ok := mt.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(mt.buckets))}
+		mt.series[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) add(name string, v float64, values ...string) {
+	m.get(name, values).value += v
+}
+
+func (m *Metrics) observeDuration(name string, d time.Duration, values ...string) {
+	v := max(d.Seconds(), 0)
+	s := m.get(name, values)
+	for i, b := range m.byName[name].buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// write prints the metrics in the Prometheus text format.
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mt := range m.metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		keys := make([]string, 0, len(mt.series))
+		for k := range mt.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := mt.series[k]
+			if mt.typ == "counter" {
+				fmt.Fprintf(w, "%s%s %s\n", mt.name, labelSet(mt.labels, s.values, "", ""), formatValue(s.value))
+				continue
+			}
+			var cumulated uint64
+			for i, b := range mt.buckets {
+				cumulated += s.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", mt.name, labelSet(mt.labels, s.values, "le", formatValue(b)), cumulated)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", mt.name, labelSet(mt.labels, s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", mt.name, labelSet(mt.labels, s.values, "", ""), formatValue(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", mt.name, labelSet(mt.labels, s.values, "", ""), s.count)
+		}
+	}
+}
+
+// labelSet formats {name="value",...}, with an extra label if given.
+func labelSet(names, values []string, extra, extraValue string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, n+"="+strconv.Quote(values[i]))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusRecorder keeps the status code of a response, and the start of the
+// body of errors, which holds their message.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	body strings.Builder
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.code >= 500 && r.body.Len() < 1024 {
+		r.body.Write(p[:min(len(p), 1024-r.body.Len())])
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush streams exec output and bundles as the API does without metrics.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController the response underneath.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,84 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/clement-tourriere/debux/internal/meta"
+)
+
+// tracerName is the instrumentation scope of debux's spans.
+const tracerName = "github.com/clement-tourriere/debux"
+
+// StartTracing exports spans over OTLP/HTTP to endpoint (e.g.
+// http://otel-collector:4318), or else to $OTEL_EXPORTER_OTLP_ENDPOINT or
+// $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT. Without any, spans are dropped and
+// shutdown does nothing. shutdown flushes the spans not exported yet.
+func StartTracing(ctx context.Context, endpoint, service string) (shutdown func(context.Context) error, err error) {
+	if endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid --otlp-endpoint %q: expected http(s)://host:port[/path]", endpoint)
+		}
+		if strings.Trim(u.Path, "/") == "" {
+			u.Path = "/v1/traces"
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(u.String()))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("setting up the OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(service), semconv.ServiceVersion(meta.BuildVersion())))
+	if err != nil {
+		res = resource.Default()
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of a phase of debux, e.g. "debux.debug-container",
+// as a child of the span of ctx, if any. Without StartTracing, spans cost
+// next to nothing.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span with the outcome of its phase.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Target is the attribute of the target of a span, as passed to debux.
+func Target(target string) attribute.KeyValue {
+	return attribute.String("debux.target", target)
+}
+
+// Image is the attribute of the image of a span.
+func Image(ref string) attribute.KeyValue {
+	return attribute.String("debux.image", ref)
+}
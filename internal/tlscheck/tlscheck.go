@@ -0,0 +1,220 @@
+// Package tlscheck inspects the TLS endpoint of a server as a target sees
+// it: the handshake runs locally over a connection dialed from the target's
+// network namespace, and the chain is verified against the target's CA
+// bundle as well as the local one, since trust often differs between the
+// two.
+package tlscheck
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// CABundles are where distributions keep their CA bundle, in the order Go
+// and OpenSSL look for them. The target's $SSL_CERT_FILE comes first.
+var CABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine, Gentoo
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS, RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine, macOS
+}
+
+// BundleScript returns the shell script printing the path of the target's CA
+// bundle on its first line, then the bundle. It exits with status 3 when the
+// target has none.
+func BundleScript() string {
+	var b strings.Builder
+	b.WriteString(`root="${DEBUX_TARGET_ROOT:-/proc/1/root}"
+for f in $(tr '\0' '\n' < /proc/1/environ 2>/dev/null | sed -n 's/^SSL_CERT_FILE=//p')`)
+	for _, p := range CABundles {
+		b.WriteString(" " + p)
+	}
+	b.WriteString(`; do
+  if [ -s "$root$f" ]; then echo "$f"; cat "$root$f"; exit 0; fi
+done
+exit 3
+`)
+	return b.String()
+}
+
+// Dialer opens a connection to the server from the target's network
+// namespace.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
+// Cert describes a certificate of the chain.
+type Cert struct {
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	DNSNames   []string  `json:"dnsNames,omitempty"`
+	IPs        []string  `json:"ips,omitempty"`
+	NotBefore  time.Time `json:"notBefore"`
+	NotAfter   time.Time `json:"notAfter"`
+	DaysLeft   int       `json:"daysLeft"`
+	Key        string    `json:"key"`
+	IsCA       bool      `json:"isCA"`
+	SelfSigned bool      `json:"selfSigned"`
+	SHA256     string    `json:"sha256"`
+}
+
+// Verification is the outcome of verifying the chain against a trust store.
+type Verification struct {
+	Store string `json:"store"` // "target (<bundle>)" or "local"
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// SNI says how the server behaves without SNI.
+type SNI struct {
+	ServerName     string `json:"serverName"`
+	WithoutSNI     string `json:"withoutSNI"` // "same certificate", "different certificate: <subject>" or the handshake error
+	RequiresSNI    bool   `json:"requiresSNI"`
+	DifferentChain bool   `json:"differentChain"`
+}
+
+// Report is the inspection of a TLS endpoint.
+type Report struct {
+	Target        string         `json:"target"`
+	Address       string         `json:"address"`
+	Version       string         `json:"version"`
+	CipherSuite   string         `json:"cipherSuite"`
+	ALPN          string         `json:"alpn,omitempty"`
+	Chain         []Cert         `json:"chain"`
+	HostnameMatch bool           `json:"hostnameMatch"`
+	HostnameError string         `json:"hostnameError,omitempty"`
+	SNI           SNI            `json:"sni"`
+	Verifications []Verification `json:"verifications"`
+}
+
+// Inspect connects to the server with dial, with serverName as SNI, and
+// then without SNI, and verifies the chain against targetRoots (from
+// targetBundle) and the local trust store.
+func Inspect(ctx context.Context, dial Dialer, address, serverName string, targetRoots *x509.CertPool, targetBundle string) (*Report, error) {
+	state, err := handshake(ctx, dial, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s: %w", address, err)
+	}
+	r := &Report{
+		Address:     address,
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		SNI:         SNI{ServerName: serverName},
+	}
+	now := time.Now()
+	for _, c := range state.PeerCertificates {
+		r.Chain = append(r.Chain, describe(c, now))
+	}
+
+	leaf := state.PeerCertificates[0]
+	if err := leaf.VerifyHostname(serverName); err != nil {
+		r.HostnameError = err.Error()
+	} else {
+		r.HostnameMatch = true
+	}
+
+	// Servers behind SNI routing (ingresses, CDNs) often present a default
+	// certificate, or none, to clients that don't send it
+	if net.ParseIP(serverName) == nil {
+		plain, err := handshake(ctx, dial, "")
+		switch {
+		case err != nil:
+			r.SNI.WithoutSNI, r.SNI.RequiresSNI = err.Error(), true
+		case plain.PeerCertificates[0].Equal(leaf):
+			r.SNI.WithoutSNI = "same certificate"
+		default:
+			r.SNI.WithoutSNI = "different certificate: " + plain.PeerCertificates[0].Subject.String()
+			r.SNI.DifferentChain = true
+		}
+	} else {
+		r.SNI.WithoutSNI = "not applicable: connecting by IP address"
+	}
+
+	if targetRoots != nil {
+		r.Verifications = append(r.Verifications, verify(state.PeerCertificates, targetRoots, "target ("+targetBundle+")"))
+	} else {
+		r.Verifications = append(r.Verifications, Verification{Store: "target", Error: "no CA bundle found in the target"})
+	}
+	r.Verifications = append(r.Verifications, verify(state.PeerCertificates, nil, "local"))
+	return r, nil
+}
+
+// handshake returns the state of a handshake that doesn't verify anything,
+// so that the chain can be described whatever its problems.
+func handshake(ctx context.Context, dial Dialer, serverName string) (*tls.ConnectionState, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	c := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, // verified by verify, against each store
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	hctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	if err := c.HandshakeContext(hctx); err != nil {
+		return nil, err
+	}
+	state := c.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("the server presented no certificate")
+	}
+	return &state, nil
+}
+
+// verify verifies chain against roots, the local trust store when nil. The
+// hostname is checked separately.
+func verify(chain []*x509.Certificate, roots *x509.CertPool, store string) Verification {
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return Verification{Store: store, Error: err.Error()}
+	}
+	return Verification{Store: store, OK: true}
+}
+
+// describe describes a certificate.
+func describe(c *x509.Certificate, now time.Time) Cert {
+	sum := sha256.Sum256(c.Raw)
+	cert := Cert{
+		Subject:    c.Subject.String(),
+		Issuer:     c.Issuer.String(),
+		DNSNames:   c.DNSNames,
+		NotBefore:  c.NotBefore,
+		NotAfter:   c.NotAfter,
+		DaysLeft:   int(c.NotAfter.Sub(now).Hours() / 24),
+		IsCA:       c.IsCA,
+		SelfSigned: c.CheckSignatureFrom(c) == nil,
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+	for _, ip := range c.IPAddresses {
+		cert.IPs = append(cert.IPs, ip.String())
+	}
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		cert.Key = fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		cert.Key = "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		cert.Key = "Ed25519"
+	default:
+		cert.Key = c.PublicKeyAlgorithm.String()
+	}
+	return cert
+}
@@ -0,0 +1,224 @@
+// Package webterm serves debug shells to a browser (debux serve): a page
+// listing targets and running xterm.js, and a WebSocket per shell.
+//
+// Every request must carry the server's token, as a bearer token or as the
+// cookie set when the page is first opened with ?token=. The browser sends
+// its keystrokes as binary messages and its size as text messages
+// ({"cols":80,"rows":24}); the shell's output comes back as binary messages.
+package webterm
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/clement-tourriere/debux/internal/api"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/gorilla/websocket"
+)
+
+const cookieName = "debux_token"
+
+//go:embed index.html
+var indexHTML []byte
+
+// Server serves the web terminal.
+type Server struct {
+	Token string
+	// Targets lists the targets offered in the browser.
+	Targets func(ctx context.Context) ([]api.Target, error)
+	// Shell runs a debug shell for a target on a browser's terminal, until
+	// it exits or ctx is done.
+	Shell func(ctx context.Context, target string, t runtime.Terminal) error
+	// Log reports sessions opening and closing; it may be nil.
+	Log func(msg string)
+
+	upgrader websocket.Upgrader
+}
+
+// Handler returns the HTTP handler of the web terminal.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.index)
+	mux.HandleFunc("GET /api/targets", s.authorized(s.targets))
+	mux.HandleFunc("GET /api/shell", s.authorized(s.shell))
+	return mux
+}
+
+func (s *Server) log(format string, args ...any) {
+	if s.Log != nil {
+		s.Log(fmt.Sprintf(format, args...))
+	}
+}
+
+// index serves the page. Opened with ?token=, it stores the token in a
+// cookie and redirects, so the token doesn't stay in the address bar or the
+// browser history.
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !s.validToken(token) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if !s.authenticated(r) {
+		http.Error(w, "open the URL printed by debux serve, with its token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(indexHTML)
+}
+
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authenticated(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) authenticated(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return s.validToken(token)
+	}
+	if c, err := r.Cookie(cookieName); err == nil {
+		return s.validToken(c.Value)
+	}
+	return false
+}
+
+func (s *Server) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *Server) targets(w http.ResponseWriter, r *http.Request) {
+	targets, err := s.Targets(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if targets == nil {
+		targets = []api.Target{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(targets)
+}
+
+// shell runs a debug shell over a WebSocket. The upgrader rejects
+// cross-origin requests, so other sites can't use the cookie.
+func (s *Server) shell(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "missing target", http.StatusBadRequest)
+		return
+	}
+	// Only offered targets can be debugged, not anything the server reaches.
+	if offered, err := s.offered(r.Context(), target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	} else if !offered {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	in, inWriter := io.Pipe()
+	resize := make(chan runtime.TerminalSize, 1)
+	out := &wsWriter{conn: conn}
+
+	go func() {
+		defer cancel()
+		defer func() { _ = inWriter.Close() }()
+		defer close(resize)
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			switch kind {
+			case websocket.BinaryMessage:
+				if _, err := inWriter.Write(data); err != nil {
+					return
+				}
+			case websocket.TextMessage:
+				var size struct{ Cols, Rows uint16 }
+				if json.Unmarshal(data, &size) != nil || size.Cols == 0 || size.Rows == 0 {
+					continue
+				}
+				// Only the latest size matters
+				select {
+				case <-resize:
+				default:
+				}
+				resize <- runtime.TerminalSize{Width: size.Cols, Height: size.Rows}
+			}
+		}
+	}()
+
+	s.log("%s opened a shell in %s", r.RemoteAddr, target)
+	err = s.Shell(ctx, target, runtime.Terminal{In: in, Out: out, Resize: resize})
+	if err != nil && ctx.Err() == nil {
+		_, _ = out.Write([]byte("\r\n\x1b[31mdebux: " + err.Error() + "\x1b[0m\r\n"))
+		s.log("%s: shell in %s failed: %v", r.RemoteAddr, target, err)
+	} else {
+		s.log("%s closed the shell in %s", r.RemoteAddr, target)
+	}
+	out.mu.Lock()
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	out.mu.Unlock()
+}
+
+// offered reports whether a target is currently offered in the browser.
+func (s *Server) offered(ctx context.Context, target string) (bool, error) {
+	targets, err := s.Targets(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range targets {
+		if t.Target == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// wsWriter sends writes as binary WebSocket messages.
+type wsWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,160 @@
+// Package wrappers generates the scripts that run the target's binaries
+// from the debug shell, chrooted into the target's filesystem.
+package wrappers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dir is where the debug shell finds the wrappers, first in its PATH.
+const Dir = "/tmp/debux-target-bin"
+
+// stampFile records what the wrappers of Dir were generated from.
+const stampFile = ".stamp"
+
+// chrootExec restores the full original environment of the target process
+// (PID 1, or DEBUX_TARGET_PID) before chroot+exec, the same environment as
+// "docker exec".
+// The working directory is kept by --skip-chdir: /proc/1/root/app becomes
+// /app.
+const chrootExec = `#!/bin/sh
+TARGET_ROOT="${DEBUX_TARGET_ROOT:-/proc/1/root}"
+CHROOT=$(command -v chroot)
+cmd="$1"; shift
+case "$PWD" in
+  "${TARGET_ROOT}"/*) ;;
+  *) cd "$TARGET_ROOT" 2>/dev/null || true ;;
+esac
+# Restore target container's original environment
+while IFS= read -r line; do
+  case "$line" in *=*) export "$line" ;; esac
+done <<ENVEOF
+$(tr '\0' '\n' < /proc/${DEBUX_TARGET_PID:-1}/environ 2>/dev/null)
+ENVEOF
+exec "$CHROOT" --skip-chdir "$TARGET_ROOT" "$cmd" "$@"
+`
+
+// Options are what wrappers are generated from.
+type Options struct {
+	// TargetRoot is the target's root filesystem, e.g. /proc/1/root.
+	TargetRoot string
+	// TargetPath is the PATH of the target, whose binaries get wrappers.
+	TargetPath string
+	// SidecarPath is the PATH of the debug shell: its own commands win
+	// over the target's, and get no wrappers.
+	SidecarPath string
+}
+
+// Generate writes to dir a wrapper for each command of the target's PATH the
+// debug shell doesn't have itself, unless they were already generated with
+// the same options and no directory of the target's PATH changed since. It
+// returns whether it generated them.
+func Generate(dir string, opts Options) (bool, error) {
+	stamp := opts.stamp()
+	if old, err := os.ReadFile(filepath.Join(dir, stampFile)); err == nil && string(old) == stamp {
+		return false, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, fmt.Errorf("creating wrapper directory: %w", err)
+	}
+	if err := writeFile(dir, ".chroot-exec", chrootExec); err != nil {
+		return false, err
+	}
+
+	sidecar := map[string]bool{}
+	for _, p := range filepath.SplitList(opts.SidecarPath) {
+		entries, _ := os.ReadDir(p)
+		for _, e := range entries {
+			if !e.IsDir() {
+				sidecar[e.Name()] = true
+			}
+		}
+	}
+
+	// The first directory of the target's PATH with a command wins, as in
+	// the target itself
+	wanted := map[string]string{}
+	for _, p := range filepath.SplitList(opts.TargetPath) {
+		if p == "" {
+			continue
+		}
+		entries, _ := os.ReadDir(opts.TargetRoot + p)
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || sidecar[name] || strings.HasPrefix(name, ".") {
+				continue
+			}
+			if _, ok := wanted[name]; !ok {
+				wanted[name] = "#!/bin/sh\nexec " + Dir + "/.chroot-exec " + shellQuote(filepath.Join(p, name)) + " \"$@\"\n"
+			}
+		}
+	}
+
+	// Drop the wrappers of commands the target no longer has
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return false, fmt.Errorf("reading wrapper directory: %w", err)
+	}
+	for _, e := range existing {
+		if _, ok := wanted[e.Name()]; !ok && !strings.HasPrefix(e.Name(), ".") {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	for name, script := range wanted {
+		if err := writeFile(dir, name, script); err != nil {
+			return false, err
+		}
+	}
+	return true, writeFile(dir, stampFile, stamp)
+}
+
+// stamp identifies the options and the state of the directories of the
+// target's PATH, whose modification times change as commands are installed
+// or removed.
+func (o Options) stamp() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "root=%s\ntarget=%s\nsidecar=%s\n", o.TargetRoot, o.TargetPath, o.SidecarPath)
+	for _, p := range filepath.SplitList(o.TargetPath) {
+		if fi, err := os.Stat(o.TargetRoot + p); err == nil {
+			fmt.Fprintf(&b, "%s %d\n", p, fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// writeFile replaces dir/name with an executable file, atomically so that
+// concurrent shells never run half-written wrappers.
+func writeFile(dir, name, content string) error {
+	path := filepath.Join(dir, name)
+	if old, err := os.ReadFile(path); err == nil && string(old) == content {
+		return nil
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("writing wrapper %s: %w", name, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.WriteString(content); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing wrapper %s: %w", name, err)
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("writing wrapper %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing wrapper %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("writing wrapper %s: %w", name, err)
+	}
+	return nil
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,285 @@
+// Package debux is the Go API of debux: debug running Docker containers and
+// Kubernetes pods from other Go programs, with the same debug containers as
+// the debux command.
+//
+//	t, err := debux.ParseTarget("k8s://prod/api-7d9f")
+//	rt, err := debux.RuntimeFor(t)
+//	code, err := rt.Run(ctx, t, debux.Options{}, []string{"ss", "-tnp"}, nil, os.Stdout, os.Stderr)
+//
+// This package follows semantic versioning with the debux module: within a
+// major version, its exported names keep their meaning and signatures, and
+// only gain new fields, methods on concrete types and functions. Everything
+// under internal/ may change at any time.
+package debux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+)
+
+// Runtime debugs the targets of a container platform.
+type Runtime interface {
+	// Name is the runtime of the targets it debugs, e.g. Docker.
+	Name() string
+	// List returns the running targets, in a namespace for runtimes that
+	// have them (empty for all of them, "default" for the kubeconfig's).
+	List(ctx context.Context, namespace string, opts Options) ([]TargetInfo, error)
+	// Sessions returns the running debug containers, in a namespace like
+	// List.
+	Sessions(ctx context.Context, namespace string, opts Options) ([]Session, error)
+	// Start returns the running debug container of a target, creating it if
+	// needed.
+	Start(ctx context.Context, t Target, opts Options) (Session, error)
+	// Run runs a command without a TTY in a target's debug container,
+	// creating it if needed, and returns its exit code. The target's root
+	// filesystem is at $DEBUX_TARGET_ROOT.
+	Run(ctx context.Context, t Target, opts Options, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+	// Shell runs the debug shell on a terminal until it exits, its input
+	// ends or ctx is done.
+	Shell(ctx context.Context, t Target, opts Options, term Terminal) error
+	// Stop removes or stops a target's debug container.
+	Stop(ctx context.Context, t Target, opts Options) error
+}
+
+// TargetInfo describes a running target.
+type TargetInfo struct {
+	Target  Target
+	Image   string // Docker
+	Status  string
+	Session bool // a debug container is running
+}
+
+// Session is a running debug container.
+type Session struct {
+	Target    Target
+	Container string    // debug container name
+	Started   time.Time // zero when unknown
+	Shells    int       // open shells, -1 when unknown
+}
+
+// Terminal is where a debug shell runs: its keystrokes, its screen and its
+// size changes, the first one being the initial size.
+type Terminal struct {
+	In     io.Reader
+	Out    io.Writer
+	Resize <-chan TerminalSize
+}
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Width, Height uint16
+}
+
+// RuntimeFor returns the runtime of a target.
+func RuntimeFor(t Target) (Runtime, error) {
+	d, err := runtime.DriverFor(t.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := d.(publicDriver); ok {
+		return r.r, nil
+	}
+	return driverRuntime{name: t.Runtime, d: d}, nil
+}
+
+// Register adds a runtime to debux, for the targets of the given schemes
+// (scheme://<name>): RuntimeFor returns it, and when the program runs the
+// debux command (see package debuxcmd), every command debugs its targets.
+// It replaces any runtime of the same name, built-in ones included, and is
+// meant to be called from init functions.
+func Register(name string, r Runtime, schemes ...string) {
+	runtime.Register(name, publicDriver{r: r}, schemes...)
+}
+
+// SetStatusOutput sets where progress messages (pulling the image, creating
+// the debug container...) go. They go to os.Stdout by default.
+func SetStatusOutput(w io.Writer) {
+	runtime.SetStatusOutput(w)
+}
+
+// internal converts a terminal for the runtime drivers.
+func (term Terminal) internal() runtime.Terminal {
+	if term.Resize == nil {
+		return runtime.Terminal{In: term.In, Out: term.Out}
+	}
+	resize := make(chan runtime.TerminalSize, 1)
+	go func() {
+		defer close(resize)
+		for size := range term.Resize {
+			resize <- runtime.TerminalSize{Width: size.Width, Height: size.Height}
+		}
+	}()
+	return runtime.Terminal{In: term.In, Out: term.Out, Resize: resize}
+}
+
+// driverRuntime is the Runtime of a built-in driver.
+type driverRuntime struct {
+	name string
+	d    runtime.Driver
+}
+
+func (r driverRuntime) Name() string { return r.name }
+
+func (r driverRuntime) List(ctx context.Context, namespace string, opts Options) ([]TargetInfo, error) {
+	list, err := r.d.List(ctx, namespace, opts.internal())
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetInfo
+	for _, info := range list {
+		t, err := ParseTarget(info.Target)
+		if err != nil {
+			return nil, err
+		}
+		target := TargetInfo{Target: t, Status: info.Status, Session: info.Session}
+		if t.Runtime == Docker {
+			target.Image = info.Detail
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func (r driverRuntime) Sessions(ctx context.Context, namespace string, opts Options) ([]Session, error) {
+	sessions, err := r.d.Sessions(ctx, namespace, opts.internal())
+	if err != nil {
+		return nil, err
+	}
+	var result []Session
+	for _, s := range sessions {
+		t, err := ParseTarget(s.Target)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Session{Target: t, Container: s.Container, Started: s.Started, Shells: s.Shells})
+	}
+	return result, nil
+}
+
+func (r driverRuntime) Start(ctx context.Context, t Target, opts Options) (Session, error) {
+	target, err := t.internal()
+	if err != nil {
+		return Session{}, err
+	}
+	name, err := r.d.Sidecar(ctx, target, opts.internal())
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{Target: t, Container: name, Shells: -1}, nil
+}
+
+func (r driverRuntime) Run(ctx context.Context, t Target, opts Options, command []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	target, err := t.internal()
+	if err != nil {
+		return -1, err
+	}
+	return r.d.Pipe(ctx, target, opts.internal(), command, stdin, stdout, stderr)
+}
+
+func (r driverRuntime) Shell(ctx context.Context, t Target, opts Options, term Terminal) error {
+	target, err := t.internal()
+	if err != nil {
+		return err
+	}
+	return r.d.Shell(ctx, target, opts.internal(), term.internal())
+}
+
+func (r driverRuntime) Stop(ctx context.Context, t Target, opts Options) error {
+	target, err := t.internal()
+	if err != nil {
+		return err
+	}
+	return r.d.Cleanup(ctx, target, opts.internal())
+}
+
+// publicDriver is the driver of a registered Runtime.
+type publicDriver struct {
+	r Runtime
+}
+
+func (p publicDriver) List(ctx context.Context, namespace string, opts runtime.DebugOpts) ([]runtime.TargetInfo, error) {
+	list, err := p.r.List(ctx, namespace, optionsOf(opts))
+	if err != nil {
+		return nil, err
+	}
+	var targets []runtime.TargetInfo
+	for _, info := range list {
+		detail := info.Image
+		if detail == "" {
+			detail = info.Target.Namespace
+		}
+		targets = append(targets, runtime.TargetInfo{Target: info.Target.String(), Name: info.Target.Name, Namespace: info.Target.Namespace, Detail: detail, Status: info.Status, Session: info.Session})
+	}
+	return targets, nil
+}
+
+func (p publicDriver) Sessions(ctx context.Context, namespace string, opts runtime.DebugOpts) ([]runtime.Session, error) {
+	sessions, err := p.r.Sessions(ctx, namespace, optionsOf(opts))
+	if err != nil {
+		return nil, err
+	}
+	var result []runtime.Session
+	for _, s := range sessions {
+		result = append(result, runtime.Session{Target: s.Target.String(), Container: s.Container, Started: s.Started, Shells: s.Shells})
+	}
+	return result, nil
+}
+
+func (p publicDriver) Exec(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts) error {
+	if opts.Detach {
+		_, err := p.Sidecar(ctx, target, opts)
+		return err
+	}
+	return runtime.LocalShell(ctx, func(t runtime.Terminal) error {
+		return p.Shell(ctx, target, opts, t)
+	})
+}
+
+func (p publicDriver) Pipe(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts, cmd []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return p.r.Run(ctx, targetOf(target), optionsOf(opts), cmd, stdin, stdout, stderr)
+}
+
+func (p publicDriver) Shell(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts, t runtime.Terminal) error {
+	return p.r.Shell(ctx, targetOf(target), optionsOf(opts), terminalOf(t))
+}
+
+func (p publicDriver) Sidecar(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts) (string, error) {
+	session, err := p.r.Start(ctx, targetOf(target), optionsOf(opts))
+	return session.Container, err
+}
+
+func (p publicDriver) Cleanup(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts) error {
+	return p.r.Stop(ctx, targetOf(target), optionsOf(opts))
+}
+
+func (p publicDriver) Copy(ctx context.Context, target *runtime.Target, opts runtime.DebugOpts, dir string, archive io.Reader) error {
+	return runtime.PipeCopy(ctx, p, target, opts, dir, archive)
+}
+
+func (p publicDriver) PortForward(context.Context, *runtime.Target, runtime.DebugOpts, string, int, func()) error {
+	return fmt.Errorf("forwarding ports with the %s runtime: %w", p.r.Name(), errors.ErrUnsupported)
+}
+
+func targetOf(t *runtime.Target) Target {
+	return Target{Runtime: t.Runtime, Name: t.Name, Namespace: t.Namespace, Container: t.Container}
+}
+
+// terminalOf converts a terminal of the runtime drivers.
+func terminalOf(t runtime.Terminal) Terminal {
+	if t.Resize == nil {
+		return Terminal{In: t.In, Out: t.Out}
+	}
+	resize := make(chan TerminalSize, 1)
+	go func() {
+		defer close(resize)
+		for size := range t.Resize {
+			resize <- TerminalSize{Width: size.Width, Height: size.Height}
+		}
+	}()
+	return Terminal{In: t.In, Out: t.Out, Resize: resize}
+}
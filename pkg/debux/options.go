@@ -0,0 +1,122 @@
+package debux
+
+import (
+	"github.com/clement-tourriere/debux/internal/config"
+	"github.com/clement-tourriere/debux/internal/runtime"
+	"github.com/clement-tourriere/debux/internal/store"
+)
+
+// Options configure debug containers. The zero value gives debux's
+// defaults, as with the debux command without flags.
+type Options struct {
+	// Image is the debug image (default: DefaultImage).
+	Image string
+	// Profile is the security profile: general (default), baseline,
+	// restricted, netadmin or sysadmin.
+	Profile string
+	// User runs the shell as uid[:gid] instead of root.
+	User string
+	// AsTargetUser runs the shell as the target's user (ignored with User).
+	AsTargetUser bool
+	// Kubeconfig overrides the kubeconfig path.
+	Kubeconfig string
+	// PullPolicy is the Kubernetes image pull policy (default IfNotPresent).
+	PullPolicy string
+	// Platform is the debug image platform, e.g. linux/arm64 (Docker;
+	// default: the target's).
+	Platform string
+	// Fresh creates a new debug container instead of reusing a running one.
+	Fresh bool
+	// NoVolumes doesn't share the target's volumes (Docker).
+	NoVolumes bool
+	// Share lists the namespaces shared with the target: net, pid, ipc, uts,
+	// cgroup (Docker; default: net, pid, ipc).
+	Share []string
+	// Mounts are host paths mounted in the debug container (Docker).
+	Mounts []Mount
+	// Env are extra KEY=VALUE environment variables.
+	Env []string
+	// Workdir is the initial working directory of shells.
+	Workdir string
+	// CPUs and Memory (bytes) limit the debug container, 0 for none (Docker).
+	CPUs   float64
+	Memory int64
+	// StoreName is the persistent Nix store (Docker; default: "default").
+	StoreName string
+	// Flake is a flake whose devShell provides the session's tools.
+	Flake string
+}
+
+// Mount is a host path mounted in a debug container.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// DefaultImage is the debug image used when Options.Image is empty.
+const DefaultImage = runtime.DefaultImage
+
+func (o Options) internal() runtime.DebugOpts {
+	opts := runtime.DebugOpts{
+		Image:        o.Image,
+		User:         o.User,
+		AsTargetUser: o.AsTargetUser,
+		AutoRemove:   true,
+		Kubeconfig:   o.Kubeconfig,
+		ShareVolumes: !o.NoVolumes,
+		PullPolicy:   o.PullPolicy,
+		Fresh:        o.Fresh,
+		Profile:      o.Profile,
+		Platform:     o.Platform,
+		StoreName:    o.StoreName,
+		Share:        o.Share,
+		Env:          o.Env,
+		Workdir:      o.Workdir,
+		CPUs:         o.CPUs,
+		Memory:       o.Memory,
+		Nix:          config.Nix{Flake: o.Flake},
+	}
+	if opts.Image == "" {
+		opts.Image = DefaultImage
+	}
+	if opts.Profile == "" {
+		opts.Profile = "general"
+	}
+	if opts.PullPolicy == "" {
+		opts.PullPolicy = "IfNotPresent"
+	}
+	if opts.StoreName == "" {
+		opts.StoreName = store.DefaultName
+	}
+	for _, m := range o.Mounts {
+		opts.Mounts = append(opts.Mounts, runtime.Mount{Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return opts
+}
+
+// optionsOf converts the options of the runtime drivers.
+func optionsOf(opts runtime.DebugOpts) Options {
+	o := Options{
+		Image:        opts.Image,
+		Profile:      opts.Profile,
+		User:         opts.User,
+		AsTargetUser: opts.AsTargetUser,
+		Kubeconfig:   opts.Kubeconfig,
+		PullPolicy:   opts.PullPolicy,
+		Platform:     opts.Platform,
+		Fresh:        opts.Fresh,
+		NoVolumes:    !opts.ShareVolumes,
+		Share:        opts.Share,
+		Env:          opts.Env,
+		Workdir:      opts.Workdir,
+		CPUs:         opts.CPUs,
+		Memory:       opts.Memory,
+		StoreName:    opts.StoreName,
+		Flake:        opts.Nix.Flake,
+	}
+	for _, m := range opts.Mounts {
+		o.Mounts = append(o.Mounts, Mount{Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return o
+}
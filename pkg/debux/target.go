@@ -0,0 +1,65 @@
+package debux
+
+import (
+	"fmt"
+
+	"github.com/clement-tourriere/debux/internal/runtime"
+)
+
+// Runtime names of targets.
+const (
+	Docker     = "docker"
+	Kubernetes = "kubernetes"
+	Containerd = "containerd"
+)
+
+// Target is a running container or pod to debug.
+type Target struct {
+	Runtime   string // Docker, Kubernetes, Containerd or a registered runtime
+	Name      string // container name or ID, or pod name
+	Namespace string // Kubernetes namespace ("default" resolves to the kubeconfig's)
+	Container string // Kubernetes container in the pod, empty for the first one
+}
+
+// ParseTarget parses a target as given to the debux command: a Docker
+// container name, docker://<container>, containerd://<container>,
+// k8s://[<namespace>/]<pod>[/<container>], or <scheme>://<name> for the
+// schemes of registered runtimes. The name is empty for a bare
+// scheme such as k8s:// or k8s://<namespace>/.
+func ParseTarget(s string) (Target, error) {
+	t, err := runtime.ParseTarget(s)
+	if err != nil {
+		return Target{}, err
+	}
+	return Target{Runtime: t.Runtime, Name: t.Name, Namespace: t.Namespace, Container: t.Container}, nil
+}
+
+// String returns the target as given to the debux command.
+func (t Target) String() string {
+	switch t.Runtime {
+	case Kubernetes:
+		s := "k8s://" + t.Namespace + "/" + t.Name
+		if t.Container != "" {
+			s += "/" + t.Container
+		}
+		return s
+	case Docker, "":
+		return t.Name
+	default:
+		if scheme := runtime.SchemeOf(t.Runtime); scheme != "" {
+			return scheme + "://" + t.Name
+		}
+		return t.Name
+	}
+}
+
+func (t Target) internal() (*runtime.Target, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("missing target name")
+	}
+	namespace := t.Namespace
+	if t.Runtime == Kubernetes && namespace == "" {
+		namespace = "default"
+	}
+	return &runtime.Target{Runtime: t.Runtime, Name: t.Name, Namespace: namespace, Container: t.Container}, nil
+}
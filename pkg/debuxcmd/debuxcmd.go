@@ -0,0 +1,35 @@
+// Package debuxcmd runs the debux command, for programs that build their
+// own debux with more runtimes:
+//
+//	import (
+//		"github.com/clement-tourriere/debux/pkg/debux"
+//		"github.com/clement-tourriere/debux/pkg/debuxcmd"
+//	)
+//
+//	func main() {
+//		debux.Register("podman", podmanRuntime{}, "podman")
+//		if err := debuxcmd.Execute(); err != nil {
+//			if code, ok := debuxcmd.ExitStatus(err); ok {
+//				os.Exit(code)
+//			}
+//			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+//			os.Exit(1)
+//		}
+//	}
+//
+// It follows semantic versioning like package debux.
+package debuxcmd
+
+import "github.com/clement-tourriere/debux/internal/cli"
+
+// Execute runs the debux command with the program's arguments.
+func Execute() error {
+	return cli.Execute()
+}
+
+// ExitStatus returns the exit status of the debug shell or command that
+// failed Execute, to exit with without reporting an error, and false for
+// other errors.
+func ExitStatus(err error) (int, bool) {
+	return cli.ExitStatus(err)
+}